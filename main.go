@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"time"
 
 	"github.com/urfave/cli"
 	"moul.io/srand"
@@ -84,6 +85,42 @@ func main() {
 					EnvVar: "SSHPORTAL_ACL_CHECK_CMD",
 					Usage:  "Execute external command to check ACL",
 				},
+				cli.StringFlag{
+					Name:   "api-bind",
+					EnvVar: "SSHPORTAL_API_BIND",
+					Usage:  "REST API bind address, i.e., 127.0.0.1:8080 (disabled if empty, requires --api-tls-cert and --api-tls-key unless it is a loopback address)",
+				},
+				cli.StringFlag{
+					Name:   "api-tls-cert",
+					EnvVar: "SSHPORTAL_API_TLS_CERT",
+					Usage:  "Path to the PEM certificate used to serve the REST API over HTTPS",
+				},
+				cli.StringFlag{
+					Name:   "api-tls-key",
+					EnvVar: "SSHPORTAL_API_TLS_KEY",
+					Usage:  "Path to the PEM private key of --api-tls-cert",
+				},
+				cli.StringFlag{
+					Name:   "metrics-bind",
+					EnvVar: "SSHPORTAL_METRICS_BIND",
+					Usage:  "Prometheus metrics bind address, i.e., 127.0.0.1:9100 (disabled if empty)",
+				},
+				cli.DurationFlag{
+					Name:   "drain-timeout",
+					EnvVar: "SSHPORTAL_DRAIN_TIMEOUT",
+					Value:  time.Minute,
+					Usage:  "Duration given to the running sessions to finish on SIGTERM or server drain, before closing them",
+				},
+				cli.StringSliceFlag{
+					Name:   "secret-provider",
+					EnvVar: "SSHPORTAL_SECRET_PROVIDERS",
+					Usage:  "Allows the hosts and keys to reference the secrets of a `PROVIDER` with secret://<name>/<key>, either <name>=exec:<command> run with the key as last argument, or <name>=file:<directory> containing the keys (can be repeated)",
+				},
+				cli.BoolFlag{
+					Name:   "host-picker",
+					EnvVar: "SSHPORTAL_HOST_PICKER",
+					Usage:  "Show the hosts allowed by the ACLs in an interactive menu to the users connecting with their own name",
+				},
 			},
 		}, {
 			Name:   "healthcheck",
@@ -103,6 +140,39 @@ func main() {
 					Usage: "Do not print errors, if any",
 				},
 			},
+		}, {
+			Name:        "rotate-key",
+			Usage:       "Re-encrypt the sensitive data with a new AES key",
+			Description: "Stop the server first, then:\n   $> SSHPORTAL_OLD_AES_KEY=<current key> SSHPORTAL_NEW_AES_KEY=<new key> sshportal rotate-key\n   $> SSHPORTAL_NEW_AES_KEY=<new key> sshportal rotate-key --encrypt-all (data stored without AES key)",
+			Action:      rotateKey,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "db-driver",
+					EnvVar: "SSHPORTAL_DB_DRIVER",
+					Value:  "sqlite3",
+					Usage:  "GORM driver (sqlite3)",
+				},
+				cli.StringFlag{
+					Name:   "db-conn",
+					EnvVar: "SSHPORTAL_DATABASE_URL",
+					Value:  "./sshportal.db",
+					Usage:  "GORM connection string",
+				},
+				cli.StringFlag{
+					Name:   "old-key",
+					EnvVar: "SSHPORTAL_OLD_AES_KEY",
+					Usage:  "Current AES key",
+				},
+				cli.StringFlag{
+					Name:   "new-key",
+					EnvVar: "SSHPORTAL_NEW_AES_KEY",
+					Usage:  "New AES key (length: 16, 24 or 32)",
+				},
+				cli.BoolFlag{
+					Name:  "encrypt-all",
+					Usage: "Encrypt data stored without AES key, --old-key must not be set",
+				},
+			},
 		}, {
 			Name:   "_test_server",
 			Hidden: true,
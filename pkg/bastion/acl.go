@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
 	"sort"
 	"strings"
 	"time"
 
+	"gorm.io/gorm"
 	"moul.io/sshportal/pkg/dbmodels"
 )
 
@@ -22,49 +24,278 @@ func (a byWeight) Len() int           { return len(a) }
 func (a byWeight) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byWeight) Less(i, j int) bool { return a[i].Weight < a[j].Weight }
 
-func checkACLs(user dbmodels.User, host dbmodels.Host, aclCheckCmd string) string {
-	currentTime := time.Now()
+// checkACLs returns the action of the ACLs for user connecting to host from the source address
+func checkACLs(user dbmodels.User, host dbmodels.Host, source net.IP, aclCheckCmd string) string {
+	acls := matchingACLs(user, host, source, time.Now())
 
-	// shared ACLs between user and host
-	aclMap := map[uint]*dbmodels.ACL{}
-	for _, userGroup := range user.Groups {
-		for _, userGroupACL := range userGroup.ACLs {
-			for _, hostGroup := range host.Groups {
-				for _, hostGroupACL := range hostGroup.ACLs {
-					if userGroupACL.ID == hostGroupACL.ID {
-						if (userGroupACL.Inception == nil || currentTime.After(*userGroupACL.Inception)) &&
-							(userGroupACL.Expiration == nil || currentTime.Before(*userGroupACL.Expiration)) {
-							aclMap[userGroupACL.ID] = userGroupACL
-						}
-					}
-				}
-			}
-		}
+	// if no shared ACL then the ACLs hook, if it exists, overrides a deny
+	action := string(dbmodels.ACLActionDeny)
+	if len(acls) > 0 {
+		action = acls[0].Action
+	}
+
+	action, err := checkACLsHook(aclCheckCmd, action, user, host)
+	if err != nil {
+		log.Println(err)
+	}
+
+	aclDecisions.With(action).Inc()
+	return action
+}
+
+// checkRemoteForwardACLs returns true if the ACL granting the access to the host allows remote forwarding
+func checkRemoteForwardACLs(user dbmodels.User, host dbmodels.Host, source net.IP) bool {
+	acl := grantingACL(user, host, source)
+	return acl != nil && acl.AllowRemoteForward
+}
+
+// checkAgentForwardACLs returns true if the ACL granting the access to the host allows agent forwarding
+func checkAgentForwardACLs(user dbmodels.User, host dbmodels.Host, source net.IP) bool {
+	acl := grantingACL(user, host, source)
+	return acl != nil && acl.AllowAgentForward
+}
+
+// allowedHosts returns the hosts user, with the expanded groups, can connect
+// to from the source address, i.e., the ACLs allow the host and its hops.
+// Only the hosts allowed by the ACLs are checked with aclCheckCmd, once per
+// host, so the hook cannot add a host denied by the ACLs to the list.
+func allowedHosts(db *gorm.DB, user dbmodels.User, source net.IP, aclCheckCmd string) ([]*dbmodels.Host, error) {
+	var hosts []*dbmodels.Host
+	if err := db.Preload("Groups").Preload("Hop").Order("name").Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	expand, err := dbmodels.HostGroupsExpander(db)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	byID := map[uint]*dbmodels.Host{}
+	allowed := map[uint]bool{}
+	for _, host := range hosts {
+		byID[host.ID] = host
+		tmpHost := *host
+		tmpHost.Groups = expand(host.Groups)
+		acls := matchingACLs(user, tmpHost, source, now)
+		allowed[host.ID] = len(acls) > 0 && acls[0].Action == string(dbmodels.ACLActionAllow)
 	}
-	// FIXME: add ACLs that match host pattern
 
-	// if no shared ACL then execute ACLs hook if it exists and return its result
-	if len(aclMap) == 0 {
-		action, err := checkACLsHook(aclCheckCmd, string(dbmodels.ACLActionDeny), user, host)
+	// the hook is run for the hosts of the chains allowed by the ACLs, it is
+	// not a connection decision and does not count in the metrics
+	hooked := map[uint]bool{}
+	checkHook := func(host *dbmodels.Host) bool {
+		if aclCheckCmd == "" {
+			return true
+		}
+		if result, found := hooked[host.ID]; found {
+			return result
+		}
+		tmpHost := *host
+		tmpHost.Groups = expand(host.Groups)
+		action, err := checkACLsHook(aclCheckCmd, string(dbmodels.ACLActionAllow), user, tmpHost)
 		if err != nil {
 			log.Println(err)
 		}
-		return action
+		hooked[host.ID] = action == string(dbmodels.ACLActionAllow)
+		return hooked[host.ID]
+	}
+
+	reachable := []*dbmodels.Host{}
+	for _, host := range hosts {
+		// the hosts behind a loop of hops cannot be reached
+		var chain []*dbmodels.Host
+		ok := true
+		seen := map[uint]bool{}
+		for current := host; current != nil; current = byID[current.HopID] {
+			if seen[current.ID] || !allowed[current.ID] {
+				ok = false
+				break
+			}
+			seen[current.ID] = true
+			chain = append(chain, current)
+		}
+		for i := 0; ok && i < len(chain); i++ {
+			ok = checkHook(chain[i])
+		}
+		if ok {
+			reachable = append(reachable, host)
+		}
+	}
+	return reachable, nil
+}
+
+// aclScheduleEndReason is the error message of the sessions closed by the end of an ACL schedule
+const aclScheduleEndReason = "closed at the end of the ACL schedule"
+
+// aclScheduleEnd returns when the schedule of the ACL granting the access to
+// host ends, or nil if the ACL does not terminate the sessions
+func aclScheduleEnd(user dbmodels.User, host dbmodels.Host, source net.IP, currentTime time.Time) *time.Time {
+	acls := matchingACLs(user, host, source, currentTime)
+	if len(acls) == 0 || acls[0].Action != string(dbmodels.ACLActionAllow) || acls[0].Schedule == "" || !acls[0].ScheduleTerminate {
+		return nil
+	}
+	schedule, err := dbmodels.ParseSchedule(acls[0].Schedule)
+	if err != nil {
+		return nil
+	}
+	end, ok := schedule.End(currentTime)
+	if !ok {
+		return nil
+	}
+	return &end
+}
+
+// aclSourceCIDR returns the source range matched by the ACL granting the access to host, if any
+func aclSourceCIDR(user dbmodels.User, host dbmodels.Host, source net.IP) string {
+	acl := grantingACL(user, host, source)
+	if acl == nil {
+		return ""
+	}
+	_, cidr, _ := acl.MatchSource(source)
+	return cidr
+}
+
+// grantingACL returns the ACL allowing user to access host, or nil
+func grantingACL(user dbmodels.User, host dbmodels.Host, source net.IP) *dbmodels.ACL {
+	acls := matchingACLs(user, host, source, time.Now())
+	if len(acls) == 0 || acls[0].Action != string(dbmodels.ACLActionAllow) {
+		return nil
+	}
+	return acls[0]
+}
+
+// matchingACLs returns the ACLs active at currentTime for the clients
+// connecting from source shared between user and host, and the user ACLs
+// matching the host pattern or the host selector, sorted by weight
+func matchingACLs(user dbmodels.User, host dbmodels.Host, source net.IP, currentTime time.Time) []*dbmodels.ACL {
+	acls := []*dbmodels.ACL{}
+	for _, evaluation := range evaluateACLs(user, host, source, currentTime) {
+		if evaluation.err != nil {
+			log.Printf("warning: acl %d: %v", evaluation.acl.ID, evaluation.err)
+		}
+		if evaluation.matched {
+			acls = append(acls, evaluation.acl)
+		}
 	}
+	return acls
+}
 
-	// transform map to slice and sort it
+// aclEvaluation is the outcome of an ACL of the user groups for a connection
+type aclEvaluation struct {
+	acl     *dbmodels.ACL
+	matched bool
+	reason  string // why the ACL matched or was skipped
+	err     error
+}
+
+// evaluateACLs evaluates each ACL of the user groups once for user connecting
+// to host from source at currentTime, sorted by weight
+func evaluateACLs(user dbmodels.User, host dbmodels.Host, source net.IP, currentTime time.Time) []aclEvaluation {
+	aclMap := map[uint]*dbmodels.ACL{}
+	for _, userGroup := range user.Groups {
+		for _, userGroupACL := range userGroup.ACLs {
+			aclMap[userGroupACL.ID] = userGroupACL
+		}
+	}
+
+	// transform map to slice and sort it, the ACLs of the same weight are
+	// ordered by ID for the decision to be reproducible
 	acls := make([]*dbmodels.ACL, 0, len(aclMap))
 	for _, acl := range aclMap {
 		acls = append(acls, acl)
 	}
-	sort.Sort(byWeight(acls))
+	sort.Slice(acls, func(i, j int) bool { return acls[i].ID < acls[j].ID })
+	sort.Stable(byWeight(acls))
+
+	evaluations := make([]aclEvaluation, 0, len(acls))
+	for _, acl := range acls {
+		evaluation := evaluateACL(acl, host, source, currentTime)
+		evaluation.acl = acl
+		evaluations = append(evaluations, evaluation)
+	}
+	return evaluations
+}
+
+func evaluateACL(acl *dbmodels.ACL, host dbmodels.Host, source net.IP, currentTime time.Time) aclEvaluation {
+	matched, reason, err := aclTargetsHost(acl, host)
+	if err != nil || !matched {
+		return aclEvaluation{reason: reason, err: err}
+	}
 
-	action, err := checkACLsHook(aclCheckCmd, acls[0].Action, user, host)
+	if acl.Inception != nil && !currentTime.After(*acl.Inception) {
+		return aclEvaluation{reason: fmt.Sprintf("not active before %s", acl.Inception.Format("2006-01-02 15:04"))}
+	}
+	if acl.Expiration != nil && !currentTime.Before(*acl.Expiration) {
+		return aclEvaluation{reason: fmt.Sprintf("expired on %s", acl.Expiration.Format("2006-01-02 15:04"))}
+	}
+	if acl.Schedule != "" {
+		schedule, err := dbmodels.ParseSchedule(acl.Schedule)
+		if err != nil {
+			return aclEvaluation{reason: "invalid schedule", err: err}
+		}
+		if !schedule.Contains(currentTime) {
+			return aclEvaluation{reason: fmt.Sprintf("outside of the schedule %q", acl.Schedule)}
+		}
+	}
+	matched, cidr, err := acl.MatchSource(source)
 	if err != nil {
-		log.Println(err)
+		return aclEvaluation{reason: "invalid source ranges", err: err}
+	}
+	if !matched {
+		if source == nil {
+			return aclEvaluation{reason: "restricted to source ranges, the client address is unknown"}
+		}
+		return aclEvaluation{reason: fmt.Sprintf("source %s is not allowed", source)}
+	}
+	if cidr != "" {
+		reason += fmt.Sprintf(", source in %s", cidr)
 	}
+	return aclEvaluation{matched: true, reason: reason}
+}
 
-	return action
+// aclTargetsHost checks if host is in a host group of the ACL, or matches its
+// host pattern or host selector
+func aclTargetsHost(acl *dbmodels.ACL, host dbmodels.Host) (bool, string, error) {
+	if aclSharesHostGroup(acl, host) {
+		return true, "shares a host group", nil
+	}
+	reasons := []string{}
+	if acl.HasLegacyHostPattern() {
+		reasons = append(reasons, fmt.Sprintf("host pattern %q is inert, set its type with 'acl update --pattern'", acl.HostPattern))
+	} else if acl.HostPattern != "" {
+		matched, err := acl.MatchHost(&host)
+		if err != nil {
+			return false, "invalid host pattern", err
+		}
+		if matched {
+			return true, fmt.Sprintf("host pattern %q matches", acl.HostPattern), nil
+		}
+		reasons = append(reasons, fmt.Sprintf("host pattern %q does not match", acl.HostPattern))
+	}
+	if acl.HostSelector != "" {
+		matched, err := acl.MatchHostSelector(&host)
+		if err != nil {
+			return false, "invalid host selector or labels", err
+		}
+		if matched {
+			return true, fmt.Sprintf("host selector %q matches", acl.HostSelector), nil
+		}
+		reasons = append(reasons, fmt.Sprintf("host selector %q does not match", acl.HostSelector))
+	}
+	if len(reasons) == 0 {
+		return false, "no shared host group", nil
+	}
+	return false, strings.Join(reasons, ", "), nil
+}
+
+func aclSharesHostGroup(acl *dbmodels.ACL, host dbmodels.Host) bool {
+	for _, hostGroup := range host.Groups {
+		for _, hostGroupACL := range hostGroup.ACLs {
+			if acl.ID == hostGroupACL.ID {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // checkACLsHook executes external command to check ACL and passes following parameters:
@@ -98,14 +329,17 @@ func checkACLsHook(aclCheckCmd string, action string, user dbmodels.User, host d
 	}
 
 	cmd := exec.CommandContext(ctx, aclCheckCmd, args...)
+	start := time.Now()
 	out, err := cmd.Output()
-	if err != nil {
-		return action, err
-	}
-
+	observeSince(aclHookDuration.With(), start)
+	// a killed command also returns an error, the timeout is checked first
 	if ctx.Err() == context.DeadlineExceeded {
+		aclHookTimeouts.With().Inc()
 		return action, fmt.Errorf("external ACL hook command timed out")
 	}
+	if err != nil {
+		return action, err
+	}
 
 	outStr := strings.TrimSuffix(string(out), "\n")
 
@@ -2,37 +2,26 @@ package bastion // import "moul.io/sshportal/pkg/bastion"
 
 import (
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 	"moul.io/sshportal/pkg/dbmodels"
 )
 
 func TestCheckACLs(t *testing.T) {
 	Convey("Testing CheckACLs", t, func(c C) {
-		// create tmp dir
-		tempDir, err := ioutil.TempDir("", "sshportal")
-		c.So(err, ShouldBeNil)
-		defer func() {
-			c.So(os.RemoveAll(tempDir), ShouldBeNil)
-		}()
-
-		// create sqlite db
-		db, err := gorm.Open(sqlite.Open(filepath.Join(tempDir, "sshportal.db")), &gorm.Config{})
-		c.So(err, ShouldBeNil)
-		c.So(DBInit(db), ShouldBeNil)
+		db := newTestDB(c)
 
 		// create dummy objects
 		var hostGroup dbmodels.HostGroup
-		err = dbmodels.HostGroupsByIdentifiers(db, []string{"default"}).First(&hostGroup).Error
+		err := dbmodels.HostGroupsByIdentifiers(db, []string{"default"}).First(&hostGroup).Error
 		c.So(err, ShouldBeNil)
 		db.Create(&dbmodels.Host{Groups: []*dbmodels.HostGroup{&hostGroup}})
 
-		//. load db
 		var (
 			hosts []dbmodels.Host
 			users []dbmodels.User
@@ -41,7 +30,362 @@ func TestCheckACLs(t *testing.T) {
 		db.Preload("Groups").Preload("Groups.ACLs").Find(&users)
 
 		// test
-		action := checkACLs(users[0], hosts[0], "")
+		action := checkACLs(users[0], hosts[0], nil, "")
 		c.So(action, ShouldEqual, dbmodels.ACLActionAllow)
 	})
 }
+
+func TestCheckACLsHostPattern(t *testing.T) {
+	Convey("Testing CheckACLs with host patterns", t, func(c C) {
+		db := newTestDB(c)
+
+		// create dummy objects: hosts outside of any host group, and a user group linked to pattern ACLs
+		userGroup := dbmodels.UserGroup{Name: "dba"}
+		c.So(db.Create(&userGroup).Error, ShouldBeNil)
+		c.So(db.Create(&dbmodels.User{Name: "alice", Email: "alice@example.com", Groups: []*dbmodels.UserGroup{&userGroup}}).Error, ShouldBeNil)
+		c.So(db.Create(&dbmodels.Host{Name: "prod-db-1", URL: "ssh://root@10.0.0.1"}).Error, ShouldBeNil)
+		c.So(db.Create(&dbmodels.Host{Name: "prod-web-1", URL: "ssh://root@web1.example.com"}).Error, ShouldBeNil)
+		c.So(db.Create(&dbmodels.Host{Name: "staging-db-1", URL: "ssh://root@db1.staging.example.com"}).Error, ShouldBeNil)
+		c.So(db.Create(&dbmodels.ACL{UserGroups: []*dbmodels.UserGroup{&userGroup}, HostPattern: "glob:prod-db-*", Action: "allow", Weight: 10}).Error, ShouldBeNil)
+		c.So(db.Create(&dbmodels.ACL{UserGroups: []*dbmodels.UserGroup{&userGroup}, HostPattern: `regex:\.staging\.example\.com$`, Action: "allow", Weight: 10}).Error, ShouldBeNil)
+		c.So(db.Create(&dbmodels.ACL{UserGroups: []*dbmodels.UserGroup{&userGroup}, HostPattern: "glob:staging-*", Action: "deny", Weight: 1}).Error, ShouldBeNil)
+
+		load := func(name string) (dbmodels.User, dbmodels.Host) {
+			var (
+				host dbmodels.Host
+				user dbmodels.User
+			)
+			c.So(db.Preload("Groups").Preload("Groups.ACLs").Where("name = ?", name).First(&host).Error, ShouldBeNil)
+			c.So(db.Preload("Groups").Preload("Groups.ACLs").Where("name = ?", "alice").First(&user).Error, ShouldBeNil)
+			return user, host
+		}
+
+		// test
+		user, host := load("prod-db-1")
+		c.So(checkACLs(user, host, nil, ""), ShouldEqual, dbmodels.ACLActionAllow)
+		user, host = load("prod-web-1")
+		c.So(checkACLs(user, host, nil, ""), ShouldEqual, dbmodels.ACLActionDeny)
+		user, host = load("staging-db-1")
+		c.So(checkACLs(user, host, nil, ""), ShouldEqual, dbmodels.ACLActionDeny)
+	})
+}
+
+func TestHostPatternMatcher(t *testing.T) {
+	Convey("Testing HostPatternMatcher", t, func(c C) {
+		for _, invalid := range []string{"prod-*", "glob:", "glob:[", "regex:(", "wildcard:prod-*"} {
+			_, err := dbmodels.HostPatternMatcher(invalid)
+			c.So(err, ShouldNotBeNil)
+		}
+		match, err := dbmodels.HostPatternMatcher("glob:prod-db-?")
+		c.So(err, ShouldBeNil)
+		c.So(match("prod-db-1"), ShouldBeTrue)
+		c.So(match("prod-db-12"), ShouldBeFalse)
+		match, err = dbmodels.HostPatternMatcher("regex:^prod-db-[0-9]+$")
+		c.So(err, ShouldBeNil)
+		c.So(match("prod-db-12"), ShouldBeTrue)
+		c.So(match("staging-prod-db-12"), ShouldBeFalse)
+
+		// the username of the URL is not matched
+		acl := &dbmodels.ACL{HostPattern: "glob:*root@*"}
+		matched, err := acl.MatchHost(&dbmodels.Host{Name: "web", URL: "ssh://root@web.example.org"})
+		c.So(err, ShouldBeNil)
+		c.So(matched, ShouldBeFalse)
+		acl.HostPattern = "glob:*.example.org"
+		matched, err = acl.MatchHost(&dbmodels.Host{Name: "web", URL: "ssh://root@web.example.org"})
+		c.So(err, ShouldBeNil)
+		c.So(matched, ShouldBeTrue)
+	})
+}
+
+func TestCheckRemoteForwardACLs(t *testing.T) {
+	Convey("Testing checkRemoteForwardACLs", t, func(c C) {
+		forward := &dbmodels.ACL{Action: string(dbmodels.ACLActionAllow), Weight: 10, AllowRemoteForward: true}
+		forward.ID = 1
+		deny := &dbmodels.ACL{Action: string(dbmodels.ACLActionDeny), Weight: 5, AllowRemoteForward: true}
+		deny.ID = 2
+		allow := &dbmodels.ACL{Action: string(dbmodels.ACLActionAllow), Weight: 1}
+		allow.ID = 3
+		check := func(acls ...*dbmodels.ACL) bool {
+			user := dbmodels.User{Groups: []*dbmodels.UserGroup{{ACLs: acls}}}
+			host := dbmodels.Host{Groups: []*dbmodels.HostGroup{{ACLs: acls}}}
+			return checkRemoteForwardACLs(user, host, nil)
+		}
+
+		c.So(check(), ShouldBeFalse)
+		c.So(check(forward), ShouldBeTrue)
+		c.So(check(forward, deny), ShouldBeFalse)
+		c.So(check(forward, allow), ShouldBeFalse)
+	})
+}
+
+func TestParseSchedule(t *testing.T) {
+	Convey("Testing ParseSchedule", t, func(c C) {
+		for _, invalid := range []string{"", "Mon-Fri", "Mon-Fri 08:00", "Lun 08:00-19:00", "Mon-Fri 8h-19h", "Mon-Fri 08:00-08:00", "Mon-Fri 24:00-08:00", "Mon-Fri 08:00-19:00 Mars/Olympus", "Mon 08:00-19:00 UTC extra"} {
+			_, err := dbmodels.ParseSchedule(invalid)
+			c.So(err, ShouldNotBeNil)
+		}
+
+		paris, err := time.LoadLocation("Europe/Paris")
+		c.So(err, ShouldBeNil)
+		schedule, err := dbmodels.ParseSchedule("Mon-Fri 08:00-19:00 Europe/Paris")
+		c.So(err, ShouldBeNil)
+		c.So(schedule.Contains(time.Date(2021, 3, 1, 8, 0, 0, 0, paris)), ShouldBeTrue) // Monday
+		c.So(schedule.Contains(time.Date(2021, 3, 1, 7, 0, 0, 0, time.UTC)), ShouldBeTrue)
+		c.So(schedule.Contains(time.Date(2021, 3, 1, 19, 0, 0, 0, paris)), ShouldBeFalse)
+		c.So(schedule.Contains(time.Date(2021, 3, 6, 12, 0, 0, 0, paris)), ShouldBeFalse) // Saturday
+		end, ok := schedule.End(time.Date(2021, 3, 1, 10, 0, 0, 0, paris))
+		c.So(ok, ShouldBeTrue)
+		c.So(end.Equal(time.Date(2021, 3, 1, 19, 0, 0, 0, paris)), ShouldBeTrue)
+
+		// windows ending the next day, day ranges wrapping around the week
+		schedule, err = dbmodels.ParseSchedule("Fri-Sun 22:00-06:00")
+		c.So(err, ShouldBeNil)
+		c.So(schedule.Contains(time.Date(2021, 3, 5, 23, 0, 0, 0, time.UTC)), ShouldBeTrue) // Friday
+		c.So(schedule.Contains(time.Date(2021, 3, 8, 5, 0, 0, 0, time.UTC)), ShouldBeTrue)  // Monday, from Sunday
+		c.So(schedule.Contains(time.Date(2021, 3, 5, 5, 0, 0, 0, time.UTC)), ShouldBeFalse) // Friday, from Thursday
+		end, ok = schedule.End(time.Date(2021, 3, 5, 23, 0, 0, 0, time.UTC))
+		c.So(ok, ShouldBeTrue)
+		c.So(end.Equal(time.Date(2021, 3, 6, 6, 0, 0, 0, time.UTC)), ShouldBeTrue)
+
+		schedule, err = dbmodels.ParseSchedule("* 12:00-24:00")
+		c.So(err, ShouldBeNil)
+		c.So(schedule.Contains(time.Date(2021, 3, 7, 23, 59, 0, 0, time.UTC)), ShouldBeTrue)
+		c.So(schedule.Contains(time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)), ShouldBeFalse)
+		end, ok = schedule.End(time.Date(2021, 3, 7, 12, 0, 0, 0, time.UTC))
+		c.So(ok, ShouldBeTrue)
+		c.So(end.Equal(time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)), ShouldBeTrue)
+	})
+}
+
+func TestScheduleEndBackToBack(t *testing.T) {
+	Convey("Testing Schedule.End with back-to-back windows", t, func(c C) {
+		// the window of the next day starts when the current one ends
+		schedule, err := dbmodels.ParseSchedule("Mon-Fri 00:00-24:00")
+		c.So(err, ShouldBeNil)
+		end, ok := schedule.End(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)) // Monday
+		c.So(ok, ShouldBeTrue)
+		c.So(end.Equal(time.Date(2021, 3, 6, 0, 0, 0, 0, time.UTC)), ShouldBeTrue)
+
+		// the windows never end
+		schedule, err = dbmodels.ParseSchedule("* 00:00-24:00")
+		c.So(err, ShouldBeNil)
+		_, ok = schedule.End(time.Date(2021, 3, 1, 23, 59, 0, 0, time.UTC))
+		c.So(ok, ShouldBeFalse)
+
+		// a gap between the windows ends the session
+		schedule, err = dbmodels.ParseSchedule("* 06:00-24:00")
+		c.So(err, ShouldBeNil)
+		end, ok = schedule.End(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC))
+		c.So(ok, ShouldBeTrue)
+		c.So(end.Equal(time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC)), ShouldBeTrue)
+	})
+}
+
+func TestMatchingACLsSchedule(t *testing.T) {
+	Convey("Testing matchingACLs with schedules", t, func(c C) {
+		business := &dbmodels.ACL{Action: string(dbmodels.ACLActionAllow), Weight: 10, Schedule: "Mon-Fri 08:00-19:00 UTC", ScheduleTerminate: true}
+		business.ID = 1
+		user := dbmodels.User{Groups: []*dbmodels.UserGroup{{ACLs: []*dbmodels.ACL{business}}}}
+		host := dbmodels.Host{Groups: []*dbmodels.HostGroup{{ACLs: []*dbmodels.ACL{business}}}}
+
+		monday := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+		c.So(len(matchingACLs(user, host, nil, monday)), ShouldEqual, 1)
+		c.So(len(matchingACLs(user, host, nil, monday.Add(10*time.Hour))), ShouldEqual, 0)
+		end := aclScheduleEnd(user, host, nil, monday)
+		c.So(end, ShouldNotBeNil)
+		c.So(end.Equal(time.Date(2021, 3, 1, 19, 0, 0, 0, time.UTC)), ShouldBeTrue)
+
+		business.ScheduleTerminate = false
+		c.So(aclScheduleEnd(user, host, nil, monday), ShouldBeNil)
+	})
+}
+
+func TestMatchingACLsSource(t *testing.T) {
+	Convey("Testing matchingACLs with source ranges", t, func(c C) {
+		for _, invalid := range []string{"10.0.0.0/33", "vpn", "10.0.0.0/8,"} {
+			_, err := dbmodels.ParseCIDRList(invalid)
+			c.So(err, ShouldNotBeNil)
+		}
+
+		vpn := &dbmodels.ACL{Action: string(dbmodels.ACLActionAllow), Weight: 10, SourceCIDRs: "10.8.0.0/16,192.168.1.10", DeniedSourceCIDRs: "10.8.99.0/24"}
+		vpn.ID = 1
+		user := dbmodels.User{Groups: []*dbmodels.UserGroup{{ACLs: []*dbmodels.ACL{vpn}}}}
+		host := dbmodels.Host{Groups: []*dbmodels.HostGroup{{ACLs: []*dbmodels.ACL{vpn}}}}
+
+		c.So(checkACLs(user, host, net.ParseIP("10.8.1.2"), ""), ShouldEqual, dbmodels.ACLActionAllow)
+		c.So(aclSourceCIDR(user, host, net.ParseIP("10.8.1.2")), ShouldEqual, "10.8.0.0/16")
+		c.So(checkACLs(user, host, net.ParseIP("192.168.1.10"), ""), ShouldEqual, dbmodels.ACLActionAllow)
+		c.So(aclSourceCIDR(user, host, net.ParseIP("192.168.1.10")), ShouldEqual, "192.168.1.10/32")
+		c.So(checkACLs(user, host, net.ParseIP("10.8.99.2"), ""), ShouldEqual, dbmodels.ACLActionDeny)
+		c.So(checkACLs(user, host, net.ParseIP("203.0.113.1"), ""), ShouldEqual, dbmodels.ACLActionDeny)
+		c.So(checkACLs(user, host, nil, ""), ShouldEqual, dbmodels.ACLActionDeny)
+
+		// a denied range alone excludes the clients from the ACL
+		vpn.SourceCIDRs = ""
+		c.So(checkACLs(user, host, net.ParseIP("203.0.113.1"), ""), ShouldEqual, dbmodels.ACLActionAllow)
+		c.So(aclSourceCIDR(user, host, net.ParseIP("203.0.113.1")), ShouldEqual, "")
+		c.So(checkACLs(user, host, net.ParseIP("10.8.99.2"), ""), ShouldEqual, dbmodels.ACLActionDeny)
+	})
+}
+
+func TestEvaluateACLs(t *testing.T) {
+	Convey("Testing evaluateACLs", t, func(c C) {
+		now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+		yesterday := now.Add(-24 * time.Hour)
+		shared := &dbmodels.ACL{Action: string(dbmodels.ACLActionAllow), Weight: 10}
+		shared.ID = 1
+		expired := &dbmodels.ACL{Action: string(dbmodels.ACLActionDeny), Weight: 1, Expiration: &yesterday}
+		expired.ID = 2
+		pattern := &dbmodels.ACL{Action: string(dbmodels.ACLActionDeny), Weight: 10, HostPattern: "glob:prod-*"}
+		pattern.ID = 3
+		other := &dbmodels.ACL{Action: string(dbmodels.ACLActionDeny), Weight: 1}
+		other.ID = 4
+		user := dbmodels.User{Groups: []*dbmodels.UserGroup{{ACLs: []*dbmodels.ACL{pattern, other}}, {ACLs: []*dbmodels.ACL{shared, expired, pattern}}}}
+		host := dbmodels.Host{Name: "prod-db-1", Groups: []*dbmodels.HostGroup{{ACLs: []*dbmodels.ACL{shared, expired}}}}
+
+		evaluations := evaluateACLs(user, host, nil, now)
+		c.So(len(evaluations), ShouldEqual, 4)
+		ids := []uint{}
+		for _, evaluation := range evaluations {
+			ids = append(ids, evaluation.acl.ID)
+		}
+		// sorted by weight then by ID, like the decision of checkACLs
+		c.So(ids, ShouldResemble, []uint{2, 4, 1, 3})
+		c.So(evaluations[0].matched, ShouldBeFalse)
+		c.So(evaluations[0].reason, ShouldEqual, "expired on 2021-02-28 10:00")
+		c.So(evaluations[1].matched, ShouldBeFalse)
+		c.So(evaluations[1].reason, ShouldEqual, "no shared host group")
+		c.So(evaluations[2].matched, ShouldBeTrue)
+		c.So(evaluations[2].reason, ShouldEqual, "shares a host group")
+		c.So(evaluations[3].matched, ShouldBeTrue)
+		c.So(evaluations[3].reason, ShouldEqual, `host pattern "glob:prod-*" matches`)
+		c.So(matchingACLs(user, host, nil, now), ShouldResemble, []*dbmodels.ACL{shared, pattern})
+
+		shared.SourceCIDRs = "10.8.0.0/16"
+		evaluations = evaluateACLs(user, host, net.ParseIP("10.8.1.2"), now)
+		c.So(evaluations[2].reason, ShouldEqual, "shares a host group, source in 10.8.0.0/16")
+		evaluations = evaluateACLs(user, host, net.ParseIP("203.0.113.1"), now)
+		c.So(evaluations[2].matched, ShouldBeFalse)
+		c.So(evaluations[2].reason, ShouldEqual, "source 203.0.113.1 is not allowed")
+	})
+}
+
+func TestMatchingACLsSelector(t *testing.T) {
+	Convey("Testing matchingACLs with host selectors", t, func(c C) {
+		for _, invalid := range []string{"", "env=prod,", "env=pr od", "=prod", "!"} {
+			_, err := dbmodels.ParseSelector(invalid)
+			c.So(err, ShouldNotBeNil)
+		}
+		labels, err := dbmodels.ParseLabels("team=data,env=prod")
+		c.So(err, ShouldBeNil)
+		c.So(dbmodels.FormatLabels(labels), ShouldEqual, "env=prod,team=data")
+		_, err = dbmodels.ParseLabels("env")
+		c.So(err, ShouldNotBeNil)
+
+		for selector, expected := range map[string]bool{
+			"env=prod":            true,
+			"env==prod,team=data": true,
+			"env=prod,team!=data": false,
+			"env!=staging":        true,
+			"region!=eu":          true,
+			"team":                true,
+			"!team":               false,
+			"!region":             true,
+			"region":              false,
+		} {
+			parsed, err := dbmodels.ParseSelector(selector)
+			c.So(err, ShouldBeNil)
+			c.So(parsed.Matches(labels), ShouldEqual, expected)
+		}
+
+		data := &dbmodels.ACL{Action: string(dbmodels.ACLActionAllow), HostPattern: "glob:web-*", HostSelector: "env=prod,team=data"}
+		data.ID = 1
+		user := dbmodels.User{Groups: []*dbmodels.UserGroup{{ACLs: []*dbmodels.ACL{data}}}}
+		c.So(checkACLs(user, dbmodels.Host{Name: "db-1", Labels: "env=prod,team=data"}, nil, ""), ShouldEqual, dbmodels.ACLActionAllow)
+		c.So(checkACLs(user, dbmodels.Host{Name: "web-1"}, nil, ""), ShouldEqual, dbmodels.ACLActionAllow)
+		c.So(checkACLs(user, dbmodels.Host{Name: "db-2", Labels: "env=staging,team=data"}, nil, ""), ShouldEqual, dbmodels.ACLActionDeny)
+		evaluations := evaluateACLs(user, dbmodels.Host{Name: "db-2"}, nil, time.Now())
+		c.So(evaluations[0].reason, ShouldEqual, `host pattern "glob:web-*" does not match, host selector "env=prod,team=data" does not match`)
+	})
+}
+
+func TestCheckACLsNestedGroups(t *testing.T) {
+	Convey("Testing CheckACLs with nested groups", t, func(c C) {
+		db := newTestDB(c)
+
+		// "sre" contains "sre-eu" which contains "sre-eu-oncall", "prod" contains "prod-eu"
+		oncall := dbmodels.UserGroup{Name: "sre-eu-oncall"}
+		c.So(db.Create(&oncall).Error, ShouldBeNil)
+		sreEU := dbmodels.UserGroup{Name: "sre-eu", Subgroups: []*dbmodels.UserGroup{&oncall}}
+		c.So(db.Create(&sreEU).Error, ShouldBeNil)
+		sre := dbmodels.UserGroup{Name: "sre", Subgroups: []*dbmodels.UserGroup{&sreEU}}
+		c.So(db.Create(&sre).Error, ShouldBeNil)
+		prodEU := dbmodels.HostGroup{Name: "prod-eu"}
+		c.So(db.Create(&prodEU).Error, ShouldBeNil)
+		prod := dbmodels.HostGroup{Name: "prod", Subgroups: []*dbmodels.HostGroup{&prodEU}}
+		c.So(db.Create(&prod).Error, ShouldBeNil)
+		acl := dbmodels.ACL{Action: string(dbmodels.ACLActionAllow), UserGroups: []*dbmodels.UserGroup{&sre}, HostGroups: []*dbmodels.HostGroup{&prod}}
+		c.So(db.Create(&acl).Error, ShouldBeNil)
+
+		alice := dbmodels.User{Name: "alice", Email: "alice@example.com", Groups: []*dbmodels.UserGroup{&oncall}}
+		c.So(db.Create(&alice).Error, ShouldBeNil)
+		host := dbmodels.Host{Name: "db-eu-1", Groups: []*dbmodels.HostGroup{&prodEU}}
+		c.So(db.Create(&host).Error, ShouldBeNil)
+
+		user := dbmodels.User{Groups: []*dbmodels.UserGroup{&oncall}}
+		target := dbmodels.Host{Groups: []*dbmodels.HostGroup{&prodEU}}
+		c.So(checkACLs(user, target, nil, ""), ShouldEqual, dbmodels.ACLActionDeny)
+		c.So(expandACLSubjects(db, &user, &target), ShouldBeNil)
+		c.So(len(user.Groups), ShouldEqual, 3)
+		c.So(len(target.Groups), ShouldEqual, 2)
+		c.So(checkACLs(user, target, nil, ""), ShouldEqual, dbmodels.ACLActionAllow)
+
+		members, err := dbmodels.UserGroupMembers(db, &sre)
+		c.So(err, ShouldBeNil)
+		c.So(len(members), ShouldEqual, 1)
+		c.So(members[0].Name, ShouldEqual, "alice")
+		hosts, err := dbmodels.HostGroupMembers(db, &prod)
+		c.So(err, ShouldBeNil)
+		c.So(len(hosts), ShouldEqual, 1)
+
+		// the hosts behind a denied hop are not allowed
+		jump := dbmodels.Host{Name: "jump"}
+		c.So(db.Create(&jump).Error, ShouldBeNil)
+		behind := dbmodels.Host{Name: "db-eu-2", Groups: []*dbmodels.HostGroup{&prodEU}, HopID: jump.ID}
+		c.So(db.Create(&behind).Error, ShouldBeNil)
+		allowed, err := allowedHosts(db, user, nil, "")
+		c.So(err, ShouldBeNil)
+		c.So(len(allowed), ShouldEqual, 1)
+		c.So(allowed[0].Name, ShouldEqual, "db-eu-1")
+
+		// the hook is only run for the hosts allowed by the ACLs and is not a decision
+		tempDir, err := ioutil.TempDir("", "sshportal")
+		c.So(err, ShouldBeNil)
+		defer func() {
+			c.So(os.RemoveAll(tempDir), ShouldBeNil)
+		}()
+		hook := filepath.Join(tempDir, "hook.sh")
+		calls := filepath.Join(tempDir, "calls")
+		c.So(ioutil.WriteFile(hook, []byte("#!/bin/sh\necho \"$1\" >> "+calls+"\necho deny\n"), 0700), ShouldBeNil)
+		decisions := aclDecisions.With(string(dbmodels.ACLActionDeny)).Value()
+		allowed, err = allowedHosts(db, user, nil, hook)
+		c.So(err, ShouldBeNil)
+		c.So(allowed, ShouldBeEmpty)
+		out, err := ioutil.ReadFile(calls)
+		c.So(err, ShouldBeNil)
+		c.So(string(out), ShouldEqual, "allow\n")
+		c.So(aclDecisions.With(string(dbmodels.ACLActionDeny)).Value(), ShouldEqual, decisions)
+
+		// cycles are rejected
+		c.So(dbmodels.CheckUserSubgroups(db, &oncall, []*dbmodels.UserGroup{&sre}), ShouldNotBeNil)
+		c.So(dbmodels.CheckUserSubgroups(db, &sre, []*dbmodels.UserGroup{&sre}), ShouldNotBeNil)
+		c.So(dbmodels.CheckUserSubgroups(db, &sre, []*dbmodels.UserGroup{&oncall}), ShouldBeNil)
+		c.So(dbmodels.CheckHostSubgroups(db, &prodEU, []*dbmodels.HostGroup{&prod}), ShouldNotBeNil)
+
+		// the links of a removed group are removed with it
+		c.So(dbmodels.UnlinkUserGroups(db, []uint{sreEU.ID}), ShouldBeNil)
+		user = dbmodels.User{Groups: []*dbmodels.UserGroup{&oncall}}
+		c.So(expandACLSubjects(db, &user, &target), ShouldBeNil)
+		c.So(len(user.Groups), ShouldEqual, 1)
+	})
+}
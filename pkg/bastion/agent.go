@@ -0,0 +1,51 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"io"
+	"log"
+
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+const (
+	agentRequestType = "auth-agent-req@openssh.com"
+	agentChannelType = "auth-agent@openssh.com"
+)
+
+// forwardAgentChannels routes the agent channels opened by the target back to
+// the client connection, every use of the agent is logged as an event
+func forwardAgentChannels(actx *authContext, conn gossh.Conn, chans <-chan gossh.NewChannel, host string, sessionID uint) {
+	for newChan := range chans {
+		go func(newChan gossh.NewChannel) {
+			lch, lreqs, err := conn.OpenChannel(agentChannelType, nil)
+			if err != nil {
+				_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+				return
+			}
+			go gossh.DiscardRequests(lreqs)
+			rch, rreqs, err := newChan.Accept()
+			if err != nil {
+				_ = lch.Close()
+				return
+			}
+			go gossh.DiscardRequests(rreqs)
+
+			log.Printf("Agent forwarded: host=%q session=%d dbUser=id:%d,email:%s", host, sessionID, actx.user.ID, actx.user.Email)
+			dbmodels.NewEvent("agent", "forward").SetAuthor(&actx.user).SetArg("host", host).SetArg("session", sessionID).Log(actx.db)
+
+			done := make(chan struct{}, 2)
+			go func() {
+				_, _ = io.Copy(lch, newCountingReader(rch, agentChannelType, "downstream"))
+				done <- struct{}{}
+			}()
+			go func() {
+				_, _ = io.Copy(rch, newCountingReader(lch, agentChannelType, "upstream"))
+				done <- struct{}{}
+			}()
+			<-done
+			_ = lch.Close()
+			_ = rch.Close()
+		}(newChan)
+	}
+}
@@ -0,0 +1,104 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+// sshTestPair returns both ends of a loopback SSH connection
+func sshTestPair(c C) (*gossh.ServerConn, *gossh.Client) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	c.So(err, ShouldBeNil)
+	signer, err := gossh.NewSignerFromKey(priv)
+	c.So(err, ShouldBeNil)
+	serverConfig := &gossh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.So(err, ShouldBeNil)
+	defer ln.Close()
+	done := make(chan *gossh.ServerConn)
+	go func() {
+		sconn, err := ln.Accept()
+		if err != nil {
+			close(done)
+			return
+		}
+		conn, chans, reqs, err := gossh.NewServerConn(sconn, serverConfig)
+		if err != nil {
+			close(done)
+			return
+		}
+		go gossh.DiscardRequests(reqs)
+		go func() {
+			for newChan := range chans {
+				_ = newChan.Reject(gossh.UnknownChannelType, "unsupported channel type")
+			}
+		}()
+		done <- conn
+	}()
+	cconn, err := net.Dial("tcp", ln.Addr().String())
+	c.So(err, ShouldBeNil)
+	conn, chans, reqs, err := gossh.NewClientConn(cconn, ln.Addr().String(), &gossh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(), // nolint:gosec
+	})
+	c.So(err, ShouldBeNil)
+	server := <-done
+	c.So(server, ShouldNotBeNil)
+	return server, gossh.NewClient(conn, chans, reqs)
+}
+
+func TestForwardAgentChannels(t *testing.T) {
+	Convey("Testing forwardAgentChannels", t, func(c C) {
+		db := newTestDB(c)
+
+		// the user connected to the bastion, its agent echoes
+		userConn, user := sshTestPair(c)
+		defer user.Close()
+		go func() {
+			for newChan := range user.HandleChannelOpen(agentChannelType) {
+				ch, reqs, err := newChan.Accept()
+				if err != nil {
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				go func() {
+					_, _ = io.Copy(ch, ch)
+					_ = ch.Close()
+				}()
+			}
+		}()
+
+		// the bastion connected to the target
+		targetConn, target := sshTestPair(c)
+		defer target.Close()
+		actx := &authContext{db: db, user: dbmodels.User{Email: "alice@example.com"}}
+		go forwardAgentChannels(actx, userConn, target.HandleChannelOpen(agentChannelType), "target:22", 42)
+
+		// the target opens an agent channel
+		ch, reqs, err := targetConn.OpenChannel(agentChannelType, nil)
+		c.So(err, ShouldBeNil)
+		go gossh.DiscardRequests(reqs)
+		_, err = ch.Write([]byte("ping"))
+		c.So(err, ShouldBeNil)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(ch, buf)
+		c.So(err, ShouldBeNil)
+		c.So(string(buf), ShouldEqual, "ping")
+		c.So(ch.Close(), ShouldBeNil)
+
+		var events []dbmodels.Event
+		c.So(db.Where("domain = ? AND action = ?", "agent", "forward").Find(&events).Error, ShouldBeNil)
+		c.So(len(events), ShouldEqual, 1)
+		c.So(string(events[0].Args), ShouldContainSubstring, `"session":42`)
+		c.So(string(events[0].Args), ShouldContainSubstring, `"host":"target:22"`)
+	})
+}
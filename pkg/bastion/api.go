@@ -0,0 +1,1549 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/docker/docker/pkg/namesgenerator"
+	"gorm.io/gorm"
+	"moul.io/sshportal/pkg/crypto"
+	"moul.io/sshportal/pkg/dbmodels"
+	"moul.io/sshportal/pkg/utils"
+)
+
+// apiPrefix is the path prefix of the REST API, i.e., /api/v1/hosts/42
+const apiPrefix = "/api/v1/"
+
+// apiMaxBodySize limits the size of the JSON documents sent to the API
+const apiMaxBodySize = 1 << 20
+
+type apiContext struct {
+	db     *gorm.DB
+	aesKey string
+	user   *dbmodels.User
+	req    *http.Request
+}
+
+// apiResource defines the operations of a /api/v1/<resource> collection, the
+// nil operations are not allowed
+type apiResource struct {
+	// permission is the resource of the required permissions, "<permission>:read"
+	// to list and get the entities, "<permission>:write" to modify them
+	permission string
+	// createPermission and removePermission replace the write permission
+	createPermission string
+	removePermission string
+	list             func(actx *apiContext) (interface{}, error)
+	get              func(actx *apiContext, id string) (interface{}, error)
+	create           func(actx *apiContext) (interface{}, error)
+	update           func(actx *apiContext, id string) (interface{}, error)
+	remove           func(actx *apiContext, id string) error
+}
+
+// requiredPermission returns the permission needed for the request method
+func (resource apiResource) requiredPermission(method string) string {
+	switch {
+	case method == http.MethodGet:
+		return resource.permission + ":read"
+	case method == http.MethodPost && resource.createPermission != "":
+		return resource.createPermission
+	case method == http.MethodDelete && resource.removePermission != "":
+		return resource.removePermission
+	}
+	return resource.permission + ":write"
+}
+
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+func apiErrorf(status int, format string, args ...interface{}) error {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+var apiResources = map[string]apiResource{
+	"hosts": {
+		permission: "host",
+		list:       apiListHosts,
+		get:        apiGetHost,
+		create:     apiCreateHost,
+		update:     apiUpdateHost,
+		remove: func(actx *apiContext, id string) error {
+			return apiRemove(dbmodels.HostsByIdentifiers(actx.db, []string{id}), &dbmodels.Host{})
+		},
+	},
+	"keys": {
+		permission: "key",
+		list: func(actx *apiContext) (interface{}, error) {
+			var keys []*dbmodels.SSHKey
+			if err := dbmodels.SSHKeysPreload(actx.db).Order("created_at desc").Find(&keys).Error; err != nil {
+				return nil, err
+			}
+			return keys, apiPrivKeys(actx, keys...)
+		},
+		get:    apiGetKey,
+		create: apiCreateKey,
+		update: apiUpdateKey,
+		remove: func(actx *apiContext, id string) error {
+			return apiRemove(dbmodels.SSHKeysByIdentifiers(actx.db, []string{id}), &dbmodels.SSHKey{})
+		},
+	},
+	"users": {
+		permission:       "user",
+		createPermission: "user:invite",
+		list: func(actx *apiContext) (interface{}, error) {
+			var users []*dbmodels.User
+			if err := dbmodels.UsersPreload(actx.db).Order("created_at desc").Find(&users).Error; err != nil {
+				return nil, err
+			}
+			for _, user := range users {
+				user.InviteToken = ""
+			}
+			return users, nil
+		},
+		get:    apiGetUser,
+		create: apiInviteUser,
+		update: apiUpdateUser,
+		remove: func(actx *apiContext, id string) error {
+			var user dbmodels.User
+			if err := dbmodels.UsersByIdentifiers(actx.db.Preload("Roles"), []string{id}).First(&user).Error; err != nil {
+				return err
+			}
+			if err := actx.user.CheckManage(&user); err != nil {
+				return apiErrorf(http.StatusForbidden, "%v", err)
+			}
+			return apiRemove(actx.db.Where("id = ?", user.ID), &dbmodels.User{})
+		},
+	},
+	"usergroups": {
+		permission: "usergroup",
+		list: func(actx *apiContext) (interface{}, error) {
+			var userGroups []*dbmodels.UserGroup
+			if err := dbmodels.UserGroupsPreload(actx.db).Order("created_at desc").Find(&userGroups).Error; err != nil {
+				return nil, err
+			}
+			return userGroups, nil
+		},
+		get:    apiGetUserGroup,
+		create: apiCreateUserGroup,
+		update: apiUpdateUserGroup,
+		remove: func(actx *apiContext, id string) error {
+			var userGroup dbmodels.UserGroup
+			if err := dbmodels.UserGroupsByIdentifiers(actx.db, []string{id}).First(&userGroup).Error; err != nil {
+				return err
+			}
+			if err := dbmodels.UnlinkUserGroups(actx.db, []uint{userGroup.ID}); err != nil {
+				return err
+			}
+			return apiRemove(actx.db.Where("id = ?", userGroup.ID), &dbmodels.UserGroup{})
+		},
+	},
+	"hostgroups": {
+		permission: "hostgroup",
+		list: func(actx *apiContext) (interface{}, error) {
+			var hostGroups []*dbmodels.HostGroup
+			if err := dbmodels.HostGroupsPreload(actx.db).Order("created_at desc").Find(&hostGroups).Error; err != nil {
+				return nil, err
+			}
+			return hostGroups, nil
+		},
+		get:    apiGetHostGroup,
+		create: apiCreateHostGroup,
+		update: apiUpdateHostGroup,
+		remove: func(actx *apiContext, id string) error {
+			var hostGroup dbmodels.HostGroup
+			if err := dbmodels.HostGroupsByIdentifiers(actx.db, []string{id}).First(&hostGroup).Error; err != nil {
+				return err
+			}
+			if err := dbmodels.UnlinkHostGroups(actx.db, []uint{hostGroup.ID}); err != nil {
+				return err
+			}
+			return apiRemove(actx.db.Where("id = ?", hostGroup.ID), &dbmodels.HostGroup{})
+		},
+	},
+	"acls": {
+		permission: "acl",
+		list: func(actx *apiContext) (interface{}, error) {
+			var acls []*dbmodels.ACL
+			if err := dbmodels.ACLsPreload(actx.db).Order("created_at desc").Find(&acls).Error; err != nil {
+				return nil, err
+			}
+			return acls, nil
+		},
+		get:    apiGetACL,
+		create: apiCreateACL,
+		update: apiUpdateACL,
+		remove: func(actx *apiContext, id string) error {
+			return apiRemove(dbmodels.ACLsByIdentifiers(actx.db, []string{id}), &dbmodels.ACL{})
+		},
+	},
+	"sessions": {
+		permission:       "session",
+		removePermission: "session:kill",
+		list:             apiListSessions,
+		get: func(actx *apiContext, id string) (interface{}, error) {
+			var session dbmodels.Session
+			return &session, dbmodels.SessionsPreload(dbmodels.SessionsByIdentifiers(actx.db, []string{id})).First(&session).Error
+		},
+		// sessions cannot be removed, deleting an active session kills it
+		remove: apiKillSession,
+	},
+	"events": {
+		permission: "event",
+		list:       apiListEvents,
+		get: func(actx *apiContext, id string) (interface{}, error) {
+			var event dbmodels.Event
+			if err := dbmodels.EventsPreload(dbmodels.EventsByIdentifiers(actx.db, []string{id})).First(&event).Error; err != nil {
+				return nil, err
+			}
+			if len(event.Args) > 0 {
+				if err := json.Unmarshal(event.Args, &event.ArgsMap); err != nil {
+					return nil, err
+				}
+			}
+			return &event, nil
+		},
+	},
+}
+
+// APIHandler serves the REST management API, the requests are authenticated
+// with the API tokens created by the `apitoken create` command
+func APIHandler(db *gorm.DB, aesKey string) http.Handler {
+	dbmodels.InitValidator()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+			apiWriteError(w, apiErrorf(http.StatusNotFound, "not found"))
+			return
+		}
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+		resource, found := apiResources[parts[0]]
+		if !found || len(parts) > 2 {
+			apiWriteError(w, apiErrorf(http.StatusNotFound, "not found"))
+			return
+		}
+		id := ""
+		if len(parts) == 2 {
+			id = parts[1]
+		}
+
+		user, err := apiAuthenticate(db, r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sshportal"`)
+			apiWriteError(w, err)
+			return
+		}
+		if err := user.CheckPermission(resource.requiredPermission(r.Method)); err != nil {
+			apiWriteError(w, apiErrorf(http.StatusForbidden, "%v", err))
+			return
+		}
+
+		dbmodels.NewEvent("api", parts[0]).SetAuthor(user).SetArg("method", r.Method).SetArg("path", r.URL.Path).Log(db)
+
+		actx := &apiContext{db: db, aesKey: aesKey, user: user, req: r}
+		var (
+			status = http.StatusOK
+			ret    interface{}
+		)
+		switch {
+		case r.Method == http.MethodGet && id == "" && resource.list != nil:
+			ret, err = resource.list(actx)
+		case r.Method == http.MethodGet && id != "" && resource.get != nil:
+			ret, err = resource.get(actx, id)
+		case r.Method == http.MethodPost && id == "" && resource.create != nil:
+			status = http.StatusCreated
+			ret, err = resource.create(actx)
+		case r.Method == http.MethodPatch && id != "" && resource.update != nil:
+			ret, err = resource.update(actx, id)
+		case r.Method == http.MethodDelete && id != "" && resource.remove != nil:
+			status = http.StatusNoContent
+			err = resource.remove(actx, id)
+		default:
+			err = apiErrorf(http.StatusMethodNotAllowed, "method %s not allowed on %s", r.Method, r.URL.Path)
+		}
+		if err != nil {
+			apiWriteError(w, err)
+			return
+		}
+
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(ret)
+	})
+}
+
+// apiAuthenticate returns the user owning the bearer token of the request
+func apiAuthenticate(db *gorm.DB, r *http.Request) (*dbmodels.User, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, apiErrorf(http.StatusUnauthorized, "missing API token")
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+
+	var apiToken dbmodels.APIToken
+	if err := db.Where("hash = ?", crypto.HashAPIToken(token)).First(&apiToken).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apiErrorf(http.StatusUnauthorized, "invalid API token")
+		}
+		return nil, err
+	}
+	var user dbmodels.User
+	if err := dbmodels.UsersPreload(db).First(&user, apiToken.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apiErrorf(http.StatusUnauthorized, "invalid API token")
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func apiWriteError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.status
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// apiDecode reads the JSON document of the request, the unknown fields are
+// refused to catch the typos
+func apiDecode(actx *apiContext, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, actx.req.Body, apiMaxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return apiErrorf(http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+// apiValidate validates the entity like the shell commands do
+func apiValidate(entity interface{}) error {
+	if _, err := govalidator.ValidateStruct(entity); err != nil {
+		return apiErrorf(http.StatusBadRequest, "%v", err)
+	}
+	return nil
+}
+
+// apiLookup loads the entity referenced by the request body, an unknown
+// reference is a bad request rather than a missing resource
+func apiLookup(query *gorm.DB, kind, identifier string, dest interface{}) error {
+	if err := query.First(dest).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apiErrorf(http.StatusBadRequest, "no such %s: %q", kind, identifier)
+		}
+		return err
+	}
+	return nil
+}
+
+func apiRemove(query *gorm.DB, model interface{}) error {
+	ret := query.Unscoped().Delete(model)
+	if ret.Error != nil {
+		return ret.Error
+	}
+	if ret.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// apiReplaceAssociation replaces the associated entities, values is a slice
+func apiReplaceAssociation(association *gorm.Association, values interface{}) error {
+	if reflect.ValueOf(values).Len() == 0 {
+		return association.Clear()
+	}
+	return association.Replace(values)
+}
+
+// apiLimit returns the ?limit= query parameter, or def
+func apiLimit(actx *apiContext, def int) (int, error) {
+	value := actx.req.URL.Query().Get("limit")
+	if value == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		return 0, apiErrorf(http.StatusBadRequest, "invalid limit %q", value)
+	}
+	return limit, nil
+}
+
+// Hosts
+
+type apiHostInput struct {
+	URL             string            `json:"url"`
+	Name            string            `json:"name"`
+	Password        string            `json:"password"`
+	Comment         string            `json:"comment"`
+	Key             string            `json:"key"`
+	CA              string            `json:"ca"`
+	Hop             string            `json:"hop"`
+	Logging         string            `json:"logging"`
+	TransferPolicy  string            `json:"transfer_policy"`
+	RecordingFormat string            `json:"recording_format"`
+	AgentForward    bool              `json:"agent_forward"`
+	Groups          []string          `json:"groups"`
+	Labels          map[string]string `json:"labels"`
+}
+
+// apiHostUpdate contains the fields to update, an empty hop or ca unsets it
+// and the groups and labels replace the current ones
+type apiHostUpdate struct {
+	Name            *string            `json:"name"`
+	URL             *string            `json:"url"`
+	Comment         *string            `json:"comment"`
+	Key             *string            `json:"key"`
+	CA              *string            `json:"ca"`
+	Hop             *string            `json:"hop"`
+	Logging         *string            `json:"logging"`
+	TransferPolicy  *string            `json:"transfer_policy"`
+	RecordingFormat *string            `json:"recording_format"`
+	AgentForward    *bool              `json:"agent_forward"`
+	Groups          *[]string          `json:"groups"`
+	Labels          *map[string]string `json:"labels"`
+}
+
+func apiHostsQuery(actx *apiContext) *gorm.DB {
+	// the keys are only visible to the users able to read them
+	if actx.user.HasPermission("key:read") {
+		return actx.db.Preload("Groups").Preload("SSHKey").Preload("CAKey")
+	}
+	return actx.db.Preload("Groups")
+}
+
+// apiLabels validates the labels and returns them as stored in the hosts
+func apiLabels(labels map[string]string) (string, error) {
+	formatted := dbmodels.FormatLabels(labels)
+	if _, err := dbmodels.ParseLabels(formatted); err != nil {
+		return "", apiErrorf(http.StatusBadRequest, "%v", err)
+	}
+	return formatted, nil
+}
+
+func apiListHosts(actx *apiContext) (interface{}, error) {
+	var hosts []*dbmodels.Host
+	if err := apiHostsQuery(actx).Order("created_at desc").Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	if err := apiHostSecrets(actx, hosts...); err != nil {
+		return nil, err
+	}
+	input := actx.req.URL.Query().Get("selector")
+	if input == "" {
+		return hosts, nil
+	}
+	selector, err := dbmodels.ParseSelector(input)
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+	}
+	matching := []*dbmodels.Host{}
+	for _, host := range hosts {
+		labels, err := dbmodels.ParseLabels(host.Labels)
+		if err != nil {
+			return nil, err
+		}
+		if selector.Matches(labels) {
+			matching = append(matching, host)
+		}
+	}
+	return matching, nil
+}
+
+func apiGetHost(actx *apiContext, id string) (interface{}, error) {
+	var host dbmodels.Host
+	if err := dbmodels.HostsByIdentifiers(apiHostsQuery(actx), []string{id}).First(&host).Error; err != nil {
+		return nil, err
+	}
+	return &host, apiHostSecrets(actx, &host)
+}
+
+// apiHostSecrets hides the passwords and private keys of the hosts unless they
+// are requested with ?decrypt=true, which requires host:write like
+// `host inspect --decrypt`, and key:write for the keys
+func apiHostSecrets(actx *apiContext, hosts ...*dbmodels.Host) error {
+	decrypt := actx.req.URL.Query().Get("decrypt") == "true"
+	if decrypt {
+		if err := actx.user.CheckPermission("host:write"); err != nil {
+			return apiErrorf(http.StatusForbidden, "%v", err)
+		}
+	}
+	for _, host := range hosts {
+		if !decrypt {
+			host.Password = ""
+		} else if err := crypto.HostDecrypt(actx.aesKey, host); err != nil {
+			return err
+		}
+		if err := apiPrivKeys(actx, host.SSHKey, host.CAKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func apiCreateHost(actx *apiContext) (interface{}, error) {
+	var input apiHostInput
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+	db := actx.db
+
+	u, err := parseInputURL(input.URL)
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+	}
+	labels, err := apiLabels(input.Labels)
+	if err != nil {
+		return nil, err
+	}
+	host := &dbmodels.Host{
+		URL:               u.String(),
+		Comment:           input.Comment,
+		Logging:           "everything", // default is everything
+		TransferPolicy:    input.TransferPolicy,
+		RecordingFormat:   input.RecordingFormat,
+		AllowAgentForward: input.AgentForward,
+		Labels:            labels,
+	}
+	host.ExtractURLPassword()
+	if input.Password != "" {
+		host.Password = input.Password
+	}
+	if err := checkSecretReference(actx.user, host.Password); err != nil {
+		return nil, apiErrorf(http.StatusForbidden, "%v", err)
+	}
+	if matched, _ := regexp.MatchString(`^([0-9]{1,3}.){3}.([0-9]{1,3})$`, host.Hostname()); matched {
+		host.Name = host.Hostname()
+	} else {
+		host.Name = strings.Split(host.Hostname(), ".")[0]
+	}
+	if input.Name != "" {
+		host.Name = input.Name
+	}
+	if input.Logging != "" {
+		host.Logging = input.Logging
+	}
+	if input.Hop != "" {
+		hop, err := dbmodels.HostByName(db, input.Hop)
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+		host.Hop = hop
+	}
+	if err := apiValidate(host); err != nil {
+		return nil, err
+	}
+
+	if input.Key == "" && host.Password == "" && input.CA == "" {
+		input.Key = "default"
+	}
+	if input.Key != "" {
+		var key dbmodels.SSHKey
+		if err := apiLookup(dbmodels.SSHKeysByIdentifiers(db, []string{input.Key}), "key", input.Key, &key); err != nil {
+			return nil, err
+		}
+		host.SSHKeyID = key.ID
+	}
+	if input.CA != "" {
+		var caKey dbmodels.SSHKey
+		if err := apiLookup(dbmodels.SSHKeysByIdentifiers(db, []string{input.CA}), "key", input.CA, &caKey); err != nil {
+			return nil, err
+		}
+		host.CAKeyID = caKey.ID
+	}
+	// the groups grant the access to the hosts
+	if len(input.Groups) == 0 {
+		input.Groups = []string{"default"}
+	} else if err := actx.user.CheckPermission("usergroup:write"); err != nil {
+		return nil, apiErrorf(http.StatusForbidden, "%v", err)
+	}
+	if err := dbmodels.HostGroupsByIdentifiers(db, input.Groups).Find(&host.Groups).Error; err != nil {
+		return nil, err
+	}
+
+	if err := crypto.HostEncrypt(actx.aesKey, host); err != nil {
+		return nil, err
+	}
+	if err := db.Create(host).Error; err != nil {
+		return nil, err
+	}
+	return apiGetHost(actx, fmt.Sprint(host.ID))
+}
+
+func apiUpdateHost(actx *apiContext, id string) (interface{}, error) {
+	var input apiHostUpdate
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+	db := actx.db
+
+	var host dbmodels.Host
+	if err := dbmodels.HostsByIdentifiers(db, []string{id}).First(&host).Error; err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{}
+	if input.Name != nil {
+		// the new name is validated like on creation
+		renamed := host
+		renamed.Name = *input.Name
+		if err := apiValidate(renamed); err != nil {
+			return nil, err
+		}
+		updates["name"] = *input.Name
+	}
+	if input.Comment != nil {
+		updates["comment"] = *input.Comment
+	}
+	if input.URL != nil {
+		u, err := parseInputURL(*input.URL)
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+		// the password is kept in the encrypted field
+		updated := dbmodels.Host{URL: u.String()}
+		if updated.ExtractURLPassword() {
+			if err := checkSecretReference(actx.user, updated.Password); err != nil {
+				return nil, apiErrorf(http.StatusForbidden, "%v", err)
+			}
+			if err := crypto.HostEncrypt(actx.aesKey, &updated); err != nil {
+				return nil, err
+			}
+			updates["password"] = updated.Password
+		}
+		updates["url"] = updated.URL
+	}
+	if input.Logging != nil {
+		if !dbmodels.IsValidHostLoggingMode(*input.Logging) {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid host logging mode: %q", *input.Logging)
+		}
+		updates["logging"] = *input.Logging
+	}
+	if input.TransferPolicy != nil {
+		if !dbmodels.IsValidHostTransferPolicy(*input.TransferPolicy) {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid host transfer policy: %q", *input.TransferPolicy)
+		}
+		updates["transfer_policy"] = *input.TransferPolicy
+	}
+	if input.RecordingFormat != nil {
+		if !dbmodels.IsValidHostRecordingFormat(*input.RecordingFormat) {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid host recording format: %q", *input.RecordingFormat)
+		}
+		updates["recording_format"] = *input.RecordingFormat
+	}
+	if input.AgentForward != nil {
+		updates["allow_agent_forward"] = *input.AgentForward
+	}
+	if input.Labels != nil {
+		labels, err := apiLabels(*input.Labels)
+		if err != nil {
+			return nil, err
+		}
+		updates["labels"] = labels
+	}
+	if input.Hop != nil {
+		updates["hop_id"] = 0
+		if *input.Hop != "" {
+			hop, err := dbmodels.HostByName(db, *input.Hop)
+			if err != nil {
+				return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+			}
+			updates["hop_id"] = hop.ID
+		}
+	}
+	if input.Key != nil {
+		var key dbmodels.SSHKey
+		if err := apiLookup(dbmodels.SSHKeysByIdentifiers(db, []string{*input.Key}), "key", *input.Key, &key); err != nil {
+			return nil, err
+		}
+		updates["ssh_key_id"] = key.ID
+	}
+	if input.CA != nil {
+		updates["ca_key_id"] = 0
+		if *input.CA != "" {
+			var caKey dbmodels.SSHKey
+			if err := apiLookup(dbmodels.SSHKeysByIdentifiers(db, []string{*input.CA}), "key", *input.CA, &caKey); err != nil {
+				return nil, err
+			}
+			updates["ca_key_id"] = caKey.ID
+		}
+	}
+
+	tx := db.Begin()
+	if len(updates) > 0 {
+		if err := tx.Model(&host).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if input.Groups != nil {
+		var groups []*dbmodels.HostGroup
+		if len(*input.Groups) > 0 {
+			if err := dbmodels.HostGroupsByIdentifiers(db, *input.Groups).Find(&groups).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if err := apiReplaceAssociation(tx.Model(&host).Association("Groups"), groups); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return apiGetHost(actx, fmt.Sprint(host.ID))
+}
+
+// Keys
+
+type apiKeyInput struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Length  uint   `json:"length"`
+	Comment string `json:"comment"`
+	// PrivKey imports an existing private key instead of generating a new one,
+	// it can be a secret:// reference
+	PrivKey string `json:"priv_key"`
+}
+
+type apiKeyUpdate struct {
+	Name    *string `json:"name"`
+	Comment *string `json:"comment"`
+}
+
+func apiGetKey(actx *apiContext, id string) (interface{}, error) {
+	var key dbmodels.SSHKey
+	if err := dbmodels.SSHKeysByIdentifiers(dbmodels.SSHKeysPreload(actx.db), []string{id}).First(&key).Error; err != nil {
+		return nil, err
+	}
+	return &key, apiPrivKeys(actx, &key)
+}
+
+// apiPrivKeys hides the private keys unless they are requested with
+// ?decrypt=true, which requires key:write like `key inspect --decrypt`
+func apiPrivKeys(actx *apiContext, keys ...*dbmodels.SSHKey) error {
+	decrypt := actx.req.URL.Query().Get("decrypt") == "true"
+	if decrypt {
+		if err := actx.user.CheckPermission("key:write"); err != nil {
+			return apiErrorf(http.StatusForbidden, "%v", err)
+		}
+	}
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		if !decrypt {
+			key.PrivKey = ""
+			continue
+		}
+		if err := crypto.SSHKeyDecrypt(actx.aesKey, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func apiCreateKey(actx *apiContext) (interface{}, error) {
+	input := apiKeyInput{Type: "ed25519"}
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+
+	var (
+		key *dbmodels.SSHKey
+		err error
+	)
+	if input.PrivKey != "" {
+		if err := checkSecretReference(actx.user, input.PrivKey); err != nil {
+			return nil, apiErrorf(http.StatusForbidden, "%v", err)
+		}
+		value, err := crypto.ResolveSecret(input.PrivKey)
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+		if key, err = crypto.ImportSSHKey(value); err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+		if crypto.IsSecretReference(input.PrivKey) {
+			// only the reference is stored, the key is resolved when connecting
+			key.PrivKey = input.PrivKey
+		}
+	} else {
+		length := input.Length
+		if length == 0 {
+			// same defaults as `key create`
+			switch input.Type {
+			case "rsa":
+				length = 3072
+			case "ecdsa":
+				length = 256
+			case "ed25519":
+				length = 1
+			}
+		}
+		if key, err = crypto.NewSSHKey(input.Type, length); err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+	}
+	key.Name = input.Name
+	if key.Name == "" {
+		key.Name = namesgenerator.GetRandomName(0)
+	}
+	key.Comment = input.Comment
+	if err := apiValidate(key); err != nil {
+		return nil, err
+	}
+
+	if err := crypto.SSHKeyEncrypt(actx.aesKey, key); err != nil {
+		return nil, err
+	}
+	if err := actx.db.Create(key).Error; err != nil {
+		return nil, err
+	}
+	return apiGetKey(actx, fmt.Sprint(key.ID))
+}
+
+func apiUpdateKey(actx *apiContext, id string) (interface{}, error) {
+	var input apiKeyUpdate
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+
+	var key dbmodels.SSHKey
+	if err := dbmodels.SSHKeysByIdentifiers(actx.db, []string{id}).First(&key).Error; err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{}
+	if input.Name != nil {
+		// the new name is validated like on creation
+		renamed := key
+		renamed.Name = *input.Name
+		if err := apiValidate(renamed); err != nil {
+			return nil, err
+		}
+		updates["name"] = *input.Name
+	}
+	if input.Comment != nil {
+		updates["comment"] = *input.Comment
+	}
+	if len(updates) > 0 {
+		if err := actx.db.Model(&key).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	return apiGetKey(actx, fmt.Sprint(key.ID))
+}
+
+// Users
+
+type apiUserInput struct {
+	Email   string   `json:"email"`
+	Name    string   `json:"name"`
+	Comment string   `json:"comment"`
+	Groups  []string `json:"groups"`
+}
+
+// apiUserUpdate contains the fields to update, the groups and roles replace
+// the current ones
+type apiUserUpdate struct {
+	Name         *string   `json:"name"`
+	Email        *string   `json:"email"`
+	Comment      *string   `json:"comment"`
+	RemoveInvite bool      `json:"remove_invite"`
+	Groups       *[]string `json:"groups"`
+	Roles        *[]string `json:"roles"`
+}
+
+func apiGetUser(actx *apiContext, id string) (interface{}, error) {
+	var user dbmodels.User
+	if err := dbmodels.UsersPreload(dbmodels.UsersByIdentifiers(actx.db, []string{id})).First(&user).Error; err != nil {
+		return nil, err
+	}
+	// a pending invite token associates any key with the account
+	user.InviteToken = ""
+	return &user, nil
+}
+
+// apiInviteUser creates a user like `user invite`, the invite token of the
+// returned user associates the account with a key
+func apiInviteUser(actx *apiContext) (interface{}, error) {
+	var input apiUserInput
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+
+	if !utils.ValidateEmail(input.Email) {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid email")
+	}
+	if input.Name == "" {
+		input.Name = strings.Split(input.Email, "@")[0]
+	}
+	inviteToken, err := randStringBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	user := dbmodels.User{
+		Name:        input.Name,
+		Email:       input.Email,
+		Comment:     input.Comment,
+		InviteToken: inviteToken,
+	}
+	if err := apiValidate(user); err != nil {
+		return nil, err
+	}
+	// the groups grant the access to the hosts
+	if len(input.Groups) == 0 {
+		input.Groups = []string{"default"}
+	} else if err := actx.user.CheckPermission("usergroup:write"); err != nil {
+		return nil, apiErrorf(http.StatusForbidden, "%v", err)
+	}
+	if err := dbmodels.UserGroupsByIdentifiers(actx.db, input.Groups).Find(&user.Groups).Error; err != nil {
+		return nil, err
+	}
+
+	if err := actx.db.Create(&user).Error; err != nil {
+		return nil, err
+	}
+	created, err := apiGetUser(actx, fmt.Sprint(user.ID))
+	if err != nil {
+		return nil, err
+	}
+	// the token is only returned to the inviter
+	created.(*dbmodels.User).InviteToken = inviteToken
+	return created, nil
+}
+
+func apiUpdateUser(actx *apiContext, id string) (interface{}, error) {
+	var input apiUserUpdate
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+	db := actx.db
+
+	var user dbmodels.User
+	if err := dbmodels.UsersByIdentifiers(db.Preload("Roles"), []string{id}).First(&user).Error; err != nil {
+		return nil, err
+	}
+	if err := actx.user.CheckManage(&user); err != nil {
+		return nil, apiErrorf(http.StatusForbidden, "%v", err)
+	}
+	// the groups grant the access to the hosts
+	if input.Groups != nil {
+		if err := actx.user.CheckPermission("usergroup:write"); err != nil {
+			return nil, apiErrorf(http.StatusForbidden, "%v", err)
+		}
+	}
+	updates := map[string]interface{}{}
+	if input.Name != nil {
+		// the new name is validated like on creation
+		renamed := user
+		renamed.Name = *input.Name
+		if err := apiValidate(renamed); err != nil {
+			return nil, err
+		}
+		updates["name"] = *input.Name
+	}
+	if input.Email != nil {
+		if !utils.ValidateEmail(*input.Email) {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid email")
+		}
+		updates["email"] = *input.Email
+	}
+	if input.Comment != nil {
+		updates["comment"] = *input.Comment
+	}
+	if input.RemoveInvite {
+		updates["invite_token"] = ""
+	}
+
+	tx := db.Begin()
+	if len(updates) > 0 {
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if input.Groups != nil {
+		var groups []*dbmodels.UserGroup
+		if len(*input.Groups) > 0 {
+			if err := dbmodels.UserGroupsByIdentifiers(db, *input.Groups).Find(&groups).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if err := apiReplaceAssociation(tx.Model(&user).Association("Groups"), groups); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if input.Roles != nil {
+		var roles []*dbmodels.UserRole
+		if len(*input.Roles) > 0 {
+			if err := dbmodels.UserRolesByIdentifiers(db, *input.Roles).Find(&roles).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		// one can only assign the roles whose permissions one has
+		for _, role := range roles {
+			if user.HasRole(role.Name) {
+				continue
+			}
+			if err := actx.user.CheckGrant(role.Permissions); err != nil {
+				tx.Rollback()
+				return nil, apiErrorf(http.StatusForbidden, "%v", err)
+			}
+		}
+		if err := apiReplaceAssociation(tx.Model(&user).Association("Roles"), roles); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return apiGetUser(actx, fmt.Sprint(user.ID))
+}
+
+// User groups
+
+type apiUserGroupInput struct {
+	Name       string   `json:"name"`
+	Comment    string   `json:"comment"`
+	Require2FA bool     `json:"require_2fa"`
+	Subgroups  []string `json:"subgroups"`
+}
+
+// apiUserGroupUpdate contains the fields to update, the subgroups replace the current ones
+type apiUserGroupUpdate struct {
+	Name       *string   `json:"name"`
+	Comment    *string   `json:"comment"`
+	Require2FA *bool     `json:"require_2fa"`
+	Subgroups  *[]string `json:"subgroups"`
+}
+
+func apiGetUserGroup(actx *apiContext, id string) (interface{}, error) {
+	var userGroup dbmodels.UserGroup
+	return &userGroup, dbmodels.UserGroupsPreload(dbmodels.UserGroupsByIdentifiers(actx.db, []string{id})).First(&userGroup).Error
+}
+
+func apiCreateUserGroup(actx *apiContext) (interface{}, error) {
+	var input apiUserGroupInput
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+
+	userGroup := dbmodels.UserGroup{
+		Name:       input.Name,
+		Comment:    input.Comment,
+		Require2FA: input.Require2FA,
+	}
+	if userGroup.Name == "" {
+		userGroup.Name = namesgenerator.GetRandomName(0)
+	}
+	if err := apiValidate(userGroup); err != nil {
+		return nil, err
+	}
+	// like `usergroup create`, the author is a member of the new group
+	userGroup.Users = []*dbmodels.User{actx.user}
+	if len(input.Subgroups) > 0 {
+		if err := dbmodels.UserGroupsByIdentifiers(actx.db, input.Subgroups).Find(&userGroup.Subgroups).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	if err := actx.db.Create(&userGroup).Error; err != nil {
+		return nil, err
+	}
+	return apiGetUserGroup(actx, fmt.Sprint(userGroup.ID))
+}
+
+func apiUpdateUserGroup(actx *apiContext, id string) (interface{}, error) {
+	var input apiUserGroupUpdate
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+
+	var userGroup dbmodels.UserGroup
+	if err := dbmodels.UserGroupsByIdentifiers(actx.db, []string{id}).First(&userGroup).Error; err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{}
+	if input.Name != nil {
+		// the new name is validated like on creation
+		renamed := userGroup
+		renamed.Name = *input.Name
+		if err := apiValidate(renamed); err != nil {
+			return nil, err
+		}
+		updates["name"] = *input.Name
+	}
+	if input.Comment != nil {
+		updates["comment"] = *input.Comment
+	}
+	if input.Require2FA != nil {
+		updates["require_2fa"] = *input.Require2FA
+	}
+
+	tx := actx.db.Begin()
+	if len(updates) > 0 {
+		if err := tx.Model(&userGroup).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if input.Subgroups != nil {
+		var subgroups []*dbmodels.UserGroup
+		if len(*input.Subgroups) > 0 {
+			if err := dbmodels.UserGroupsByIdentifiers(tx, *input.Subgroups).Find(&subgroups).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if err := dbmodels.CheckUserSubgroups(tx, &userGroup, subgroups); err != nil {
+			tx.Rollback()
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+		if err := apiReplaceAssociation(tx.Model(&userGroup).Association("Subgroups"), subgroups); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return apiGetUserGroup(actx, fmt.Sprint(userGroup.ID))
+}
+
+// Host groups
+
+type apiHostGroupInput struct {
+	Name      string   `json:"name"`
+	Comment   string   `json:"comment"`
+	Subgroups []string `json:"subgroups"`
+}
+
+// apiHostGroupUpdate contains the fields to update, the subgroups replace the current ones
+type apiHostGroupUpdate struct {
+	Name      *string   `json:"name"`
+	Comment   *string   `json:"comment"`
+	Subgroups *[]string `json:"subgroups"`
+}
+
+func apiGetHostGroup(actx *apiContext, id string) (interface{}, error) {
+	var hostGroup dbmodels.HostGroup
+	return &hostGroup, dbmodels.HostGroupsPreload(dbmodels.HostGroupsByIdentifiers(actx.db, []string{id})).First(&hostGroup).Error
+}
+
+func apiCreateHostGroup(actx *apiContext) (interface{}, error) {
+	var input apiHostGroupInput
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+
+	hostGroup := dbmodels.HostGroup{
+		Name:    input.Name,
+		Comment: input.Comment,
+	}
+	if hostGroup.Name == "" {
+		hostGroup.Name = namesgenerator.GetRandomName(0)
+	}
+	if err := apiValidate(hostGroup); err != nil {
+		return nil, err
+	}
+	if len(input.Subgroups) > 0 {
+		if err := dbmodels.HostGroupsByIdentifiers(actx.db, input.Subgroups).Find(&hostGroup.Subgroups).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	if err := actx.db.Create(&hostGroup).Error; err != nil {
+		return nil, err
+	}
+	return apiGetHostGroup(actx, fmt.Sprint(hostGroup.ID))
+}
+
+func apiUpdateHostGroup(actx *apiContext, id string) (interface{}, error) {
+	var input apiHostGroupUpdate
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+
+	var hostGroup dbmodels.HostGroup
+	if err := dbmodels.HostGroupsByIdentifiers(actx.db, []string{id}).First(&hostGroup).Error; err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{}
+	if input.Name != nil {
+		// the new name is validated like on creation
+		renamed := hostGroup
+		renamed.Name = *input.Name
+		if err := apiValidate(renamed); err != nil {
+			return nil, err
+		}
+		updates["name"] = *input.Name
+	}
+	if input.Comment != nil {
+		updates["comment"] = *input.Comment
+	}
+
+	tx := actx.db.Begin()
+	if len(updates) > 0 {
+		if err := tx.Model(&hostGroup).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if input.Subgroups != nil {
+		var subgroups []*dbmodels.HostGroup
+		if len(*input.Subgroups) > 0 {
+			if err := dbmodels.HostGroupsByIdentifiers(tx, *input.Subgroups).Find(&subgroups).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if err := dbmodels.CheckHostSubgroups(tx, &hostGroup, subgroups); err != nil {
+			tx.Rollback()
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+		if err := apiReplaceAssociation(tx.Model(&hostGroup).Association("Subgroups"), subgroups); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return apiGetHostGroup(actx, fmt.Sprint(hostGroup.ID))
+}
+
+// ACLs
+
+// apiACLInput uses the date-time format of the shell ("2006-01-02 15:04")
+type apiACLInput struct {
+	UserGroups        []string `json:"user_groups"`
+	HostGroups        []string `json:"host_groups"`
+	Pattern           string   `json:"pattern"`
+	Selector          string   `json:"selector"`
+	Comment           string   `json:"comment"`
+	Action            string   `json:"action"`
+	Weight            uint     `json:"weight"`
+	Inception         string   `json:"inception"`
+	Expiration        string   `json:"expiration"`
+	Schedule          string   `json:"schedule"`
+	ScheduleTerminate bool     `json:"schedule_terminate"`
+	Sources           []string `json:"sources"`
+	DeniedSources     []string `json:"denied_sources"`
+	RemoteForward     bool     `json:"remote_forward"`
+	AgentForward      bool     `json:"agent_forward"`
+}
+
+// apiACLUpdate contains the fields to update, an empty selector, inception,
+// expiration or schedule unsets it and the groups and sources replace the current ones
+type apiACLUpdate struct {
+	UserGroups        *[]string `json:"user_groups"`
+	HostGroups        *[]string `json:"host_groups"`
+	Pattern           *string   `json:"pattern"`
+	Selector          *string   `json:"selector"`
+	Comment           *string   `json:"comment"`
+	Action            *string   `json:"action"`
+	Weight            *uint     `json:"weight"`
+	Inception         *string   `json:"inception"`
+	Expiration        *string   `json:"expiration"`
+	Schedule          *string   `json:"schedule"`
+	ScheduleTerminate *bool     `json:"schedule_terminate"`
+	Sources           *[]string `json:"sources"`
+	DeniedSources     *[]string `json:"denied_sources"`
+	RemoteForward     *bool     `json:"remote_forward"`
+	AgentForward      *bool     `json:"agent_forward"`
+}
+
+// apiCIDRList validates the CIDR ranges and returns them as stored in the ACLs
+func apiCIDRList(cidrs []string) (string, error) {
+	list := strings.Join(cidrs, ",")
+	if list == "" {
+		return "", nil
+	}
+	if _, err := dbmodels.ParseCIDRList(list); err != nil {
+		return "", apiErrorf(http.StatusBadRequest, "%v", err)
+	}
+	return list, nil
+}
+
+func apiGetACL(actx *apiContext, id string) (interface{}, error) {
+	var acl dbmodels.ACL
+	return &acl, dbmodels.ACLsPreload(dbmodels.ACLsByIdentifiers(actx.db, []string{id})).First(&acl).Error
+}
+
+func apiCreateACL(actx *apiContext) (interface{}, error) {
+	input := apiACLInput{Action: string(dbmodels.ACLActionAllow)}
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+	db := actx.db
+
+	inception, err := parseOptionalTime(input.Inception)
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+	}
+	expiration, err := parseOptionalTime(input.Expiration)
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+	}
+	if input.Schedule != "" {
+		if _, err := dbmodels.ParseSchedule(input.Schedule); err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+	}
+	if input.Selector != "" {
+		if _, err := dbmodels.ParseSelector(input.Selector); err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+	}
+	sources, err := apiCIDRList(input.Sources)
+	if err != nil {
+		return nil, err
+	}
+	deniedSources, err := apiCIDRList(input.DeniedSources)
+	if err != nil {
+		return nil, err
+	}
+	acl := dbmodels.ACL{
+		Comment:            input.Comment,
+		HostPattern:        input.Pattern,
+		HostSelector:       input.Selector,
+		Weight:             input.Weight,
+		Inception:          inception,
+		Expiration:         expiration,
+		Schedule:           input.Schedule,
+		ScheduleTerminate:  input.ScheduleTerminate,
+		SourceCIDRs:        sources,
+		DeniedSourceCIDRs:  deniedSources,
+		Action:             input.Action,
+		AllowRemoteForward: input.RemoteForward,
+		AllowAgentForward:  input.AgentForward,
+	}
+	if acl.Action != string(dbmodels.ACLActionAllow) && acl.Action != string(dbmodels.ACLActionDeny) {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid action %q, allowed values: allow, deny", acl.Action)
+	}
+	if err := apiValidate(acl); err != nil {
+		return nil, err
+	}
+	if len(input.UserGroups) > 0 {
+		if err := dbmodels.UserGroupsByIdentifiers(db, input.UserGroups).Find(&acl.UserGroups).Error; err != nil {
+			return nil, err
+		}
+	}
+	if len(input.HostGroups) > 0 {
+		if err := dbmodels.HostGroupsByIdentifiers(db, input.HostGroups).Find(&acl.HostGroups).Error; err != nil {
+			return nil, err
+		}
+	}
+	if len(acl.UserGroups) == 0 {
+		return nil, apiErrorf(http.StatusBadRequest, "an ACL must have at least one user group")
+	}
+	if len(acl.HostGroups) == 0 && acl.HostPattern == "" && acl.HostSelector == "" {
+		return nil, apiErrorf(http.StatusBadRequest, "an ACL must have at least one host group, host pattern or host selector")
+	}
+
+	if err := db.Create(&acl).Error; err != nil {
+		return nil, err
+	}
+	return apiGetACL(actx, fmt.Sprint(acl.ID))
+}
+
+func apiUpdateACL(actx *apiContext, id string) (interface{}, error) {
+	var input apiACLUpdate
+	if err := apiDecode(actx, &input); err != nil {
+		return nil, err
+	}
+	db := actx.db
+
+	var acl dbmodels.ACL
+	if err := dbmodels.ACLsByIdentifiers(db, []string{id}).First(&acl).Error; err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{}
+	if input.Pattern != nil {
+		if *input.Pattern != "" {
+			if _, err := dbmodels.HostPatternMatcher(*input.Pattern); err != nil {
+				return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+			}
+		}
+		updates["host_pattern"] = *input.Pattern
+	}
+	if input.Selector != nil {
+		if *input.Selector != "" {
+			if _, err := dbmodels.ParseSelector(*input.Selector); err != nil {
+				return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+			}
+		}
+		updates["host_selector"] = *input.Selector
+	}
+	if input.Comment != nil {
+		updates["comment"] = *input.Comment
+	}
+	if input.Action != nil {
+		if *input.Action != string(dbmodels.ACLActionAllow) && *input.Action != string(dbmodels.ACLActionDeny) {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid action %q, allowed values: allow, deny", *input.Action)
+		}
+		updates["action"] = *input.Action
+	}
+	if input.Weight != nil {
+		updates["weight"] = *input.Weight
+	}
+	for column, value := range map[string]*string{"inception": input.Inception, "expiration": input.Expiration} {
+		if value == nil {
+			continue
+		}
+		parsed, err := parseOptionalTime(*value)
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+		updates[column] = parsed
+	}
+	if input.Schedule != nil {
+		if *input.Schedule != "" {
+			if _, err := dbmodels.ParseSchedule(*input.Schedule); err != nil {
+				return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+			}
+		}
+		updates["schedule"] = *input.Schedule
+	}
+	if input.ScheduleTerminate != nil {
+		updates["schedule_terminate"] = *input.ScheduleTerminate
+	}
+	for column, value := range map[string]*[]string{"source_cidrs": input.Sources, "denied_source_cidrs": input.DeniedSources} {
+		if value == nil {
+			continue
+		}
+		list, err := apiCIDRList(*value)
+		if err != nil {
+			return nil, err
+		}
+		updates[column] = list
+	}
+	if input.RemoteForward != nil {
+		updates["allow_remote_forward"] = *input.RemoteForward
+	}
+	if input.AgentForward != nil {
+		updates["allow_agent_forward"] = *input.AgentForward
+	}
+
+	tx := db.Begin()
+	if len(updates) > 0 {
+		if err := tx.Model(&acl).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if input.UserGroups != nil {
+		var userGroups []*dbmodels.UserGroup
+		if len(*input.UserGroups) > 0 {
+			if err := dbmodels.UserGroupsByIdentifiers(db, *input.UserGroups).Find(&userGroups).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if len(userGroups) == 0 {
+			tx.Rollback()
+			return nil, apiErrorf(http.StatusBadRequest, "an ACL must have at least one user group")
+		}
+		if err := apiReplaceAssociation(tx.Model(&acl).Association("UserGroups"), userGroups); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if input.HostGroups != nil {
+		var hostGroups []*dbmodels.HostGroup
+		if len(*input.HostGroups) > 0 {
+			if err := dbmodels.HostGroupsByIdentifiers(db, *input.HostGroups).Find(&hostGroups).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if err := apiReplaceAssociation(tx.Model(&acl).Association("HostGroups"), hostGroups); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return apiGetACL(actx, fmt.Sprint(acl.ID))
+}
+
+// Sessions and events
+
+func apiListSessions(actx *apiContext) (interface{}, error) {
+	limit, err := apiLimit(actx, 60000)
+	if err != nil {
+		return nil, err
+	}
+	query := dbmodels.SessionsPreload(actx.db).Order("created_at desc").Limit(limit)
+	if actx.req.URL.Query().Get("active") == "true" {
+		query = query.Where("status = ?", string(dbmodels.SessionStatusActive))
+	}
+	var sessions []*dbmodels.Session
+	if err := query.Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// apiKillSession closes an active session like `session kill`
+func apiKillSession(actx *apiContext, id string) error {
+	var session dbmodels.Session
+	if err := dbmodels.SessionsByIdentifiers(actx.db, []string{id}).First(&session).Error; err != nil {
+		return err
+	}
+	if session.Status != string(dbmodels.SessionStatusActive) {
+		return apiErrorf(http.StatusConflict, "session %d is not active", session.ID)
+	}
+	// sessions only live in the memory of the instance handling them
+	if !runningSessions.kill(session.ID, actx.user.Name) {
+		return apiErrorf(http.StatusConflict, "session %d is not running on this instance", session.ID)
+	}
+	dbmodels.NewEvent("session", "kill").SetAuthor(actx.user).SetArg("session", session.ID).Log(actx.db)
+	return nil
+}
+
+func apiListEvents(actx *apiContext) (interface{}, error) {
+	limit, err := apiLimit(actx, -1)
+	if err != nil {
+		return nil, err
+	}
+	var events []*dbmodels.Event
+	if err := dbmodels.EventsPreload(actx.db).Order("created_at desc").Limit(limit).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if len(event.Args) > 0 {
+			if err := json.Unmarshal(event.Args, &event.ArgsMap); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return events, nil
+}
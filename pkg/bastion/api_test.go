@@ -0,0 +1,284 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"moul.io/sshportal/pkg/crypto"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+func TestAPIHandler(t *testing.T) {
+	Convey("Testing APIHandler", t, func(c C) {
+		db := newTestDB(c)
+
+		// an admin, a user allowed to list the hosts, a helpdesk user and an auditor
+		var adminRole, listHostsRole dbmodels.UserRole
+		c.So(db.Where("name = ?", "admin").First(&adminRole).Error, ShouldBeNil)
+		c.So(db.Where("name = ?", "listhosts").First(&listHostsRole).Error, ShouldBeNil)
+		helpdeskRole := dbmodels.UserRole{Name: "helpdesk", Permissions: "user:*"}
+		c.So(db.Create(&helpdeskRole).Error, ShouldBeNil)
+		auditorRole := dbmodels.UserRole{Name: "auditor", Permissions: "key:read"}
+		c.So(db.Create(&auditorRole).Error, ShouldBeNil)
+		opsRole := dbmodels.UserRole{Name: "ops", Permissions: "host:*,key:*"}
+		c.So(db.Create(&opsRole).Error, ShouldBeNil)
+		tokens := map[string]string{}
+		for name, role := range map[string]*dbmodels.UserRole{"alice": &adminRole, "bob": &listHostsRole, "dave": &helpdeskRole, "frank": &auditorRole, "grace": &opsRole} {
+			user := dbmodels.User{Name: name, Email: name + "@example.com", Roles: []*dbmodels.UserRole{role}}
+			c.So(db.Create(&user).Error, ShouldBeNil)
+			token, hash, err := crypto.NewAPIToken()
+			c.So(err, ShouldBeNil)
+			c.So(db.Create(&dbmodels.APIToken{Name: name, Hash: hash, UserID: user.ID}).Error, ShouldBeNil)
+			tokens[name] = token
+		}
+
+		srv := httptest.NewServer(APIHandler(db, "0123456789abcdef"))
+		defer srv.Close()
+		do := func(token, method, path, body string) (int, string) {
+			req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+			c.So(err, ShouldBeNil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			c.So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			out, err := ioutil.ReadAll(resp.Body)
+			c.So(err, ShouldBeNil)
+			return resp.StatusCode, string(out)
+		}
+
+		// authentication and roles
+		status, _ := do("", "GET", "/api/v1/hosts", "")
+		c.So(status, ShouldEqual, http.StatusUnauthorized)
+		status, _ = do("invalid", "GET", "/api/v1/hosts", "")
+		c.So(status, ShouldEqual, http.StatusUnauthorized)
+		status, _ = do(tokens["bob"], "GET", "/api/v1/hosts", "")
+		c.So(status, ShouldEqual, http.StatusOK)
+		status, _ = do(tokens["bob"], "POST", "/api/v1/hosts", `{"url": "root@example.org"}`)
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		status, _ = do(tokens["bob"], "GET", "/api/v1/users", "")
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		status, _ = do(tokens["alice"], "GET", "/api/v1/unknown", "")
+		c.So(status, ShouldEqual, http.StatusNotFound)
+		status, _ = do(tokens["alice"], "POST", "/api/v1/events", "{}")
+		c.So(status, ShouldEqual, http.StatusMethodNotAllowed)
+
+		// hosts
+		status, body := do(tokens["alice"], "POST", "/api/v1/hosts", `{"url": "root:secret@example.org", "comment": "created by the API"}`)
+		c.So(status, ShouldEqual, http.StatusCreated)
+		var host dbmodels.Host
+		c.So(json.Unmarshal([]byte(body), &host), ShouldBeNil)
+		c.So(host.Name, ShouldEqual, "example")
+		c.So(host.URL, ShouldEqual, "ssh://root@example.org")
+		c.So(host.Password, ShouldBeEmpty)
+		var stored dbmodels.Host
+		c.So(db.First(&stored, host.ID).Error, ShouldBeNil)
+		c.So(crypto.IsEncrypted(stored.Password), ShouldBeTrue)
+		status, body = do(tokens["bob"], "GET", "/api/v1/hosts/example?decrypt=true", "")
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		status, body = do(tokens["alice"], "GET", "/api/v1/hosts/example?decrypt=true", "")
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(body, ShouldContainSubstring, `"Password": "secret"`)
+		c.So(len(host.Groups), ShouldEqual, 1)
+		status, _ = do(tokens["alice"], "POST", "/api/v1/hosts", `{"url": "root@example.org", "unknown": true}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+		status, _ = do(tokens["alice"], "POST", "/api/v1/hosts", `{"url": "root@example2.org", "key": "unknown"}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+
+		status, body = do(tokens["alice"], "PATCH", "/api/v1/hosts/example", `{"name": "renamed", "agent_forward": true, "groups": []}`)
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(json.Unmarshal([]byte(body), &host), ShouldBeNil)
+		c.So(host.Name, ShouldEqual, "renamed")
+		c.So(host.AllowAgentForward, ShouldBeTrue)
+		c.So(host.Comment, ShouldEqual, "created by the API")
+		c.So(len(host.Groups), ShouldEqual, 0)
+		status, _ = do(tokens["alice"], "PATCH", "/api/v1/hosts/renamed", `{"logging": "invalid"}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+		status, body = do(tokens["alice"], "PATCH", "/api/v1/hosts/renamed", `{"labels": {"team": "data", "env": "prod"}}`)
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(json.Unmarshal([]byte(body), &host), ShouldBeNil)
+		c.So(host.Labels, ShouldEqual, "env=prod,team=data")
+		status, _ = do(tokens["alice"], "PATCH", "/api/v1/hosts/renamed", `{"labels": {"env": "prod,staging"}}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+		status, body = do(tokens["alice"], "GET", "/api/v1/hosts?selector=env=prod,team!=web", "")
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(body, ShouldContainSubstring, `"Name": "renamed"`)
+		status, body = do(tokens["alice"], "GET", "/api/v1/hosts?selector=!env", "")
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(body, ShouldNotContainSubstring, `"Name": "renamed"`)
+
+		status, body = do(tokens["bob"], "GET", "/api/v1/hosts/renamed", "")
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(body, ShouldNotContainSubstring, "PrivKey")
+
+		status, _ = do(tokens["alice"], "DELETE", "/api/v1/hosts/renamed", "")
+		c.So(status, ShouldEqual, http.StatusNoContent)
+		status, _ = do(tokens["alice"], "GET", "/api/v1/hosts/renamed", "")
+		c.So(status, ShouldEqual, http.StatusNotFound)
+		status, _ = do(tokens["alice"], "DELETE", "/api/v1/hosts/renamed", "")
+		c.So(status, ShouldEqual, http.StatusNotFound)
+
+		// keys
+		status, body = do(tokens["alice"], "POST", "/api/v1/keys", `{"name": "deploy"}`)
+		c.So(status, ShouldEqual, http.StatusCreated)
+		c.So(body, ShouldContainSubstring, `"PrivKey": ""`)
+		status, body = do(tokens["frank"], "GET", "/api/v1/keys", "")
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(body, ShouldContainSubstring, `"PrivKey": ""`)
+		status, _ = do(tokens["frank"], "GET", "/api/v1/keys/deploy?decrypt=true", "")
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		status, body = do(tokens["alice"], "GET", "/api/v1/keys/deploy?decrypt=true", "")
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(body, ShouldContainSubstring, "BEGIN PRIVATE KEY")
+
+		// acls
+		status, body = do(tokens["alice"], "POST", "/api/v1/acls", `{"user_groups": ["default"], "pattern": "glob:*", "weight": 10}`)
+		c.So(status, ShouldEqual, http.StatusCreated)
+		var acl dbmodels.ACL
+		c.So(json.Unmarshal([]byte(body), &acl), ShouldBeNil)
+		c.So(acl.Action, ShouldEqual, "allow")
+		c.So(acl.Weight, ShouldEqual, 10)
+		status, _ = do(tokens["alice"], "POST", "/api/v1/acls", `{"pattern": "glob:*"}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+		status, body = do(tokens["alice"], "PATCH", fmt.Sprintf("/api/v1/acls/%d", acl.ID), `{"action": "deny", "expiration": "2030-01-02 15:04"}`)
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(json.Unmarshal([]byte(body), &acl), ShouldBeNil)
+		c.So(acl.Action, ShouldEqual, "deny")
+		c.So(acl.Expiration, ShouldNotBeNil)
+		status, _ = do(tokens["alice"], "PATCH", fmt.Sprintf("/api/v1/acls/%d", acl.ID), `{"schedule": "Mon-Fri 8h-19h"}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+		status, body = do(tokens["alice"], "PATCH", fmt.Sprintf("/api/v1/acls/%d", acl.ID), `{"schedule": "Mon-Fri 08:00-19:00 UTC", "schedule_terminate": true}`)
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(json.Unmarshal([]byte(body), &acl), ShouldBeNil)
+		c.So(acl.Schedule, ShouldEqual, "Mon-Fri 08:00-19:00 UTC")
+		c.So(acl.ScheduleTerminate, ShouldBeTrue)
+		status, _ = do(tokens["alice"], "PATCH", fmt.Sprintf("/api/v1/acls/%d", acl.ID), `{"sources": ["vpn"]}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+		status, body = do(tokens["alice"], "PATCH", fmt.Sprintf("/api/v1/acls/%d", acl.ID), `{"sources": ["10.8.0.0/16"], "denied_sources": ["10.8.99.0/24"]}`)
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(json.Unmarshal([]byte(body), &acl), ShouldBeNil)
+		c.So(acl.SourceCIDRs, ShouldEqual, "10.8.0.0/16")
+		c.So(acl.DeniedSourceCIDRs, ShouldEqual, "10.8.99.0/24")
+		status, body = do(tokens["alice"], "PATCH", fmt.Sprintf("/api/v1/acls/%d", acl.ID), `{"selector": "env=prod,team!=data"}`)
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(json.Unmarshal([]byte(body), &acl), ShouldBeNil)
+		c.So(acl.HostSelector, ShouldEqual, "env=prod,team!=data")
+
+		// groups
+		status, _ = do(tokens["alice"], "POST", "/api/v1/usergroups", `{"name": "sre-eu"}`)
+		c.So(status, ShouldEqual, http.StatusCreated)
+		status, body = do(tokens["alice"], "POST", "/api/v1/usergroups", `{"name": "sre", "subgroups": ["sre-eu"]}`)
+		c.So(status, ShouldEqual, http.StatusCreated)
+		var userGroup dbmodels.UserGroup
+		c.So(json.Unmarshal([]byte(body), &userGroup), ShouldBeNil)
+		c.So(len(userGroup.Subgroups), ShouldEqual, 1)
+		status, _ = do(tokens["alice"], "PATCH", "/api/v1/usergroups/sre-eu", `{"subgroups": ["sre"]}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+		status, _ = do(tokens["alice"], "DELETE", "/api/v1/usergroups/sre-eu", "")
+		c.So(status, ShouldEqual, http.StatusNoContent)
+		status, body = do(tokens["alice"], "GET", "/api/v1/usergroups/sre", "")
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(json.Unmarshal([]byte(body), &userGroup), ShouldBeNil)
+		c.So(len(userGroup.Subgroups), ShouldEqual, 0)
+
+		// users
+		status, body = do(tokens["alice"], "POST", "/api/v1/users", `{"email": "carol@example.com"}`)
+		c.So(status, ShouldEqual, http.StatusCreated)
+		var user dbmodels.User
+		c.So(json.Unmarshal([]byte(body), &user), ShouldBeNil)
+		c.So(user.Name, ShouldEqual, "carol")
+		c.So(user.InviteToken, ShouldNotBeEmpty)
+		status, body = do(tokens["alice"], "GET", "/api/v1/users/carol", "")
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(json.Unmarshal([]byte(body), &user), ShouldBeNil)
+		c.So(user.InviteToken, ShouldBeEmpty)
+		status, body = do(tokens["alice"], "PATCH", "/api/v1/users/carol", `{"roles": ["listhosts"], "remove_invite": true}`)
+		c.So(status, ShouldEqual, http.StatusOK)
+		c.So(json.Unmarshal([]byte(body), &user), ShouldBeNil)
+		c.So(user.InviteToken, ShouldBeEmpty)
+		c.So(user.HasRole("listhosts"), ShouldBeTrue)
+		status, _ = do(tokens["alice"], "PATCH", "/api/v1/users/carol", `{"name": ""}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+		status, _ = do(tokens["alice"], "PATCH", "/api/v1/users/carol", `{"name": "carol"}`)
+		c.So(status, ShouldEqual, http.StatusOK)
+		status, _ = do(tokens["alice"], "PATCH", "/api/v1/usergroups/sre", `{"name": ""}`)
+		c.So(status, ShouldEqual, http.StatusBadRequest)
+
+		// permissions
+		status, body = do(tokens["dave"], "POST", "/api/v1/users", `{"email": "erin@example.com"}`)
+		c.So(status, ShouldEqual, http.StatusCreated)
+		status, body = do(tokens["dave"], "POST", "/api/v1/users", `{"email": "mallory@example.com", "groups": ["sre"]}`)
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		c.So(body, ShouldContainSubstring, "usergroup:write")
+		status, body = do(tokens["dave"], "PATCH", "/api/v1/users/dave", `{"groups": ["sre"]}`)
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		c.So(body, ShouldContainSubstring, "usergroup:write")
+		status, _ = do(tokens["dave"], "GET", "/api/v1/hosts", "")
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		status, body = do(tokens["dave"], "PATCH", "/api/v1/users/erin", `{"roles": ["admin"]}`)
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		c.So(body, ShouldContainSubstring, "you cannot grant")
+		status, _ = do(tokens["dave"], "PATCH", "/api/v1/users/erin", `{"roles": ["helpdesk"]}`)
+		c.So(status, ShouldEqual, http.StatusOK)
+		status, body = do(tokens["dave"], "PATCH", "/api/v1/users/alice", `{"email": "dave@example.com"}`)
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		c.So(body, ShouldContainSubstring, "you cannot manage the user")
+		status, _ = do(tokens["dave"], "DELETE", "/api/v1/users/alice", "")
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		status, _ = do(tokens["dave"], "DELETE", "/api/v1/users/erin", "")
+		c.So(status, ShouldEqual, http.StatusNoContent)
+		status, body = do(tokens["grace"], "POST", "/api/v1/hosts", `{"url": "root@attacker.example.org", "password": "secret://vault/db"}`)
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		c.So(body, ShouldContainSubstring, "secret:use")
+		status, _ = do(tokens["grace"], "POST", "/api/v1/keys", `{"priv_key": "secret://vault/db.pem"}`)
+		c.So(status, ShouldEqual, http.StatusForbidden)
+		status, _ = do(tokens["bob"], "DELETE", "/api/v1/sessions/1", "")
+		c.So(status, ShouldEqual, http.StatusForbidden)
+
+		// every request is logged
+		var events []dbmodels.Event
+		c.So(db.Where("domain = ?", "api").Find(&events).Error, ShouldBeNil)
+		c.So(len(events), ShouldBeGreaterThan, 10)
+		c.So(string(events[0].Args), ShouldContainSubstring, `"method":"GET"`)
+	})
+}
+
+func TestRolePermissions(t *testing.T) {
+	Convey("Testing role permissions", t, func(c C) {
+		_, err := dbmodels.ParsePermissions("host:read,host:delete")
+		c.So(err, ShouldNotBeNil)
+		_, err = dbmodels.ParsePermissions("unknown:*")
+		c.So(err, ShouldNotBeNil)
+		permissions, err := dbmodels.ParsePermissions("host:read, session:*,host:read")
+		c.So(err, ShouldBeNil)
+		c.So(permissions, ShouldResemble, []string{"host:read", "session:*"})
+
+		helpdesk := dbmodels.User{Roles: []*dbmodels.UserRole{{Name: "helpdesk", Permissions: "user:read,user:invite,session:*"}}}
+		c.So(helpdesk.HasPermission("user:invite"), ShouldBeTrue)
+		c.So(helpdesk.HasPermission("session:kill"), ShouldBeTrue)
+		c.So(helpdesk.CheckPermission("user:write"), ShouldNotBeNil)
+		c.So(helpdesk.CheckGrant("user:invite,session:read"), ShouldBeNil)
+		c.So(helpdesk.CheckGrant("user:*"), ShouldNotBeNil)
+		c.So(helpdesk.CheckGrant("*"), ShouldNotBeNil)
+
+		admin := dbmodels.User{Roles: []*dbmodels.UserRole{{Name: "admin", Permissions: "*"}}}
+		c.So(admin.CheckGrant("*"), ShouldBeNil)
+		c.So(admin.HasPermission("config:restore"), ShouldBeTrue)
+
+		// one can only manage the users having no more permissions
+		c.So(helpdesk.CheckManage(&admin), ShouldNotBeNil)
+		c.So(helpdesk.CheckManage(&dbmodels.User{Roles: []*dbmodels.UserRole{{Permissions: "user:read"}}}), ShouldBeNil)
+		c.So(helpdesk.CheckManage(&dbmodels.User{}), ShouldBeNil)
+		c.So(admin.CheckManage(&helpdesk), ShouldBeNil)
+
+		c.So(dbmodels.RevokePermissions([]string{"host:*", "user:invite"}, []string{"host:write"}), ShouldResemble, []string{"host:read", "user:invite"})
+		c.So(dbmodels.RevokePermissions([]string{"session:*"}, []string{"session:*"}), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,215 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const asciicastExtension = ".cast"
+
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// asciicastRecorder writes an interactive session in the asciicast v2 format.
+//
+// The header needs the terminal size, so it is written on the pty-req or
+// before the first event if the session has no pty.
+type asciicastRecorder struct {
+	mu            sync.Mutex
+	w             io.Writer
+	start         time.Time
+	header        asciicastHeader
+	headerWritten bool
+	recordInput   bool
+	recordOutput  bool
+	pending       map[string][]byte // incomplete UTF-8 sequences by event type
+}
+
+func newAsciicastRecorder(w io.Writer, loggingMode string) *asciicastRecorder {
+	now := time.Now()
+	return &asciicastRecorder{
+		w:            w,
+		start:        now,
+		header:       asciicastHeader{Version: 2, Width: 80, Height: 24, Timestamp: now.Unix()},
+		recordInput:  loggingMode == "everything" || loggingMode == "input",
+		recordOutput: loggingMode != "input",
+		pending:      map[string][]byte{},
+	}
+}
+
+// request records the terminal information of pty-req and window-change requests
+func (r *asciicastRecorder) request(req *gossh.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch req.Type {
+	case "pty-req":
+		var pty struct {
+			Term                         string
+			Columns, Rows, Width, Height uint32
+			Modes                        string
+		}
+		if err := gossh.Unmarshal(req.Payload, &pty); err != nil {
+			return
+		}
+		if r.headerWritten {
+			r.writeEvent("r", []byte(fmt.Sprintf("%dx%d", pty.Columns, pty.Rows)))
+			return
+		}
+		r.header.Width, r.header.Height = pty.Columns, pty.Rows
+		if pty.Term != "" {
+			r.header.Env = map[string]string{"TERM": pty.Term}
+		}
+		r.writeHeader()
+	case "window-change":
+		var size struct {
+			Columns, Rows, Width, Height uint32
+		}
+		if err := gossh.Unmarshal(req.Payload, &size); err != nil {
+			return
+		}
+		r.writeEvent("r", []byte(fmt.Sprintf("%dx%d", size.Columns, size.Rows)))
+	}
+}
+
+// output wraps the writer receiving the data sent to the client
+func (r *asciicastRecorder) output(w io.Writer) io.Writer {
+	return asciicastWriter{r: r, w: w, kind: "o", enabled: r.recordOutput}
+}
+
+// input wraps the writer receiving the data sent by the client
+func (r *asciicastRecorder) input(w io.Writer) io.Writer {
+	return asciicastWriter{r: r, w: w, kind: "i", enabled: r.recordInput}
+}
+
+// exec records an exec request as if it was typed
+func (r *asciicastRecorder) exec(command []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeEvent("o", append(append([]byte{}, command...), '\r', '\n'))
+}
+
+func (r *asciicastRecorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.headerWritten {
+		r.writeHeader()
+	}
+}
+
+func (r *asciicastRecorder) writeHeader() {
+	r.headerWritten = true
+	if err := json.NewEncoder(r.w).Encode(r.header); err != nil {
+		log.Printf("failed to write asciicast header: %v", err)
+	}
+}
+
+func (r *asciicastRecorder) writeEvent(kind string, data []byte) {
+	if !r.headerWritten {
+		r.writeHeader()
+	}
+	data, r.pending[kind] = splitIncompleteRune(append(r.pending[kind], data...))
+	if len(data) == 0 {
+		return
+	}
+	encoded, err := json.Marshal(string(data))
+	if err != nil {
+		log.Printf("failed to encode asciicast event: %v", err)
+		return
+	}
+	if _, err := fmt.Fprintf(r.w, "[%.6f, %q, %s]\n", time.Since(r.start).Seconds(), kind, encoded); err != nil {
+		log.Printf("failed to write asciicast event: %v", err)
+	}
+}
+
+type asciicastWriter struct {
+	r       *asciicastRecorder
+	w       io.Writer
+	kind    string
+	enabled bool
+}
+
+func (w asciicastWriter) Write(data []byte) (int, error) {
+	if w.enabled {
+		w.r.mu.Lock()
+		w.r.writeEvent(w.kind, data)
+		w.r.mu.Unlock()
+	}
+	return w.w.Write(data)
+}
+
+// splitIncompleteRune returns data without its trailing incomplete UTF-8 sequence, and that sequence
+func splitIncompleteRune(data []byte) ([]byte, []byte) {
+	for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if utf8.FullRune(data[len(data)-i:]) {
+				return data, nil
+			}
+			return data[:len(data)-i], data[len(data)-i:]
+		}
+	}
+	return data, nil
+}
+
+// readAsciicastFrames reads the output events of an asciicast v2 recording
+func readAsciicastFrames(r io.Reader) func() (*ttyrecFrame, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), ttyrecMaxFrameSize)
+	var start time.Time
+	return func() (*ttyrecFrame, error) {
+		if start.IsZero() {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			}
+			var header asciicastHeader
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				return nil, fmt.Errorf("invalid asciicast header: %v", err)
+			}
+			if header.Version != 2 {
+				return nil, fmt.Errorf("unsupported asciicast version: %d", header.Version)
+			}
+			start = time.Unix(header.Timestamp, 0)
+		}
+		for scanner.Scan() {
+			var event []interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				return nil, fmt.Errorf("invalid asciicast event: %v", err)
+			}
+			if len(event) != 3 {
+				return nil, fmt.Errorf("invalid asciicast event: %s", scanner.Text())
+			}
+			offset, ok1 := event[0].(float64)
+			kind, ok2 := event[1].(string)
+			data, ok3 := event[2].(string)
+			if !ok1 || !ok2 || !ok3 {
+				return nil, fmt.Errorf("invalid asciicast event: %s", scanner.Text())
+			}
+			if kind != "o" {
+				continue
+			}
+			return &ttyrecFrame{
+				Time: start.Add(time.Duration(offset * float64(time.Second))),
+				Data: []byte(data),
+			}, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
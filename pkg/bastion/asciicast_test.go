@@ -0,0 +1,83 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestAsciicastRecorder(t *testing.T) {
+	Convey("Testing asciicastRecorder", t, func(c C) {
+		recording := bytes.Buffer{}
+		cast := newAsciicastRecorder(&recording, "everything")
+
+		cast.request(&gossh.Request{Type: "pty-req", Payload: gossh.Marshal(struct {
+			Term                         string
+			Columns, Rows, Width, Height uint32
+			Modes                        string
+		}{"xterm-256color", 120, 40, 0, 0, ""})})
+		client, target := bytes.Buffer{}, bytes.Buffer{}
+		_, err := cast.input(&target).Write([]byte("ls\r"))
+		c.So(err, ShouldBeNil)
+		// "é" split across two writes
+		_, err = cast.output(&client).Write([]byte("caf\xc3"))
+		c.So(err, ShouldBeNil)
+		_, err = cast.output(&client).Write([]byte("\xa9\r\n"))
+		c.So(err, ShouldBeNil)
+		cast.request(&gossh.Request{Type: "window-change", Payload: gossh.Marshal(struct {
+			Columns, Rows, Width, Height uint32
+		}{100, 30, 0, 0})})
+		cast.close()
+		c.So(target.String(), ShouldEqual, "ls\r")
+		c.So(client.String(), ShouldEqual, "café\r\n")
+
+		lines := strings.Split(strings.TrimSpace(recording.String()), "\n")
+		c.So(len(lines), ShouldEqual, 5)
+		var header asciicastHeader
+		c.So(json.Unmarshal([]byte(lines[0]), &header), ShouldBeNil)
+		c.So(header.Version, ShouldEqual, 2)
+		c.So(header.Width, ShouldEqual, 120)
+		c.So(header.Height, ShouldEqual, 40)
+		c.So(header.Env["TERM"], ShouldEqual, "xterm-256color")
+		events := make([][]interface{}, 0, 4)
+		for _, line := range lines[1:] {
+			var event []interface{}
+			c.So(json.Unmarshal([]byte(line), &event), ShouldBeNil)
+			events = append(events, event[1:])
+		}
+		c.So(events, ShouldResemble, [][]interface{}{{"i", "ls\r"}, {"o", "caf"}, {"o", "é\r\n"}, {"r", "100x30"}})
+
+		Convey("replay", func() {
+			tempDir, err := ioutil.TempDir("", "sshportal")
+			c.So(err, ShouldBeNil)
+			defer func() {
+				c.So(os.RemoveAll(tempDir), ShouldBeNil)
+			}()
+			c.So(ioutil.WriteFile(filepath.Join(tempDir, "web-alice-session-42-2021-01-01T00:00:00Z.cast"), recording.Bytes(), 0600), ShouldBeNil)
+
+			out := bytes.Buffer{}
+			c.So(replaySessionLogs(&out, tempDir, 42, replayOptions{Raw: true}), ShouldBeNil)
+			c.So(out.String(), ShouldEqual, "café\r\n")
+		})
+	})
+
+	Convey("Testing asciicastRecorder without pty in input mode", t, func() {
+		recording := bytes.Buffer{}
+		cast := newAsciicastRecorder(&recording, "input")
+		_, err := cast.output(&bytes.Buffer{}).Write([]byte("hidden"))
+		So(err, ShouldBeNil)
+		cast.exec([]byte("uptime"))
+		cast.close()
+		lines := strings.Split(strings.TrimSpace(recording.String()), "\n")
+		So(len(lines), ShouldEqual, 2)
+		So(lines[0], ShouldContainSubstring, `"width":80`)
+		So(lines[1], ShouldContainSubstring, `"uptime\r\n"`)
+	})
+}
@@ -18,7 +18,9 @@ import (
 	"moul.io/sshportal/pkg/dbmodels"
 )
 
-func DBInit(db *gorm.DB) error {
+// DBInit migrates the database and creates the default objects, aesKey is used
+// to encrypt the migrated sensitive data
+func DBInit(db *gorm.DB, aesKey string) error {
 	log.SetOutput(ioutil.Discard)
 	log.SetOutput(os.Stderr)
 
@@ -536,6 +538,334 @@ func DBInit(db *gorm.DB) error {
 				return tx.AutoMigrate(&ACL{})
 			},
 			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "33",
+			Migrate: func(tx *gorm.DB) error {
+				type Host struct {
+					gorm.Model
+					Name           string
+					Addr           string
+					User           string
+					Password       string
+					URL            string
+					SSHKey         *dbmodels.SSHKey      `gorm:"ForeignKey:SSHKeyID"`
+					SSHKeyID       uint                  `gorm:"index"`
+					HostKey        []byte                `sql:"size:10000"`
+					Groups         []*dbmodels.HostGroup `gorm:"many2many:host_host_groups;"`
+					Comment        string
+					Hop            *dbmodels.Host
+					Logging        string
+					HopID          uint
+					TransferPolicy string
+				}
+				return tx.AutoMigrate(&Host{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "34",
+			Migrate: func(tx *gorm.DB) error {
+				type UserCA struct {
+					gorm.Model
+					Name          string `gorm:"index:uix_usercas_name,unique"`
+					Key           []byte `sql:"size:1000"`
+					AuthorizedKey string `sql:"size:1000"`
+					Comment       string
+				}
+				type UserCertRevocation struct {
+					gorm.Model
+					UserCAID uint `gorm:"index"`
+					Serial   uint64
+					Comment  string
+				}
+				return tx.AutoMigrate(&UserCA{}, &UserCertRevocation{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable("user_cert_revocations", "user_cas")
+			},
+		}, {
+			ID: "35",
+			Migrate: func(tx *gorm.DB) error {
+				type Host struct {
+					gorm.Model
+					Name           string
+					Addr           string
+					User           string
+					Password       string
+					URL            string
+					SSHKey         *dbmodels.SSHKey      `gorm:"ForeignKey:SSHKeyID"`
+					SSHKeyID       uint                  `gorm:"index"`
+					CAKey          *dbmodels.SSHKey      `gorm:"ForeignKey:CAKeyID"`
+					CAKeyID        uint                  `gorm:"index"`
+					HostKey        []byte                `sql:"size:10000"`
+					Groups         []*dbmodels.HostGroup `gorm:"many2many:host_host_groups;"`
+					Comment        string
+					Hop            *dbmodels.Host
+					Logging        string
+					HopID          uint
+					TransferPolicy string
+				}
+				return tx.AutoMigrate(&Host{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "36",
+			Migrate: func(tx *gorm.DB) error {
+				type User struct {
+					gorm.Model
+					Email         string
+					Name          string
+					Comment       string
+					InviteToken   string
+					TOTPSecret    string
+					RecoveryCodes string
+				}
+				type UserGroup struct {
+					gorm.Model
+					Name       string
+					Comment    string
+					Require2FA bool `gorm:"column:require_2fa"`
+				}
+				return tx.AutoMigrate(&User{}, &UserGroup{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "37",
+			Migrate: func(tx *gorm.DB) error {
+				type Host struct {
+					gorm.Model
+					Name            string
+					Addr            string
+					User            string
+					Password        string
+					URL             string
+					SSHKey          *dbmodels.SSHKey      `gorm:"ForeignKey:SSHKeyID"`
+					SSHKeyID        uint                  `gorm:"index"`
+					CAKey           *dbmodels.SSHKey      `gorm:"ForeignKey:CAKeyID"`
+					CAKeyID         uint                  `gorm:"index"`
+					HostKey         []byte                `sql:"size:10000"`
+					Groups          []*dbmodels.HostGroup `gorm:"many2many:host_host_groups;"`
+					Comment         string
+					Hop             *dbmodels.Host
+					Logging         string
+					HopID           uint
+					TransferPolicy  string
+					RecordingFormat string
+				}
+				return tx.AutoMigrate(&Host{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "38",
+			Migrate: func(tx *gorm.DB) error {
+				type ACL struct {
+					gorm.Model
+					HostGroups         []*dbmodels.HostGroup `gorm:"many2many:host_group_acls;"`
+					UserGroups         []*dbmodels.UserGroup `gorm:"many2many:user_group_acls;"`
+					HostPattern        string                `valid:"optional"`
+					Action             string                `valid:"required"`
+					Weight             uint                  ``
+					Comment            string                `valid:"optional"`
+					Inception          *time.Time
+					Expiration         *time.Time
+					AllowRemoteForward bool
+				}
+				return tx.AutoMigrate(&ACL{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "39",
+			Migrate: func(tx *gorm.DB) error {
+				type Host struct {
+					gorm.Model
+					Name              string
+					Addr              string
+					User              string
+					Password          string
+					URL               string
+					SSHKey            *dbmodels.SSHKey      `gorm:"ForeignKey:SSHKeyID"`
+					SSHKeyID          uint                  `gorm:"index"`
+					CAKey             *dbmodels.SSHKey      `gorm:"ForeignKey:CAKeyID"`
+					CAKeyID           uint                  `gorm:"index"`
+					HostKey           []byte                `sql:"size:10000"`
+					Groups            []*dbmodels.HostGroup `gorm:"many2many:host_host_groups;"`
+					Comment           string
+					Hop               *dbmodels.Host
+					Logging           string
+					HopID             uint
+					TransferPolicy    string
+					RecordingFormat   string
+					AllowAgentForward bool
+				}
+				type ACL struct {
+					gorm.Model
+					HostGroups         []*dbmodels.HostGroup `gorm:"many2many:host_group_acls;"`
+					UserGroups         []*dbmodels.UserGroup `gorm:"many2many:user_group_acls;"`
+					HostPattern        string                `valid:"optional"`
+					Action             string                `valid:"required"`
+					Weight             uint                  ``
+					Comment            string                `valid:"optional"`
+					Inception          *time.Time
+					Expiration         *time.Time
+					AllowRemoteForward bool
+					AllowAgentForward  bool
+				}
+				return tx.AutoMigrate(&Host{}, &ACL{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "40",
+			Migrate: func(tx *gorm.DB) error {
+				// move the passwords embedded in the URLs to the encrypted password field
+				type Host struct {
+					gorm.Model
+					URL      string
+					Password string
+				}
+				var hosts []Host
+				if err := tx.Unscoped().Where("url LIKE ?", "%@%").Find(&hosts).Error; err != nil {
+					return err
+				}
+				for _, h := range hosts {
+					host := dbmodels.Host{URL: h.URL}
+					if !host.ExtractURLPassword() {
+						continue
+					}
+					if err := crypto.HostEncrypt(aesKey, &host); err != nil {
+						return err
+					}
+					if err := tx.Unscoped().Model(&Host{}).Where("id = ?", h.ID).Updates(map[string]interface{}{"url": host.URL, "password": host.Password}).Error; err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "41",
+			Migrate: func(tx *gorm.DB) error {
+				type APIToken struct {
+					gorm.Model
+					Name    string `gorm:"index:uix_apitokens_name,unique"`
+					Hash    string `gorm:"index:uix_apitokens_hash,unique"`
+					UserID  uint   `gorm:"index"`
+					Comment string
+				}
+				return tx.AutoMigrate(&APIToken{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable("api_tokens")
+			},
+		}, {
+			ID: "42",
+			Migrate: func(tx *gorm.DB) error {
+				type ACL struct {
+					gorm.Model
+					Schedule          string
+					ScheduleTerminate bool
+				}
+				return tx.AutoMigrate(&ACL{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "43",
+			Migrate: func(tx *gorm.DB) error {
+				type ACL struct {
+					gorm.Model
+					SourceCIDRs       string `gorm:"column:source_cidrs"`
+					DeniedSourceCIDRs string `gorm:"column:denied_source_cidrs"`
+				}
+				type Session struct {
+					gorm.Model
+					ClientAddr string
+					SourceCIDR string `gorm:"column:source_cidr"`
+				}
+				return tx.AutoMigrate(&ACL{}, &Session{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "44",
+			Migrate: func(tx *gorm.DB) error {
+				type Host struct {
+					gorm.Model
+					Labels string
+				}
+				type ACL struct {
+					gorm.Model
+					HostSelector string
+				}
+				return tx.AutoMigrate(&Host{}, &ACL{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "45",
+			Migrate: func(tx *gorm.DB) error {
+				type UserGroup struct {
+					gorm.Model
+					Subgroups []*UserGroup `gorm:"many2many:user_group_subgroups;"`
+				}
+				type HostGroup struct {
+					gorm.Model
+					Subgroups []*HostGroup `gorm:"many2many:host_group_subgroups;"`
+				}
+				return tx.AutoMigrate(&UserGroup{}, &HostGroup{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable("user_group_subgroups", "host_group_subgroups")
+			},
+		}, {
+			ID: "46",
+			Migrate: func(tx *gorm.DB) error {
+				type UserRole struct {
+					gorm.Model
+					Permissions string
+					Comment     string
+				}
+				if err := tx.AutoMigrate(&UserRole{}); err != nil {
+					return err
+				}
+				// the built-in roles keep their former meaning
+				if err := tx.Model(&UserRole{}).Where("name = ?", "admin").Update("permissions", "*").Error; err != nil {
+					return err
+				}
+				return tx.Model(&UserRole{}).Where("name = ?", "listhosts").Update("permissions", "host:read").Error
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "47",
+			Migrate: func(tx *gorm.DB) error {
+				type ACL struct {
+					gorm.Model
+					HostPattern string
+				}
+				var acls []*ACL
+				if err := tx.Unscoped().Where("host_pattern <> ?", "").Find(&acls).Error; err != nil {
+					return err
+				}
+				// the patterns stored before the pattern types were never
+				// matched, they stay inert until an administrator chooses
+				// their type instead of granting access on upgrade
+				for _, acl := range acls {
+					if strings.HasPrefix(acl.HostPattern, "glob:") || strings.HasPrefix(acl.HostPattern, "regex:") || strings.HasPrefix(acl.HostPattern, "legacy:") {
+						continue
+					}
+					log.Printf("warning: the host pattern %q of acl %d is kept inert as 'legacy:%s', set its type with 'acl update --pattern=glob:<value>|regex:<value> %d'", acl.HostPattern, acl.ID, acl.HostPattern, acl.ID)
+					if err := tx.Unscoped().Model(acl).Update("host_pattern", "legacy:"+acl.HostPattern).Error; err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
+		}, {
+			ID: "48",
+			Migrate: func(tx *gorm.DB) error {
+				type User struct {
+					gorm.Model
+					TOTPLastStep int64
+				}
+				return tx.AutoMigrate(&User{})
+			},
+			Rollback: func(tx *gorm.DB) error { return fmt.Errorf("not implemented") },
 		},
 	})
 	if err := m.Migrate(); err != nil {
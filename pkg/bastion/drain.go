@@ -0,0 +1,50 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DrainReason is the error message of the sessions still running at the end of the drain timeout
+const DrainReason = "closed by the sshportal shutdown"
+
+// sessionCloseTimeout bounds the time given to the killed sessions to record their closure
+const sessionCloseTimeout = 5 * time.Second
+
+var drainRequest = struct {
+	once sync.Once
+	ch   chan struct{}
+}{ch: make(chan struct{})}
+
+// Drain asks the server to stop accepting connections and to shut down once
+// the running sessions are finished
+func Drain() {
+	drainRequest.once.Do(func() { close(drainRequest.ch) })
+}
+
+// DrainRequested returns a channel closed when Drain is called
+func DrainRequested() <-chan struct{} {
+	return drainRequest.ch
+}
+
+func draining() bool {
+	select {
+	case <-drainRequest.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseSessions waits for the sessions running on this instance to finish,
+// when ctx is done the remaining sessions are killed with reason
+func CloseSessions(ctx context.Context, reason string) {
+	if runningSessions.wait(ctx) == nil {
+		return
+	}
+	runningSessions.killAll(reason)
+	ctx, cancel := context.WithTimeout(context.Background(), sessionCloseTimeout)
+	defer cancel()
+	_ = runningSessions.wait(ctx)
+}
@@ -0,0 +1,35 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCloseSessions(t *testing.T) {
+	Convey("Testing CloseSessions", t, func() {
+		// the finished sessions are not killed
+		CloseSessions(context.Background(), DrainReason)
+
+		kill := runningSessions.register(42)
+		reasons := make(chan string, 1)
+		go func() {
+			reason := <-kill
+			runningSessions.unregister(42)
+			reasons <- reason
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		CloseSessions(ctx, DrainReason)
+		So(runningSessions.count(), ShouldEqual, 0)
+		So(<-reasons, ShouldEqual, DrainReason)
+
+		So(draining(), ShouldBeFalse)
+		Drain()
+		Drain()
+		So(draining(), ShouldBeTrue)
+		<-DrainRequested()
+	})
+}
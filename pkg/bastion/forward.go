@@ -0,0 +1,290 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+type remoteForwardChannelData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// remoteForwards holds the listeners opened on the target hosts by the
+// tcpip-forward requests of a connection, keyed by bind address
+type remoteForwards struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+func newRemoteForwards() *remoteForwards {
+	return &remoteForwards{listeners: map[string]net.Listener{}}
+}
+
+func (f *remoteForwards) add(addr string, ln net.Listener) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, found := f.listeners[addr]; found {
+		return false
+	}
+	f.listeners[addr] = ln
+	return true
+}
+
+func (f *remoteForwards) remove(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.listeners, addr)
+}
+
+// cancel closes the listener bound on addr, it returns false if there is none
+func (f *remoteForwards) cancel(addr string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ln, found := f.listeners[addr]
+	if !found {
+		return false
+	}
+	delete(f.listeners, addr)
+	_ = ln.Close()
+	return true
+}
+
+// RemoteForwardHandler handles the tcpip-forward and cancel-tcpip-forward
+// requests (ssh -R) of the bastion users, the port is opened on the target
+// host and the connections are forwarded back to the client
+func RemoteForwardHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	actx, ok := ctx.Value(authContextKey).(*authContext)
+	if !ok || actx.user.ID == 0 || actx.userType() != userTypeBastion {
+		return false, nil
+	}
+	var payload remoteForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+		return false, nil
+	}
+
+	switch req.Type {
+	case "tcpip-forward":
+		port, err := startRemoteForward(ctx, actx, payload)
+		if err != nil {
+			log.Printf("Remote forward failed: sshUser=%q bind=%q dbUser=id:%d,email:%s: %v", ctx.User(), net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(payload.BindPort))), actx.user.ID, actx.user.Email, err)
+			return false, nil
+		}
+		if payload.BindPort == 0 {
+			return true, gossh.Marshal(&remoteForwardSuccess{BindPort: port})
+		}
+		return true, nil
+	case "cancel-tcpip-forward":
+		return actx.remoteForwards.cancel(net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(payload.BindPort)))), nil
+	default:
+		return false, nil
+	}
+}
+
+// startRemoteForward opens the listener on the target host and returns the bound port
+func startRemoteForward(ctx ssh.Context, actx *authContext, bind remoteForwardRequest) (uint32, error) {
+	pending, err := secondFactorPending(actx)
+	if err != nil {
+		return 0, err
+	}
+	if pending {
+		return 0, errors.New("a verification code is required, open an interactive session first")
+	}
+
+	host, err := dbmodels.HostByName(actx.db, actx.inputUsername)
+	if err != nil {
+		return 0, err
+	}
+	if host.Scheme() != dbmodels.BastionSchemeSSH {
+		return 0, fmt.Errorf("remote forwarding is not supported by the %q scheme", host.Scheme())
+	}
+
+	// the configs are only built if the ACLs grant the access to the host
+	configs, err := hostSessionConfigs(ctx, host)
+	if err != nil {
+		return 0, err
+	}
+	tmpUser, tmpHost, err := aclSubjects(actx, host)
+	if err != nil {
+		return 0, err
+	}
+	if !checkRemoteForwardACLs(tmpUser, tmpHost, actx.clientIP) {
+		return 0, errors.New("remote forwarding is not allowed by the ACLs")
+	}
+	configs[len(configs)-1].PortForward = true
+
+	sess := dbmodels.Session{
+		UserID:     actx.user.ID,
+		HostID:     host.ID,
+		Status:     string(dbmodels.SessionStatusActive),
+		ClientAddr: ctx.RemoteAddr().String(),
+		SourceCIDR: configs[len(configs)-1].SourceCIDR,
+	}
+	if err = actx.db.Create(&sess).Error; err != nil {
+		return 0, err
+	}
+	closeSession := func(err error) {
+		now := time.Now()
+		sessUpdate := dbmodels.Session{
+			Status:    string(dbmodels.SessionStatusClosed),
+			ErrMsg:    fmt.Sprintf("%v", err),
+			StoppedAt: &now,
+		}
+		if err == nil {
+			sessUpdate.ErrMsg = ""
+		}
+		actx.db.Model(&sess).Updates(&sessUpdate)
+	}
+
+	ln, closeHops, err := listenRemote(configs, sess.ID, actx.user, bind)
+	if err != nil {
+		closeSession(err)
+		return 0, err
+	}
+	port := uint32(ln.Addr().(*net.TCPAddr).Port)
+	addr := net.JoinHostPort(bind.BindAddr, strconv.Itoa(int(port)))
+	if !actx.remoteForwards.add(addr, ln) {
+		_ = ln.Close()
+		closeHops()
+		err = fmt.Errorf("%s is already forwarded", addr)
+		closeSession(err)
+		return 0, err
+	}
+
+	config := configs[len(configs)-1]
+	logWriter := newDiscardWriteCloser()
+	if config.LoggingMode != "disabled" {
+		filename := filepath.Join(config.LogsLocation, fmt.Sprintf("%s-%s-forwarded-tcpip-%d-%s", ctx.User(), actx.user.Name, sess.ID, time.Now().Format(time.RFC3339)))
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0440)
+		if err != nil {
+			actx.remoteForwards.remove(addr)
+			_ = ln.Close()
+			closeHops()
+			closeSession(err)
+			return 0, err
+		}
+		log.Printf("Session forwarded-tcpip is recorded in %v", f.Name())
+		// the connections accepted by the listener are recorded concurrently
+		logWriter = newSyncWriteCloser(f)
+	}
+
+	log.Printf("New remote forward: sshUser=%q host=%q bind=%q dbUser=id:%d,email:%s", ctx.User(), host.Name, addr, actx.user.ID, actx.user.Email)
+	conn := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	kill := runningSessions.register(sess.ID)
+	stopSchedule := closeAtScheduleEnd(sess.ID, config)
+	accepted := make(chan struct{})
+	go func() {
+		defer close(accepted)
+		var wg sync.WaitGroup
+		for {
+			rconn, err := ln.Accept()
+			if err != nil {
+				break
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				forwardConn(conn, rconn, bind.BindAddr, port, logWriter)
+			}()
+		}
+		wg.Wait()
+	}()
+	go func() {
+		defer runningSessions.unregister(sess.ID)
+		defer stopSchedule()
+		var err error
+		select {
+		case reason := <-kill:
+			err = errors.New(reason)
+		case <-ctx.Done():
+		case <-accepted:
+		}
+		actx.remoteForwards.remove(addr)
+		_ = ln.Close()
+		closeHops()
+		<-accepted
+		_ = logWriter.Close()
+		closeSession(err)
+	}()
+	return port, nil
+}
+
+// listenRemote connects to the target host through its hops and asks it to listen on bind
+func listenRemote(configs []sessionConfig, sessionID uint, user dbmodels.User, bind remoteForwardRequest) (net.Listener, func(), error) {
+	if err := signSessionCertificates(configs, user, sessionID); err != nil {
+		return nil, nil, err
+	}
+	client, closeHops, err := dialHops(configs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// x/crypto/ssh only sends IP addresses, an empty address means all the interfaces
+	bindAddr := bind.BindAddr
+	if bindAddr == "" || bindAddr == "*" {
+		bindAddr = "0.0.0.0"
+	}
+	ln, err := client.Listen("tcp", net.JoinHostPort(bindAddr, strconv.Itoa(int(bind.BindPort))))
+	if err != nil {
+		closeHops()
+		return nil, nil, err
+	}
+	return ln, closeHops, nil
+}
+
+// forwardConn pipes a connection accepted on the target host into a
+// forwarded-tcpip channel opened on the client connection
+func forwardConn(conn gossh.Conn, rconn net.Conn, bindAddr string, bindPort uint32, logWriter io.WriteCloser) {
+	defer func() { _ = rconn.Close() }()
+
+	originAddr, originPort := rconn.RemoteAddr().String(), 0
+	if addr, ok := rconn.RemoteAddr().(*net.TCPAddr); ok {
+		originAddr, originPort = addr.IP.String(), addr.Port
+	}
+	lch, lreqs, err := conn.OpenChannel("forwarded-tcpip", gossh.Marshal(&remoteForwardChannelData{
+		DestAddr:   bindAddr,
+		DestPort:   bindPort,
+		OriginAddr: originAddr,
+		OriginPort: uint32(originPort),
+	}))
+	if err != nil {
+		log.Printf("failed to open forwarded-tcpip channel: %v", err)
+		return
+	}
+	go gossh.DiscardRequests(lreqs)
+	defer func() { _ = lch.Close() }()
+
+	// like the direct-tcpip tunnels of gliderlabs/ssh, the first side to end closes the tunnel
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(newLogTunnel(lch, logWriter, originAddr), newCountingReader(rconn, "forwarded-tcpip", "downstream"))
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(newLogTunnel(rconn, logWriter, bindAddr), newCountingReader(lch, "forwarded-tcpip", "upstream"))
+		done <- struct{}{}
+	}()
+	<-done
+}
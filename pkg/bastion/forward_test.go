@@ -0,0 +1,70 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRemoteForwards(t *testing.T) {
+	Convey("Testing remoteForwards", t, func(c C) {
+		forwards := newRemoteForwards()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.So(err, ShouldBeNil)
+
+		c.So(forwards.add("localhost:8080", ln), ShouldBeTrue)
+		c.So(forwards.add("localhost:8080", ln), ShouldBeFalse)
+		c.So(forwards.cancel("localhost:8081"), ShouldBeFalse)
+		c.So(forwards.cancel("localhost:8080"), ShouldBeTrue)
+		c.So(forwards.cancel("localhost:8080"), ShouldBeFalse)
+
+		// the canceled listener is closed
+		_, err = ln.Accept()
+		c.So(err, ShouldNotBeNil)
+	})
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestLogTunnelConcurrentWrites(t *testing.T) {
+	Convey("Testing concurrent logTunnel writes", t, func(c C) {
+		recording := bytes.Buffer{}
+		writer := newSyncWriteCloser(nopWriteCloser{&recording})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(host string) {
+				defer wg.Done()
+				tunnel := newLogTunnel(nopWriteCloser{ioutil.Discard}, writer, host)
+				for j := 0; j < 100; j++ {
+					_, _ = tunnel.Write([]byte(strings.Repeat(host, 64)))
+				}
+			}(fmt.Sprintf("%d", i))
+		}
+		wg.Wait()
+
+		// every frame is intact
+		frames := 0
+		for {
+			frame, err := readTTYRecFrame(&recording)
+			if err == io.EOF {
+				break
+			}
+			c.So(err, ShouldBeNil)
+			host := string(frame.Data[:1])
+			c.So(string(frame.Data), ShouldEqual, host+": "+strings.Repeat(host, 64))
+			frames++
+		}
+		c.So(frames, ShouldEqual, 800)
+	})
+}
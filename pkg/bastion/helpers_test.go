@@ -0,0 +1,26 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newTestDB returns an initialized sqlite database, removed when the
+// current Convey scope ends
+func newTestDB(c C) *gorm.DB {
+	tempDir, err := ioutil.TempDir("", "sshportal")
+	c.So(err, ShouldBeNil)
+	c.Reset(func() {
+		c.So(os.RemoveAll(tempDir), ShouldBeNil)
+	})
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(tempDir, "sshportal.db")), &gorm.Config{})
+	c.So(err, ShouldBeNil)
+	c.So(DBInit(db, ""), ShouldBeNil)
+	return db
+}
@@ -1,19 +1,19 @@
 package bastion // import "moul.io/sshportal/pkg/bastion"
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
 	"log"
+	"sync"
 	"syscall"
 	"time"
-
-	"golang.org/x/crypto/ssh"
 )
 
 type logTunnel struct {
 	host    string
-	channel ssh.Channel
+	channel io.WriteCloser
 	writer  io.WriteCloser
 }
 
@@ -32,7 +32,7 @@ func writeHeader(fd io.Writer, length int) {
 	if err := binary.Write(fd, binary.LittleEndian, int32(tv.Sec)); err != nil {
 		log.Printf("failed to write log header: %v", err)
 	}
-	if err := binary.Write(fd, binary.LittleEndian, tv.Usec); err != nil {
+	if err := binary.Write(fd, binary.LittleEndian, int32(tv.Usec)); err != nil {
 		log.Printf("failed to write log header: %v", err)
 	}
 	if err := binary.Write(fd, binary.LittleEndian, int32(length)); err != nil {
@@ -40,7 +40,7 @@ func writeHeader(fd io.Writer, length int) {
 	}
 }
 
-func newLogTunnel(channel ssh.Channel, writer io.WriteCloser, host string) io.ReadWriteCloser {
+func newLogTunnel(channel io.WriteCloser, writer io.WriteCloser, host string) io.ReadWriteCloser {
 	return &logTunnel{
 		host:    host,
 		channel: channel,
@@ -53,11 +53,12 @@ func (l *logTunnel) Read(data []byte) (int, error) {
 }
 
 func (l *logTunnel) Write(data []byte) (int, error) {
-	writeHeader(l.writer, len(data)+len(l.host+": "))
-	if _, err := l.writer.Write([]byte(l.host + ": ")); err != nil {
-		log.Printf("failed to write log: %v", err)
-	}
-	if _, err := l.writer.Write(data); err != nil {
+	// the frame is written at once, the tunnels of a connection share the writer
+	frame := bytes.Buffer{}
+	writeHeader(&frame, len(data)+len(l.host+": "))
+	frame.WriteString(l.host + ": ")
+	frame.Write(data)
+	if _, err := l.writer.Write(frame.Bytes()); err != nil {
 		log.Printf("failed to write log: %v", err)
 	}
 
@@ -69,3 +70,25 @@ func (l *logTunnel) Close() error {
 
 	return l.channel.Close()
 }
+
+// syncWriteCloser serializes the writes of the tunnels sharing a log file
+type syncWriteCloser struct {
+	mu     sync.Mutex
+	writer io.WriteCloser
+}
+
+func newSyncWriteCloser(writer io.WriteCloser) io.WriteCloser {
+	return &syncWriteCloser{writer: writer}
+}
+
+func (w *syncWriteCloser) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writer.Write(data)
+}
+
+func (w *syncWriteCloser) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writer.Close()
+}
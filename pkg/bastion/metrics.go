@@ -0,0 +1,76 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"moul.io/sshportal/pkg/metrics"
+)
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	authAttempts = metricsRegistry.NewCounterVec("sshportal_auth_attempts_total",
+		"Number of SSH authentication attempts by method and result.", "method", "result")
+	sessionDuration = metricsRegistry.NewHistogramVec("sshportal_session_duration_seconds",
+		"Duration of the sessions opened on the target hosts.",
+		[]float64{1, 10, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600})
+	upstreamDialDuration = metricsRegistry.NewHistogramVec("sshportal_upstream_dial_duration_seconds",
+		"Duration of the SSH connections to the hops and target hosts.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "hop")
+	upstreamDialErrors = metricsRegistry.NewCounterVec("sshportal_upstream_dial_errors_total",
+		"Number of failed SSH connections to the hops and target hosts.", "hop")
+	aclDecisions = metricsRegistry.NewCounterVec("sshportal_acl_decisions_total",
+		"Number of ACL decisions by action.", "action")
+	aclHookDuration = metricsRegistry.NewHistogramVec("sshportal_acl_hook_duration_seconds",
+		"Duration of the external ACL hook executions.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2})
+	aclHookTimeouts = metricsRegistry.NewCounterVec("sshportal_acl_hook_timeouts_total",
+		"Number of external ACL hook executions that timed out.")
+	proxiedBytes = metricsRegistry.NewCounterVec("sshportal_proxied_bytes_total",
+		"Number of bytes proxied between the clients and the target hosts, upstream is from the client to the target.",
+		"channel_type", "direction")
+
+	_ = metricsRegistry.NewGaugeFunc("sshportal_active_sessions",
+		"Number of sessions currently running on this instance.",
+		func() float64 { return float64(runningSessions.count()) })
+)
+
+// MetricsHandler serves the bastion metrics in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return metricsRegistry.Handler()
+}
+
+// recordAuthAttempt counts an authentication attempt once the auth handler has returned
+func recordAuthAttempt(actx *authContext) {
+	if actx.userType() == userTypeHealthcheck {
+		return
+	}
+	result := "failure"
+	if actx.err == nil && actx.user.ID > 0 {
+		result = "success"
+	}
+	authAttempts.With(actx.authMethod, result).Inc()
+}
+
+// observeSince records the seconds elapsed since start in h
+func observeSince(h *metrics.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// countingReader counts the bytes read from a proxied channel
+type countingReader struct {
+	io.Reader
+	counter *metrics.Counter
+}
+
+func newCountingReader(r io.Reader, channelType, direction string) io.Reader {
+	return countingReader{Reader: r, counter: proxiedBytes.With(channelType, direction)}
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.counter.Add(uint64(n))
+	return n, err
+}
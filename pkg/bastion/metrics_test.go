@@ -0,0 +1,36 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	Convey("Testing MetricsHandler", t, func() {
+		denied := aclDecisions.With(string(dbmodels.ACLActionDeny)).Value()
+		So(checkACLs(dbmodels.User{}, dbmodels.Host{}, nil, ""), ShouldEqual, string(dbmodels.ACLActionDeny))
+		So(aclDecisions.With(string(dbmodels.ACLActionDeny)).Value(), ShouldEqual, denied+1)
+
+		failed := authAttempts.With("pubkey", "failure").Value()
+		recordAuthAttempt(&authContext{inputUsername: "alice", authMethod: "pubkey"})
+		recordAuthAttempt(&authContext{inputUsername: "healthcheck", authMethod: "pubkey"})
+		So(authAttempts.With("pubkey", "failure").Value(), ShouldEqual, failed+1)
+
+		r := strings.NewReader("hello")
+		_, err := ioutil.ReadAll(newCountingReader(r, "test", "upstream"))
+		So(err, ShouldBeNil)
+		So(proxiedBytes.With("test", "upstream").Value(), ShouldEqual, 5)
+
+		rec := httptest.NewRecorder()
+		MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body := rec.Body.String()
+		So(body, ShouldContainSubstring, `sshportal_proxied_bytes_total{channel_type="test",direction="upstream"} 5`)
+		So(body, ShouldContainSubstring, "# TYPE sshportal_active_sessions gauge")
+		So(body, ShouldContainSubstring, "# TYPE sshportal_session_duration_seconds histogram")
+	})
+}
@@ -0,0 +1,394 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mgutz/ansi"
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+// errHostPickerQuit is returned when the user leaves the host picker
+var errHostPickerQuit = errors.New("host picker closed")
+
+// hostPickerChannel shows the hosts allowed by the ACLs in a menu on the
+// interactive session channels, the requests received before the shell
+// are acknowledged and replayed to the handler of the returned channel.
+//
+// It returns the picked host, or nil for the sshportal shell, which is also
+// used for the commands and the sessions without a terminal.
+func hostPickerChannel(actx *authContext, newChan gossh.NewChannel) (gossh.NewChannel, *dbmodels.Host, error) {
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		buffered []*gossh.Request
+		ptyReq   *gossh.Request
+		started  string
+	)
+	for req := range reqs {
+		replayed := acknowledgeRequest(req)
+		buffered = append(buffered, replayed)
+		switch req.Type {
+		case "pty-req":
+			ptyReq = replayed
+		case "shell", "exec", "subsystem":
+			started = req.Type
+		}
+		if started != "" {
+			break
+		}
+	}
+	if started != "shell" || ptyReq == nil {
+		return &acceptedChannel{NewChannel: newChan, ch: ch, reqs: replayRequests(buffered, reqs)}, nil, nil
+	}
+
+	var pty struct {
+		Term                         string
+		Columns, Rows, Width, Height uint32
+		Modes                        string
+	}
+	if err := gossh.Unmarshal(ptyReq.Payload, &pty); err != nil {
+		return nil, nil, err
+	}
+	tmpUser, err := aclUser(actx)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts, err := allowedHosts(actx.db, tmpUser, actx.clientIP, actx.aclCheckCmd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a single goroutine reads the channel, the picker then the next handler
+	// consume its input
+	picked := newPickerChannel(ch)
+	picker := &hostPicker{hosts: hosts, width: int(pty.Columns), height: int(pty.Rows)}
+	host, err := picker.run(picked, picked.input, reqs)
+	if err != nil {
+		if err == errHostPickerQuit {
+			fmt.Fprint(ch, "bye\r\n")
+		}
+		go gossh.DiscardRequests(reqs)
+		_ = picked.Close()
+		return nil, nil, err
+	}
+
+	// the terminal of the target has the current size
+	pty.Columns, pty.Rows = uint32(picker.width), uint32(picker.height)
+	ptyReq.Payload = gossh.Marshal(&pty)
+	return &acceptedChannel{NewChannel: newChan, ch: picked, reqs: replayRequests(buffered, reqs)}, host, nil
+}
+
+// replayRequests returns the buffered requests followed by the next ones
+func replayRequests(buffered []*gossh.Request, reqs <-chan *gossh.Request) <-chan *gossh.Request {
+	replay := make(chan *gossh.Request, len(buffered))
+	for _, req := range buffered {
+		replay <- req
+	}
+	go func() {
+		defer close(replay)
+		for req := range reqs {
+			replay <- req
+		}
+	}()
+	return replay
+}
+
+// pickerChannel is a gossh.Channel whose input is read by a goroutine, so
+// that the picker does not lose the input of the next handler
+type pickerChannel struct {
+	gossh.Channel
+	input     chan []byte
+	pending   []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPickerChannel(ch gossh.Channel) *pickerChannel {
+	c := &pickerChannel{Channel: ch, input: make(chan []byte), closed: make(chan struct{})}
+	go func() {
+		defer close(c.input)
+		for {
+			buf := make([]byte, 1024)
+			n, err := ch.Read(buf)
+			if n > 0 {
+				select {
+				case c.input <- buf[:n]:
+				case <-c.closed:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *pickerChannel) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		data, ok := <-c.input
+		if !ok {
+			return 0, io.EOF
+		}
+		c.pending = data
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *pickerChannel) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Channel.Close()
+}
+
+// hostPicker is a menu of hosts filtered by a fuzzy search
+type hostPicker struct {
+	hosts    []*dbmodels.Host
+	query    []rune
+	matches  []*dbmodels.Host
+	selected int
+	offset   int
+	width    int
+	height   int
+}
+
+// run shows the menu on w until a host is picked, it returns nil when the
+// user asks for the sshportal shell and errHostPickerQuit when they leave
+func (p *hostPicker) run(w io.Writer, input <-chan []byte, reqs <-chan *gossh.Request) (*dbmodels.Host, error) {
+	p.filter()
+	for {
+		p.render(w)
+		select {
+		case data, ok := <-input:
+			if !ok {
+				return nil, io.EOF
+			}
+			for len(data) > 0 {
+				var key string
+				key, data = nextKey(data)
+				switch key {
+				case "enter":
+					if len(p.matches) > 0 {
+						p.clear(w)
+						return p.matches[p.selected], nil
+					}
+				case "escape":
+					p.clear(w)
+					return nil, nil
+				case "quit":
+					p.clear(w)
+					return nil, errHostPickerQuit
+				case "up":
+					p.move(-1)
+				case "down":
+					p.move(1)
+				case "pageup":
+					p.move(-p.pageSize())
+				case "pagedown":
+					p.move(p.pageSize())
+				case "backspace":
+					if len(p.query) > 0 {
+						p.query = p.query[:len(p.query)-1]
+						p.filter()
+					}
+				case "clear":
+					p.query = nil
+					p.filter()
+				default:
+					if r, _ := utf8.DecodeRuneInString(key); utf8.RuneCountInString(key) == 1 && unicode.IsPrint(r) {
+						p.query = append(p.query, r)
+						p.filter()
+					}
+				}
+			}
+		case req, ok := <-reqs:
+			if !ok {
+				return nil, io.EOF
+			}
+			if req.Type == "window-change" {
+				var size struct{ Columns, Rows, Width, Height uint32 }
+				if err := gossh.Unmarshal(req.Payload, &size); err == nil {
+					p.width, p.height = int(size.Columns), int(size.Rows)
+				}
+			}
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+// nextKey returns the first key pressed in data and the remaining input
+func nextKey(data []byte) (string, []byte) {
+	sequences := []struct{ prefix, key string }{
+		{"\x1b[A", "up"}, {"\x1bOA", "up"},
+		{"\x1b[B", "down"}, {"\x1bOB", "down"},
+		{"\x1b[5~", "pageup"}, {"\x1b[6~", "pagedown"},
+	}
+	for _, sequence := range sequences {
+		if strings.HasPrefix(string(data), sequence.prefix) {
+			return sequence.key, data[len(sequence.prefix):]
+		}
+	}
+	switch data[0] {
+	case '\x1b':
+		// the other escape sequences are skipped, i.e., the function keys
+		if len(data) > 1 && data[1] == 'O' {
+			if len(data) > 2 {
+				return "", data[3:]
+			}
+			return "", nil
+		}
+		if len(data) > 1 && data[1] == '[' {
+			// parameter and intermediate bytes, then the final byte
+			end := 2
+			for end < len(data) && data[end] >= 0x20 && data[end] <= 0x3f {
+				end++
+			}
+			if end < len(data) {
+				end++
+			}
+			return "", data[end:]
+		}
+		return "escape", data[1:]
+	case '\r', '\n':
+		return "enter", data[1:]
+	case 0x03, 0x04: // Ctrl-C, Ctrl-D
+		return "quit", data[1:]
+	case 0x7f, 0x08:
+		return "backspace", data[1:]
+	case 0x15: // Ctrl-U
+		return "clear", data[1:]
+	case 0x10: // Ctrl-P
+		return "up", data[1:]
+	case 0x0e: // Ctrl-N
+		return "down", data[1:]
+	}
+	r, size := utf8.DecodeRune(data)
+	return string(r), data[size:]
+}
+
+// filter selects the hosts matching the query, the best matches first
+func (p *hostPicker) filter() {
+	type match struct {
+		host  *dbmodels.Host
+		score int
+	}
+	matches := []match{}
+	for _, host := range p.hosts {
+		if score, ok := fuzzyScore(string(p.query), hostPickerLabel(host)); ok {
+			matches = append(matches, match{host: host, score: score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score < matches[j].score })
+	p.matches = make([]*dbmodels.Host, 0, len(matches))
+	for _, match := range matches {
+		p.matches = append(p.matches, match.host)
+	}
+	p.selected, p.offset = 0, 0
+}
+
+// fuzzyScore returns whether the characters of pattern appear in order in
+// candidate, ignoring the case, and a score, lower for the closer matches
+func fuzzyScore(pattern, candidate string) (int, bool) {
+	candidate = strings.ToLower(candidate)
+	score, pos := 0, 0
+	for _, r := range strings.ToLower(pattern) {
+		idx := strings.IndexRune(candidate[pos:], r)
+		if idx < 0 {
+			return 0, false
+		}
+		score += idx
+		pos += idx + utf8.RuneLen(r)
+	}
+	return score, true
+}
+
+func hostPickerLabel(host *dbmodels.Host) string {
+	label := host.Name
+	if host.Labels != "" {
+		label += "  " + strings.Replace(host.Labels, ",", ", ", -1)
+	}
+	if host.Comment != "" {
+		label += "  " + host.Comment
+	}
+	return label
+}
+
+func (p *hostPicker) pageSize() int {
+	// some clients do not send the size of their terminal
+	if p.height == 0 {
+		return 20
+	}
+	// the title, the search and the status lines
+	if size := p.height - 3; size > 1 {
+		return size
+	}
+	return 1
+}
+
+func (p *hostPicker) move(delta int) {
+	if len(p.matches) == 0 {
+		return
+	}
+	p.selected += delta
+	if p.selected < 0 {
+		p.selected = 0
+	}
+	if p.selected >= len(p.matches) {
+		p.selected = len(p.matches) - 1
+	}
+	if p.selected < p.offset {
+		p.offset = p.selected
+	}
+	if p.selected >= p.offset+p.pageSize() {
+		p.offset = p.selected - p.pageSize() + 1
+	}
+}
+
+func (p *hostPicker) line(text string) string {
+	if p.width > 3 {
+		text = wrapText(text, p.width)
+	}
+	return text + "\x1b[K\r\n"
+}
+
+func (p *hostPicker) render(w io.Writer) {
+	selectedColor := func(text string) string { return "\x1b[7m" + text + ansi.Reset }
+	titleColor := ansi.ColorFunc("magenta+bh")
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	screen.WriteString(titleColor(p.line("Select a host: up/down to move, type to search, enter to connect, esc for the sshportal shell, ctrl-c to quit")))
+	screen.WriteString(p.line("> " + string(p.query)))
+	for i := p.offset; i < len(p.matches) && i < p.offset+p.pageSize(); i++ {
+		if i == p.selected {
+			screen.WriteString(selectedColor(p.line("> " + hostPickerLabel(p.matches[i]))))
+		} else {
+			screen.WriteString(p.line("  " + hostPickerLabel(p.matches[i])))
+		}
+	}
+	switch {
+	case len(p.hosts) == 0:
+		screen.WriteString(p.line("You are not allowed to reach any host."))
+	default:
+		screen.WriteString(p.line(fmt.Sprintf("%d/%d hosts", len(p.matches), len(p.hosts))))
+	}
+	// the cursor stays on the search line
+	screen.WriteString(fmt.Sprintf("\x1b[J\x1b[2;%dH", len(p.query)+3))
+	_, _ = io.WriteString(w, screen.String())
+}
+
+func (p *hostPicker) clear(w io.Writer) {
+	_, _ = io.WriteString(w, "\x1b[H\x1b[J")
+}
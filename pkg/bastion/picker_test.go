@@ -0,0 +1,106 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	Convey("Testing fuzzyScore", t, func() {
+		score, ok := fuzzyScore("", "web")
+		So(ok, ShouldBeTrue)
+		So(score, ShouldEqual, 0)
+
+		_, ok = fuzzyScore("wb", "Web-01")
+		So(ok, ShouldBeTrue)
+		_, ok = fuzzyScore("bw", "web-01")
+		So(ok, ShouldBeFalse)
+
+		closer, _ := fuzzyScore("db", "db-01")
+		farther, _ := fuzzyScore("db", "dashboard")
+		So(closer, ShouldBeLessThan, farther)
+	})
+}
+
+func TestNextKey(t *testing.T) {
+	Convey("Testing nextKey", t, func() {
+		var keys []string
+		data := []byte("a\x1b[B\x1bOA\x7f\x15\r")
+		for len(data) > 0 {
+			var key string
+			key, data = nextKey(data)
+			keys = append(keys, key)
+		}
+		So(keys, ShouldResemble, []string{"a", "down", "up", "backspace", "clear", "enter"})
+
+		key, rest := nextKey([]byte("\x1b"))
+		So(key, ShouldEqual, "escape")
+		So(rest, ShouldBeEmpty)
+
+		key, _ = nextKey([]byte("\x03"))
+		So(key, ShouldEqual, "quit")
+
+		// the unknown sequences are skipped, not the keys typed after them
+		key, rest = nextKey([]byte("\x1b[15~db"))
+		So(key, ShouldEqual, "")
+		So(string(rest), ShouldEqual, "db")
+		key, rest = nextKey([]byte("\x1bOPw"))
+		So(key, ShouldEqual, "")
+		So(string(rest), ShouldEqual, "w")
+		key, rest = nextKey([]byte("\x1b[1;5C"))
+		So(key, ShouldEqual, "")
+		So(rest, ShouldBeEmpty)
+	})
+}
+
+func TestHostPicker(t *testing.T) {
+	Convey("Testing hostPicker", t, func() {
+		hosts := []*dbmodels.Host{
+			{Name: "db-01", Comment: "main database"},
+			{Name: "web-01", Labels: "env=prod"},
+			{Name: "web-02", Labels: "env=staging"},
+		}
+		var screen bytes.Buffer
+
+		Convey("search and pick a host", func() {
+			input := make(chan []byte, 2)
+			input <- []byte("web")
+			input <- []byte("\x1b[B\r")
+			picker := &hostPicker{hosts: hosts, width: 80, height: 24}
+			host, err := picker.run(&screen, input, nil)
+			So(err, ShouldBeNil)
+			So(host.Name, ShouldEqual, "web-02")
+			So(screen.String(), ShouldContainSubstring, "2/3 hosts")
+		})
+
+		Convey("resize the menu", func() {
+			input := make(chan []byte)
+			reqs := make(chan *gossh.Request, 1)
+			reqs <- &gossh.Request{Type: "window-change", Payload: gossh.Marshal(&struct{ Columns, Rows, Width, Height uint32 }{120, 4, 0, 0})}
+			close(reqs)
+			picker := &hostPicker{hosts: hosts, width: 80, height: 24}
+			_, err := picker.run(&screen, input, reqs)
+			So(err, ShouldNotBeNil)
+			So(picker.width, ShouldEqual, 120)
+			So(picker.pageSize(), ShouldEqual, 1)
+			picker.move(2)
+			So(picker.offset, ShouldEqual, 2)
+		})
+
+		Convey("leave the menu", func() {
+			input := make(chan []byte, 1)
+			input <- []byte("\x1b")
+			host, err := (&hostPicker{hosts: hosts}).run(&screen, input, nil)
+			So(err, ShouldBeNil)
+			So(host, ShouldBeNil)
+
+			input <- []byte("\x03")
+			_, err = (&hostPicker{hosts: hosts}).run(&screen, input, nil)
+			So(err, ShouldEqual, errHostPickerQuit)
+		})
+	})
+}
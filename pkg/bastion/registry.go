@@ -0,0 +1,104 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sessionRegistry tracks the sessions running on this sshportal instance
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[uint]*runningSession
+}
+
+type runningSession struct {
+	kill    chan string
+	started time.Time
+}
+
+var runningSessions = &sessionRegistry{sessions: map[uint]*runningSession{}}
+
+// register returns a channel receiving the reason closing the session, i.e., "killed by alice"
+func (r *sessionRegistry) register(sessionID uint) <-chan string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sess := &runningSession{kill: make(chan string, 1), started: time.Now()}
+	r.sessions[sessionID] = sess
+	return sess.kill
+}
+
+func (r *sessionRegistry) unregister(sessionID uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sess, found := r.sessions[sessionID]; found {
+		observeSince(sessionDuration.With(), sess.started)
+		delete(r.sessions, sessionID)
+	}
+}
+
+// count returns the number of sessions running on this instance
+func (r *sessionRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// wait returns once no session is running on this instance, or ctx is done
+func (r *sessionRegistry) wait(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for r.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// kill asks a running session to stop, it returns false if the session is not running on this instance
+func (r *sessionRegistry) kill(sessionID uint, by string) bool {
+	return r.stop(sessionID, "killed by "+by)
+}
+
+// stop asks a running session to stop for reason, it returns false if the session is not running on this instance
+func (r *sessionRegistry) stop(sessionID uint, reason string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sess, found := r.sessions[sessionID]
+	if !found {
+		return false
+	}
+	sess.stop(reason)
+	return true
+}
+
+// killAll asks all the running sessions to stop for reason
+func (r *sessionRegistry) killAll(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sess := range r.sessions {
+		sess.stop(reason)
+	}
+}
+
+func (s *runningSession) stop(reason string) {
+	select {
+	case s.kill <- reason:
+	default: // already being killed
+	}
+}
+
+// closeAtScheduleEnd stops the session at the end of the schedule of the ACL
+// granting the access to the target of config, the returned function cancels it
+func closeAtScheduleEnd(sessionID uint, config sessionConfig) func() {
+	if config.ScheduleEnd == nil {
+		return func() {}
+	}
+	timer := time.AfterFunc(time.Until(*config.ScheduleEnd), func() {
+		runningSessions.stop(sessionID, aclScheduleEndReason)
+	})
+	return func() { timer.Stop() }
+}
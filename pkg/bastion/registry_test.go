@@ -0,0 +1,48 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+type sessionNewChannel struct {
+	gossh.NewChannel
+}
+
+func (sessionNewChannel) ChannelType() string { return "session" }
+
+// stderrChannel keeps stderr apart from the data read by the pipe goroutines
+type stderrChannel struct {
+	bufferChannel
+	stderr bytes.Buffer
+}
+
+func (c *stderrChannel) Stderr() io.ReadWriter { return &c.stderr }
+
+func TestSessionRegistry(t *testing.T) {
+	Convey("Testing sessionRegistry", t, func() {
+		registry := &sessionRegistry{sessions: map[uint]*runningSession{}}
+		So(registry.kill(1, "alice"), ShouldBeFalse)
+
+		kill := registry.register(1)
+		So(registry.count(), ShouldEqual, 1)
+		So(registry.kill(1, "alice"), ShouldBeTrue)
+		So(registry.kill(1, "bob"), ShouldBeTrue) // already being killed
+
+		lch, rch := &stderrChannel{}, &bufferChannel{}
+		audit := newTransferAuditor(nil, dbmodels.User{}, 1, "", lch, rch)
+		err := pipe(nil, nil, lch, rch, sessionConfig{LoggingMode: "disabled"}, "host", "alice", 1, sessionNewChannel{}, audit, kill)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "killed by alice")
+		So(lch.stderr.String(), ShouldContainSubstring, "session killed by alice")
+
+		registry.unregister(1)
+		So(registry.kill(1, "alice"), ShouldBeFalse)
+		So(registry.count(), ShouldEqual, 0)
+	})
+}
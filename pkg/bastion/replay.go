@@ -0,0 +1,217 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// ttyrecMaxFrameSize protects against corrupted length fields
+const ttyrecMaxFrameSize = 1 << 24
+
+type ttyrecFrame struct {
+	Time time.Time
+	Data []byte
+}
+
+// readTTYRecFrame reads a ttyrec record (int32 sec, int32 usec, int32 length, data)
+func readTTYRecFrame(r io.Reader) (*ttyrecFrame, error) {
+	var header struct {
+		Sec, Usec, Len int32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Len < 0 || header.Len > ttyrecMaxFrameSize {
+		return nil, fmt.Errorf("invalid ttyrec frame length: %d", header.Len)
+	}
+	frame := ttyrecFrame{
+		Time: time.Unix(int64(header.Sec), int64(header.Usec)*int64(time.Microsecond)),
+		Data: make([]byte, header.Len),
+	}
+	if _, err := io.ReadFull(r, frame.Data); err != nil {
+		return nil, err
+	}
+	return &frame, nil
+}
+
+// sessionLogFiles returns the recordings of a session, sorted by name
+func sessionLogFiles(logsLocation string, sessionID uint) ([]string, error) {
+	// files are named <user>-<username>-<channel type>-<session ID>-<RFC3339 date>[.cast]
+	re := regexp.MustCompile(fmt.Sprintf(`-(session|direct-tcpip|forwarded-tcpip)-%d-\d{4}-\d{2}-\d{2}T[^/]*$`, sessionID))
+	candidates, err := filepath.Glob(filepath.Join(logsLocation, fmt.Sprintf("*-%d-*", sessionID)))
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, candidate := range candidates {
+		if re.MatchString(filepath.Base(candidate)) {
+			files = append(files, candidate)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// errReplayAborted is returned when the viewer stops a replay
+var errReplayAborted = errors.New("replay aborted")
+
+type replayOptions struct {
+	Speed   float64
+	IdleCap time.Duration
+	Raw     bool
+	// Wait pauses between two frames, it returns false to abort the replay
+	Wait func(time.Duration) bool
+}
+
+// replayFrames writes the frames returned by next to w, reproducing the
+// original timing unless opts.Raw is set
+func replayFrames(w io.Writer, next func() (*ttyrecFrame, error), opts replayOptions) error {
+	var last time.Time
+	for {
+		frame, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !opts.Raw && !last.IsZero() {
+			delay := frame.Time.Sub(last)
+			if opts.IdleCap > 0 && delay > opts.IdleCap {
+				delay = opts.IdleCap
+			}
+			if opts.Speed > 0 {
+				delay = time.Duration(float64(delay) / opts.Speed)
+			}
+			if delay > 0 && !opts.Wait(delay) {
+				return errReplayAborted
+			}
+		}
+		last = frame.Time
+		if _, err := w.Write(frame.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// replaySessionLogs replays every recording of a session
+func replaySessionLogs(w io.Writer, logsLocation string, sessionID uint, opts replayOptions) error {
+	files, err := sessionLogFiles(logsLocation, sessionID)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no recording found for session %d", sessionID)
+	}
+	for _, file := range files {
+		if len(files) > 1 {
+			fmt.Fprintf(w, "==> %s <==\r\n", filepath.Base(file))
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		next := func() (*ttyrecFrame, error) { return readTTYRecFrame(f) }
+		if strings.HasSuffix(file, asciicastExtension) {
+			next = readAsciicastFrames(f)
+		}
+		err = replayFrames(w, next, opts)
+		_ = f.Close()
+		if err == errReplayAborted {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", filepath.Base(file), err)
+		}
+	}
+	return nil
+}
+
+// replayWaiter returns a replayOptions.Wait sleeping for the delay, the
+// replay is aborted when Ctrl-C or q is read from keys or when ctx is done
+func replayWaiter(ctx context.Context, keys <-chan []byte) func(time.Duration) bool {
+	return func(delay time.Duration) bool {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				return true
+			case <-ctx.Done():
+				return false
+			case chunk, ok := <-keys:
+				if !ok {
+					// the input is closed but the viewer can still watch
+					keys = nil
+					continue
+				}
+				if bytes.ContainsAny(chunk, "\x03q") {
+					return false
+				}
+			}
+		}
+	}
+}
+
+// shellInput reads the input of a session in a goroutine started on the first
+// read, so a command can watch the keys without stealing the next ones from
+// the shell
+type shellInput struct {
+	ssh.Session
+	once    sync.Once
+	chunks  chan []byte
+	err     error
+	pending []byte
+}
+
+// keys returns the chunks read from the session, it is closed on error
+func (i *shellInput) keys() <-chan []byte {
+	i.once.Do(func() {
+		i.chunks = make(chan []byte)
+		go func() {
+			defer close(i.chunks)
+			for {
+				buf := make([]byte, 256)
+				n, err := i.Session.Read(buf)
+				if n > 0 {
+					select {
+					case i.chunks <- buf[:n]:
+					case <-i.Context().Done():
+						return
+					}
+				}
+				if err != nil {
+					i.err = err
+					return
+				}
+			}
+		}()
+	})
+	return i.chunks
+}
+
+func (i *shellInput) Read(p []byte) (int, error) {
+	if len(i.pending) == 0 {
+		chunk, ok := <-i.keys()
+		if !ok {
+			return 0, i.err
+		}
+		i.pending = chunk
+	}
+	n := copy(p, i.pending)
+	i.pending = i.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,116 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func ttyrecTestFrame(sec, usec int32, data string) []byte {
+	buf := bytes.Buffer{}
+	_ = binary.Write(&buf, binary.LittleEndian, []int32{sec, usec, int32(len(data))})
+	buf.WriteString(data)
+	return buf.Bytes()
+}
+
+func TestReplaySessionLogs(t *testing.T) {
+	Convey("Testing replaySessionLogs", t, func(c C) {
+		tempDir, err := ioutil.TempDir("", "sshportal")
+		c.So(err, ShouldBeNil)
+		defer func() {
+			c.So(os.RemoveAll(tempDir), ShouldBeNil)
+		}()
+
+		recording := bytes.Join([][]byte{
+			ttyrecTestFrame(100, 0, "$ "),
+			ttyrecTestFrame(100, 500000, "ls\r\n"),
+			ttyrecTestFrame(160, 500000, "bin etc\r\n"),
+		}, nil)
+		c.So(ioutil.WriteFile(filepath.Join(tempDir, "web-alice-session-42-2021-01-01T00:00:00Z"), recording, 0600), ShouldBeNil)
+		c.So(ioutil.WriteFile(filepath.Join(tempDir, "web-alice-session-420-2021-01-01T00:00:00Z"), recording, 0600), ShouldBeNil)
+
+		files, err := sessionLogFiles(tempDir, 42)
+		c.So(err, ShouldBeNil)
+		c.So(len(files), ShouldEqual, 1)
+
+		var sleeps []time.Duration
+		opts := replayOptions{Speed: 2, IdleCap: 10 * time.Second, Wait: func(d time.Duration) bool {
+			sleeps = append(sleeps, d)
+			return true
+		}}
+
+		Convey("with timing", func() {
+			out := bytes.Buffer{}
+			c.So(replaySessionLogs(&out, tempDir, 42, opts), ShouldBeNil)
+			c.So(out.String(), ShouldEqual, "$ ls\r\nbin etc\r\n")
+			c.So(sleeps, ShouldResemble, []time.Duration{250 * time.Millisecond, 5 * time.Second})
+		})
+
+		Convey("raw", func() {
+			opts.Raw = true
+			out := bytes.Buffer{}
+			c.So(replaySessionLogs(&out, tempDir, 42, opts), ShouldBeNil)
+			c.So(out.String(), ShouldEqual, "$ ls\r\nbin etc\r\n")
+			c.So(len(sleeps), ShouldEqual, 0)
+		})
+
+		Convey("aborted", func() {
+			opts.Wait = func(time.Duration) bool { return false }
+			out := bytes.Buffer{}
+			c.So(replaySessionLogs(&out, tempDir, 42, opts), ShouldEqual, errReplayAborted)
+			c.So(out.String(), ShouldEqual, "$ ")
+		})
+
+		Convey("missing recording", func() {
+			c.So(replaySessionLogs(&bytes.Buffer{}, tempDir, 43, opts), ShouldNotBeNil)
+		})
+
+		Convey("tunnel headers", func() {
+			buf := bytes.Buffer{}
+			writeHeader(&buf, 3)
+			buf.WriteString("abc")
+			frame, err := readTTYRecFrame(&buf)
+			c.So(err, ShouldBeNil)
+			c.So(string(frame.Data), ShouldEqual, "abc")
+		})
+	})
+}
+
+func TestReplayWaiter(t *testing.T) {
+	Convey("Testing replayWaiter", t, func(c C) {
+		keys := make(chan []byte, 1)
+
+		Convey("timeout", func() {
+			keys <- []byte("x")
+			c.So(replayWaiter(context.Background(), keys)(10*time.Millisecond), ShouldBeTrue)
+		})
+
+		Convey("closed input", func() {
+			close(keys)
+			c.So(replayWaiter(context.Background(), keys)(10*time.Millisecond), ShouldBeTrue)
+		})
+
+		Convey("q", func() {
+			keys <- []byte("q")
+			c.So(replayWaiter(context.Background(), keys)(time.Hour), ShouldBeFalse)
+		})
+
+		Convey("Ctrl-C", func() {
+			keys <- []byte("\x03")
+			c.So(replayWaiter(context.Background(), keys)(time.Hour), ShouldBeFalse)
+		})
+
+		Convey("done context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			c.So(replayWaiter(ctx, keys)(time.Hour), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,179 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"errors"
+	"fmt"
+
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"moul.io/sshportal/pkg/crypto"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+// RotateAESKey re-encrypts every sensitive column with newKey in a single
+// transaction and returns the number of updated rows.
+//
+// With encryptAll, the values are expected to be unencrypted (sshportal was
+// started without AES key so far) and oldKey must be empty.
+//
+// The legacy AES-CFB values have no integrity check, the private keys must
+// parse once decrypted so that a wrong old key does not replace every
+// secret with garbage.
+func RotateAESKey(db *gorm.DB, oldKey, newKey string, encryptAll bool) (int, error) {
+	if newKey == "" {
+		return 0, errors.New("the new AES key is required")
+	}
+	if encryptAll && oldKey != "" {
+		return 0, errors.New("the old AES key cannot be used to encrypt unencrypted data")
+	}
+	if !encryptAll && oldKey == "" {
+		return 0, errors.New("the old AES key is required to rotate the key")
+	}
+	// with encryptAll, an encrypted value means that a key was already used
+	checkUnencrypted := func(kind string, id uint, value string) error {
+		if encryptAll && (crypto.IsEncrypted(value) || crypto.IsLegacyEncrypted(value)) {
+			return fmt.Errorf("%s %d is already encrypted, use the old AES key to rotate it", kind, id)
+		}
+		return nil
+	}
+	// the old key is proved by a value with an integrity check or by a
+	// private key which parses once decrypted
+	proved := encryptAll
+
+	updated := 0
+	// the soft-deleted rows are rotated too, they still hold the secrets
+	tx := db.Unscoped().Begin()
+
+	var keys []*dbmodels.SSHKey
+	if err := tx.Find(&keys).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := checkUnencrypted("key", key.ID, key.PrivKey); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		encrypted := crypto.IsEncrypted(key.PrivKey)
+		if err := crypto.SSHKeyDecrypt(oldKey, key); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("key %d: %v", key.ID, err)
+		}
+		if !crypto.IsSecretReference(key.PrivKey) {
+			if _, err := gossh.ParsePrivateKey([]byte(key.PrivKey)); err != nil {
+				if _, ok := err.(*gossh.PassphraseMissingError); !ok {
+					tx.Rollback()
+					return 0, fmt.Errorf("key %d: cannot decrypt the private key, wrong AES key?: %v", key.ID, err)
+				}
+			}
+			proved = true
+		}
+		proved = proved || encrypted
+		if err := crypto.SSHKeyEncrypt(newKey, key); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if err := tx.Model(key).Update("priv_key", key.PrivKey).Error; err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		updated++
+	}
+
+	var hosts []*dbmodels.Host
+	if err := tx.Where("password != ?", "").Find(&hosts).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, host := range hosts {
+		if err := checkUnencrypted("host", host.ID, host.Password); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		proved = proved || crypto.IsEncrypted(host.Password)
+		if err := crypto.HostDecrypt(oldKey, host); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("host %d: %v", host.ID, err)
+		}
+		if err := crypto.HostEncrypt(newKey, host); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if err := tx.Model(host).Update("password", host.Password).Error; err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		updated++
+	}
+
+	var users []*dbmodels.User
+	if err := tx.Where("totp_secret != ?", "").Find(&users).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, user := range users {
+		if err := checkUnencrypted("user", user.ID, user.TOTPSecret); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		proved = proved || crypto.IsEncrypted(user.TOTPSecret)
+		if err := crypto.UserDecrypt(oldKey, user); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("user %d: %v", user.ID, err)
+		}
+		if err := crypto.UserEncrypt(newKey, user); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if err := tx.Model(user).Update("totp_secret", user.TOTPSecret).Error; err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		updated++
+	}
+
+	if !proved && updated > 0 {
+		tx.Rollback()
+		return 0, errors.New("cannot check the old AES key, no value encrypted with it can be verified")
+	}
+	return updated, tx.Commit().Error
+}
+
+// unencryptedRows returns the number of sensitive values which are not
+// encrypted, and the number of values encrypted with the legacy AES-CFB
+func unencryptedRows(db *gorm.DB) (int, int, error) {
+	values := []string{}
+	var keys []dbmodels.SSHKey
+	if err := db.Unscoped().Select("priv_key").Find(&keys).Error; err != nil {
+		return 0, 0, err
+	}
+	for _, key := range keys {
+		values = append(values, key.PrivKey)
+	}
+	var hosts []dbmodels.Host
+	if err := db.Unscoped().Select("password").Where("password != ?", "").Find(&hosts).Error; err != nil {
+		return 0, 0, err
+	}
+	for _, host := range hosts {
+		values = append(values, host.Password)
+	}
+	var users []dbmodels.User
+	if err := db.Unscoped().Select("totp_secret").Where("totp_secret != ?", "").Find(&users).Error; err != nil {
+		return 0, 0, err
+	}
+	for _, user := range users {
+		values = append(values, user.TOTPSecret)
+	}
+
+	unencrypted, legacy := 0, 0
+	for _, value := range values {
+		switch {
+		case crypto.IsEncrypted(value):
+		case crypto.IsLegacyEncrypted(value):
+			legacy++
+		default:
+			unencrypted++
+		}
+	}
+	return unencrypted, legacy, nil
+}
@@ -0,0 +1,107 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"moul.io/sshportal/pkg/crypto"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+func TestRotateAESKey(t *testing.T) {
+	Convey("Testing RotateAESKey", t, func(c C) {
+		db := newTestDB(c)
+
+		// the default keys are created unencrypted
+		c.So(db.Create(&dbmodels.Host{Name: "example", URL: "ssh://root@example.org", Password: "secret"}).Error, ShouldBeNil)
+		deleted := dbmodels.Host{Name: "deleted", URL: "ssh://root@example.org", Password: "deleted secret"}
+		c.So(db.Create(&deleted).Error, ShouldBeNil)
+		c.So(db.Delete(&deleted).Error, ShouldBeNil)
+		unencrypted, legacy, err := unencryptedRows(db)
+		c.So(err, ShouldBeNil)
+		c.So(unencrypted, ShouldEqual, 4)
+		c.So(legacy, ShouldEqual, 0)
+
+		oldKey, newKey := "0123456789abcdef", "fedcba9876543210"
+		_, err = RotateAESKey(db, "", oldKey, false)
+		c.So(err, ShouldNotBeNil)
+		updated, err := RotateAESKey(db, "", oldKey, true)
+		c.So(err, ShouldBeNil)
+		c.So(updated, ShouldEqual, 4)
+		unencrypted, _, err = unencryptedRows(db)
+		c.So(err, ShouldBeNil)
+		c.So(unencrypted, ShouldEqual, 0)
+
+		// already encrypted
+		_, err = RotateAESKey(db, "", oldKey, true)
+		c.So(err, ShouldNotBeNil)
+		// wrong key, nothing is updated
+		_, err = RotateAESKey(db, newKey, oldKey, false)
+		c.So(err, ShouldNotBeNil)
+
+		updated, err = RotateAESKey(db, oldKey, newKey, false)
+		c.So(err, ShouldBeNil)
+		c.So(updated, ShouldEqual, 4)
+		host, err := dbmodels.HostByName(db, "example")
+		c.So(err, ShouldBeNil)
+		c.So(crypto.HostDecrypt(oldKey, host), ShouldNotBeNil)
+		c.So(crypto.HostDecrypt(newKey, host), ShouldBeNil)
+		c.So(host.Password, ShouldEqual, "secret")
+		c.So(db.Unscoped().First(&deleted, deleted.ID).Error, ShouldBeNil)
+		c.So(crypto.HostDecrypt(newKey, &deleted), ShouldBeNil)
+		c.So(deleted.Password, ShouldEqual, "deleted secret")
+	})
+}
+
+func TestRotateLegacyAESKey(t *testing.T) {
+	Convey("Testing RotateAESKey with AES-CFB values", t, func(c C) {
+		db := newTestDB(c)
+
+		// the values encrypted by the previous versions
+		oldKey, wrongKey, newKey := "0123456789abcdef", "abcdef0123456789", "fedcba9876543210"
+		var keys []*dbmodels.SSHKey
+		c.So(db.Find(&keys).Error, ShouldBeNil)
+		for _, key := range keys {
+			c.So(db.Model(key).Update("priv_key", encryptCFB(c, oldKey, key.PrivKey)).Error, ShouldBeNil)
+		}
+		c.So(db.Create(&dbmodels.Host{Name: "example", URL: "ssh://root@example.org", Password: encryptCFB(c, oldKey, "legacy secret")}).Error, ShouldBeNil)
+		unencrypted, legacy, err := unencryptedRows(db)
+		c.So(err, ShouldBeNil)
+		c.So(unencrypted, ShouldEqual, 0)
+		c.So(legacy, ShouldEqual, len(keys)+1)
+
+		// the legacy values are not encrypted twice
+		_, err = RotateAESKey(db, "", newKey, true)
+		c.So(err, ShouldNotBeNil)
+		// a wrong key is detected, nothing is updated
+		_, err = RotateAESKey(db, wrongKey, newKey, false)
+		c.So(err, ShouldNotBeNil)
+		_, legacy, err = unencryptedRows(db)
+		c.So(err, ShouldBeNil)
+		c.So(legacy, ShouldEqual, len(keys)+1)
+
+		updated, err := RotateAESKey(db, oldKey, newKey, false)
+		c.So(err, ShouldBeNil)
+		c.So(updated, ShouldEqual, len(keys)+1)
+		host, err := dbmodels.HostByName(db, "example")
+		c.So(err, ShouldBeNil)
+		c.So(crypto.HostDecrypt(newKey, host), ShouldBeNil)
+		c.So(host.Password, ShouldEqual, "legacy secret")
+	})
+}
+
+// encryptCFB encrypts text like the previous versions of sshportal
+func encryptCFB(c C, key, text string) string {
+	block, err := aes.NewCipher([]byte(key))
+	c.So(err, ShouldBeNil)
+	ciphertext := make([]byte, aes.BlockSize+len(text))
+	_, err = io.ReadFull(rand.Reader, ciphertext[:aes.BlockSize])
+	c.So(err, ShouldBeNil)
+	cipher.NewCFBEncrypter(block, ciphertext[:aes.BlockSize]).XORKeyStream(ciphertext[aes.BlockSize:], []byte(text))
+	return base64.URLEncoding.EncodeToString(ciphertext)
+}
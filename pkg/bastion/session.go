@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"time"
@@ -13,17 +14,28 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sabban/bastion/pkg/logchannel"
 	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
 )
 
 type sessionConfig struct {
-	Addr         string
-	LogsLocation string
-	ClientConfig *gossh.ClientConfig
-	LoggingMode  string
+	Addr            string
+	LogsLocation    string
+	ClientConfig    *gossh.ClientConfig
+	LoggingMode     string
+	TransferPolicy  string
+	RecordingFormat string
+	CAKey           *dbmodels.SSHKey
+	AgentForward    bool
+	// PTY and PortForward are permitted by the session certificate of the target
+	PTY         bool
+	PortForward bool
+	// ScheduleEnd closes the session at the end of the schedule of the ACL granting the access
+	ScheduleEnd *time.Time
+	// SourceCIDR is the client range matched by the ACL granting the access
+	SourceCIDR string
 }
 
-func multiChannelHandler(conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context, configs []sessionConfig, sessionID uint) error {
-	var lastClient *gossh.Client
+func multiChannelHandler(conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context, configs []sessionConfig, sessionID uint, kill <-chan string) error {
 	switch newChan.ChannelType() {
 	case "session":
 		lch, lreqs, err := newChan.Accept()
@@ -33,28 +45,17 @@ func multiChannelHandler(conn *gossh.ServerConn, newChan gossh.NewChannel, ctx s
 			return nil
 		}
 
-		// go through all the hops
-		for _, config := range configs {
-			var client *gossh.Client
-			if lastClient == nil {
-				client, err = gossh.Dial("tcp", config.Addr, config.ClientConfig)
-			} else {
-				rconn, err := lastClient.Dial("tcp", config.Addr)
-				if err != nil {
-					return err
-				}
-				ncc, chans, reqs, err := gossh.NewClientConn(rconn, config.Addr, config.ClientConfig)
-				if err != nil {
-					return err
-				}
-				client = gossh.NewClient(ncc, chans, reqs)
-			}
-			if err != nil {
-				lch.Close() // fix #56
-				return err
-			}
-			defer func() { _ = client.Close() }()
-			lastClient = client
+		lastClient, closeHops, err := dialHops(configs)
+		if err != nil {
+			_ = lch.Close() // fix #56
+			return err
+		}
+		defer closeHops()
+
+		actx := ctx.Value(authContextKey).(*authContext)
+		target := configs[len(configs)-1]
+		if target.AgentForward {
+			go forwardAgentChannels(actx, conn, lastClient.HandleChannelOpen(agentChannelType), target.Addr, sessionID)
 		}
 
 		rch, rreqs, err := lastClient.OpenChannel("session", []byte{})
@@ -62,10 +63,11 @@ func multiChannelHandler(conn *gossh.ServerConn, newChan gossh.NewChannel, ctx s
 			return err
 		}
 		user := conn.User()
-		actx := ctx.Value(authContextKey).(*authContext)
 		username := actx.user.Name
+		audit := newTransferAuditor(actx.db, actx.user, sessionID, configs[len(configs)-1].TransferPolicy, lch, rch)
+		defer audit.close()
 		// pipe everything
-		return pipe(lreqs, rreqs, lch, rch, configs[len(configs)-1], user, username, sessionID, newChan)
+		return pipe(lreqs, rreqs, lch, rch, configs[len(configs)-1], user, username, sessionID, newChan, audit, kill)
 	case "direct-tcpip":
 		lch, lreqs, err := newChan.Accept()
 		// TODO: defer clean closer
@@ -74,29 +76,12 @@ func multiChannelHandler(conn *gossh.ServerConn, newChan gossh.NewChannel, ctx s
 			return nil
 		}
 
-		// go through all the hops
-		for _, config := range configs {
-			var client *gossh.Client
-			if lastClient == nil {
-				client, err = gossh.Dial("tcp", config.Addr, config.ClientConfig)
-			} else {
-				rconn, err := lastClient.Dial("tcp", config.Addr)
-				if err != nil {
-					return err
-				}
-				ncc, chans, reqs, err := gossh.NewClientConn(rconn, config.Addr, config.ClientConfig)
-				if err != nil {
-					return err
-				}
-				client = gossh.NewClient(ncc, chans, reqs)
-			}
-			if err != nil {
-				lch.Close()
-				return err
-			}
-			defer func() { _ = client.Close() }()
-			lastClient = client
+		lastClient, closeHops, err := dialHops(configs)
+		if err != nil {
+			_ = lch.Close()
+			return err
 		}
+		defer closeHops()
 
 		d := logTunnelForwardData{}
 		if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
@@ -110,7 +95,7 @@ func multiChannelHandler(conn *gossh.ServerConn, newChan gossh.NewChannel, ctx s
 		actx := ctx.Value(authContextKey).(*authContext)
 		username := actx.user.Name
 		// pipe everything
-		return pipe(lreqs, rreqs, lch, rch, configs[len(configs)-1], user, username, sessionID, newChan)
+		return pipe(lreqs, rreqs, lch, rch, configs[len(configs)-1], user, username, sessionID, newChan, nil, kill)
 	default:
 		if err := newChan.Reject(gossh.UnknownChannelType, "unsupported channel type"); err != nil {
 			log.Printf("failed to reject chan: %v", err)
@@ -119,7 +104,50 @@ func multiChannelHandler(conn *gossh.ServerConn, newChan gossh.NewChannel, ctx s
 	}
 }
 
-func pipe(lreqs, rreqs <-chan *gossh.Request, lch, rch gossh.Channel, sessConfig sessionConfig, user string, username string, sessionID uint, newChan gossh.NewChannel) error {
+// dialHops connects to the last config through the previous ones, closeHops
+// closes all the opened clients
+func dialHops(configs []sessionConfig) (lastClient *gossh.Client, closeHops func(), err error) {
+	clients := make([]*gossh.Client, 0, len(configs))
+	closeHops = func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			_ = clients[i].Close()
+		}
+	}
+	for _, config := range configs {
+		var client *gossh.Client
+		start := time.Now()
+		if lastClient == nil {
+			client, err = gossh.Dial("tcp", config.Addr, config.ClientConfig)
+		} else {
+			var rconn net.Conn
+			rconn, err = lastClient.Dial("tcp", config.Addr)
+			if err == nil {
+				var (
+					ncc   gossh.Conn
+					chans <-chan gossh.NewChannel
+					reqs  <-chan *gossh.Request
+				)
+				ncc, chans, reqs, err = gossh.NewClientConn(rconn, config.Addr, config.ClientConfig)
+				if err != nil {
+					_ = rconn.Close()
+				} else {
+					client = gossh.NewClient(ncc, chans, reqs)
+				}
+			}
+		}
+		if err != nil {
+			upstreamDialErrors.With(config.Addr).Inc()
+			closeHops()
+			return nil, nil, err
+		}
+		observeSince(upstreamDialDuration.With(config.Addr), start)
+		clients = append(clients, client)
+		lastClient = client
+	}
+	return lastClient, closeHops, nil
+}
+
+func pipe(lreqs, rreqs <-chan *gossh.Request, lch, rch gossh.Channel, sessConfig sessionConfig, user string, username string, sessionID uint, newChan gossh.NewChannel, audit *transferAuditor, kill <-chan string) error {
 	defer func() {
 		_ = lch.Close()
 		_ = rch.Close()
@@ -129,9 +157,17 @@ func pipe(lreqs, rreqs <-chan *gossh.Request, lch, rch gossh.Channel, sessConfig
 	quit := make(chan string, 1)
 	channeltype := newChan.ChannelType()
 
+	// the copies read from lreader and rreader to count the proxied bytes
+	lreader := newCountingReader(lch, channeltype, "upstream")
+	rreader := newCountingReader(rch, channeltype, "downstream")
+
+	asciicast := channeltype == "session" && sessConfig.RecordingFormat == string(dbmodels.RecordingFormatAsciicast)
 	var logWriter io.WriteCloser = newDiscardWriteCloser()
 	if sessConfig.LoggingMode != "disabled" {
 		filename := filepath.Join(sessConfig.LogsLocation, fmt.Sprintf("%s-%s-%s-%d-%s", user, username, channeltype, sessionID, time.Now().Format(time.RFC3339)))
+		if asciicast {
+			filename += asciicastExtension
+		}
 		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0440)
 		if err != nil {
 			return errors.Wrap(err, "open log file")
@@ -143,26 +179,38 @@ func pipe(lreqs, rreqs <-chan *gossh.Request, lch, rch gossh.Channel, sessConfig
 		logWriter = f
 	}
 
-	if channeltype == "session" {
+	var cast *asciicastRecorder
+	if asciicast {
+		cast = newAsciicastRecorder(logWriter, sessConfig.LoggingMode)
+		defer cast.close()
+		go func(quit chan string) {
+			_, _ = io.Copy(audit.downstream(cast.output(lch)), rreader)
+			quit <- "rch"
+		}(quit)
+		go func(quit chan string) {
+			_, _ = io.Copy(audit.upstream(cast.input(rch)), lreader)
+			quit <- "lch"
+		}(quit)
+	} else if channeltype == "session" {
 		switch sessConfig.LoggingMode {
 		case "input":
 			wrappedrch := logchannel.New(rch, logWriter)
 			go func(quit chan string) {
-				_, _ = io.Copy(lch, rch)
+				_, _ = io.Copy(audit.downstream(lch), rreader)
 				quit <- "rch"
 			}(quit)
 			go func(quit chan string) {
-				_, _ = io.Copy(wrappedrch, lch)
+				_, _ = io.Copy(audit.upstream(wrappedrch), lreader)
 				quit <- "lch"
 			}(quit)
 		default: // everything, disabled
 			wrappedlch := logchannel.New(lch, logWriter)
 			go func(quit chan string) {
-				_, _ = io.Copy(wrappedlch, rch)
+				_, _ = io.Copy(audit.downstream(wrappedlch), rreader)
 				quit <- "rch"
 			}(quit)
 			go func(quit chan string) {
-				_, _ = io.Copy(rch, lch)
+				_, _ = io.Copy(audit.upstream(rch), lreader)
 				quit <- "lch"
 			}(quit)
 		}
@@ -172,23 +220,48 @@ func pipe(lreqs, rreqs <-chan *gossh.Request, lch, rch gossh.Channel, sessConfig
 		if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
 			return err
 		}
-		wrappedlch := newLogTunnel(lch, logWriter, d.SourceHost)
-		wrappedrch := newLogTunnel(rch, logWriter, d.DestinationHost)
+		tunnelWriter := newSyncWriteCloser(logWriter)
+		wrappedlch := newLogTunnel(lch, tunnelWriter, d.SourceHost)
+		wrappedrch := newLogTunnel(rch, tunnelWriter, d.DestinationHost)
 		go func(quit chan string) {
-			_, _ = io.Copy(wrappedlch, rch)
+			_, _ = io.Copy(wrappedlch, rreader)
 			quit <- "rch"
 		}(quit)
 
 		go func(quit chan string) {
-			_, _ = io.Copy(wrappedrch, lch)
+			_, _ = io.Copy(wrappedrch, lreader)
 			quit <- "lch"
 		}(quit)
 	}
 
 	go func(quit chan string) {
 		for req := range lreqs {
+			if req.Type == agentRequestType && !sessConfig.AgentForward {
+				log.Printf("Agent forwarding denied: session=%d", sessionID)
+				if err := req.Reply(false, nil); err != nil {
+					errch <- err
+				}
+				continue
+			}
+			if audit != nil {
+				if err := audit.checkRequest(req); err != nil {
+					fmt.Fprintf(lch.Stderr(), "error: %v\r\n", err)
+					if err2 := req.Reply(false, nil); err2 != nil {
+						errch <- err2
+					}
+					continue
+				}
+			}
+			if cast != nil {
+				cast.request(req)
+			}
 			b, err := rch.SendRequest(req.Type, req.WantReply, req.Payload)
-			if req.Type == "exec" {
+			if req.Type == "exec" && cast != nil {
+				var exec struct{ Command string }
+				if err := gossh.Unmarshal(req.Payload, &exec); err == nil {
+					cast.exec([]byte(exec.Command))
+				}
+			} else if req.Type == "exec" {
 				wrappedlch := logchannel.New(lch, logWriter)
 				req.Payload = append(req.Payload, []byte("\n")...)
 				if _, err := wrappedlch.LogWrite(req.Payload); err != nil {
@@ -224,6 +297,9 @@ func pipe(lreqs, rreqs <-chan *gossh.Request, lch, rch gossh.Channel, sessConfig
 		select {
 		case err := <-errch:
 			return err
+		case reason := <-kill:
+			fmt.Fprintf(lch.Stderr(), "\r\nsession %s\r\n", reason)
+			return errors.New(reason)
 		case q := <-quit:
 			switch q {
 			case "lch":
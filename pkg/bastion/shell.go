@@ -6,10 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"os"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,6 +25,7 @@ import (
 	"github.com/urfave/cli"
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal" // nolint:staticcheck
+	"gorm.io/gorm"
 	"moul.io/sshportal/pkg/crypto"
 	"moul.io/sshportal/pkg/dbmodels"
 	"moul.io/sshportal/pkg/utils"
@@ -47,7 +50,10 @@ func shell(s ssh.Session, version, gitSha, gitTag string) error {
 	var (
 		sshCommand = s.Command()
 		actx       = s.Context().Value(authContextKey).(*authContext)
+		input      = &shellInput{Session: s}
 	)
+	// every read goes through input, so session replay can watch the keys
+	s = input
 	if len(sshCommand) == 0 {
 		if _, err := fmt.Fprint(s, banner); err != nil {
 			return err
@@ -84,19 +90,26 @@ GLOBAL OPTIONS:
 				{
 					Name:        "create",
 					Usage:       "Creates a new ACL",
-					Description: "$> acl create -",
+					Description: "$> acl create --usergroup=default --hostgroup=default\n   $> acl create --usergroup=dba --pattern='glob:prod-db-*'\n   $> acl create --usergroup=data --selector='env=prod,team=data'\n   $> acl create --usergroup=contractors --hostgroup=prod --schedule='Mon-Fri 08:00-19:00 Europe/Paris' --schedule-terminate",
 					Flags: []cli.Flag{
 						cli.StringSliceFlag{Name: "hostgroup, hg", Usage: "Assigns `HOSTGROUPS` to the acl"},
 						cli.StringSliceFlag{Name: "usergroup, ug", Usage: "Assigns `USERGROUP` to the acl"},
-						cli.StringFlag{Name: "pattern", Usage: "Assigns a host pattern to the acl"},
+						cli.StringFlag{Name: "pattern", Usage: "Assigns a host `PATTERN` to the acl (glob:<pattern> or regex:<pattern>)"},
+						cli.StringFlag{Name: "selector", Usage: "Assigns a host label `SELECTOR` to the acl (i.e., 'env=prod,team!=data')"},
 						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
 						cli.StringFlag{Name: "action", Usage: "Assigns the ACL action (allow,deny)", Value: string(dbmodels.ACLActionAllow)},
 						cli.UintFlag{Name: "weight, w", Usage: "Assigns the ACL weight (priority)"},
 						cli.StringFlag{Name: "inception, i", Usage: "Assigns inception date-time"},
 						cli.StringFlag{Name: "expiration, e", Usage: "Assigns expiration date-time"},
+						cli.StringFlag{Name: "schedule", Usage: "Restricts the ACL to a recurring `SCHEDULE` (i.e., 'Mon-Fri 08:00-19:00 Europe/Paris')"},
+						cli.BoolFlag{Name: "schedule-terminate", Usage: "Closes the sessions granted by the ACL at the end of the schedule"},
+						cli.StringSliceFlag{Name: "source", Usage: "Restricts the ACL to the clients connecting from `CIDRS`"},
+						cli.StringSliceFlag{Name: "deny-source", Usage: "Excludes the clients connecting from `CIDRS` from the ACL"},
+						cli.BoolFlag{Name: "remote-forward", Usage: "Allows remote port forwarding (ssh -R)"},
+						cli.BoolFlag{Name: "agent-forward", Usage: "Allows agent forwarding (ssh -A)"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("acl:write"); err != nil {
 							return err
 						}
 
@@ -108,16 +121,42 @@ GLOBAL OPTIONS:
 						if err != nil {
 							return err
 						}
+						if schedule := c.String("schedule"); schedule != "" {
+							if _, err := dbmodels.ParseSchedule(schedule); err != nil {
+								return err
+							}
+						}
+						if selector := c.String("selector"); selector != "" {
+							if _, err := dbmodels.ParseSelector(selector); err != nil {
+								return err
+							}
+						}
+						sources, deniedSources := strings.Join(c.StringSlice("source"), ","), strings.Join(c.StringSlice("deny-source"), ",")
+						for _, list := range []string{sources, deniedSources} {
+							if list == "" {
+								continue
+							}
+							if _, err := dbmodels.ParseCIDRList(list); err != nil {
+								return err
+							}
+						}
 
 						acl := dbmodels.ACL{
-							Comment:     c.String("comment"),
-							HostPattern: c.String("pattern"),
-							UserGroups:  []*dbmodels.UserGroup{},
-							HostGroups:  []*dbmodels.HostGroup{},
-							Weight:      c.Uint("weight"),
-							Inception:   inception,
-							Expiration:  expiration,
-							Action:      c.String("action"),
+							Comment:            c.String("comment"),
+							HostPattern:        c.String("pattern"),
+							HostSelector:       c.String("selector"),
+							UserGroups:         []*dbmodels.UserGroup{},
+							HostGroups:         []*dbmodels.HostGroup{},
+							Weight:             c.Uint("weight"),
+							Inception:          inception,
+							Expiration:         expiration,
+							Schedule:           c.String("schedule"),
+							ScheduleTerminate:  c.Bool("schedule-terminate"),
+							SourceCIDRs:        sources,
+							DeniedSourceCIDRs:  deniedSources,
+							Action:             c.String("action"),
+							AllowRemoteForward: c.Bool("remote-forward"),
+							AllowAgentForward:  c.Bool("agent-forward"),
 						}
 						if acl.Action != string(dbmodels.ACLActionAllow) && acl.Action != string(dbmodels.ACLActionDeny) {
 							return fmt.Errorf("invalid action %q, allowed values: allow, deny", acl.Action)
@@ -140,8 +179,8 @@ GLOBAL OPTIONS:
 						if len(acl.UserGroups) == 0 {
 							return fmt.Errorf("an ACL must have at least one user group")
 						}
-						if len(acl.HostGroups) == 0 && acl.HostPattern == "" {
-							return fmt.Errorf("an ACL must have at least one host group or host pattern")
+						if len(acl.HostGroups) == 0 && acl.HostPattern == "" && acl.HostSelector == "" {
+							return fmt.Errorf("an ACL must have at least one host group, host pattern or host selector")
 						}
 
 						if err := db.Create(&acl).Error; err != nil {
@@ -150,6 +189,150 @@ GLOBAL OPTIONS:
 						fmt.Fprintf(s, "%d\n", acl.ID)
 						return nil
 					},
+				}, {
+					Name:        "explain",
+					Usage:       "Explains the ACL decision for a user connecting to a host",
+					Description: "$> acl explain --user=alice --host=prod-db-1\n   $> acl explain --user=alice --host=prod-db-1 --at='2021-03-01 22:00' --from=10.8.1.2",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "user, u", Usage: "Simulates the connection of `USER`"},
+						cli.StringFlag{Name: "host", Usage: "Simulates the connection to `HOST`"},
+						cli.StringFlag{Name: "at", Usage: "Simulates the connection at a date-time instead of now"},
+						cli.StringFlag{Name: "from", Usage: "Simulates the connection from the client `IP`"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("user") == "" || c.String("host") == "" {
+							return cli.ShowSubcommandHelp(c)
+						}
+						if err := myself.CheckPermission("acl:read"); err != nil {
+							return err
+						}
+
+						at := time.Now()
+						if input := c.String("at"); input != "" {
+							parsed, err := parseOptionalTime(input)
+							if err != nil {
+								return err
+							}
+							at = *parsed
+						}
+						var source net.IP
+						if input := c.String("from"); input != "" {
+							if source = net.ParseIP(input); source == nil {
+								return fmt.Errorf("invalid client IP %q", input)
+							}
+						}
+
+						var users []dbmodels.User
+						if err := dbmodels.UsersByIdentifiers(db.Preload("Groups"), []string{c.String("user")}).Find(&users).Error; err != nil {
+							return err
+						}
+						if len(users) == 0 {
+							return fmt.Errorf("user %q not found", c.String("user"))
+						}
+						user := users[0]
+						var hosts []dbmodels.Host
+						if err := dbmodels.HostsByIdentifiers(db.Preload("Groups"), []string{c.String("host")}).Find(&hosts).Error; err != nil {
+							return err
+						}
+						if len(hosts) == 0 {
+							return fmt.Errorf("host %q not found", c.String("host"))
+						}
+						if err := expandACLSubjects(db, &user, &hosts[0]); err != nil {
+							return err
+						}
+
+						userGroups := []string{}
+						for _, group := range user.Groups {
+							userGroups = append(userGroups, group.Name)
+						}
+						fmt.Fprintf(s, "User:   %s (groups: %s)\n", user.Name, strings.Join(userGroups, ", "))
+						fmt.Fprintf(s, "Time:   %s\n", at.Format("2006-01-02 15:04 MST"))
+						if source != nil {
+							fmt.Fprintf(s, "Source: %s\n", source)
+						} else {
+							fmt.Fprintf(s, "Source: unknown, use --from to check the ACLs restricted to source ranges\n")
+						}
+
+						// the hops are checked like the target host, the
+						// connection is allowed if every host of the chain is
+						overall := string(dbmodels.ACLActionAllow)
+						seen := map[uint]bool{}
+						for host := &hosts[0]; host != nil; {
+							if seen[host.ID] {
+								fmt.Fprintf(s, "\nHost: %s is already in the chain of hops, the loop denies the connection\n", host.Name)
+								overall = string(dbmodels.ACLActionDeny)
+								break
+							}
+							seen[host.ID] = true
+							hostGroups := []string{}
+							for _, group := range host.Groups {
+								hostGroups = append(hostGroups, group.Name)
+							}
+							fmt.Fprintf(s, "\nHost: %s (groups: %s)\n", host.Name, strings.Join(hostGroups, ", "))
+							table := tablewriter.NewWriter(s)
+							table.SetHeader([]string{"ACL", "Weight", "Action", "Result", "Reason"})
+							table.SetBorder(false)
+							table.SetAutoWrapText(false)
+							var winner *dbmodels.ACL
+							for _, evaluation := range evaluateACLs(user, *host, source, at) {
+								result := "skipped"
+								if evaluation.matched {
+									result = "matched"
+									if winner == nil {
+										result = "matched, wins"
+										winner = evaluation.acl
+									}
+								}
+								reason := evaluation.reason
+								if evaluation.err != nil {
+									reason = fmt.Sprintf("%s: %v", reason, evaluation.err)
+								}
+								table.Append([]string{
+									fmt.Sprintf("%d", evaluation.acl.ID),
+									fmt.Sprintf("%d", evaluation.acl.Weight),
+									evaluation.acl.Action,
+									result,
+									reason,
+								})
+							}
+							table.Render()
+							action := string(dbmodels.ACLActionDeny)
+							if winner != nil {
+								action = winner.Action
+								fmt.Fprintf(s, "Winning ACL:   %d (weight %d, %s)\n", winner.ID, winner.Weight, winner.Action)
+							} else {
+								fmt.Fprintf(s, "Winning ACL:   none, defaults to deny\n")
+							}
+
+							hookAction, err := checkACLsHook(actx.aclCheckCmd, action, user, *host)
+							switch {
+							case actx.aclCheckCmd == "":
+								fmt.Fprintf(s, "acl-check-cmd: not configured\n")
+							case err != nil:
+								fmt.Fprintf(s, "acl-check-cmd: failed (%v), keeps %s\n", err, action)
+							default:
+								fmt.Fprintf(s, "acl-check-cmd: returned %s\n", hookAction)
+							}
+							fmt.Fprintf(s, "Decision:      %s\n", hookAction)
+							if hookAction != string(dbmodels.ACLActionAllow) {
+								overall = string(dbmodels.ACLActionDeny)
+							}
+
+							if host.HopID == 0 {
+								break
+							}
+							var hop dbmodels.Host
+							if err := db.Preload("Groups").Where("id = ?", host.HopID).First(&hop).Error; err != nil {
+								return err
+							}
+							if hop.Groups, err = dbmodels.HostGroupsWithParents(db, hop.Groups); err != nil {
+								return err
+							}
+							host = &hop
+						}
+						fmt.Fprintf(s, "\nOverall decision: %s\n", overall)
+						return nil
+					},
 				}, {
 					Name:      "inspect",
 					Usage:     "Shows detailed information on one or more ACLs",
@@ -158,7 +341,7 @@ GLOBAL OPTIONS:
 						if c.NArg() < 1 {
 							return cli.ShowSubcommandHelp(c)
 						}
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("acl:read"); err != nil {
 							return err
 						}
 
@@ -179,7 +362,7 @@ GLOBAL OPTIONS:
 						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("acl:read"); err != nil {
 							return err
 						}
 
@@ -202,7 +385,7 @@ GLOBAL OPTIONS:
 						}
 
 						table := tablewriter.NewWriter(s)
-						table.SetHeader([]string{"ID", "Weight", "User groups", "Host groups", "Host pattern", "Action", "Inception", "Expiration", "Updated", "Created", "Comment"})
+						table.SetHeader([]string{"ID", "Weight", "User groups", "Host groups", "Host pattern", "Host selector", "Action", "Inception", "Expiration", "Schedule", "Sources", "Updated", "Created", "Comment"})
 						table.SetBorder(false)
 						table.SetCaption(true, fmt.Sprintf("Total: %d ACLs.", len(acls)))
 						for _, acl := range acls {
@@ -223,6 +406,15 @@ GLOBAL OPTIONS:
 							if acl.Expiration != nil {
 								expiration = acl.Expiration.Format("2006-01-02 15:04 MST")
 							}
+							sources := []string{}
+							if acl.SourceCIDRs != "" {
+								sources = append(sources, strings.Split(acl.SourceCIDRs, ",")...)
+							}
+							if acl.DeniedSourceCIDRs != "" {
+								for _, cidr := range strings.Split(acl.DeniedSourceCIDRs, ",") {
+									sources = append(sources, "!"+cidr)
+								}
+							}
 
 							table.Append([]string{
 								fmt.Sprintf("%d", acl.ID),
@@ -230,9 +422,12 @@ GLOBAL OPTIONS:
 								strings.Join(userGroups, ", "),
 								strings.Join(hostGroups, ", "),
 								acl.HostPattern,
+								acl.HostSelector,
 								acl.Action,
 								inception,
 								expiration,
+								acl.Schedule,
+								strings.Join(sources, ", "),
 								humanize.Time(acl.UpdatedAt),
 								humanize.Time(acl.CreatedAt),
 								acl.Comment,
@@ -249,7 +444,7 @@ GLOBAL OPTIONS:
 						if c.NArg() < 1 {
 							return cli.ShowSubcommandHelp(c)
 						}
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("acl:write"); err != nil {
 							return err
 						}
 
@@ -261,13 +456,27 @@ GLOBAL OPTIONS:
 					ArgsUsage: "ACL...",
 					Flags: []cli.Flag{
 						cli.StringFlag{Name: "action, a", Usage: "Update action"},
-						cli.StringFlag{Name: "pattern, p", Usage: "Update host-pattern"},
+						cli.StringFlag{Name: "pattern, p", Usage: "Update host-pattern (glob:<pattern> or regex:<pattern>)"},
+						cli.StringFlag{Name: "selector", Usage: "Update the host label `SELECTOR` (i.e., 'env=prod,team!=data')"},
+						cli.BoolFlag{Name: "unset-selector", Usage: "Unset host selector"},
 						cli.UintFlag{Name: "weight, w", Usage: "Update weight"},
 						cli.StringFlag{Name: "inception, i", Usage: "Update inception date-time"},
 						cli.BoolFlag{Name: "unset-inception", Usage: "Unset inception date-time"},
 						cli.BoolFlag{Name: "unset-expiration", Usage: "Unset expiration date-time"},
 						cli.StringFlag{Name: "expiration, e", Usage: "Update expiration date-time"},
+						cli.StringFlag{Name: "schedule", Usage: "Update the recurring `SCHEDULE` (i.e., 'Mon-Fri 08:00-19:00 Europe/Paris')"},
+						cli.BoolFlag{Name: "unset-schedule", Usage: "Unset schedule"},
+						cli.BoolFlag{Name: "schedule-terminate", Usage: "Close the sessions at the end of the schedule"},
+						cli.BoolFlag{Name: "no-schedule-terminate", Usage: "Let the sessions run after the end of the schedule"},
+						cli.StringSliceFlag{Name: "source", Usage: "Replace the allowed client `CIDRS`"},
+						cli.BoolFlag{Name: "unset-source", Usage: "Allow the clients from any address"},
+						cli.StringSliceFlag{Name: "deny-source", Usage: "Replace the denied client `CIDRS`"},
+						cli.BoolFlag{Name: "unset-deny-source", Usage: "Deny no client address"},
 						cli.StringFlag{Name: "comment, c", Usage: "Update comment"},
+						cli.BoolFlag{Name: "remote-forward", Usage: "Allow remote port forwarding (ssh -R)"},
+						cli.BoolFlag{Name: "no-remote-forward", Usage: "Deny remote port forwarding"},
+						cli.BoolFlag{Name: "agent-forward", Usage: "Allow agent forwarding (ssh -A)"},
+						cli.BoolFlag{Name: "no-agent-forward", Usage: "Deny agent forwarding"},
 						cli.StringSliceFlag{Name: "assign-usergroup, ug", Usage: "Assign the ACL to new `USERGROUPS`"},
 						cli.StringSliceFlag{Name: "unassign-usergroup", Usage: "Unassign the ACL from `USERGROUPS`"},
 						cli.StringSliceFlag{Name: "assign-hostgroup, hg", Usage: "Assign the ACL to new `HOSTGROUPS`"},
@@ -277,10 +486,35 @@ GLOBAL OPTIONS:
 						if c.NArg() < 1 {
 							return cli.ShowSubcommandHelp(c)
 						}
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("acl:write"); err != nil {
 							return err
 						}
 
+						if pattern := c.String("pattern"); pattern != "" {
+							if _, err := dbmodels.HostPatternMatcher(pattern); err != nil {
+								return err
+							}
+						}
+						if schedule := c.String("schedule"); schedule != "" {
+							if _, err := dbmodels.ParseSchedule(schedule); err != nil {
+								return err
+							}
+						}
+						if selector := c.String("selector"); selector != "" {
+							if _, err := dbmodels.ParseSelector(selector); err != nil {
+								return err
+							}
+						}
+						sources, deniedSources := strings.Join(c.StringSlice("source"), ","), strings.Join(c.StringSlice("deny-source"), ",")
+						for _, list := range []string{sources, deniedSources} {
+							if list == "" {
+								continue
+							}
+							if _, err := dbmodels.ParseCIDRList(list); err != nil {
+								return err
+							}
+						}
+
 						var acls []*dbmodels.ACL
 						if err := dbmodels.ACLsByIdentifiers(db, c.Args()).Find(&acls).Error; err != nil {
 							return err
@@ -299,12 +533,16 @@ GLOBAL OPTIONS:
 							}
 
 							update := dbmodels.ACL{
-								Action:      c.String("action"),
-								HostPattern: c.String("pattern"),
-								Weight:      c.Uint("weight"),
-								Inception:   inception,
-								Expiration:  expiration,
-								Comment:     c.String("comment"),
+								Action:            c.String("action"),
+								HostPattern:       c.String("pattern"),
+								HostSelector:      c.String("selector"),
+								Weight:            c.Uint("weight"),
+								Inception:         inception,
+								Expiration:        expiration,
+								Schedule:          c.String("schedule"),
+								SourceCIDRs:       sources,
+								DeniedSourceCIDRs: deniedSources,
+								Comment:           c.String("comment"),
 							}
 							if err := model.Updates(update).Error; err != nil {
 								tx.Rollback()
@@ -323,6 +561,48 @@ GLOBAL OPTIONS:
 									return err
 								}
 							}
+							if c.Bool("unset-selector") {
+								if err := model.Update("host_selector", "").Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if c.Bool("unset-schedule") {
+								if err := model.Update("schedule", "").Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if c.Bool("unset-source") {
+								if err := model.Update("source_cidrs", "").Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if c.Bool("unset-deny-source") {
+								if err := model.Update("denied_source_cidrs", "").Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if c.Bool("schedule-terminate") || c.Bool("no-schedule-terminate") {
+								if err := model.Update("schedule_terminate", c.Bool("schedule-terminate")).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if c.Bool("remote-forward") || c.Bool("no-remote-forward") {
+								if err := model.Update("allow_remote_forward", c.Bool("remote-forward")).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if c.Bool("agent-forward") || c.Bool("no-agent-forward") {
+								if err := model.Update("allow_agent_forward", c.Bool("agent-forward")).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
 
 							// associations
 							var appendUserGroups []dbmodels.UserGroup
@@ -372,6 +652,130 @@ GLOBAL OPTIONS:
 					},
 				},
 			},
+		}, {
+			Name:  "apitoken",
+			Usage: "Manages REST API tokens",
+			Subcommands: []cli.Command{
+				{
+					Name:        "create",
+					Usage:       "Creates a new API token",
+					Description: "$> apitoken create --name=ci\n   $> apitoken create --name=inventory --user=bob",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "name, n", Usage: "Assigns a name to the token"},
+						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+						cli.StringFlag{Name: "user, u", Usage: "`USER` on behalf of whom the requests are made (default: yourself)"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := myself.CheckPermission("apitoken:write"); err != nil {
+							return err
+						}
+
+						user := *myself
+						if c.String("user") != "" {
+							var other dbmodels.User
+							if err := dbmodels.UsersByIdentifiers(db.Preload("Roles"), []string{c.String("user")}).First(&other).Error; err != nil {
+								return err
+							}
+							// the token acts with the permissions of its user
+							for _, role := range other.Roles {
+								if err := myself.CheckGrant(role.Permissions); err != nil {
+									return err
+								}
+							}
+							user = other
+						}
+
+						token, hash, err := crypto.NewAPIToken()
+						if err != nil {
+							return err
+						}
+						apiToken := dbmodels.APIToken{
+							Name:    c.String("name"),
+							Hash:    hash,
+							UserID:  user.ID,
+							Comment: c.String("comment"),
+						}
+						if apiToken.Name == "" {
+							apiToken.Name = namesgenerator.GetRandomName(0)
+						}
+						if _, err := govalidator.ValidateStruct(apiToken); err != nil {
+							return err
+						}
+
+						if err := db.Create(&apiToken).Error; err != nil {
+							return err
+						}
+						fmt.Fprintf(s, "Token %d created for %s, it won't be displayed again:\n%s\n", apiToken.ID, user.Name, token)
+						return nil
+					},
+				}, {
+					Name:  "ls",
+					Usage: "Lists API tokens",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "latest, l", Usage: "Show the latest API token"},
+						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := myself.CheckPermission("apitoken:read"); err != nil {
+							return err
+						}
+
+						var apiTokens []*dbmodels.APIToken
+						query := dbmodels.APITokensPreload(db.Order("created_at desc"))
+						if c.Bool("latest") {
+							var apiToken dbmodels.APIToken
+							if err := query.First(&apiToken).Error; err != nil {
+								return err
+							}
+							apiTokens = append(apiTokens, &apiToken)
+						} else if err := query.Find(&apiTokens).Error; err != nil {
+							return err
+						}
+						if c.Bool("quiet") {
+							for _, apiToken := range apiTokens {
+								fmt.Fprintln(s, apiToken.ID)
+							}
+							return nil
+						}
+
+						table := tablewriter.NewWriter(s)
+						table.SetHeader([]string{"ID", "Name", "User", "Updated", "Created", "Comment"})
+						table.SetBorder(false)
+						table.SetCaption(true, fmt.Sprintf("Total: %d API tokens.", len(apiTokens)))
+						for _, apiToken := range apiTokens {
+							name := naMessage
+							if apiToken.User != nil {
+								name = apiToken.User.Name
+							}
+							table.Append([]string{
+								fmt.Sprintf("%d", apiToken.ID),
+								apiToken.Name,
+								name,
+								humanize.Time(apiToken.UpdatedAt),
+								humanize.Time(apiToken.CreatedAt),
+								apiToken.Comment,
+							})
+						}
+						table.Render()
+						return nil
+					},
+				}, {
+					Name:      "rm",
+					Usage:     "Revokes one or more API tokens",
+					ArgsUsage: "APITOKEN...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("apitoken:write"); err != nil {
+							return err
+						}
+
+						return dbmodels.APITokensByIdentifiers(db, c.Args()).Unscoped().Delete(&dbmodels.APIToken{}).Error
+					},
+				},
+			},
 		}, {
 			Name:  "config",
 			Usage: "Manages global configuration",
@@ -386,7 +790,7 @@ GLOBAL OPTIONS:
 					},
 					Description: "ssh admin@portal config backup > sshportal.bkp",
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("config:backup"); err != nil {
 							return err
 						}
 
@@ -399,7 +803,9 @@ GLOBAL OPTIONS:
 							return err
 						}
 						for _, key := range config.SSHKeys {
-							crypto.SSHKeyDecrypt(actx.aesKey, key)
+							if err := crypto.SSHKeyDecrypt(actx.aesKey, key); err != nil {
+								return err
+							}
 						}
 						if !c.Bool("decrypt") {
 							for _, key := range config.SSHKeys {
@@ -413,7 +819,9 @@ GLOBAL OPTIONS:
 							return err
 						}
 						for _, host := range config.Hosts {
-							crypto.HostDecrypt(actx.aesKey, host)
+							if err := crypto.HostDecrypt(actx.aesKey, host); err != nil {
+								return err
+							}
 						}
 						if !c.Bool("decrypt") {
 							for _, host := range config.Hosts {
@@ -429,6 +837,15 @@ GLOBAL OPTIONS:
 						if err := dbmodels.UsersPreload(db).Find(&config.Users).Error; err != nil {
 							return err
 						}
+						for _, user := range config.Users {
+							if user.Has2FA() {
+								config.UserSecrets = append(config.UserSecrets, &dbmodels.UserSecret{
+									UserID:        user.ID,
+									TOTPSecret:    user.TOTPSecret,
+									RecoveryCodes: user.RecoveryCodes,
+								})
+							}
+						}
 						if err := dbmodels.UserGroupsPreload(db).Find(&config.UserGroups).Error; err != nil {
 							return err
 						}
@@ -444,6 +861,9 @@ GLOBAL OPTIONS:
 						if err := dbmodels.SessionsPreload(db).Find(&config.Sessions).Error; err != nil {
 							return err
 						}
+						if err := dbmodels.UserCAsPreload(db).Find(&config.UserCAs).Error; err != nil {
+							return err
+						}
 						if !c.Bool("ignore-events") {
 							if err := dbmodels.EventsPreload(db).Find(&config.Events).Error; err != nil {
 								return err
@@ -465,7 +885,7 @@ GLOBAL OPTIONS:
 						cli.BoolFlag{Name: "decrypt", Usage: "do not encrypt sensitive data"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("config:restore"); err != nil {
 							return err
 						}
 
@@ -486,6 +906,8 @@ GLOBAL OPTIONS:
 						fmt.Fprintf(s, "* %d Users\n", len(config.Users))
 						fmt.Fprintf(s, "* %d Settings\n", len(config.Settings))
 						fmt.Fprintf(s, "* %d Sessions\n", len(config.Sessions))
+						fmt.Fprintf(s, "* %d UserCAs\n", len(config.UserCAs))
+						fmt.Fprintf(s, "* %d UserSecrets\n", len(config.UserSecrets))
 						fmt.Fprintf(s, "* %d Events\n", len(config.Events))
 
 						if !c.Bool("confirm") {
@@ -515,6 +937,8 @@ GLOBAL OPTIONS:
 							"sessions",
 							"settings",
 							"ssh_keys",
+							"user_cas",
+							"user_cert_revocations",
 							"user_group_acls",
 							"user_groups",
 							"user_keys",
@@ -533,7 +957,12 @@ GLOBAL OPTIONS:
 						}
 						for _, host := range config.Hosts {
 							host := host
-							crypto.HostDecrypt(actx.aesKey, host)
+							if err := crypto.HostDecrypt(actx.aesKey, host); err != nil {
+								tx.Rollback()
+								return err
+							}
+							// backups of previous versions can have passwords in the URLs
+							host.ExtractURLPassword()
 							if !c.Bool("decrypt") {
 								if err := crypto.HostEncrypt(actx.aesKey, host); err != nil {
 									return err
@@ -546,11 +975,40 @@ GLOBAL OPTIONS:
 						}
 						for _, user := range config.Users {
 							user := user
+							if err := crypto.UserDecrypt(actx.aesKey, user); err != nil {
+								tx.Rollback()
+								return err
+							}
+							if !c.Bool("decrypt") {
+								if err := crypto.UserEncrypt(actx.aesKey, user); err != nil {
+									return err
+								}
+							}
 							if err := tx.FirstOrCreate(&user).Error; err != nil {
 								tx.Rollback()
 								return err
 							}
 						}
+						for _, secret := range config.UserSecrets {
+							user := dbmodels.User{TOTPSecret: secret.TOTPSecret}
+							if err := crypto.UserDecrypt(actx.aesKey, &user); err != nil {
+								tx.Rollback()
+								return err
+							}
+							if !c.Bool("decrypt") {
+								if err := crypto.UserEncrypt(actx.aesKey, &user); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if err := tx.Model(&dbmodels.User{}).Where("id = ?", secret.UserID).Updates(map[string]interface{}{
+								"totp_secret":    user.TOTPSecret,
+								"recovery_codes": secret.RecoveryCodes,
+							}).Error; err != nil {
+								tx.Rollback()
+								return err
+							}
+						}
 						for _, acl := range config.ACLs {
 							acl := acl
 							if err := tx.FirstOrCreate(&acl).Error; err != nil {
@@ -574,7 +1032,10 @@ GLOBAL OPTIONS:
 						}
 						for _, sshKey := range config.SSHKeys {
 							sshKey := sshKey
-							crypto.SSHKeyDecrypt(actx.aesKey, sshKey)
+							if err := crypto.SSHKeyDecrypt(actx.aesKey, sshKey); err != nil {
+								tx.Rollback()
+								return err
+							}
 							if !c.Bool("decrypt") {
 								if err := crypto.SSHKeyEncrypt(actx.aesKey, sshKey); err != nil {
 									return err
@@ -606,6 +1067,13 @@ GLOBAL OPTIONS:
 								return err
 							}
 						}
+						for _, userCA := range config.UserCAs {
+							userCA := userCA
+							if err := tx.FirstOrCreate(&userCA).Error; err != nil {
+								tx.Rollback()
+								return err
+							}
+						}
 						for _, event := range config.Events {
 							event := event
 							if err := tx.FirstOrCreate(&event).Error; err != nil {
@@ -636,7 +1104,7 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("event:read"); err != nil {
 							return err
 						}
 
@@ -665,7 +1133,7 @@ GLOBAL OPTIONS:
 						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("event:read"); err != nil {
 							return err
 						}
 
@@ -720,22 +1188,27 @@ GLOBAL OPTIONS:
 					Name:        "create",
 					Usage:       "Creates a new host",
 					ArgsUsage:   "[scheme://]<user>[:<password>]@<host>[:<port>]",
-					Description: "$> host create bart@foo.org\n   $> host create bob:marley@example.com:2222",
+					Description: "$> host create bart@foo.org\n   $> host create bob:marley@example.com:2222\n   $> host create --label=env=prod --label=team=data root@db1.example.com",
 					Flags: []cli.Flag{
 						cli.StringFlag{Name: "name, n", Usage: "Assigns a name to the host"},
 						cli.StringFlag{Name: "password, p", Usage: "If present, sshportal will use password-based authentication"},
 						cli.StringFlag{Name: "comment, c"},
 						cli.StringFlag{Name: "key, k", Usage: "`KEY` to use for authentication"},
+						cli.StringFlag{Name: "ca", Usage: "Sign short-lived session certificates with the `KEY` (the host trusts it with TrustedUserCAKeys)"},
 						cli.StringFlag{Name: "hop, o", Usage: "Hop to use for connecting to the server"},
 						cli.StringFlag{Name: "logging, l", Usage: "Logging mode (disabled, input, everything)"},
+						cli.StringFlag{Name: "transfer-policy", Usage: "sftp/scp transfer policy (allow, deny-upload, deny-download, deny)"},
+						cli.StringFlag{Name: "recording-format", Usage: "Session recording format (ttyrec, asciicast)"},
+						cli.BoolFlag{Name: "agent-forward", Usage: "Allows agent forwarding (ssh -A) to the host for every user"},
 						cli.StringSliceFlag{Name: "group, g", Usage: "Assigns the host to `HOSTGROUPS` (default: \"default\")"},
+						cli.StringSliceFlag{Name: "label", Usage: "Assigns the `KEY=VALUE` label to the host"},
 					},
 					Action: func(c *cli.Context) error {
 						if c.NArg() != 1 {
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("host:write"); err != nil {
 							return err
 						}
 
@@ -747,9 +1220,13 @@ GLOBAL OPTIONS:
 							URL:     u.String(),
 							Comment: c.String("comment"),
 						}
+						host.ExtractURLPassword()
 						if c.String("password") != "" {
 							host.Password = c.String("password")
 						}
+						if err := checkSecretReference(myself, host.Password); err != nil {
+							return err
+						}
 						matched, err := regexp.MatchString(`^([0-9]{1,3}.){3}.([0-9]{1,3})$`, host.Hostname())
 						if err != nil {
 							return err
@@ -775,6 +1252,14 @@ GLOBAL OPTIONS:
 						if c.String("logging") != "" {
 							host.Logging = c.String("logging")
 						}
+						host.TransferPolicy = c.String("transfer-policy")
+						host.RecordingFormat = c.String("recording-format")
+						host.AllowAgentForward = c.Bool("agent-forward")
+						labels, err := dbmodels.ParseLabels(strings.Join(c.StringSlice("label"), ","))
+						if err != nil {
+							return err
+						}
+						host.Labels = dbmodels.FormatLabels(labels)
 						// FIXME: check if name already exists
 
 						if _, err := govalidator.ValidateStruct(host); err != nil {
@@ -782,7 +1267,7 @@ GLOBAL OPTIONS:
 						}
 
 						inputKey := c.String("key")
-						if inputKey == "" && host.Password == "" {
+						if inputKey == "" && host.Password == "" && c.String("ca") == "" {
 							inputKey = "default"
 						}
 						if inputKey != "" {
@@ -792,6 +1277,13 @@ GLOBAL OPTIONS:
 							}
 							host.SSHKeyID = key.ID
 						}
+						if c.String("ca") != "" {
+							var caKey dbmodels.SSHKey
+							if err := dbmodels.SSHKeysByIdentifiers(db, []string{c.String("ca")}).First(&caKey).Error; err != nil {
+								return err
+							}
+							host.CAKeyID = caKey.ID
+						}
 
 						// host group
 						inputGroups := c.StringSlice("group")
@@ -825,13 +1317,19 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin", "listhosts"}); err != nil {
+						if err := myself.CheckPermission("host:read"); err != nil {
 							return err
 						}
+						// the passwords are only decrypted for the users able to change them
+						if c.Bool("decrypt") {
+							if err := myself.CheckPermission("host:write"); err != nil {
+								return err
+							}
+						}
 
 						var hosts []*dbmodels.Host
-						if myself.HasRole("admin") {
-							if err := dbmodels.HostsByIdentifiers(db.Preload("Groups").Preload("SSHKey"), c.Args()).Find(&hosts).Error; err != nil {
+						if myself.HasPermission("key:read") {
+							if err := dbmodels.HostsByIdentifiers(db.Preload("Groups").Preload("SSHKey").Preload("CAKey"), c.Args()).Find(&hosts).Error; err != nil {
 								return err
 							}
 						} else {
@@ -842,7 +1340,10 @@ GLOBAL OPTIONS:
 
 						if c.Bool("decrypt") {
 							for _, host := range hosts {
-								crypto.HostDecrypt(actx.aesKey, host)
+								if err := crypto.HostDecrypt(actx.aesKey, host); err != nil {
+									return err
+								}
+								host.URL = host.DecryptedURL()
 							}
 						}
 
@@ -856,15 +1357,24 @@ GLOBAL OPTIONS:
 					Flags: []cli.Flag{
 						cli.BoolFlag{Name: "latest, l", Usage: "Show the latest host"},
 						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
+						cli.StringFlag{Name: "selector, s", Usage: "Only display the hosts whose labels match the `SELECTOR` (i.e., 'env=prod,team!=data')"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin", "listhosts"}); err != nil {
+						if err := myself.CheckPermission("host:read"); err != nil {
 							return err
 						}
 
+						var selector dbmodels.Selector
+						if input := c.String("selector"); input != "" {
+							var err error
+							if selector, err = dbmodels.ParseSelector(input); err != nil {
+								return err
+							}
+						}
+
 						var hosts []*dbmodels.Host
 						query := db.Order("created_at desc").Preload("Groups")
-						if c.Bool("latest") {
+						if c.Bool("latest") && selector == nil {
 							var host dbmodels.Host
 							if err := query.First(&host).Error; err != nil {
 								return err
@@ -873,6 +1383,22 @@ GLOBAL OPTIONS:
 						} else if err := query.Find(&hosts).Error; err != nil {
 							return err
 						}
+						if selector != nil {
+							matching := []*dbmodels.Host{}
+							for _, host := range hosts {
+								labels, err := dbmodels.ParseLabels(host.Labels)
+								if err != nil {
+									return err
+								}
+								if selector.Matches(labels) {
+									matching = append(matching, host)
+								}
+							}
+							hosts = matching
+							if c.Bool("latest") && len(hosts) > 1 {
+								hosts = hosts[:1]
+							}
+						}
 
 						if c.Bool("quiet") {
 							for _, host := range hosts {
@@ -882,7 +1408,7 @@ GLOBAL OPTIONS:
 						}
 
 						table := tablewriter.NewWriter(s)
-						table.SetHeader([]string{"ID", "Name", "URL", "Key", "Groups", "Updated", "Created", "Comment", "Hop", "Logging"})
+						table.SetHeader([]string{"ID", "Name", "URL", "Key", "Groups", "Labels", "Updated", "Created", "Comment", "Hop", "Logging"})
 						table.SetBorder(false)
 						table.SetCaption(true, fmt.Sprintf("Total: %d hosts.", len(hosts)))
 						for _, host := range hosts {
@@ -914,6 +1440,7 @@ GLOBAL OPTIONS:
 								host.String(),
 								authKey,
 								strings.Join(groupNames, ", "),
+								strings.Replace(host.Labels, ",", ", ", -1),
 								humanize.Time(host.UpdatedAt),
 								humanize.Time(host.CreatedAt),
 								host.Comment,
@@ -934,7 +1461,7 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("host:write"); err != nil {
 							return err
 						}
 
@@ -949,18 +1476,26 @@ GLOBAL OPTIONS:
 						cli.StringFlag{Name: "url, u", Usage: "Update connection URL"},
 						cli.StringFlag{Name: "comment, c", Usage: "Update/set a host comment"},
 						cli.StringFlag{Name: "key, k", Usage: "Link a `KEY` to use for authentication"},
+						cli.StringFlag{Name: "ca", Usage: "Sign short-lived session certificates with the `KEY`"},
 						cli.StringFlag{Name: "hop, o", Usage: "Change the hop to use for connecting to the server"},
 						cli.StringFlag{Name: "logging, l", Usage: "Logging mode (disabled, input, everything)"},
+						cli.StringFlag{Name: "transfer-policy", Usage: "sftp/scp transfer policy (allow, deny-upload, deny-download, deny)"},
+						cli.StringFlag{Name: "recording-format", Usage: "Session recording format (ttyrec, asciicast)"},
 						cli.BoolFlag{Name: "unset-hop", Usage: "Remove the hop set for this host"},
+						cli.BoolFlag{Name: "unset-ca", Usage: "Stop signing session certificates for this host"},
+						cli.BoolFlag{Name: "agent-forward", Usage: "Allow agent forwarding (ssh -A) to the host for every user"},
+						cli.BoolFlag{Name: "no-agent-forward", Usage: "Only allow agent forwarding through the ACLs"},
 						cli.StringSliceFlag{Name: "assign-group, g", Usage: "Assign the host to a new `HOSTGROUPS`"},
 						cli.StringSliceFlag{Name: "unassign-group", Usage: "Unassign the host from a `HOSTGROUPS`"},
+						cli.StringSliceFlag{Name: "label", Usage: "Add or replace the `KEY=VALUE` label"},
+						cli.StringSliceFlag{Name: "unlabel", Usage: "Remove the `KEY` label"},
 					},
 					Action: func(c *cli.Context) error {
 						if c.NArg() < 1 {
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("host:write"); err != nil {
 							return err
 						}
 
@@ -972,6 +1507,10 @@ GLOBAL OPTIONS:
 						if len(hosts) > 1 && c.String("name") != "" {
 							return fmt.Errorf("cannot set --name when editing multiple hosts at once")
 						}
+						updatedLabels, err := dbmodels.ParseLabels(strings.Join(c.StringSlice("label"), ","))
+						if err != nil {
+							return err
+						}
 
 						tx := db.Begin()
 						for _, host := range hosts {
@@ -994,12 +1533,28 @@ GLOBAL OPTIONS:
 									tx.Rollback()
 									return err
 								}
-								if err := model.Update("url", u.String()).Error; err != nil {
-									tx.Rollback()
-									return err
-								}
-							}
-
+								// the password is kept in the encrypted field
+								updated := dbmodels.Host{URL: u.String()}
+								if updated.ExtractURLPassword() {
+									if err := checkSecretReference(myself, updated.Password); err != nil {
+										tx.Rollback()
+										return err
+									}
+									if err := crypto.HostEncrypt(actx.aesKey, &updated); err != nil {
+										tx.Rollback()
+										return err
+									}
+									if err := model.Update("password", updated.Password).Error; err != nil {
+										tx.Rollback()
+										return err
+									}
+								}
+								if err := model.Update("url", updated.URL).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+
 							// hop
 							if c.String("hop") != "" {
 								hop, err := dbmodels.HostByName(db, c.String("hop"))
@@ -1024,6 +1579,57 @@ GLOBAL OPTIONS:
 								}
 							}
 
+							// transfer policy
+							if policy := c.String("transfer-policy"); policy != "" {
+								if !dbmodels.IsValidHostTransferPolicy(policy) {
+									tx.Rollback()
+									return fmt.Errorf("invalid host transfer policy: %q", policy)
+								}
+								if err := model.Update("transfer_policy", policy).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+
+							// recording format
+							if format := c.String("recording-format"); format != "" {
+								if !dbmodels.IsValidHostRecordingFormat(format) {
+									tx.Rollback()
+									return fmt.Errorf("invalid host recording format: %q", format)
+								}
+								if err := model.Update("recording_format", format).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+
+							// agent forwarding
+							if c.Bool("agent-forward") || c.Bool("no-agent-forward") {
+								if err := model.Update("allow_agent_forward", c.Bool("agent-forward")).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+
+							// labels
+							if len(updatedLabels) > 0 || len(c.StringSlice("unlabel")) > 0 {
+								labels, err := dbmodels.ParseLabels(host.Labels)
+								if err != nil {
+									tx.Rollback()
+									return err
+								}
+								for key, value := range updatedLabels {
+									labels[key] = value
+								}
+								for _, key := range c.StringSlice("unlabel") {
+									delete(labels, key)
+								}
+								if err := model.Update("labels", dbmodels.FormatLabels(labels)).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+
 							// remove the hop
 							if c.Bool("unset-hop") {
 								var hopHost dbmodels.Host
@@ -1049,6 +1655,23 @@ GLOBAL OPTIONS:
 									return err
 								}
 							}
+							if c.String("ca") != "" {
+								var caKey dbmodels.SSHKey
+								if err := dbmodels.SSHKeysByIdentifiers(db, []string{c.String("ca")}).First(&caKey).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+								if err := model.Association("CAKey").Replace(&caKey); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if c.Bool("unset-ca") {
+								if err := model.Update("ca_key_id", 0).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
 							var appendGroups []dbmodels.HostGroup
 							var deleteGroups []dbmodels.HostGroup
 							if err := dbmodels.HostGroupsByIdentifiers(db, c.StringSlice("assign-group")).Find(&appendGroups).Error; err != nil {
@@ -1082,13 +1705,14 @@ GLOBAL OPTIONS:
 				{
 					Name:        "create",
 					Usage:       "Creates a new host group",
-					Description: "$> hostgroup create --name=prod",
+					Description: "$> hostgroup create --name=prod\n   $> hostgroup create --name=prod --subgroup=prod-eu --subgroup=prod-us",
 					Flags: []cli.Flag{
 						cli.StringFlag{Name: "name", Usage: "Assigns a name to the host group"},
 						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+						cli.StringSliceFlag{Name: "subgroup", Usage: "Includes the hosts of `HOSTGROUPS` in the host group"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("hostgroup:write"); err != nil {
 							return err
 						}
 
@@ -1104,6 +1728,13 @@ GLOBAL OPTIONS:
 						}
 						// FIXME: check if name already exists
 
+						// a new group has no parent, its subgroups cannot create a cycle
+						if len(c.StringSlice("subgroup")) > 0 {
+							if err := dbmodels.HostGroupsByIdentifiers(db, c.StringSlice("subgroup")).Find(&hostGroup.Subgroups).Error; err != nil {
+								return err
+							}
+						}
+
 						if err := db.Create(&hostGroup).Error; err != nil {
 							return err
 						}
@@ -1119,18 +1750,32 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("hostgroup:read"); err != nil {
 							return err
 						}
 
-						var hostGroups []dbmodels.HostGroup
+						var hostGroups []*dbmodels.HostGroup
 						if err := dbmodels.HostGroupsPreload(dbmodels.HostGroupsByIdentifiers(db, c.Args())).Find(&hostGroups).Error; err != nil {
 							return err
 						}
 
+						// the effective hosts include the hosts of the subgroups
+						type inspectedHostGroup struct {
+							*dbmodels.HostGroup
+							EffectiveHosts []*dbmodels.Host
+						}
+						inspected := make([]inspectedHostGroup, 0, len(hostGroups))
+						for _, hostGroup := range hostGroups {
+							members, err := dbmodels.HostGroupMembers(db, hostGroup)
+							if err != nil {
+								return err
+							}
+							inspected = append(inspected, inspectedHostGroup{HostGroup: hostGroup, EffectiveHosts: members})
+						}
+
 						enc := json.NewEncoder(s)
 						enc.SetIndent("", "  ")
-						return enc.Encode(hostGroups)
+						return enc.Encode(inspected)
 					},
 				}, {
 					Name:  "ls",
@@ -1140,12 +1785,12 @@ GLOBAL OPTIONS:
 						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("hostgroup:read"); err != nil {
 							return err
 						}
 
 						var hostGroups []*dbmodels.HostGroup
-						query := db.Order("created_at desc").Preload("ACLs").Preload("Hosts")
+						query := db.Order("created_at desc").Preload("ACLs").Preload("Hosts").Preload("Subgroups")
 						if c.Bool("latest") {
 							var hostGroup dbmodels.HostGroup
 							if err := query.First(&hostGroup).Error; err != nil {
@@ -1164,7 +1809,7 @@ GLOBAL OPTIONS:
 						}
 
 						table := tablewriter.NewWriter(s)
-						table.SetHeader([]string{"ID", "Name", "Hosts", "ACLs", "Updated", "Created", "Comment"})
+						table.SetHeader([]string{"ID", "Name", "Hosts", "Subgroups", "ACLs", "Updated", "Created", "Comment"})
 						table.SetBorder(false)
 						table.SetCaption(true, fmt.Sprintf("Total: %d host groups.", len(hostGroups)))
 						for _, hostGroup := range hostGroups {
@@ -1173,6 +1818,7 @@ GLOBAL OPTIONS:
 								fmt.Sprintf("%d", hostGroup.ID),
 								hostGroup.Name,
 								fmt.Sprintf("%d", len(hostGroup.Hosts)),
+								fmt.Sprintf("%d", len(hostGroup.Subgroups)),
 								fmt.Sprintf("%d", len(hostGroup.ACLs)),
 								humanize.Time(hostGroup.UpdatedAt),
 								humanize.Time(hostGroup.CreatedAt),
@@ -1191,11 +1837,25 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("hostgroup:write"); err != nil {
 							return err
 						}
 
-						return dbmodels.HostGroupsByIdentifiers(db, c.Args()).Unscoped().Delete(&dbmodels.HostGroup{}).Error
+						var hostGroups []*dbmodels.HostGroup
+						if err := dbmodels.HostGroupsByIdentifiers(db, c.Args()).Find(&hostGroups).Error; err != nil {
+							return err
+						}
+						ids := make([]uint, 0, len(hostGroups))
+						for _, hostGroup := range hostGroups {
+							ids = append(ids, hostGroup.ID)
+						}
+						if len(ids) == 0 {
+							return nil
+						}
+						if err := dbmodels.UnlinkHostGroups(db, ids); err != nil {
+							return err
+						}
+						return db.Where("id IN (?)", ids).Unscoped().Delete(&dbmodels.HostGroup{}).Error
 					},
 				}, {
 					Name:      "update",
@@ -1204,13 +1864,15 @@ GLOBAL OPTIONS:
 					Flags: []cli.Flag{
 						cli.StringFlag{Name: "name", Usage: "Assigns a new name to the host group"},
 						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+						cli.StringSliceFlag{Name: "assign-subgroup", Usage: "Includes the hosts of `HOSTGROUPS` in the host group"},
+						cli.StringSliceFlag{Name: "unassign-subgroup", Usage: "Stops including the hosts of `HOSTGROUPS`"},
 					},
 					Action: func(c *cli.Context) error {
 						if c.NArg() < 1 {
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("hostgroup:write"); err != nil {
 							return err
 						}
 
@@ -1235,6 +1897,32 @@ GLOBAL OPTIONS:
 									}
 								}
 							}
+							var appendSubgroups []*dbmodels.HostGroup
+							var deleteSubgroups []*dbmodels.HostGroup
+							if err := dbmodels.HostGroupsByIdentifiers(db, c.StringSlice("assign-subgroup")).Find(&appendSubgroups).Error; err != nil {
+								tx.Rollback()
+								return err
+							}
+							if err := dbmodels.HostGroupsByIdentifiers(db, c.StringSlice("unassign-subgroup")).Find(&deleteSubgroups).Error; err != nil {
+								tx.Rollback()
+								return err
+							}
+							if len(appendSubgroups) > 0 {
+								if err := dbmodels.CheckHostSubgroups(tx, hostgroup, appendSubgroups); err != nil {
+									tx.Rollback()
+									return err
+								}
+								if err := tx.Model(hostgroup).Association("Subgroups").Append(appendSubgroups); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if len(deleteSubgroups) > 0 {
+								if err := tx.Model(hostgroup).Association("Subgroups").Delete(deleteSubgroups); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
 						}
 						return tx.Commit().Error
 					},
@@ -1244,7 +1932,7 @@ GLOBAL OPTIONS:
 			Name:  "info",
 			Usage: "Shows system-wide information",
 			Action: func(c *cli.Context) error {
-				if err := myself.CheckRoles([]string{"admin"}); err != nil {
+				if err := myself.CheckPermission("server:read"); err != nil {
 					return err
 				}
 
@@ -1262,6 +1950,13 @@ GLOBAL OPTIONS:
 				fmt.Fprintf(s, "Go routines: %d\n", runtime.NumGoroutine())
 				fmt.Fprintf(s, "Go version (build): %v\n", runtime.Version())
 				fmt.Fprintf(s, "Uptime: %v\n", time.Since(startTime))
+				fmt.Fprintf(s, "Draining: %v\n", draining())
+				unencrypted, legacy, err := unencryptedRows(db)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(s, "Unencrypted rows: %d\n", unencrypted)
+				fmt.Fprintf(s, "Legacy encrypted rows (AES-CFB): %d\n", legacy)
 
 				fmt.Fprintf(s, "User ID: %v\n", myself.ID)
 				fmt.Fprintf(s, "User email: %s\n", myself.Email)
@@ -1291,7 +1986,7 @@ GLOBAL OPTIONS:
 						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("key:write"); err != nil {
 							return err
 						}
 
@@ -1344,13 +2039,14 @@ GLOBAL OPTIONS:
 				}, {
 					Name:        "import",
 					Usage:       "Imports an existing private key",
-					Description: "$> key import\n   $> key import --name=mykey",
+					Description: "$> key import\n   $> key import --name=mykey\n   $> key import --secret=secret://files/mykey.pem",
 					Flags: []cli.Flag{
 						cli.StringFlag{Name: "name", Usage: "Assigns a name to the key"},
 						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+						cli.StringFlag{Name: "secret", Usage: "References the private key stored outside of the database (secret://<provider>/<key>, see the --secret-provider server flag)"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("key:write"); err != nil {
 							return err
 						}
 
@@ -1362,22 +2058,41 @@ GLOBAL OPTIONS:
 						}
 
 						var value string
-						term := terminal.NewTerminal(s, "Paste your key and end with a blank line> ")
-						for {
-							line, err := term.ReadLine()
+						reference := c.String("secret")
+						if reference != "" {
+							if !crypto.IsSecretReference(reference) {
+								return fmt.Errorf("invalid secret reference %q", reference)
+							}
+							if err := checkSecretReference(myself, reference); err != nil {
+								return err
+							}
+							secret, err := crypto.ResolveSecret(reference)
 							if err != nil {
 								return err
 							}
-							if line != "" {
-								value += line + "\n"
-							} else {
-								break
+							value = secret + "\n"
+						} else {
+							term := terminal.NewTerminal(s, "Paste your key and end with a blank line> ")
+							for {
+								line, err := term.ReadLine()
+								if err != nil {
+									return err
+								}
+								if line != "" {
+									value += line + "\n"
+								} else {
+									break
+								}
 							}
 						}
 						key, err := crypto.ImportSSHKey(value)
 						if err != nil {
 							return err
 						}
+						if reference != "" {
+							// only the reference is stored, the key is resolved when connecting
+							key.PrivKey = reference
+						}
 
 						key.Name = name
 						key.Comment = c.String("comment")
@@ -1407,9 +2122,14 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("key:read"); err != nil {
 							return err
 						}
+						if c.Bool("decrypt") {
+							if err := myself.CheckPermission("key:write"); err != nil {
+								return err
+							}
+						}
 
 						var keys []*dbmodels.SSHKey
 						if err := dbmodels.SSHKeysByIdentifiers(dbmodels.SSHKeysPreload(db), c.Args()).Find(&keys).Error; err != nil {
@@ -1418,7 +2138,9 @@ GLOBAL OPTIONS:
 
 						if c.Bool("decrypt") {
 							for _, key := range keys {
-								crypto.SSHKeyDecrypt(actx.aesKey, key)
+								if err := crypto.SSHKeyDecrypt(actx.aesKey, key); err != nil {
+									return err
+								}
 							}
 						}
 
@@ -1434,7 +2156,7 @@ GLOBAL OPTIONS:
 						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("key:read"); err != nil {
 							return err
 						}
 
@@ -1485,7 +2207,7 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("key:write"); err != nil {
 							return err
 						}
 
@@ -1495,6 +2217,9 @@ GLOBAL OPTIONS:
 					Name:      "setup",
 					Usage:     "Return shell command to install key on remote host",
 					ArgsUsage: "KEY",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "ca", Usage: "Trust the key as a user CA in sshd_config instead (run as root)"},
+					},
 					Action: func(c *cli.Context) error {
 						if c.NArg() != 1 {
 							return cli.ShowSubcommandHelp(c)
@@ -1506,6 +2231,10 @@ GLOBAL OPTIONS:
 						if err := dbmodels.SSHKeysByIdentifiers(db, c.Args()).First(&key).Error; err != nil {
 							return err
 						}
+						if c.Bool("ca") {
+							fmt.Fprintf(s, "echo %s sshportal >> /etc/ssh/sshportal_ca.pub; grep -q '^TrustedUserCAKeys' /etc/ssh/sshd_config || echo 'TrustedUserCAKeys /etc/ssh/sshportal_ca.pub' >> /etc/ssh/sshd_config; echo 'reload sshd to apply'\n", key.PubKey)
+							return nil
+						}
 						fmt.Fprintf(s, "umask 077; mkdir -p .ssh; echo %s sshportal >> .ssh/authorized_keys\n", key.PubKey)
 						return nil
 					},
@@ -1524,7 +2253,9 @@ GLOBAL OPTIONS:
 						if err := dbmodels.SSHKeysByIdentifiers(dbmodels.SSHKeysPreload(db), c.Args()).First(&key).Error; err != nil {
 							return err
 						}
-						crypto.SSHKeyDecrypt(actx.aesKey, &key)
+						if err := crypto.SSHKeyDecrypt(actx.aesKey, &key); err != nil {
+							return err
+						}
 
 						type line struct {
 							key   string
@@ -1586,165 +2317,684 @@ GLOBAL OPTIONS:
 				},
 			},
 		}, {
-			Name:  "user",
-			Usage: "Manages users",
+			Name:  "me",
+			Usage: "Manages your account",
 			Subcommands: []cli.Command{
 				{
-					Name:      "inspect",
-					Usage:     "Shows detailed information on one or more users",
-					ArgsUsage: "USER...",
-					Action: func(c *cli.Context) error {
-						if c.NArg() < 1 {
-							return cli.ShowSubcommandHelp(c)
-						}
-
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
-							return err
-						}
-
-						var users []dbmodels.User
-						if err := dbmodels.UsersPreload(dbmodels.UsersByIdentifiers(db, c.Args())).Find(&users).Error; err != nil {
-							return err
-						}
-
-						enc := json.NewEncoder(s)
-						enc.SetIndent("", "  ")
-						return enc.Encode(users)
-					},
-				}, {
-					Name:        "invite",
-					ArgsUsage:   "<email>",
-					Usage:       "Invites a new user",
-					Description: "$> user invite bob@example.com\n   $> user invite --name=Robert bob@example.com",
-					Flags: []cli.Flag{
-						cli.StringFlag{Name: "name", Usage: "Assigns a name to the user"},
-						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
-						cli.StringSliceFlag{Name: "group, g", Usage: "Names or IDs of `USERGROUPS` (default: \"default\")"},
-					},
+					Name:  "groups",
+					Usage: "Lists your user groups, including the groups containing them",
 					Action: func(c *cli.Context) error {
-						if c.NArg() != 1 {
-							return cli.ShowSubcommandHelp(c)
-						}
-
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						// not checking permissions, every user can see their own account
+						var user dbmodels.User
+						if err := db.Preload("Groups").Where("id = ?", myself.ID).First(&user).Error; err != nil {
 							return err
 						}
-
-						email := c.Args().First()
-						valid := utils.ValidateEmail(email)
-						if !valid {
-							return errors.New("invalid email")
+						membership := map[uint]string{}
+						for _, group := range actx.certGroups {
+							membership[group.ID] = "certificate"
 						}
-						name := strings.Split(email, "@")[0]
-						if c.String("name") != "" {
-							name = c.String("name")
+						for _, group := range user.Groups {
+							membership[group.ID] = "direct"
 						}
-
-						r, err := randStringBytes(16)
+						tmpUser, err := aclUser(actx)
 						if err != nil {
 							return err
 						}
-						user := dbmodels.User{
-							Name:        name,
-							Email:       email,
-							Comment:     c.String("comment"),
-							InviteToken: r,
-						}
-
-						if _, err := govalidator.ValidateStruct(user); err != nil {
-							return err
-						}
-
-						// user group
-						inputGroups := c.StringSlice("group")
-						if len(inputGroups) == 0 {
-							inputGroups = []string{"default"}
-						}
-						if err := dbmodels.UserGroupsByIdentifiers(db, inputGroups).Find(&user.Groups).Error; err != nil {
-							return err
-						}
 
-						// save the user in database
-						if err := db.Create(&user).Error; err != nil {
-							return err
+						table := tablewriter.NewWriter(s)
+						table.SetHeader([]string{"ID", "Name", "Membership", "2FA", "Comment"})
+						table.SetBorder(false)
+						table.SetCaption(true, fmt.Sprintf("Total: %d user groups.", len(tmpUser.Groups)))
+						for _, group := range tmpUser.Groups {
+							through := membership[group.ID]
+							if through == "" {
+								through = "nested"
+							}
+							table.Append([]string{
+								fmt.Sprintf("%d", group.ID),
+								group.Name,
+								through,
+								fmt.Sprintf("%t", group.Require2FA),
+								group.Comment,
+							})
 						}
-						fmt.Fprintf(s, "User %d created.\nTo associate this account with a key, use the following SSH user: 'invite:%s'.\n", user.ID, user.InviteToken)
+						table.Render()
 						return nil
 					},
 				}, {
-					Name:  "ls",
-					Usage: "Lists users",
+					Name:  "hosts",
+					Usage: "Lists the hosts you are allowed to connect to",
 					Flags: []cli.Flag{
-						cli.BoolFlag{Name: "latest, l", Usage: "Show the latest user"},
-						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
+						cli.BoolFlag{Name: "quiet, q", Usage: "Only display names"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						tmpUser, err := aclUser(actx)
+						if err != nil {
 							return err
 						}
-
-						var users []*dbmodels.User
-						query := db.Order("created_at desc").Preload("Groups").Preload("Roles").Preload("Keys")
-						if c.Bool("latest") {
-							var user dbmodels.User
-							if err := query.First(&user).Error; err != nil {
-								return err
-							}
-							users = append(users, &user)
-						} else if err := query.Find(&users).Error; err != nil {
+						hosts, err := allowedHosts(db, tmpUser, actx.clientIP, actx.aclCheckCmd)
+						if err != nil {
 							return err
 						}
 						if c.Bool("quiet") {
-							for _, user := range users {
-								fmt.Fprintln(s, user.ID)
+							for _, host := range hosts {
+								fmt.Fprintln(s, host.Name)
 							}
 							return nil
 						}
 
 						table := tablewriter.NewWriter(s)
-						table.SetHeader([]string{"ID", "Name", "Email", "Roles", "Keys", "Groups", "Updated", "Created", "Comment"})
+						table.SetHeader([]string{"Name", "Hop", "Labels", "Comment"})
 						table.SetBorder(false)
-						table.SetCaption(true, fmt.Sprintf("Total: %d users.", len(users)))
-						for _, user := range users {
-							groupNames := []string{}
-							for _, userGroup := range user.Groups {
-								groupNames = append(groupNames, userGroup.Name)
-							}
-							roleNames := []string{}
-							for _, role := range user.Roles {
-								roleNames = append(roleNames, role.Name)
+						table.SetCaption(true, fmt.Sprintf("Total: %d hosts.", len(hosts)))
+						for _, host := range hosts {
+							hop := ""
+							if host.Hop != nil {
+								hop = host.Hop.Name
 							}
 							table.Append([]string{
-								fmt.Sprintf("%d", user.ID),
-								user.Name,
-								user.Email,
-								strings.Join(roleNames, ", "),
-								fmt.Sprintf("%d", len(user.Keys)),
-								strings.Join(groupNames, ", "),
-								humanize.Time(user.UpdatedAt),
-								humanize.Time(user.CreatedAt),
-								user.Comment,
+								host.Name,
+								hop,
+								strings.Replace(host.Labels, ",", ", ", -1),
+								host.Comment,
 							})
 						}
 						table.Render()
 						return nil
 					},
 				}, {
-					Name:      "rm",
-					Usage:     "Removes one or more users",
-					ArgsUsage: "USER...",
-					Action: func(c *cli.Context) error {
-						if c.NArg() < 1 {
-							return cli.ShowSubcommandHelp(c)
-						}
+					Name:  "key",
+					Usage: "Manages your keys",
+					Subcommands: []cli.Command{
+						{
+							Name:        "add",
+							Usage:       "Adds keys to your account",
+							Description: "$> me key add --comment=laptop < ~/.ssh/id_ed25519.pub",
+							Flags: []cli.Flag{
+								cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+							},
+							Action: func(c *cli.Context) error {
+								return readAuthorizedKeys(s, len(sshCommand) == 0, func(text string) error {
+									key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+									if err != nil {
+										return err
+									}
+									if err := validateUserKey(db, key); err != nil {
+										return err
+									}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
-							return err
-						}
+									userkey := dbmodels.UserKey{
+										UserID:        myself.ID,
+										Key:           key.Marshal(),
+										Comment:       comment,
+										AuthorizedKey: string(gossh.MarshalAuthorizedKey(key)),
+									}
+									if c.String("comment") != "" {
+										userkey.Comment = c.String("comment")
+									}
 
-						return dbmodels.UsersByIdentifiers(db, c.Args()).Unscoped().Delete(&dbmodels.User{}).Error
-					},
-				}, {
+									if _, err := govalidator.ValidateStruct(userkey); err != nil {
+										return err
+									}
+
+									if err := db.Create(&userkey).Error; err != nil {
+										return err
+									}
+									fmt.Fprintf(s, "%d\n", userkey.ID)
+									return nil
+								})
+							},
+						}, {
+							Name:  "ls",
+							Usage: "Lists your keys",
+							Flags: []cli.Flag{
+								cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
+							},
+							Action: func(c *cli.Context) error {
+								var userKeys []*dbmodels.UserKey
+								if err := db.Where("user_id = ?", myself.ID).Order("created_at desc").Find(&userKeys).Error; err != nil {
+									return err
+								}
+								if c.Bool("quiet") {
+									for _, userKey := range userKeys {
+										fmt.Fprintln(s, userKey.ID)
+									}
+									return nil
+								}
+
+								table := tablewriter.NewWriter(s)
+								table.SetHeader([]string{"ID", "Fingerprint", "Current", "Updated", "Created", "Comment"})
+								table.SetBorder(false)
+								table.SetCaption(true, fmt.Sprintf("Total: %d userkeys.", len(userKeys)))
+								for _, userKey := range userKeys {
+									fingerprint := naMessage
+									if key, err := gossh.ParsePublicKey(userKey.Key); err == nil {
+										fingerprint = gossh.FingerprintSHA256(key)
+									}
+									table.Append([]string{
+										fmt.Sprintf("%d", userKey.ID),
+										fingerprint,
+										fmt.Sprintf("%t", userKey.ID == actx.userKey.ID),
+										humanize.Time(userKey.UpdatedAt),
+										humanize.Time(userKey.CreatedAt),
+										userKey.Comment,
+									})
+								}
+								table.Render()
+								return nil
+							},
+						}, {
+							Name:      "rm",
+							Usage:     "Removes one or more of your keys",
+							ArgsUsage: "USERKEY...",
+							Action: func(c *cli.Context) error {
+								if c.NArg() < 1 {
+									return cli.ShowSubcommandHelp(c)
+								}
+
+								var userKeys []*dbmodels.UserKey
+								if err := db.Where("user_id = ? AND id IN (?)", myself.ID, c.Args()).Find(&userKeys).Error; err != nil {
+									return err
+								}
+								if len(userKeys) != c.NArg() {
+									return fmt.Errorf("you can only remove your own keys, see 'me key ls'")
+								}
+								ids := make([]uint, 0, len(userKeys))
+								for _, userKey := range userKeys {
+									// keeping the key of the connection, the user could be locked out otherwise
+									if userKey.ID == actx.userKey.ID {
+										return fmt.Errorf("cannot remove the key %d, it is used by the current connection", userKey.ID)
+									}
+									ids = append(ids, userKey.ID)
+								}
+								return db.Where("id IN (?)", ids).Unscoped().Delete(&dbmodels.UserKey{}).Error
+							},
+						},
+					},
+				},
+			},
+		}, {
+			Name:  "role",
+			Usage: "Manages roles",
+			Subcommands: []cli.Command{
+				{
+					Name:        "create",
+					Usage:       "Creates a new role",
+					Description: "$> role create --name=helpdesk --permission=user:read --permission=user:invite\n   $> role create --name=inventory --permission=host:read,hostgroup:read\n\n   PERMISSIONS: " + strings.Join(dbmodels.Permissions, ", ") + ", '<resource>:*' or '*'",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "name", Usage: "Assigns a name to the role"},
+						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+						cli.StringSliceFlag{Name: "permission, p", Usage: "Grants the `PERMISSIONS` to the role"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := myself.CheckPermission("role:write"); err != nil {
+							return err
+						}
+
+						permissions, err := dbmodels.ParsePermissions(strings.Join(c.StringSlice("permission"), ","))
+						if err != nil {
+							return err
+						}
+						role := dbmodels.UserRole{
+							Name:        c.String("name"),
+							Comment:     c.String("comment"),
+							Permissions: strings.Join(permissions, ","),
+						}
+						if role.Name == "" {
+							role.Name = namesgenerator.GetRandomName(0)
+						}
+						if err := myself.CheckGrant(role.Permissions); err != nil {
+							return err
+						}
+
+						if _, err := govalidator.ValidateStruct(role); err != nil {
+							return err
+						}
+
+						if err := db.Create(&role).Error; err != nil {
+							return err
+						}
+						fmt.Fprintf(s, "%d\n", role.ID)
+						return nil
+					},
+				}, {
+					Name:      "inspect",
+					Usage:     "Shows detailed information on one or more roles",
+					ArgsUsage: "ROLE...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("role:read"); err != nil {
+							return err
+						}
+
+						var roles []*dbmodels.UserRole
+						if err := dbmodels.UserRolesPreload(dbmodels.UserRolesByIdentifiers(db, c.Args())).Find(&roles).Error; err != nil {
+							return err
+						}
+
+						enc := json.NewEncoder(s)
+						enc.SetIndent("", "  ")
+						return enc.Encode(roles)
+					},
+				}, {
+					Name:  "ls",
+					Usage: "Lists roles",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "latest, l", Usage: "Show the latest role"},
+						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := myself.CheckPermission("role:read"); err != nil {
+							return err
+						}
+
+						var roles []*dbmodels.UserRole
+						query := db.Order("created_at desc").Preload("Users")
+						if c.Bool("latest") {
+							var role dbmodels.UserRole
+							if err := query.First(&role).Error; err != nil {
+								return err
+							}
+							roles = append(roles, &role)
+						} else if err := query.Find(&roles).Error; err != nil {
+							return err
+						}
+						if c.Bool("quiet") {
+							for _, role := range roles {
+								fmt.Fprintln(s, role.ID)
+							}
+							return nil
+						}
+
+						table := tablewriter.NewWriter(s)
+						table.SetHeader([]string{"ID", "Name", "Permissions", "Users", "Update", "Create", "Comment"})
+						table.SetBorder(false)
+						table.SetCaption(true, fmt.Sprintf("Total: %d roles.", len(roles)))
+						for _, role := range roles {
+							table.Append([]string{
+								fmt.Sprintf("%d", role.ID),
+								role.Name,
+								strings.Replace(role.Permissions, ",", ", ", -1),
+								fmt.Sprintf("%d", len(role.Users)),
+								humanize.Time(role.UpdatedAt),
+								humanize.Time(role.CreatedAt),
+								role.Comment,
+							})
+						}
+						table.Render()
+						return nil
+					},
+				}, {
+					Name:      "rm",
+					Usage:     "Removes one or more roles",
+					ArgsUsage: "ROLE...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("role:write"); err != nil {
+							return err
+						}
+
+						var roles []*dbmodels.UserRole
+						if err := dbmodels.UserRolesByIdentifiers(db, c.Args()).Find(&roles).Error; err != nil {
+							return err
+						}
+						ids := make([]uint, 0, len(roles))
+						for _, role := range roles {
+							if role.Name == "admin" {
+								return fmt.Errorf("the admin role cannot be removed")
+							}
+							// one can only manage the roles whose permissions one has
+							if err := myself.CheckGrant(role.Permissions); err != nil {
+								return err
+							}
+							ids = append(ids, role.ID)
+						}
+						if len(ids) == 0 {
+							return nil
+						}
+						if err := dbmodels.UnlinkUserRoles(db, ids); err != nil {
+							return err
+						}
+						return db.Where("id IN (?)", ids).Unscoped().Delete(&dbmodels.UserRole{}).Error
+					},
+				}, {
+					Name:        "update",
+					Usage:       "Updates one or more roles",
+					ArgsUsage:   "ROLE...",
+					Description: "$> role update helpdesk --grant=userkey:read --revoke=user:write",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "name", Usage: "Assigns a new name to the role"},
+						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+						cli.StringSliceFlag{Name: "grant", Usage: "Grants the `PERMISSIONS` to the role"},
+						cli.StringSliceFlag{Name: "revoke", Usage: "Revokes the `PERMISSIONS` from the role"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("role:write"); err != nil {
+							return err
+						}
+
+						var roles []*dbmodels.UserRole
+						if err := dbmodels.UserRolesByIdentifiers(db, c.Args()).Find(&roles).Error; err != nil {
+							return err
+						}
+
+						if len(roles) > 1 && c.String("name") != "" {
+							return fmt.Errorf("cannot set --name when editing multiple roles at once")
+						}
+						grant, err := dbmodels.ParsePermissions(strings.Join(c.StringSlice("grant"), ","))
+						if err != nil {
+							return err
+						}
+						revoke, err := dbmodels.ParsePermissions(strings.Join(c.StringSlice("revoke"), ","))
+						if err != nil {
+							return err
+						}
+						if err := myself.CheckGrant(strings.Join(grant, ",")); err != nil {
+							return err
+						}
+
+						tx := db.Begin()
+						for _, role := range roles {
+							// the admin role keeps all the permissions, the other
+							// features rely on its name
+							if role.Name == "admin" && (c.String("name") != "" || len(grant) > 0 || len(revoke) > 0) {
+								tx.Rollback()
+								return fmt.Errorf("the name and permissions of the admin role cannot be changed")
+							}
+							if err := myself.CheckGrant(role.Permissions); err != nil {
+								tx.Rollback()
+								return err
+							}
+							model := tx.Model(role)
+							// simple fields
+							for _, fieldname := range []string{"name", "comment"} {
+								if c.String(fieldname) != "" {
+									if err := model.Update(fieldname, c.String(fieldname)).Error; err != nil {
+										tx.Rollback()
+										return err
+									}
+								}
+							}
+							if len(grant) > 0 || len(revoke) > 0 {
+								granted, err := dbmodels.ParsePermissions(role.Permissions)
+								if err != nil {
+									tx.Rollback()
+									return err
+								}
+								permissions, err := dbmodels.ParsePermissions(strings.Join(append(dbmodels.RevokePermissions(granted, revoke), grant...), ","))
+								if err != nil {
+									tx.Rollback()
+									return err
+								}
+								if err := model.Update("permissions", strings.Join(permissions, ",")).Error; err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+						}
+						return tx.Commit().Error
+					},
+				},
+			},
+		}, {
+			Name:  "user",
+			Usage: "Manages users",
+			Subcommands: []cli.Command{
+				{
+					Name:  "2fa",
+					Usage: "Manages the second factor of users",
+					Subcommands: []cli.Command{
+						{
+							Name:        "enroll",
+							Usage:       "Generates a TOTP secret and recovery codes for a user",
+							ArgsUsage:   "USER",
+							Description: "$> user 2fa enroll bob",
+							Action: func(c *cli.Context) error {
+								if c.NArg() != 1 {
+									return cli.ShowSubcommandHelp(c)
+								}
+
+								if err := myself.CheckPermission("user:write"); err != nil {
+									return err
+								}
+
+								var user dbmodels.User
+								if err := dbmodels.UsersByIdentifiers(db.Preload("Roles"), c.Args()).First(&user).Error; err != nil {
+									return err
+								}
+								if err := myself.CheckManage(&user); err != nil {
+									return err
+								}
+								if user.Has2FA() {
+									return fmt.Errorf("user %q is already enrolled, run 'user 2fa reset' first", user.Name)
+								}
+
+								secret, err := crypto.NewTOTPSecret()
+								if err != nil {
+									return err
+								}
+								codes, hashes, err := crypto.NewRecoveryCodes(10)
+								if err != nil {
+									return err
+								}
+								user.TOTPSecret = secret
+								if err := crypto.UserEncrypt(actx.aesKey, &user); err != nil {
+									return err
+								}
+								if err := db.Model(&user).Updates(map[string]interface{}{
+									"totp_secret":    user.TOTPSecret,
+									"recovery_codes": strings.Join(hashes, ","),
+									"totp_last_step": 0,
+								}).Error; err != nil {
+									return err
+								}
+
+								fmt.Fprintf(s, "Secret: %s\n", secret)
+								fmt.Fprintf(s, "URI:    %s\n", crypto.TOTPURI("sshportal", user.Email, secret))
+								fmt.Fprintf(s, "\nRecovery codes (single-use, they won't be displayed again):\n")
+								for _, code := range codes {
+									fmt.Fprintf(s, "  %s\n", code)
+								}
+								return nil
+							},
+						}, {
+							Name:      "reset",
+							Usage:     "Removes the second factor and recovery codes of one or more users",
+							ArgsUsage: "USER...",
+							Action: func(c *cli.Context) error {
+								if c.NArg() < 1 {
+									return cli.ShowSubcommandHelp(c)
+								}
+
+								if err := myself.CheckPermission("user:write"); err != nil {
+									return err
+								}
+
+								users, err := manageableUsers(db, myself, c.Args())
+								if err != nil {
+									return err
+								}
+								return db.Model(&dbmodels.User{}).Where("id IN (?)", users).Updates(map[string]interface{}{
+									"totp_secret":    "",
+									"recovery_codes": "",
+									"totp_last_step": 0,
+								}).Error
+							},
+						},
+					},
+				}, {
+					Name:      "inspect",
+					Usage:     "Shows detailed information on one or more users",
+					ArgsUsage: "USER...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("user:read"); err != nil {
+							return err
+						}
+
+						var users []dbmodels.User
+						if err := dbmodels.UsersPreload(dbmodels.UsersByIdentifiers(db, c.Args())).Find(&users).Error; err != nil {
+							return err
+						}
+
+						enc := json.NewEncoder(s)
+						enc.SetIndent("", "  ")
+						return enc.Encode(users)
+					},
+				}, {
+					Name:        "invite",
+					ArgsUsage:   "<email>",
+					Usage:       "Invites a new user",
+					Description: "$> user invite bob@example.com\n   $> user invite --name=Robert bob@example.com",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "name", Usage: "Assigns a name to the user"},
+						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+						cli.StringSliceFlag{Name: "group, g", Usage: "Names or IDs of `USERGROUPS` (default: \"default\")"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("user:invite"); err != nil {
+							return err
+						}
+
+						email := c.Args().First()
+						valid := utils.ValidateEmail(email)
+						if !valid {
+							return errors.New("invalid email")
+						}
+						name := strings.Split(email, "@")[0]
+						if c.String("name") != "" {
+							name = c.String("name")
+						}
+
+						r, err := randStringBytes(16)
+						if err != nil {
+							return err
+						}
+						user := dbmodels.User{
+							Name:        name,
+							Email:       email,
+							Comment:     c.String("comment"),
+							InviteToken: r,
+						}
+
+						if _, err := govalidator.ValidateStruct(user); err != nil {
+							return err
+						}
+
+						// user group, the groups grant the access to the hosts
+						inputGroups := c.StringSlice("group")
+						if len(inputGroups) == 0 {
+							inputGroups = []string{"default"}
+						} else if err := myself.CheckPermission("usergroup:write"); err != nil {
+							return err
+						}
+						if err := dbmodels.UserGroupsByIdentifiers(db, inputGroups).Find(&user.Groups).Error; err != nil {
+							return err
+						}
+
+						// save the user in database
+						if err := db.Create(&user).Error; err != nil {
+							return err
+						}
+						fmt.Fprintf(s, "User %d created.\nTo associate this account with a key, use the following SSH user: 'invite:%s'.\n", user.ID, user.InviteToken)
+						return nil
+					},
+				}, {
+					Name:  "ls",
+					Usage: "Lists users",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "latest, l", Usage: "Show the latest user"},
+						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := myself.CheckPermission("user:read"); err != nil {
+							return err
+						}
+
+						var users []*dbmodels.User
+						query := db.Order("created_at desc").Preload("Groups").Preload("Roles").Preload("Keys")
+						if c.Bool("latest") {
+							var user dbmodels.User
+							if err := query.First(&user).Error; err != nil {
+								return err
+							}
+							users = append(users, &user)
+						} else if err := query.Find(&users).Error; err != nil {
+							return err
+						}
+						if c.Bool("quiet") {
+							for _, user := range users {
+								fmt.Fprintln(s, user.ID)
+							}
+							return nil
+						}
+
+						table := tablewriter.NewWriter(s)
+						table.SetHeader([]string{"ID", "Name", "Email", "Roles", "Keys", "Groups", "2FA", "Updated", "Created", "Comment"})
+						table.SetBorder(false)
+						table.SetCaption(true, fmt.Sprintf("Total: %d users.", len(users)))
+						for _, user := range users {
+							groupNames := []string{}
+							for _, userGroup := range user.Groups {
+								groupNames = append(groupNames, userGroup.Name)
+							}
+							roleNames := []string{}
+							for _, role := range user.Roles {
+								roleNames = append(roleNames, role.Name)
+							}
+							table.Append([]string{
+								fmt.Sprintf("%d", user.ID),
+								user.Name,
+								user.Email,
+								strings.Join(roleNames, ", "),
+								fmt.Sprintf("%d", len(user.Keys)),
+								strings.Join(groupNames, ", "),
+								fmt.Sprintf("%t", user.Has2FA()),
+								humanize.Time(user.UpdatedAt),
+								humanize.Time(user.CreatedAt),
+								user.Comment,
+							})
+						}
+						table.Render()
+						return nil
+					},
+				}, {
+					Name:      "rm",
+					Usage:     "Removes one or more users",
+					ArgsUsage: "USER...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("user:write"); err != nil {
+							return err
+						}
+
+						users, err := manageableUsers(db, myself, c.Args())
+						if err != nil {
+							return err
+						}
+						return db.Where("id IN (?)", users).Unscoped().Delete(&dbmodels.User{}).Error
+					},
+				}, {
 					Name:      "update",
 					Usage:     "Updates an existing user",
 					ArgsUsage: "USER...",
@@ -1763,15 +3013,26 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("user:write"); err != nil {
 							return err
 						}
 
 						// FIXME: check if unset-admin + user == myself
 						var users []*dbmodels.User
-						if err := dbmodels.UsersByIdentifiers(db, c.Args()).Find(&users).Error; err != nil {
+						if err := dbmodels.UsersByIdentifiers(db.Preload("Roles"), c.Args()).Find(&users).Error; err != nil {
 							return err
 						}
+						for _, user := range users {
+							if err := myself.CheckManage(user); err != nil {
+								return err
+							}
+						}
+						// the groups grant the access to the hosts
+						if len(c.StringSlice("assign-group")) > 0 || len(c.StringSlice("unassign-group")) > 0 {
+							if err := myself.CheckPermission("usergroup:write"); err != nil {
+								return err
+							}
+						}
 
 						if c.Bool("set-admin") && c.Bool("unset-admin") {
 							return fmt.Errorf("cannot use --set-admin and --unset-admin altogether")
@@ -1816,28 +3077,283 @@ GLOBAL OPTIONS:
 								tx.Rollback()
 								return err
 							}
-							if len(deleteGroups) > 0 {
-								if err := model.Association("Groups").Delete(deleteGroups); err != nil {
+							if len(deleteGroups) > 0 {
+								if err := model.Association("Groups").Delete(deleteGroups); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							var appendRoles []dbmodels.UserRole
+							if err := dbmodels.UserRolesByIdentifiers(db, c.StringSlice("assign-role")).Find(&appendRoles).Error; err != nil {
+								tx.Rollback()
+								return err
+							}
+							for _, role := range appendRoles {
+								if err := myself.CheckGrant(role.Permissions); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							var deleteRoles []dbmodels.UserRole
+							if err := dbmodels.UserRolesByIdentifiers(db, c.StringSlice("unassign-role")).Find(&deleteRoles).Error; err != nil {
+								tx.Rollback()
+								return err
+							}
+							for _, role := range deleteRoles {
+								if err := myself.CheckGrant(role.Permissions); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+							if err := model.Association("Roles").Append(&appendRoles); err != nil {
+								tx.Rollback()
+								return err
+							}
+							if len(deleteRoles) > 0 {
+								if err := model.Association("Roles").Delete(deleteRoles); err != nil {
+									tx.Rollback()
+									return err
+								}
+							}
+						}
+						return tx.Commit().Error
+					},
+				},
+			},
+		}, {
+			Name:  "usergroup",
+			Usage: "Manages user groups",
+			Subcommands: []cli.Command{
+				{
+					Name:        "create",
+					Usage:       "Creates a new user group",
+					Description: "$> usergroup create --name=prod\n   $> usergroup create --name=sre --subgroup=sre-eu --subgroup=sre-us",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "name", Usage: "Assigns a name to the user group"},
+						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+						cli.BoolFlag{Name: "require-2fa", Usage: "Denies access to members without a second factor"},
+						cli.StringSliceFlag{Name: "subgroup", Usage: "Includes the members of `USERGROUPS` in the user group"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := myself.CheckPermission("usergroup:write"); err != nil {
+							return err
+						}
+
+						userGroup := dbmodels.UserGroup{
+							Name:       c.String("name"),
+							Comment:    c.String("comment"),
+							Require2FA: c.Bool("require-2fa"),
+						}
+						if userGroup.Name == "" {
+							userGroup.Name = namesgenerator.GetRandomName(0)
+						}
+
+						if _, err := govalidator.ValidateStruct(userGroup); err != nil {
+							return err
+						}
+						// FIXME: check if name already exists
+						// FIXME: add myself to the new group
+
+						userGroup.Users = []*dbmodels.User{myself}
+						// a new group has no parent, its subgroups cannot create a cycle
+						if len(c.StringSlice("subgroup")) > 0 {
+							if err := dbmodels.UserGroupsByIdentifiers(db, c.StringSlice("subgroup")).Find(&userGroup.Subgroups).Error; err != nil {
+								return err
+							}
+						}
+
+						if err := db.Create(&userGroup).Error; err != nil {
+							return err
+						}
+						fmt.Fprintf(s, "%d\n", userGroup.ID)
+						return nil
+					},
+				}, {
+					Name:      "inspect",
+					Usage:     "Shows detailed information on one or more user groups",
+					ArgsUsage: "USERGROUP...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("usergroup:read"); err != nil {
+							return err
+						}
+
+						var userGroups []*dbmodels.UserGroup
+						if err := dbmodels.UserGroupsPreload(dbmodels.UserGroupsByIdentifiers(db, c.Args())).Find(&userGroups).Error; err != nil {
+							return err
+						}
+
+						// the effective users include the users of the subgroups
+						type inspectedUserGroup struct {
+							*dbmodels.UserGroup
+							EffectiveUsers []*dbmodels.User
+						}
+						inspected := make([]inspectedUserGroup, 0, len(userGroups))
+						for _, userGroup := range userGroups {
+							members, err := dbmodels.UserGroupMembers(db, userGroup)
+							if err != nil {
+								return err
+							}
+							inspected = append(inspected, inspectedUserGroup{UserGroup: userGroup, EffectiveUsers: members})
+						}
+
+						enc := json.NewEncoder(s)
+						enc.SetIndent("", "  ")
+						return enc.Encode(inspected)
+					},
+				}, {
+					Name:  "ls",
+					Usage: "Lists user groups",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "latest, l", Usage: "Show the latest user group"},
+						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
+					},
+					Action: func(c *cli.Context) error {
+						if err := myself.CheckPermission("usergroup:read"); err != nil {
+							return err
+						}
+
+						var userGroups []*dbmodels.UserGroup
+						query := db.Order("created_at desc").Preload("ACLs").Preload("Users").Preload("Subgroups")
+						if c.Bool("latest") {
+							var userGroup dbmodels.UserGroup
+							if err := query.First(&userGroup).Error; err != nil {
+								return err
+							}
+							userGroups = append(userGroups, &userGroup)
+						} else if err := query.Find(&userGroups).Error; err != nil {
+							return err
+						}
+						if c.Bool("quiet") {
+							for _, userGroup := range userGroups {
+								fmt.Fprintln(s, userGroup.ID)
+							}
+							return nil
+						}
+
+						table := tablewriter.NewWriter(s)
+						table.SetHeader([]string{"ID", "Name", "Users", "Subgroups", "ACLs", "2FA", "Update", "Create", "Comment"})
+						table.SetBorder(false)
+						table.SetCaption(true, fmt.Sprintf("Total: %d user groups.", len(userGroups)))
+						for _, userGroup := range userGroups {
+							table.Append([]string{
+								fmt.Sprintf("%d", userGroup.ID),
+								userGroup.Name,
+								fmt.Sprintf("%d", len(userGroup.Users)),
+								fmt.Sprintf("%d", len(userGroup.Subgroups)),
+								fmt.Sprintf("%d", len(userGroup.ACLs)),
+								fmt.Sprintf("%t", userGroup.Require2FA),
+								humanize.Time(userGroup.UpdatedAt),
+								humanize.Time(userGroup.CreatedAt),
+								userGroup.Comment,
+							})
+							// FIXME: add more stats (amount of users, linked usergroups, ...)
+						}
+						table.Render()
+						return nil
+					},
+				}, {
+					Name:      "rm",
+					Usage:     "Removes one or more user groups",
+					ArgsUsage: "USERGROUP...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("usergroup:write"); err != nil {
+							return err
+						}
+
+						var userGroups []*dbmodels.UserGroup
+						if err := dbmodels.UserGroupsByIdentifiers(db, c.Args()).Find(&userGroups).Error; err != nil {
+							return err
+						}
+						ids := make([]uint, 0, len(userGroups))
+						for _, userGroup := range userGroups {
+							ids = append(ids, userGroup.ID)
+						}
+						if len(ids) == 0 {
+							return nil
+						}
+						if err := dbmodels.UnlinkUserGroups(db, ids); err != nil {
+							return err
+						}
+						return db.Where("id IN (?)", ids).Unscoped().Delete(&dbmodels.UserGroup{}).Error
+					},
+				}, {
+					Name:      "update",
+					Usage:     "Updates a user group",
+					ArgsUsage: "USERGROUP...",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "name", Usage: "Assigns a new name to the user group"},
+						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+						cli.BoolFlag{Name: "require-2fa", Usage: "Denies access to members without a second factor"},
+						cli.BoolFlag{Name: "no-require-2fa", Usage: "Stops requiring a second factor"},
+						cli.StringSliceFlag{Name: "assign-subgroup", Usage: "Includes the members of `USERGROUPS` in the user group"},
+						cli.StringSliceFlag{Name: "unassign-subgroup", Usage: "Stops including the members of `USERGROUPS`"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("usergroup:write"); err != nil {
+							return err
+						}
+
+						var usergroups []*dbmodels.UserGroup
+						if err := dbmodels.UserGroupsByIdentifiers(db, c.Args()).Find(&usergroups).Error; err != nil {
+							return err
+						}
+
+						if len(usergroups) > 1 && c.String("name") != "" {
+							return fmt.Errorf("cannot set --name when editing multiple usergroups at once")
+						}
+
+						tx := db.Begin()
+						for _, usergroup := range usergroups {
+							model := tx.Model(usergroup)
+							// simple fields
+							for _, fieldname := range []string{"name", "comment"} {
+								if c.String(fieldname) != "" {
+									if err := model.Update(fieldname, c.String(fieldname)).Error; err != nil {
+										tx.Rollback()
+										return err
+									}
+								}
+							}
+							if c.Bool("require-2fa") || c.Bool("no-require-2fa") {
+								if err := model.Update("require_2fa", c.Bool("require-2fa")).Error; err != nil {
 									tx.Rollback()
 									return err
 								}
 							}
-							var appendRoles []dbmodels.UserRole
-							if err := dbmodels.UserRolesByIdentifiers(db, c.StringSlice("assign-role")).Find(&appendRoles).Error; err != nil {
+							var appendSubgroups []*dbmodels.UserGroup
+							var deleteSubgroups []*dbmodels.UserGroup
+							if err := dbmodels.UserGroupsByIdentifiers(db, c.StringSlice("assign-subgroup")).Find(&appendSubgroups).Error; err != nil {
 								tx.Rollback()
 								return err
 							}
-							var deleteRoles []dbmodels.UserRole
-							if err := dbmodels.UserRolesByIdentifiers(db, c.StringSlice("unassign-role")).Find(&deleteRoles).Error; err != nil {
+							if err := dbmodels.UserGroupsByIdentifiers(db, c.StringSlice("unassign-subgroup")).Find(&deleteSubgroups).Error; err != nil {
 								tx.Rollback()
 								return err
 							}
-							if err := model.Association("Roles").Append(&appendRoles); err != nil {
-								tx.Rollback()
-								return err
+							if len(appendSubgroups) > 0 {
+								if err := dbmodels.CheckUserSubgroups(tx, usergroup, appendSubgroups); err != nil {
+									tx.Rollback()
+									return err
+								}
+								if err := tx.Model(usergroup).Association("Subgroups").Append(appendSubgroups); err != nil {
+									tx.Rollback()
+									return err
+								}
 							}
-							if len(deleteRoles) > 0 {
-								if err := model.Association("Roles").Delete(deleteRoles); err != nil {
+							if len(deleteSubgroups) > 0 {
+								if err := tx.Model(usergroup).Association("Subgroups").Delete(deleteSubgroups); err != nil {
 									tx.Rollback()
 									return err
 								}
@@ -1848,170 +3364,231 @@ GLOBAL OPTIONS:
 				},
 			},
 		}, {
-			Name:  "usergroup",
-			Usage: "Manages user groups",
+			Name:  "userca",
+			Usage: "Manages trusted user certificate authorities",
 			Subcommands: []cli.Command{
 				{
 					Name:        "create",
-					Usage:       "Creates a new user group",
-					Description: "$> usergroup create --name=prod",
+					Usage:       "Trusts a new user certificate authority",
+					Description: "$> userca create --name=corp-ca < ca.pub",
 					Flags: []cli.Flag{
-						cli.StringFlag{Name: "name", Usage: "Assigns a name to the user group"},
+						cli.StringFlag{Name: "name, n", Usage: "Assigns a name to the CA"},
 						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("userca:write"); err != nil {
 							return err
 						}
 
-						userGroup := dbmodels.UserGroup{
-							Name:    c.String("name"),
-							Comment: c.String("comment"),
+						var text string
+						if len(sshCommand) == 0 { // interactive mode
+							term := terminal.NewTerminal(s, "Paste the CA public key> ")
+							line, err := term.ReadLine()
+							if err != nil && err != io.EOF {
+								return err
+							}
+							text = line
+						} else {
+							fmt.Fprintf(s, "Enter CA public key:\n")
+							line, err := bufio.NewReader(s).ReadString('\n')
+							if err != nil && err != io.EOF {
+								return err
+							}
+							text = line
 						}
-						if userGroup.Name == "" {
-							userGroup.Name = namesgenerator.GetRandomName(0)
+						key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+						if err != nil {
+							return err
 						}
 
-						if _, err := govalidator.ValidateStruct(userGroup); err != nil {
-							return err
+						userCA := dbmodels.UserCA{
+							Name:          c.String("name"),
+							Key:           key.Marshal(),
+							Comment:       comment,
+							AuthorizedKey: string(gossh.MarshalAuthorizedKey(key)),
+						}
+						if c.String("comment") != "" {
+							userCA.Comment = c.String("comment")
+						}
+						if userCA.Name == "" {
+							userCA.Name = namesgenerator.GetRandomName(0)
 						}
-						// FIXME: check if name already exists
-						// FIXME: add myself to the new group
 
-						userGroup.Users = []*dbmodels.User{myself}
+						if _, err := govalidator.ValidateStruct(userCA); err != nil {
+							return err
+						}
 
-						if err := db.Create(&userGroup).Error; err != nil {
+						if err := db.Create(&userCA).Error; err != nil {
 							return err
 						}
-						fmt.Fprintf(s, "%d\n", userGroup.ID)
+						fmt.Fprintf(s, "%d\n", userCA.ID)
 						return nil
 					},
 				}, {
 					Name:      "inspect",
-					Usage:     "Shows detailed information on one or more user groups",
-					ArgsUsage: "USERGROUP...",
+					Usage:     "Shows detailed information on one or more user CAs",
+					ArgsUsage: "USERCA...",
 					Action: func(c *cli.Context) error {
 						if c.NArg() < 1 {
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("userca:read"); err != nil {
 							return err
 						}
 
-						var userGroups []dbmodels.UserGroup
-						if err := dbmodels.UserGroupsPreload(dbmodels.UserGroupsByIdentifiers(db, c.Args())).Find(&userGroups).Error; err != nil {
+						var userCAs []dbmodels.UserCA
+						if err := dbmodels.UserCAsPreload(dbmodels.UserCAsByIdentifiers(db, c.Args())).Find(&userCAs).Error; err != nil {
 							return err
 						}
 
 						enc := json.NewEncoder(s)
 						enc.SetIndent("", "  ")
-						return enc.Encode(userGroups)
+						return enc.Encode(userCAs)
 					},
 				}, {
 					Name:  "ls",
-					Usage: "Lists user groups",
+					Usage: "Lists user CAs",
 					Flags: []cli.Flag{
-						cli.BoolFlag{Name: "latest, l", Usage: "Show the latest user group"},
 						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("userca:read"); err != nil {
 							return err
 						}
 
-						var userGroups []*dbmodels.UserGroup
-						query := db.Order("created_at desc").Preload("ACLs").Preload("Users")
-						if c.Bool("latest") {
-							var userGroup dbmodels.UserGroup
-							if err := query.First(&userGroup).Error; err != nil {
-								return err
-							}
-							userGroups = append(userGroups, &userGroup)
-						} else if err := query.Find(&userGroups).Error; err != nil {
+						var userCAs []*dbmodels.UserCA
+						if err := dbmodels.UserCAsPreload(db).Find(&userCAs).Error; err != nil {
 							return err
 						}
 						if c.Bool("quiet") {
-							for _, userGroup := range userGroups {
-								fmt.Fprintln(s, userGroup.ID)
+							for _, userCA := range userCAs {
+								fmt.Fprintln(s, userCA.ID)
 							}
 							return nil
 						}
 
 						table := tablewriter.NewWriter(s)
-						table.SetHeader([]string{"ID", "Name", "Users", "ACLs", "Update", "Create", "Comment"})
+						table.SetHeader([]string{"ID", "Name", "Fingerprint", "Revoked", "Updated", "Created", "Comment"})
 						table.SetBorder(false)
-						table.SetCaption(true, fmt.Sprintf("Total: %d user groups.", len(userGroups)))
-						for _, userGroup := range userGroups {
+						table.SetCaption(true, fmt.Sprintf("Total: %d user CAs.", len(userCAs)))
+						for _, userCA := range userCAs {
+							fingerprint := naMessage
+							if key, err := gossh.ParsePublicKey(userCA.Key); err == nil {
+								fingerprint = gossh.FingerprintSHA256(key)
+							}
 							table.Append([]string{
-								fmt.Sprintf("%d", userGroup.ID),
-								userGroup.Name,
-								fmt.Sprintf("%d", len(userGroup.Users)),
-								fmt.Sprintf("%d", len(userGroup.ACLs)),
-								humanize.Time(userGroup.UpdatedAt),
-								humanize.Time(userGroup.CreatedAt),
-								userGroup.Comment,
+								fmt.Sprintf("%d", userCA.ID),
+								userCA.Name,
+								fingerprint,
+								fmt.Sprintf("%d", len(userCA.Revocations)),
+								humanize.Time(userCA.UpdatedAt),
+								humanize.Time(userCA.CreatedAt),
+								userCA.Comment,
 							})
-							// FIXME: add more stats (amount of users, linked usergroups, ...)
 						}
 						table.Render()
 						return nil
 					},
 				}, {
-					Name:      "rm",
-					Usage:     "Removes one or more user groups",
-					ArgsUsage: "USERGROUP...",
+					Name:      "revoke",
+					Usage:     "Revokes one or more certificate serials issued by a user CA",
+					ArgsUsage: "USERCA SERIAL...",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
+					},
 					Action: func(c *cli.Context) error {
-						if c.NArg() < 1 {
+						if c.NArg() < 2 {
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("userca:write"); err != nil {
 							return err
 						}
 
-						return dbmodels.UserGroupsByIdentifiers(db, c.Args()).Unscoped().Delete(&dbmodels.UserGroup{}).Error
+						var userCA dbmodels.UserCA
+						if err := dbmodels.UserCAsPreload(dbmodels.UserCAsByIdentifiers(db, c.Args()[:1])).First(&userCA).Error; err != nil {
+							return err
+						}
+
+						tx := db.Begin()
+						for _, arg := range c.Args()[1:] {
+							serial, err := strconv.ParseUint(arg, 10, 64)
+							if err != nil {
+								tx.Rollback()
+								return fmt.Errorf("invalid serial %q: %v", arg, err)
+							}
+							if userCA.IsRevoked(serial) {
+								continue
+							}
+							revocation := dbmodels.UserCertRevocation{
+								UserCAID: userCA.ID,
+								Serial:   serial,
+								Comment:  c.String("comment"),
+							}
+							if err := tx.Create(&revocation).Error; err != nil {
+								tx.Rollback()
+								return err
+							}
+						}
+						return tx.Commit().Error
 					},
 				}, {
-					Name:      "update",
-					Usage:     "Updates a user group",
-					ArgsUsage: "USERGROUP...",
-					Flags: []cli.Flag{
-						cli.StringFlag{Name: "name", Usage: "Assigns a new name to the user group"},
-						cli.StringFlag{Name: "comment", Usage: "Adds a comment"},
-					},
+					Name:      "rm",
+					Usage:     "Removes one or more user CAs",
+					ArgsUsage: "USERCA...",
 					Action: func(c *cli.Context) error {
 						if c.NArg() < 1 {
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("userca:write"); err != nil {
 							return err
 						}
 
-						var usergroups []*dbmodels.UserGroup
-						if err := dbmodels.UserGroupsByIdentifiers(db, c.Args()).Find(&usergroups).Error; err != nil {
+						var userCAs []*dbmodels.UserCA
+						if err := dbmodels.UserCAsByIdentifiers(db, c.Args()).Find(&userCAs).Error; err != nil {
 							return err
 						}
+						tx := db.Begin()
+						for _, userCA := range userCAs {
+							if err := tx.Unscoped().Where("user_ca_id = ?", userCA.ID).Delete(&dbmodels.UserCertRevocation{}).Error; err != nil {
+								tx.Rollback()
+								return err
+							}
+							if err := tx.Unscoped().Delete(userCA).Error; err != nil {
+								tx.Rollback()
+								return err
+							}
+						}
+						return tx.Commit().Error
+					},
+				}, {
+					Name:      "unrevoke",
+					Usage:     "Lifts the revocation of one or more certificate serials",
+					ArgsUsage: "USERCA SERIAL...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 2 {
+							return cli.ShowSubcommandHelp(c)
+						}
 
-						if len(usergroups) > 1 && c.String("name") != "" {
-							return fmt.Errorf("cannot set --name when editing multiple usergroups at once")
+						if err := myself.CheckPermission("userca:write"); err != nil {
+							return err
 						}
 
-						tx := db.Begin()
-						for _, usergroup := range usergroups {
-							model := tx.Model(usergroup)
-							// simple fields
-							for _, fieldname := range []string{"name", "comment"} {
-								if c.String(fieldname) != "" {
-									if err := model.Update(fieldname, c.String(fieldname)).Error; err != nil {
-										tx.Rollback()
-										return err
-									}
-								}
+						var userCA dbmodels.UserCA
+						if err := dbmodels.UserCAsByIdentifiers(db, c.Args()[:1]).First(&userCA).Error; err != nil {
+							return err
+						}
+						serials := []uint64{}
+						for _, arg := range c.Args()[1:] {
+							serial, err := strconv.ParseUint(arg, 10, 64)
+							if err != nil {
+								return fmt.Errorf("invalid serial %q: %v", arg, err)
 							}
+							serials = append(serials, serial)
 						}
-						return tx.Commit().Error
+						return db.Unscoped().Where("user_ca_id = ? AND serial IN (?)", userCA.ID, serials).Delete(&dbmodels.UserCertRevocation{}).Error
 					},
 				},
 			},
@@ -2032,68 +3609,45 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("userkey:write"); err != nil {
 							return err
 						}
 
 						var user dbmodels.User
-						if err := dbmodels.UsersByIdentifiers(db, c.Args()).First(&user).Error; err != nil {
+						if err := dbmodels.UsersByIdentifiers(db.Preload("Roles"), c.Args()).First(&user).Error; err != nil {
 							return err
 						}
-
-						var reader *bufio.Reader
-						var term *terminal.Terminal
-						if len(sshCommand) == 0 { // interactive mode
-							term = terminal.NewTerminal(s, "Paste your key(s) and end with a blank line> ")
-						} else {
-							fmt.Fprintf(s, "Enter key(s):\n")
-							reader = bufio.NewReader(s)
+						if err := myself.CheckManage(&user); err != nil {
+							return err
 						}
 
-						for {
-							var text string
-							var errReadline error
-							if len(sshCommand) == 0 { // interactive mode
-								text, errReadline = term.ReadLine()
-							} else {
-								text, errReadline = reader.ReadString('\n')
-							}
-							if errReadline != nil && errReadline != io.EOF {
-								return errReadline
+						return readAuthorizedKeys(s, len(sshCommand) == 0, func(text string) error {
+							key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+							if err != nil {
+								return err
 							}
-							if text != "" && text != "\n" {
-								key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
-								if err != nil {
-									return err
-								}
 
-								userkey := dbmodels.UserKey{
-									User:          &user,
-									Key:           key.Marshal(),
-									Comment:       comment,
-									AuthorizedKey: string(gossh.MarshalAuthorizedKey(key)),
-								}
-								if c.String("comment") != "" {
-									userkey.Comment = c.String("comment")
-								}
+							userkey := dbmodels.UserKey{
+								User:          &user,
+								Key:           key.Marshal(),
+								Comment:       comment,
+								AuthorizedKey: string(gossh.MarshalAuthorizedKey(key)),
+							}
+							if c.String("comment") != "" {
+								userkey.Comment = c.String("comment")
+							}
 
-								if _, err := govalidator.ValidateStruct(userkey); err != nil {
-									return err
-								}
+							if _, err := govalidator.ValidateStruct(userkey); err != nil {
+								return err
+							}
 
-								// save the userkey in database
-								if err := db.Create(&userkey).Error; err != nil {
-									return err
-								}
-								fmt.Fprintf(s, "%d\n", userkey.ID)
-								if errReadline == io.EOF {
-									return nil
-								}
-							} else {
-								break
+							// save the userkey in database
+							if err := db.Create(&userkey).Error; err != nil {
+								return err
 							}
-						}
-						return nil
+							fmt.Fprintf(s, "%d\n", userkey.ID)
+							return nil
+						})
 					},
 				}, {
 					Name:      "inspect",
@@ -2104,7 +3658,7 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("userkey:read"); err != nil {
 							return err
 						}
 
@@ -2125,7 +3679,7 @@ GLOBAL OPTIONS:
 						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("userkey:read"); err != nil {
 							return err
 						}
 
@@ -2177,12 +3731,16 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("userkey:write"); err != nil {
 							return err
 						}
-						if err := dbmodels.UserKeysByIdentifiers(db, c.Args()).Find(&dbmodels.UserKey{}).Error; err != nil {
+						var userKeys []*dbmodels.UserKey
+						if err := dbmodels.UserKeysByIdentifiers(db.Preload("User.Roles"), c.Args()).Find(&userKeys).Error; err != nil {
 							var user dbmodels.User
-							if err := dbmodels.UsersByIdentifiers(db, c.Args()).First(&user).Error; err != nil {
+							if err := dbmodels.UsersByIdentifiers(db.Preload("Roles"), c.Args()).First(&user).Error; err != nil {
+								return err
+							}
+							if err := myself.CheckManage(&user); err != nil {
 								return err
 							}
 							if err := dbmodels.UserKeysByUserID(db, []string{fmt.Sprint(user.ID)}).Find(&dbmodels.UserKey{}).Error; err != nil {
@@ -2190,10 +3748,37 @@ GLOBAL OPTIONS:
 							}
 							return dbmodels.UserKeysByUserID(db, []string{fmt.Sprint(user.ID)}).Unscoped().Delete(&dbmodels.UserKey{}).Error
 						}
+						for _, userKey := range userKeys {
+							if userKey.User == nil {
+								continue
+							}
+							if err := myself.CheckManage(userKey.User); err != nil {
+								return err
+							}
+						}
 						return dbmodels.UserKeysByIdentifiers(db, c.Args()).Unscoped().Delete(&dbmodels.UserKey{}).Error
 					},
 				},
 			},
+		}, {
+			Name:  "server",
+			Usage: "Manages this sshportal instance",
+			Subcommands: []cli.Command{
+				{
+					Name:        "drain",
+					Usage:       "Stops accepting connections and shuts down once the running sessions are finished",
+					Description: "The sessions still running after the drain timeout of the server are closed.\n   Only the instance handling this shell is drained.",
+					Action: func(c *cli.Context) error {
+						if err := myself.CheckPermission("server:drain"); err != nil {
+							return err
+						}
+
+						Drain()
+						fmt.Fprintf(s, "draining, %d sessions running\n", runningSessions.count())
+						return nil
+					},
+				},
+			},
 		}, {
 			Name:  "session",
 			Usage: "Manages sessions",
@@ -2207,7 +3792,7 @@ GLOBAL OPTIONS:
 							return cli.ShowSubcommandHelp(c)
 						}
 
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("session:read"); err != nil {
 							return err
 						}
 
@@ -2220,6 +3805,48 @@ GLOBAL OPTIONS:
 						enc.SetIndent("", "  ")
 						return enc.Encode(sessions)
 					},
+				}, {
+					Name:      "kill",
+					Usage:     "Closes one or more active sessions",
+					ArgsUsage: "SESSION...",
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("session:kill"); err != nil {
+							return err
+						}
+
+						var sessions []*dbmodels.Session
+						if err := dbmodels.SessionsByIdentifiers(db, c.Args()).Find(&sessions).Error; err != nil {
+							return err
+						}
+						if len(sessions) == 0 {
+							return errors.New("no such session")
+						}
+
+						var failed []string
+						for _, session := range sessions {
+							if session.Status != string(dbmodels.SessionStatusActive) {
+								fmt.Fprintf(s, "session %d is not active\n", session.ID)
+								failed = append(failed, fmt.Sprint(session.ID))
+								continue
+							}
+							// sessions only live in the memory of the instance handling them
+							if !runningSessions.kill(session.ID, myself.Name) {
+								fmt.Fprintf(s, "session %d is not running on this instance\n", session.ID)
+								failed = append(failed, fmt.Sprint(session.ID))
+								continue
+							}
+							dbmodels.NewEvent("session", "kill").SetAuthor(myself).SetArg("session", session.ID).Log(db)
+							fmt.Fprintf(s, "%d\n", session.ID)
+						}
+						if len(failed) > 0 {
+							return fmt.Errorf("cannot kill sessions: %s", strings.Join(failed, ", "))
+						}
+						return nil
+					},
 				}, {
 					Name:  "ls",
 					Usage: "Lists sessions",
@@ -2229,7 +3856,7 @@ GLOBAL OPTIONS:
 						cli.BoolFlag{Name: "quiet, q", Usage: "Only display IDs"},
 					},
 					Action: func(c *cli.Context) error {
-						if err := myself.CheckRoles([]string{"admin"}); err != nil {
+						if err := myself.CheckPermission("session:read"); err != nil {
 							return err
 						}
 
@@ -2307,6 +3934,45 @@ GLOBAL OPTIONS:
 						table.Render()
 						return nil
 					},
+				}, {
+					Name:        "replay",
+					Usage:       "Replays the recording of a session, q or Ctrl-C stops it",
+					ArgsUsage:   "SESSION",
+					Description: "$> session replay 42\n   $> session replay --speed=4 --idle-cap=2s 42",
+					Flags: []cli.Flag{
+						cli.Float64Flag{Name: "speed, s", Value: 1, Usage: "Playback speed multiplier"},
+						cli.DurationFlag{Name: "idle-cap, i", Value: 5 * time.Second, Usage: "Maximum pause between two frames, 0 to disable"},
+						cli.BoolFlag{Name: "raw, r", Usage: "Dump the recording without timing"},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.ShowSubcommandHelp(c)
+						}
+
+						if err := myself.CheckPermission("session:read"); err != nil {
+							return err
+						}
+
+						var session dbmodels.Session
+						if err := dbmodels.SessionsByIdentifiers(db, c.Args()).First(&session).Error; err != nil {
+							return err
+						}
+						if c.Float64("speed") <= 0 {
+							return fmt.Errorf("invalid speed: %v", c.Float64("speed"))
+						}
+
+						err := replaySessionLogs(s, actx.logsLocation, session.ID, replayOptions{
+							Speed:   c.Float64("speed"),
+							IdleCap: c.Duration("idle-cap"),
+							Raw:     c.Bool("raw"),
+							Wait:    replayWaiter(s.Context(), input.keys()),
+						})
+						if err == errReplayAborted {
+							fmt.Fprint(s, "\r\n")
+							return nil
+						}
+						return err
+					},
 				},
 			},
 		}, {
@@ -2372,6 +4038,68 @@ GLOBAL OPTIONS:
 	return nil
 }
 
+// manageableUsers returns the IDs of the users matching the identifiers, or
+// an error if myself cannot manage one of them
+func manageableUsers(db *gorm.DB, myself *dbmodels.User, identifiers []string) ([]uint, error) {
+	var users []*dbmodels.User
+	if err := dbmodels.UsersByIdentifiers(db.Preload("Roles"), identifiers).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]uint, 0, len(users))
+	for _, user := range users {
+		if err := myself.CheckManage(user); err != nil {
+			return nil, err
+		}
+		ids = append(ids, user.ID)
+	}
+	return ids, nil
+}
+
+// checkSecretReference returns an error if value is a secret:// reference and
+// myself cannot use the secrets, a host pointing to another server with a
+// referenced password would send it there
+func checkSecretReference(myself *dbmodels.User, value string) error {
+	if !crypto.IsSecretReference(value) {
+		return nil
+	}
+	return myself.CheckPermission("secret:use")
+}
+
+// readAuthorizedKeys calls add with each key pasted in the interactive shell,
+// or sent to the standard input of a command, until a blank line
+func readAuthorizedKeys(s ssh.Session, interactive bool, add func(text string) error) error {
+	var reader *bufio.Reader
+	var term *terminal.Terminal
+	if interactive {
+		term = terminal.NewTerminal(s, "Paste your key(s) and end with a blank line> ")
+	} else {
+		fmt.Fprintf(s, "Enter key(s):\n")
+		reader = bufio.NewReader(s)
+	}
+
+	for {
+		var text string
+		var errReadline error
+		if interactive {
+			text, errReadline = term.ReadLine()
+		} else {
+			text, errReadline = reader.ReadString('\n')
+		}
+		if errReadline != nil && errReadline != io.EOF {
+			return errReadline
+		}
+		if text == "" || text == "\n" {
+			return nil
+		}
+		if err := add(text); err != nil {
+			return err
+		}
+		if errReadline == io.EOF {
+			return nil
+		}
+	}
+}
+
 func wrapText(in string, length int) string {
 	if len(in) <= length {
 		return in
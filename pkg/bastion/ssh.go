@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strings"
@@ -27,14 +28,21 @@ type authContext struct {
 	inputUsername   string
 	db              *gorm.DB
 	userKey         dbmodels.UserKey
+	certGroups      []*dbmodels.UserGroup
+	secondFactor    *secondFactorState
+	remoteForwards  *remoteForwards
 	logsLocation    string
 	aclCheckCmd     string
 	aesKey          string
 	dbDriver, dbURL string
 	bindAddr        string
 	demo, debug     bool
-	authMethod      string
-	authSuccess     bool
+	// hostPicker shows a menu of the allowed hosts to the users connecting with their own name
+	hostPicker  bool
+	authMethod  string
+	authSuccess bool
+	// clientIP is the address of the client evaluated by the ACLs
+	clientIP net.IP
 }
 
 type userType string
@@ -46,6 +54,14 @@ const (
 	userTypeShell       userType = "shell"
 )
 
+// remoteIP returns the IP address of a TCP client, or nil
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
 func (c authContext) userType() userType {
 	switch {
 	case c.inputUsername == "healthcheck":
@@ -105,6 +121,42 @@ func ChannelHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewCh
 		}
 	}
 
+	if actx.userType() != userTypeHealthcheck {
+		var err error
+		if newChan, err = secondFactorChannel(actx, newChan); err != nil {
+			log.Printf("Second factor failed: sshUser=%q remote=%q dbUser=id:%d,email:%s: %v", conn.User(), conn.RemoteAddr(), actx.user.ID, actx.user.Email, err)
+			return
+		}
+	}
+
+	if actx.userType() == userTypeShell && actx.hostPicker && actx.inputUsername != "admin" && newChan.ChannelType() == "session" {
+		var (
+			host *dbmodels.Host
+			err  error
+		)
+		if newChan, host, err = hostPickerChannel(actx, newChan); err != nil {
+			if err != errHostPickerQuit && err != io.EOF {
+				log.Printf("Host picker failed: sshUser=%q remote=%q dbUser=id:%d,email:%s: %v", conn.User(), conn.RemoteAddr(), actx.user.ID, actx.user.Email, err)
+			}
+			return
+		}
+		if host != nil {
+			log.Printf("New connection(picker): sshUser=%q remote=%q local=%q dbUser=id:%d,email:%s host=%q", conn.User(), conn.RemoteAddr(), conn.LocalAddr(), actx.user.ID, actx.user.Email, host.Name)
+			// the picked host is loaded as if the user connected to it
+			if host, err = dbmodels.HostByName(actx.db, host.Name); err != nil {
+				ch, _, err2 := newChan.Accept()
+				if err2 != nil {
+					return
+				}
+				fmt.Fprintf(ch, "error: %v\r\n", err)
+				_ = ch.Close()
+				return
+			}
+			bastionChannel(conn, newChan, ctx, host)
+			return
+		}
+	}
+
 	switch actx.userType() {
 	case userTypeBastion:
 		log.Printf("New connection(bastion): sshUser=%q remote=%q local=%q dbUser=id:%d,email:%s", conn.User(), conn.RemoteAddr(), conn.LocalAddr(), actx.user.ID, actx.user.Email)
@@ -119,114 +171,225 @@ func ChannelHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewCh
 			_ = ch.Close()
 			return
 		}
+		bastionChannel(conn, newChan, ctx, host)
+	default: // shell
+		DefaultChannelHandler(srv, conn, newChan, ctx)
+	}
+}
 
-		switch host.Scheme() {
-		case dbmodels.BastionSchemeSSH:
-			sessionConfigs := make([]sessionConfig, 0)
-			currentHost := host
-			for currentHost != nil {
-				clientConfig, err2 := bastionClientConfig(ctx, currentHost)
-				if err2 != nil {
-					ch, _, err3 := newChan.Accept()
-					if err3 != nil {
-						return
-					}
-					fmt.Fprintf(ch, "error: %v\n", err2)
-					// FIXME: force close all channels
-					_ = ch.Close()
-					return
-				}
-				sessionConfigs = append([]sessionConfig{{
-					Addr:         currentHost.DialAddr(),
-					ClientConfig: clientConfig,
-					LogsLocation: actx.logsLocation,
-					LoggingMode:  currentHost.Logging,
-				}}, sessionConfigs...)
-				if currentHost.HopID != 0 {
-					var newHost dbmodels.Host
-					if err := actx.db.Model(currentHost).Association("HopID").Find(&newHost); err != nil {
-						log.Printf("Error: %v", err)
-						return
-					}
-					hostname := newHost.Name
-					currentHost, _ = dbmodels.HostByName(actx.db, hostname)
-				} else {
-					currentHost = nil
-				}
-			}
-
-			sess := dbmodels.Session{
-				UserID: actx.user.ID,
-				HostID: host.ID,
-				Status: string(dbmodels.SessionStatusActive),
-			}
-			if err = actx.db.Create(&sess).Error; err != nil {
-				ch, _, err2 := newChan.Accept()
-				if err2 != nil {
-					return
-				}
-				fmt.Fprintf(ch, "error: %v\n", err)
-				_ = ch.Close()
+// bastionChannel proxies newChan to host
+func bastionChannel(conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context, host *dbmodels.Host) {
+	actx := ctx.Value(authContextKey).(*authContext)
+	var err error
+	switch host.Scheme() {
+	case dbmodels.BastionSchemeSSH:
+		sessionConfigs, err2 := hostSessionConfigs(ctx, host)
+		if err2 != nil {
+			ch, _, err3 := newChan.Accept()
+			if err3 != nil {
 				return
 			}
-			go func() {
-				err = multiChannelHandler(conn, newChan, ctx, sessionConfigs, sess.ID)
-				if err != nil {
-					log.Printf("Error: %v", err)
-				}
-
-				now := time.Now()
-				sessUpdate := dbmodels.Session{
-					Status:    string(dbmodels.SessionStatusClosed),
-					ErrMsg:    fmt.Sprintf("%v", err),
-					StoppedAt: &now,
-				}
-				if err == nil {
-					sessUpdate.ErrMsg = ""
-				}
-				actx.db.Model(&sess).Updates(&sessUpdate)
-			}()
-		case dbmodels.BastionSchemeTelnet:
-			tmpSrv := ssh.Server{
-				// PtyCallback: srv.PtyCallback,
-				Handler: telnetHandler(host),
+			fmt.Fprintf(ch, "error: %v\n", err2)
+			// FIXME: force close all channels
+			_ = ch.Close()
+			return
+		}
+		// the interactive sessions need a pty and the tunnels opened by the
+		// client are forwarded by the target
+		target := &sessionConfigs[len(sessionConfigs)-1]
+		target.PTY = newChan.ChannelType() == "session"
+		target.PortForward = newChan.ChannelType() == "direct-tcpip"
+
+		sess := dbmodels.Session{
+			UserID:     actx.user.ID,
+			HostID:     host.ID,
+			Status:     string(dbmodels.SessionStatusActive),
+			ClientAddr: conn.RemoteAddr().String(),
+			SourceCIDR: sessionConfigs[len(sessionConfigs)-1].SourceCIDR,
+		}
+		if err = actx.db.Create(&sess).Error; err != nil {
+			ch, _, err2 := newChan.Accept()
+			if err2 != nil {
+				return
 			}
-			DefaultChannelHandler(&tmpSrv, conn, newChan, ctx)
-		default:
+			fmt.Fprintf(ch, "error: %v\n", err)
+			_ = ch.Close()
+			return
+		}
+		if err = signSessionCertificates(sessionConfigs, actx.user, sess.ID); err != nil {
+			now := time.Now()
+			actx.db.Model(&sess).Updates(&dbmodels.Session{
+				Status:    string(dbmodels.SessionStatusClosed),
+				ErrMsg:    err.Error(),
+				StoppedAt: &now,
+			})
 			ch, _, err2 := newChan.Accept()
 			if err2 != nil {
 				return
 			}
-			fmt.Fprintf(ch, "error: unknown bastion scheme: %q\n", host.Scheme())
-			// FIXME: force close all channels
+			fmt.Fprintf(ch, "error: %v\n", err)
 			_ = ch.Close()
+			return
 		}
-	default: // shell
-		DefaultChannelHandler(srv, conn, newChan, ctx)
+		kill := runningSessions.register(sess.ID)
+		stopSchedule := closeAtScheduleEnd(sess.ID, sessionConfigs[len(sessionConfigs)-1])
+		go func() {
+			defer runningSessions.unregister(sess.ID)
+			defer stopSchedule()
+			err = multiChannelHandler(conn, newChan, ctx, sessionConfigs, sess.ID, kill)
+			if err != nil {
+				log.Printf("Error: %v", err)
+			}
+
+			now := time.Now()
+			sessUpdate := dbmodels.Session{
+				Status:    string(dbmodels.SessionStatusClosed),
+				ErrMsg:    fmt.Sprintf("%v", err),
+				StoppedAt: &now,
+			}
+			if err == nil {
+				sessUpdate.ErrMsg = ""
+			}
+			actx.db.Model(&sess).Updates(&sessUpdate)
+		}()
+	case dbmodels.BastionSchemeTelnet:
+		tmpSrv := ssh.Server{
+			// PtyCallback: srv.PtyCallback,
+			Handler: telnetHandler(host),
+		}
+		DefaultChannelHandler(&tmpSrv, conn, newChan, ctx)
+	default:
+		ch, _, err2 := newChan.Accept()
+		if err2 != nil {
+			return
+		}
+		fmt.Fprintf(ch, "error: unknown bastion scheme: %q\n", host.Scheme())
+		// FIXME: force close all channels
+		_ = ch.Close()
 	}
 }
 
-func bastionClientConfig(ctx ssh.Context, host *dbmodels.Host) (*gossh.ClientConfig, error) {
+// hostSessionConfigs returns the configurations to reach host through its hops, in dialing order
+func hostSessionConfigs(ctx ssh.Context, host *dbmodels.Host) ([]sessionConfig, error) {
 	actx := ctx.Value(authContextKey).(*authContext)
+	sessionConfigs := make([]sessionConfig, 0)
+	currentHost := host
+	for currentHost != nil {
+		clientConfig, err := bastionClientConfig(ctx, currentHost)
+		if err != nil {
+			return nil, err
+		}
+		sessionConfigs = append([]sessionConfig{{
+			Addr:            currentHost.DialAddr(),
+			ClientConfig:    clientConfig,
+			LogsLocation:    actx.logsLocation,
+			LoggingMode:     currentHost.Logging,
+			TransferPolicy:  currentHost.TransferPolicy,
+			RecordingFormat: currentHost.RecordingFormat,
+			CAKey:           currentHost.CAKey,
+		}}, sessionConfigs...)
+		if currentHost.HopID != 0 {
+			var newHost dbmodels.Host
+			if err := actx.db.Model(currentHost).Association("HopID").Find(&newHost); err != nil {
+				return nil, err
+			}
+			hostname := newHost.Name
+			currentHost, _ = dbmodels.HostByName(actx.db, hostname)
+		} else {
+			currentHost = nil
+		}
+	}
 
-	crypto.HostDecrypt(actx.aesKey, host)
-	crypto.SSHKeyDecrypt(actx.aesKey, host.SSHKey)
-
-	clientConfig, err := host.ClientConfig(dynamicHostKey(actx.db, host))
+	tmpUser, tmpHost, err := aclSubjects(actx, host)
 	if err != nil {
 		return nil, err
 	}
+	// agent forwarding is allowed by the target host or by the ACL granting the access to it
+	target := &sessionConfigs[len(sessionConfigs)-1]
+	target.AgentForward = host.AllowAgentForward || checkAgentForwardACLs(tmpUser, tmpHost, actx.clientIP)
+	target.ScheduleEnd = aclScheduleEnd(tmpUser, tmpHost, actx.clientIP, time.Now())
+	target.SourceCIDR = aclSourceCIDR(tmpUser, tmpHost, actx.clientIP)
+	return sessionConfigs, nil
+}
 
+// aclSubjects loads the user and the host with the groups and ACLs used by checkACLs
+func aclSubjects(actx *authContext, host *dbmodels.Host) (dbmodels.User, dbmodels.Host, error) {
 	var tmpUser dbmodels.User
-	if err = actx.db.Preload("Groups").Preload("Groups.ACLs").Where("id = ?", actx.user.ID).First(&tmpUser).Error; err != nil {
-		return nil, err
+	if err := actx.db.Preload("Groups").Where("id = ?", actx.user.ID).First(&tmpUser).Error; err != nil {
+		return tmpUser, dbmodels.Host{}, err
 	}
+	// groups granted by the certificate principals
+	tmpUser.Groups = append(tmpUser.Groups, actx.certGroups...)
 	var tmpHost dbmodels.Host
-	if err = actx.db.Preload("Groups").Preload("Groups.ACLs").Where("id = ?", host.ID).First(&tmpHost).Error; err != nil {
+	if err := actx.db.Preload("Groups").Where("id = ?", host.ID).First(&tmpHost).Error; err != nil {
+		return tmpUser, tmpHost, err
+	}
+	return tmpUser, tmpHost, expandACLSubjects(actx.db, &tmpUser, &tmpHost)
+}
+
+// aclUser loads the user with the expanded groups and ACLs used by checkACLs
+func aclUser(actx *authContext) (dbmodels.User, error) {
+	var tmpUser dbmodels.User
+	if err := actx.db.Preload("Groups").Where("id = ?", actx.user.ID).First(&tmpUser).Error; err != nil {
+		return tmpUser, err
+	}
+	// groups granted by the certificate principals
+	groups, err := dbmodels.UserGroupsWithParents(actx.db, append(tmpUser.Groups, actx.certGroups...))
+	if err != nil {
+		return tmpUser, err
+	}
+	tmpUser.Groups = groups
+	return tmpUser, nil
+}
+
+// expandACLSubjects replaces the groups of user and host with their groups
+// and the groups containing them, transitively, with their ACLs
+func expandACLSubjects(db *gorm.DB, user *dbmodels.User, host *dbmodels.Host) error {
+	userGroups, err := dbmodels.UserGroupsWithParents(db, user.Groups)
+	if err != nil {
+		return err
+	}
+	user.Groups = userGroups
+	hostGroups, err := dbmodels.HostGroupsWithParents(db, host.Groups)
+	if err != nil {
+		return err
+	}
+	host.Groups = hostGroups
+	return nil
+}
+
+func bastionClientConfig(ctx ssh.Context, host *dbmodels.Host) (*gossh.ClientConfig, error) {
+	actx := ctx.Value(authContextKey).(*authContext)
+
+	if err := crypto.HostDecrypt(actx.aesKey, host); err != nil {
+		return nil, err
+	}
+	if err := crypto.HostResolveSecrets(host); err != nil {
 		return nil, err
 	}
+	for _, key := range []*dbmodels.SSHKey{host.SSHKey, host.CAKey} {
+		if key == nil {
+			continue
+		}
+		if err := crypto.SSHKeyDecrypt(actx.aesKey, key); err != nil {
+			return nil, err
+		}
+		if err := crypto.SSHKeyResolveSecrets(key); err != nil {
+			return nil, err
+		}
+	}
 
-	action := checkACLs(tmpUser, tmpHost, actx.aclCheckCmd)
+	clientConfig, err := host.ClientConfig(dynamicHostKey(actx.db, host))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpUser, tmpHost, err := aclSubjects(actx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	action := checkACLs(tmpUser, tmpHost, actx.clientIP, actx.aclCheckCmd)
 	switch action {
 	case string(dbmodels.ACLActionAllow):
 		// do nothing
@@ -238,6 +401,48 @@ func bastionClientConfig(ctx ssh.Context, host *dbmodels.Host) (*gossh.ClientCon
 	return clientConfig, nil
 }
 
+// sessionCertificateTTL is the validity of the certificates signed for each
+// session, they are only used during the authentication with the host
+const sessionCertificateTTL = 5 * time.Minute
+
+// signSessionCertificates adds a short-lived certificate to the hops whose
+// host has a CA key, the key ID identifies the sshportal user and session.
+//
+// The intermediate hops are only used to reach the next one, the target is
+// only permitted the pty, agent and port forwarding allowed by its config.
+func signSessionCertificates(configs []sessionConfig, user dbmodels.User, sessionID uint) error {
+	for i, config := range configs {
+		if config.CAKey == nil {
+			continue
+		}
+		extensions := []string{"permit-port-forwarding"}
+		if i == len(configs)-1 {
+			extensions = sessionCertificateExtensions(config)
+		}
+		keyID := fmt.Sprintf("sshportal:user_id=%d:user=%s:session=%d", user.ID, user.Name, sessionID)
+		signer, err := crypto.NewSessionCertSigner(config.CAKey, config.ClientConfig.User, keyID, extensions, sessionCertificateTTL)
+		if err != nil {
+			return fmt.Errorf("cannot sign session certificate: %v", err)
+		}
+		config.ClientConfig.Auth = append([]gossh.AuthMethod{gossh.PublicKeys(signer)}, config.ClientConfig.Auth...)
+	}
+	return nil
+}
+
+func sessionCertificateExtensions(config sessionConfig) []string {
+	extensions := []string{}
+	if config.PTY {
+		extensions = append(extensions, "permit-pty")
+	}
+	if config.AgentForward {
+		extensions = append(extensions, "permit-agent-forwarding")
+	}
+	if config.PortForward {
+		extensions = append(extensions, "permit-port-forwarding")
+	}
+	return extensions
+}
+
 func ShellHandler(s ssh.Session, version, gitSha, gitTag string) {
 	actx := s.Context().Value(authContextKey).(*authContext)
 	if actx.userType() != userTypeHealthcheck {
@@ -271,20 +476,25 @@ func ShellHandler(s ssh.Session, version, gitSha, gitTag string) {
 	panic("should not happen")
 }
 
-func PasswordAuthHandler(db *gorm.DB, logsLocation, aclCheckCmd, aesKey, dbDriver, dbURL, bindAddr string, demo bool) ssh.PasswordHandler {
+func PasswordAuthHandler(db *gorm.DB, logsLocation, aclCheckCmd, aesKey, dbDriver, dbURL, bindAddr string, demo, hostPicker bool) ssh.PasswordHandler {
 	return func(ctx ssh.Context, pass string) bool {
 		actx := &authContext{
-			db:            db,
-			inputUsername: ctx.User(),
-			logsLocation:  logsLocation,
-			aclCheckCmd:   aclCheckCmd,
-			aesKey:        aesKey,
-			dbDriver:      dbDriver,
-			dbURL:         dbURL,
-			bindAddr:      bindAddr,
-			demo:          demo,
-			authMethod:    "password",
+			db:             db,
+			inputUsername:  ctx.User(),
+			logsLocation:   logsLocation,
+			aclCheckCmd:    aclCheckCmd,
+			aesKey:         aesKey,
+			dbDriver:       dbDriver,
+			dbURL:          dbURL,
+			bindAddr:       bindAddr,
+			demo:           demo,
+			hostPicker:     hostPicker,
+			authMethod:     "password",
+			clientIP:       remoteIP(ctx.RemoteAddr()),
+			secondFactor:   &secondFactorState{},
+			remoteForwards: newRemoteForwards(),
 		}
+		defer recordAuthAttempt(actx)
 		actx.authSuccess = actx.userType() == userTypeHealthcheck
 		ctx.SetValue(authContextKey, actx)
 		return actx.authSuccess
@@ -297,7 +507,12 @@ func PrivateKeyFromDB(db *gorm.DB, aesKey string) func(*ssh.Server) error {
 		if err := dbmodels.SSHKeysByIdentifiers(db, []string{"host"}).First(&key).Error; err != nil {
 			return err
 		}
-		crypto.SSHKeyDecrypt(aesKey, &key)
+		if err := crypto.SSHKeyDecrypt(aesKey, &key); err != nil {
+			return err
+		}
+		if err := crypto.SSHKeyResolveSecrets(&key); err != nil {
+			return err
+		}
 
 		signer, err := gossh.ParsePrivateKey([]byte(key.PrivKey))
 		if err != nil {
@@ -308,23 +523,42 @@ func PrivateKeyFromDB(db *gorm.DB, aesKey string) func(*ssh.Server) error {
 	}
 }
 
-func PublicKeyAuthHandler(db *gorm.DB, logsLocation, aclCheckCmd, aesKey, dbDriver, dbURL, bindAddr string, demo bool) ssh.PublicKeyHandler {
+func PublicKeyAuthHandler(db *gorm.DB, logsLocation, aclCheckCmd, aesKey, dbDriver, dbURL, bindAddr string, demo, hostPicker bool) ssh.PublicKeyHandler {
 	return func(ctx ssh.Context, key ssh.PublicKey) bool {
 		actx := &authContext{
-			db:            db,
-			inputUsername: ctx.User(),
-			logsLocation:  logsLocation,
-			aclCheckCmd:   aclCheckCmd,
-			aesKey:        aesKey,
-			dbDriver:      dbDriver,
-			dbURL:         dbURL,
-			bindAddr:      bindAddr,
-			demo:          demo,
-			authMethod:    "pubkey",
-			authSuccess:   true,
+			db:             db,
+			inputUsername:  ctx.User(),
+			logsLocation:   logsLocation,
+			aclCheckCmd:    aclCheckCmd,
+			aesKey:         aesKey,
+			dbDriver:       dbDriver,
+			dbURL:          dbURL,
+			bindAddr:       bindAddr,
+			demo:           demo,
+			hostPicker:     hostPicker,
+			authMethod:     "pubkey",
+			clientIP:       remoteIP(ctx.RemoteAddr()),
+			authSuccess:    true,
+			secondFactor:   &secondFactorState{},
+			remoteForwards: newRemoteForwards(),
 		}
+		defer recordAuthAttempt(actx)
 		ctx.SetValue(authContextKey, actx)
 
+		// lookup user by certificate
+		if cert, ok := key.(*gossh.Certificate); ok {
+			if actx.userType() == userTypeInvite {
+				actx.err = errors.New("invites are only supported for new SSH keys, not certificates")
+			} else if err := userCertificateAuth(db, actx, cert, ctx.RemoteAddr()); err != nil {
+				actx.err = err
+			}
+			if actx.err != nil {
+				actx.user = dbmodels.User{Name: "Anonymous"}
+			}
+			actx.authMethod = "certificate"
+			return true
+		}
+
 		// lookup user by key
 		db.Where("authorized_key = ?", string(gossh.MarshalAuthorizedKey(key))).First(&actx.userKey)
 		if actx.userKey.UserID > 0 {
@@ -0,0 +1,46 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/crypto"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+func TestSignSessionCertificates(t *testing.T) {
+	Convey("Testing signSessionCertificates", t, func() {
+		caKey, err := crypto.NewSSHKey("ed25519", 1)
+		So(err, ShouldBeNil)
+		caPub, _, _, _, err := gossh.ParseAuthorizedKey([]byte(caKey.PubKey))
+		So(err, ShouldBeNil)
+
+		configs := []sessionConfig{
+			{ClientConfig: &gossh.ClientConfig{User: "hop"}},
+			{ClientConfig: &gossh.ClientConfig{User: "deploy"}, CAKey: caKey},
+		}
+		So(signSessionCertificates(configs, dbmodels.User{Email: "alice@example.com"}, 42), ShouldBeNil)
+		So(len(configs[0].ClientConfig.Auth), ShouldEqual, 0)
+		So(len(configs[1].ClientConfig.Auth), ShouldEqual, 1)
+
+		signer, err := crypto.NewSessionCertSigner(caKey, "deploy", "test", []string{"permit-pty"}, sessionCertificateTTL)
+		So(err, ShouldBeNil)
+		cert, ok := signer.PublicKey().(*gossh.Certificate)
+		So(ok, ShouldBeTrue)
+		So(cert.ValidPrincipals, ShouldResemble, []string{"deploy"})
+		So(cert.Permissions.Extensions, ShouldResemble, map[string]string{"permit-pty": ""})
+		So(cert.ValidBefore, ShouldBeLessThanOrEqualTo, uint64(time.Now().Add(sessionCertificateTTL).Unix()))
+
+		checker := gossh.CertChecker{}
+		So(checker.CheckCert("deploy", cert), ShouldBeNil)
+		So(checker.CheckCert("root", cert), ShouldNotBeNil)
+		So(gossh.FingerprintSHA256(cert.SignatureKey), ShouldEqual, gossh.FingerprintSHA256(caPub))
+
+		// the target is only permitted what its config allows
+		So(sessionCertificateExtensions(sessionConfig{}), ShouldBeEmpty)
+		So(sessionCertificateExtensions(sessionConfig{PTY: true, AgentForward: true}), ShouldResemble, []string{"permit-pty", "permit-agent-forwarding"})
+		So(sessionCertificateExtensions(sessionConfig{PortForward: true}), ShouldResemble, []string{"permit-port-forwarding"})
+	})
+}
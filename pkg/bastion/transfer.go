@@ -0,0 +1,603 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+type transferMode int
+
+const (
+	transferModeNone transferMode = iota
+	transferModeSFTP
+	transferModeSCPUpload
+	transferModeSCPDownload
+	// transferModePassthrough is used when the stream cannot be parsed anymore
+	transferModePassthrough
+)
+
+// sftp packet types, see draft-ietf-secsh-filexfer-02
+const (
+	sftpInit          = 1
+	sftpOpen          = 3
+	sftpClose         = 4
+	sftpRead          = 5
+	sftpWrite         = 6
+	sftpSetstat       = 9
+	sftpFsetstat      = 10
+	sftpRemove        = 13
+	sftpMkdir         = 14
+	sftpRmdir         = 15
+	sftpRename        = 18
+	sftpSymlink       = 20
+	sftpStatus        = 101
+	sftpHandle        = 102
+	sftpData          = 103
+	sftpExtended      = 200
+	sftpFlagRead      = 0x01
+	sftpFlagWrite     = 0x02
+	sftpFlagAppend    = 0x04
+	sftpFlagCreat     = 0x08
+	sftpFlagTrunc     = 0x10
+	sftpStatusOK      = 0
+	sftpStatusDenied  = 3
+	sftpMaxPacketSize = 1 << 24
+)
+
+var sftpStatusNames = []string{"ok", "eof", "no such file", "permission denied", "failure", "bad message", "no connection", "connection lost", "operation unsupported"}
+
+type sftpPendingOp struct {
+	action string
+	path   string
+	target string
+	handle string
+	size   int
+}
+
+type sftpFile struct {
+	path              string
+	read, written     int64
+	readOp, writeOp   bool
+	readErr, writeErr string
+}
+
+// transferAuditor inspects the file transfers (sftp subsystem and legacy scp)
+// going through a session channel, records them as events and enforces the
+// host transfer policy.
+type transferAuditor struct {
+	db        *gorm.DB
+	user      dbmodels.User
+	sessionID uint
+	policy    string
+	lch, rch  gossh.Channel
+
+	mu       sync.Mutex
+	lchMu    sync.Mutex
+	mode     transferMode
+	target   string
+	upBuf    []byte
+	downBuf  []byte
+	pending  map[uint32]*sftpPendingOp
+	handles  map[string]*sftpFile
+	scpState scpParser
+}
+
+func newTransferAuditor(db *gorm.DB, user dbmodels.User, sessionID uint, policy string, lch, rch gossh.Channel) *transferAuditor {
+	return &transferAuditor{
+		db:        db,
+		user:      user,
+		sessionID: sessionID,
+		policy:    policy,
+		lch:       lch,
+		rch:       rch,
+		pending:   map[uint32]*sftpPendingOp{},
+		handles:   map[string]*sftpFile{},
+	}
+}
+
+func (a *transferAuditor) uploadAllowed() bool {
+	return a.policy != "deny" && a.policy != "deny-upload"
+}
+
+func (a *transferAuditor) downloadAllowed() bool {
+	return a.policy != "deny" && a.policy != "deny-download"
+}
+
+func (a *transferAuditor) event(domain, action, path string) *dbmodels.Event {
+	event := dbmodels.NewEvent(domain, action).SetAuthor(&a.user).SetArg("session", a.sessionID).SetArg("path", path)
+	event.Entity = path
+	return event
+}
+
+// checkRequest inspects session requests sent by the client, switches the
+// auditor to the right transfer mode and returns an error if the transfer is
+// not allowed by the host policy.
+func (a *transferAuditor) checkRequest(req *gossh.Request) error {
+	var payload struct{ Value string }
+	switch req.Type {
+	case "subsystem":
+		if err := gossh.Unmarshal(req.Payload, &payload); err != nil || payload.Value != "sftp" {
+			return nil
+		}
+		if !a.uploadAllowed() && !a.downloadAllowed() {
+			a.event("sftp", "denied", "").SetArg("result", "denied by policy").Log(a.db)
+			return fmt.Errorf("file transfers are not allowed on this host")
+		}
+		a.setMode(transferModeSFTP, "")
+	case "exec":
+		if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+			return nil
+		}
+		mode, target := parseSCPCommand(payload.Value)
+		switch mode {
+		case transferModeSCPUpload:
+			if !a.uploadAllowed() {
+				a.event("scp", "denied", target).SetArg("result", "upload denied by policy").Log(a.db)
+				return fmt.Errorf("uploads are not allowed on this host")
+			}
+		case transferModeSCPDownload:
+			if !a.downloadAllowed() {
+				a.event("scp", "denied", target).SetArg("result", "download denied by policy").Log(a.db)
+				return fmt.Errorf("downloads are not allowed on this host")
+			}
+		default:
+			return nil
+		}
+		a.setMode(mode, target)
+	}
+	return nil
+}
+
+func (a *transferAuditor) setMode(mode transferMode, target string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.mode = mode
+	a.target = target
+}
+
+// parseSCPCommand detects legacy scp remote invocations ("scp -t DIR" or "scp -f FILE")
+func parseSCPCommand(command string) (transferMode, string) {
+	fields := strings.Fields(command)
+	if len(fields) < 2 || path.Base(fields[0]) != "scp" {
+		return transferModeNone, ""
+	}
+	mode := transferModeNone
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "-") || field == "--" {
+			continue
+		}
+		switch {
+		case strings.Contains(field, "t"):
+			mode = transferModeSCPUpload
+		case strings.Contains(field, "f"):
+			mode = transferModeSCPDownload
+		}
+	}
+	return mode, fields[len(fields)-1]
+}
+
+// upstream wraps the writer used to copy data from the client to the target
+func (a *transferAuditor) upstream(logged io.Writer) io.Writer {
+	return transferWriter{a: a, logged: logged, fromClient: true}
+}
+
+// downstream wraps the writer used to copy data from the target to the client
+func (a *transferAuditor) downstream(logged io.Writer) io.Writer {
+	return transferWriter{a: a, logged: logged}
+}
+
+type transferWriter struct {
+	a          *transferAuditor
+	logged     io.Writer
+	fromClient bool
+}
+
+func (w transferWriter) Write(data []byte) (int, error) {
+	a := w.a
+	a.mu.Lock()
+	mode := a.mode
+	a.mu.Unlock()
+
+	switch mode {
+	case transferModeSFTP:
+		if w.fromClient {
+			return a.writeSFTPRequests(data)
+		}
+		return a.writeSFTPResponses(data)
+	case transferModeSCPUpload:
+		// binary file content is not recorded in the session log
+		if w.fromClient {
+			a.feedSCP(data, "write")
+		}
+		return a.writeRaw(w.fromClient, data)
+	case transferModeSCPDownload:
+		if !w.fromClient {
+			a.feedSCP(data, "read")
+		}
+		return a.writeRaw(w.fromClient, data)
+	case transferModePassthrough:
+		return a.writeRaw(w.fromClient, data)
+	default:
+		return w.logged.Write(data)
+	}
+}
+
+func (a *transferAuditor) writeRaw(fromClient bool, data []byte) (int, error) {
+	if fromClient {
+		return a.rch.Write(data)
+	}
+	a.lchMu.Lock()
+	defer a.lchMu.Unlock()
+	return a.lch.Write(data)
+}
+
+// close records the files that were still open when the session ended
+func (a *transferAuditor) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for handle, file := range a.handles {
+		a.logSFTPFile(file, "unclosed")
+		delete(a.handles, handle)
+	}
+}
+
+//
+// sftp
+//
+
+// splitSFTPPackets returns the complete packets of buf and the remaining bytes
+func splitSFTPPackets(buf []byte) ([][]byte, []byte, error) {
+	var packets [][]byte
+	for len(buf) >= 5 {
+		length := binary.BigEndian.Uint32(buf)
+		if length == 0 || length > sftpMaxPacketSize {
+			return nil, nil, fmt.Errorf("invalid sftp packet length: %d", length)
+		}
+		if uint32(len(buf)-4) < length {
+			break
+		}
+		packets = append(packets, buf[:4+length])
+		buf = buf[4+length:]
+	}
+	return packets, buf, nil
+}
+
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	length := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < length {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	v := string(r.data[:length])
+	r.data = r.data[length:]
+	return v
+}
+
+func sftpStatusPacket(id uint32, code uint32, message string) []byte {
+	packet := make([]byte, 4+1+4+4+4+len(message)+4)
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	packet[4] = sftpStatus
+	binary.BigEndian.PutUint32(packet[5:], id)
+	binary.BigEndian.PutUint32(packet[9:], code)
+	binary.BigEndian.PutUint32(packet[13:], uint32(len(message)))
+	copy(packet[17:], message)
+	// the trailing language tag is left empty
+	return packet
+}
+
+func sftpStatusName(code uint32) string {
+	if int(code) < len(sftpStatusNames) {
+		return sftpStatusNames[code]
+	}
+	return fmt.Sprintf("status %d", code)
+}
+
+func (a *transferAuditor) passthrough(err error) {
+	log.Printf("warning: session %d: %v, disabling transfer auditing", a.sessionID, err)
+	a.event("sftp", "error", "").SetArg("result", err.Error()).Log(a.db)
+	a.mode = transferModePassthrough
+	a.upBuf, a.downBuf = nil, nil
+}
+
+func (a *transferAuditor) writeSFTPRequests(data []byte) (int, error) {
+	a.mu.Lock()
+	a.upBuf = append(a.upBuf, data...)
+	packets, rest, err := splitSFTPPackets(a.upBuf)
+	if err != nil {
+		pending := a.upBuf
+		a.passthrough(err)
+		a.mu.Unlock()
+		if _, err := a.rch.Write(pending); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	a.upBuf = append([]byte(nil), rest...)
+	var forward, denied [][]byte
+	for _, packet := range packets {
+		if id, deny := a.inspectSFTPRequest(packet[4:]); deny {
+			denied = append(denied, sftpStatusPacket(id, sftpStatusDenied, "denied by sshportal transfer policy"))
+			continue
+		}
+		forward = append(forward, packet)
+	}
+	a.mu.Unlock()
+
+	for _, packet := range forward {
+		if _, err := a.rch.Write(packet); err != nil {
+			return 0, err
+		}
+	}
+	for _, packet := range denied {
+		if _, err := a.writeRaw(false, packet); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// inspectSFTPRequest records the pending request and reports whether it must be denied
+func (a *transferAuditor) inspectSFTPRequest(packet []byte) (uint32, bool) {
+	if packet[0] == sftpInit {
+		return 0, false
+	}
+	r := sftpReader{data: packet[1:]}
+	id := r.uint32()
+	op := &sftpPendingOp{}
+	modification := false
+	switch packet[0] {
+	case sftpOpen:
+		op.action, op.path = "open", r.string()
+		flags := r.uint32()
+		if flags&sftpFlagRead != 0 && !a.downloadAllowed() {
+			a.event("sftp", "open", op.path).SetArg("result", "download denied by policy").Log(a.db)
+			return id, true
+		}
+		if flags&(sftpFlagWrite|sftpFlagAppend|sftpFlagCreat|sftpFlagTrunc) != 0 && !a.uploadAllowed() {
+			a.event("sftp", "open", op.path).SetArg("result", "upload denied by policy").Log(a.db)
+			return id, true
+		}
+	case sftpClose:
+		op.action, op.handle = "close", r.string()
+	case sftpRead:
+		op.action, op.handle = "read", r.string()
+	case sftpWrite:
+		op.action, op.handle = "write", r.string()
+		r.uint32()
+		r.uint32() // offset
+		op.size = len(r.string())
+	case sftpRemove:
+		op.action, op.path, modification = "remove", r.string(), true
+	case sftpMkdir:
+		op.action, op.path, modification = "mkdir", r.string(), true
+	case sftpRmdir:
+		op.action, op.path, modification = "rmdir", r.string(), true
+	case sftpRename:
+		op.action, op.path, modification = "rename", r.string(), true
+		op.target = r.string()
+	case sftpSetstat, sftpFsetstat, sftpSymlink:
+		modification = true
+	case sftpExtended:
+		switch r.string() {
+		case "posix-rename@openssh.com":
+			op.action, op.path, modification = "rename", r.string(), true
+			op.target = r.string()
+		case "hardlink@openssh.com":
+			modification = true
+		}
+	}
+	if r.err != nil {
+		return id, false
+	}
+	if modification && !a.uploadAllowed() {
+		if op.action != "" {
+			a.event("sftp", op.action, op.path).SetArg("result", "denied by policy").Log(a.db)
+		}
+		return id, true
+	}
+	if op.action != "" {
+		a.pending[id] = op
+	}
+	return id, false
+}
+
+func (a *transferAuditor) writeSFTPResponses(data []byte) (int, error) {
+	a.mu.Lock()
+	a.downBuf = append(a.downBuf, data...)
+	packets, rest, err := splitSFTPPackets(a.downBuf)
+	if err != nil {
+		pending := a.downBuf
+		a.passthrough(err)
+		a.mu.Unlock()
+		if _, err := a.writeRaw(false, pending); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	a.downBuf = append([]byte(nil), rest...)
+	for _, packet := range packets {
+		a.inspectSFTPResponse(packet[4:])
+	}
+	a.mu.Unlock()
+
+	// complete packets are written at once so that policy denials are never interleaved
+	for _, packet := range packets {
+		if _, err := a.writeRaw(false, packet); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (a *transferAuditor) inspectSFTPResponse(packet []byte) {
+	r := sftpReader{data: packet[1:]}
+	id := r.uint32()
+	op, found := a.pending[id]
+	if r.err != nil || !found {
+		return
+	}
+	delete(a.pending, id)
+
+	switch packet[0] {
+	case sftpHandle:
+		handle := r.string()
+		if op.action == "open" && r.err == nil {
+			a.handles[handle] = &sftpFile{path: op.path}
+			a.event("sftp", "open", op.path).SetArg("result", "ok").Log(a.db)
+		}
+	case sftpData:
+		if file := a.handles[op.handle]; file != nil && op.action == "read" {
+			file.readOp = true
+			file.read += int64(len(r.string()))
+		}
+	case sftpStatus:
+		code := r.uint32()
+		result := sftpStatusName(code)
+		switch op.action {
+		case "open":
+			a.event("sftp", "open", op.path).SetArg("result", result).Log(a.db)
+		case "write":
+			if file := a.handles[op.handle]; file != nil {
+				file.writeOp = true
+				if code == sftpStatusOK {
+					file.written += int64(op.size)
+				} else {
+					file.writeErr = result
+				}
+			}
+		case "read":
+			if file := a.handles[op.handle]; file != nil && code != 1 { // eof is the expected end of a download
+				file.readErr = result
+			}
+		case "close":
+			if file := a.handles[op.handle]; file != nil {
+				a.logSFTPFile(file, "")
+				delete(a.handles, op.handle)
+			}
+		case "rename":
+			a.event("sftp", "rename", op.path).SetArg("target", op.target).SetArg("result", result).Log(a.db)
+		default:
+			a.event("sftp", op.action, op.path).SetArg("result", result).Log(a.db)
+		}
+	}
+}
+
+func (a *transferAuditor) logSFTPFile(file *sftpFile, defaultResult string) {
+	result := func(err string) string {
+		if err != "" {
+			return err
+		}
+		if defaultResult != "" {
+			return defaultResult
+		}
+		return "ok"
+	}
+	if file.readOp {
+		a.event("sftp", "read", file.path).SetArg("size", file.read).SetArg("result", result(file.readErr)).Log(a.db)
+	}
+	if file.writeOp {
+		a.event("sftp", "write", file.path).SetArg("size", file.written).SetArg("result", result(file.writeErr)).Log(a.db)
+	}
+}
+
+//
+// scp
+//
+
+// scpParser follows the stream sent by the scp source, see
+// https://web.archive.org/web/20170215184048/https://blogs.oracle.com/janp/entry/how_the_scp_protocol_works
+type scpParser struct {
+	line      []byte
+	remaining int64
+	dirs      []string
+	name      string
+	size      int64
+}
+
+func (a *transferAuditor) feedSCP(data []byte, action string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	p := &a.scpState
+	for len(data) > 0 {
+		// file content followed by a '\0'
+		if p.remaining > 0 {
+			n := p.remaining
+			if int64(len(data)) < n {
+				n = int64(len(data))
+			}
+			data = data[n:]
+			p.remaining -= n
+			if p.remaining == 0 {
+				name := path.Join(append(append([]string{}, p.dirs...), p.name)...)
+				a.event("scp", action, name).SetArg("target", a.target).SetArg("size", p.size).SetArg("result", "ok").Log(a.db)
+			}
+			continue
+		}
+
+		// control line
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			p.line = append(p.line, data...)
+			if len(p.line) > 4096 {
+				p.line = nil
+				a.mode = transferModePassthrough
+			}
+			return
+		}
+		line := string(append(p.line, data[:idx]...))
+		p.line = nil
+		data = data[idx+1:]
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 'C', 'D':
+			parts := strings.SplitN(line[1:], " ", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			if line[0] == 'D' {
+				p.dirs = append(p.dirs, parts[2])
+				continue
+			}
+			size, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			p.name, p.size, p.remaining = parts[2], size, size+1
+		case 'E':
+			if len(p.dirs) > 0 {
+				p.dirs = p.dirs[:len(p.dirs)-1]
+			}
+		case 1, 2: // warning or error sent by the source
+			a.event("scp", action, a.target).SetArg("result", strings.TrimSpace(line[1:])).Log(a.db)
+		}
+	}
+}
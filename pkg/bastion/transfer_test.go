@@ -0,0 +1,123 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+type bufferChannel struct {
+	bytes.Buffer
+}
+
+func (c *bufferChannel) Close() error      { return nil }
+func (c *bufferChannel) CloseWrite() error { return nil }
+func (c *bufferChannel) SendRequest(string, bool, []byte) (bool, error) {
+	return true, nil
+}
+func (c *bufferChannel) Stderr() io.ReadWriter { return &c.Buffer }
+
+func sftpTestPacket(kind byte, id uint32, fields ...interface{}) []byte {
+	payload := []byte{kind}
+	payload = append(payload, gossh.Marshal(struct{ ID uint32 }{id})...)
+	for _, field := range fields {
+		switch v := field.(type) {
+		case string:
+			payload = append(payload, gossh.Marshal(struct{ V string }{v})...)
+		case uint32:
+			payload = append(payload, gossh.Marshal(struct{ V uint32 }{v})...)
+		case uint64:
+			payload = append(payload, gossh.Marshal(struct{ V uint64 }{v})...)
+		}
+	}
+	packet := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(packet, uint32(len(payload)))
+	return append(packet, payload...)
+}
+
+func TestTransferAuditor(t *testing.T) {
+	Convey("Testing transferAuditor", t, func(c C) {
+		db := newTestDB(c)
+
+		events := func(domain string) []dbmodels.Event {
+			var events []dbmodels.Event
+			c.So(db.Where("domain = ?", domain).Order("id").Find(&events).Error, ShouldBeNil)
+			return events
+		}
+		subsystem := &gossh.Request{Type: "subsystem", Payload: gossh.Marshal(struct{ V string }{"sftp"})}
+
+		Convey("sftp download and denied upload", func() {
+			lch, rch := &bufferChannel{}, &bufferChannel{}
+			audit := newTransferAuditor(db, dbmodels.User{}, 42, "deny-upload", lch, rch)
+			c.So(audit.checkRequest(subsystem), ShouldBeNil)
+
+			// the client opens a file for reading and another one for writing
+			upstream := audit.upstream(rch)
+			read := sftpTestPacket(sftpOpen, 1, "/etc/hosts", uint32(sftpFlagRead), uint32(0))
+			write := sftpTestPacket(sftpOpen, 2, "/tmp/upload", uint32(sftpFlagWrite|sftpFlagCreat), uint32(0))
+			_, err := upstream.Write(append(read, write[:7]...))
+			c.So(err, ShouldBeNil)
+			_, err = upstream.Write(write[7:])
+			c.So(err, ShouldBeNil)
+			c.So(rch.Bytes(), ShouldResemble, read)
+			c.So(lch.Bytes(), ShouldResemble, sftpStatusPacket(2, sftpStatusDenied, "denied by sshportal transfer policy"))
+			lch.Reset()
+
+			// the target replies with a handle, data and closes the file
+			downstream := audit.downstream(lch)
+			_, err = upstream.Write(sftpTestPacket(sftpRead, 3, "h1", uint64(0), uint32(32768)))
+			c.So(err, ShouldBeNil)
+			_, err = upstream.Write(sftpTestPacket(sftpClose, 4, "h1"))
+			c.So(err, ShouldBeNil)
+			responses := bytes.Join([][]byte{
+				sftpTestPacket(sftpHandle, 1, "h1"),
+				sftpTestPacket(sftpData, 3, "127.0.0.1 localhost\n"),
+				sftpTestPacket(sftpStatus, 4, uint32(sftpStatusOK), "", ""),
+			}, nil)
+			_, err = downstream.Write(responses)
+			c.So(err, ShouldBeNil)
+			c.So(lch.Bytes(), ShouldResemble, responses)
+
+			logged := events("sftp")
+			c.So(len(logged), ShouldEqual, 3)
+			c.So(logged[0].Action, ShouldEqual, "open")
+			c.So(logged[0].Entity, ShouldEqual, "/tmp/upload")
+			c.So(string(logged[0].Args), ShouldContainSubstring, "upload denied by policy")
+			c.So(logged[1].Action, ShouldEqual, "open")
+			c.So(logged[1].Entity, ShouldEqual, "/etc/hosts")
+			c.So(logged[2].Action, ShouldEqual, "read")
+			c.So(string(logged[2].Args), ShouldContainSubstring, `"size":20`)
+			c.So(string(logged[2].Args), ShouldContainSubstring, `"session":42`)
+		})
+
+		Convey("scp upload", func() {
+			lch, rch := &bufferChannel{}, &bufferChannel{}
+			audit := newTransferAuditor(db, dbmodels.User{}, 43, "", lch, rch)
+			c.So(audit.checkRequest(&gossh.Request{Type: "exec", Payload: gossh.Marshal(struct{ V string }{"scp -r -t /tmp"})}), ShouldBeNil)
+
+			upstream := audit.upstream(rch)
+			for _, chunk := range []string{"D0755 0 dir\nC0644 5 he", "llo.txt\nhel", "lo\x00E\n"} {
+				_, err := upstream.Write([]byte(chunk))
+				c.So(err, ShouldBeNil)
+			}
+			c.So(rch.String(), ShouldEqual, "D0755 0 dir\nC0644 5 hello.txt\nhello\x00E\n")
+
+			logged := events("scp")
+			c.So(len(logged), ShouldEqual, 1)
+			c.So(logged[0].Action, ShouldEqual, "write")
+			c.So(logged[0].Entity, ShouldEqual, "dir/hello.txt")
+			c.So(string(logged[0].Args), ShouldContainSubstring, `"size":5`)
+		})
+
+		Convey("scp download denied", func() {
+			audit := newTransferAuditor(db, dbmodels.User{}, 44, "deny-download", &bufferChannel{}, &bufferChannel{})
+			c.So(audit.checkRequest(&gossh.Request{Type: "exec", Payload: gossh.Marshal(struct{ V string }{"scp -f /etc/shadow"})}), ShouldNotBeNil)
+			c.So(audit.checkRequest(&gossh.Request{Type: "exec", Payload: gossh.Marshal(struct{ V string }{"ls -t /etc"})}), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,234 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal" // nolint:staticcheck
+	"moul.io/sshportal/pkg/crypto"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+const secondFactorMaxAttempts = 3
+
+// secondFactorEnv is the environment variable of the session carrying the
+// verification code, i.e., `ssh -o SetEnv=SSHPORTAL_2FA_CODE=123456`
+const secondFactorEnv = "SSHPORTAL_2FA_CODE"
+
+// secondFactorState is shared by the channels of a connection, the code is
+// only asked once per connection
+type secondFactorState struct {
+	mu       sync.Mutex
+	verified bool
+}
+
+// acceptedChannel is a gossh.NewChannel that was already accepted to ask
+// for the verification code
+type acceptedChannel struct {
+	gossh.NewChannel
+	ch   gossh.Channel
+	reqs <-chan *gossh.Request
+}
+
+func (c *acceptedChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	return c.ch, c.reqs, nil
+}
+
+func (c *acceptedChannel) Reject(reason gossh.RejectionReason, message string) error {
+	fmt.Fprintf(c.ch, "error: %s\r\n", message)
+	go gossh.DiscardRequests(c.reqs)
+	return c.ch.Close()
+}
+
+// secondFactorChannel enforces the second factor of the user before newChan
+// is handled.
+//
+// x/crypto/ssh cannot chain keyboard-interactive after a successful
+// public-key authentication, so the code is checked on the first session
+// channel of the connection: it is read from the SSHPORTAL_2FA_CODE variable
+// of the session if the client sets it (commands, scp and sftp), or asked
+// in-band. Other channels (i.e., direct-tcpip) are rejected until the
+// connection is verified.
+func secondFactorChannel(actx *authContext, newChan gossh.NewChannel) (gossh.NewChannel, error) {
+	state := actx.secondFactor
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.verified {
+		return newChan, nil
+	}
+
+	var user dbmodels.User
+	if err := actx.db.Preload("Groups").Where("id = ?", actx.user.ID).First(&user).Error; err != nil {
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return nil, err
+	}
+	// groups granted by the certificate principals and the groups containing them
+	groups, err := dbmodels.UserGroupsWithParents(actx.db, append(user.Groups, actx.certGroups...))
+	if err != nil {
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return nil, err
+	}
+	user.Groups = groups
+	if !user.Has2FA() {
+		if user.Requires2FA() {
+			err := errors.New("a second factor is required, ask an administrator to enroll you with 'user 2fa enroll'")
+			_ = newChan.Reject(gossh.Prohibited, err.Error())
+			return nil, err
+		}
+		return newChan, nil
+	}
+
+	if newChan.ChannelType() != "session" {
+		err := errors.New("a verification code is required, open an interactive session first")
+		_ = newChan.Reject(gossh.Prohibited, err.Error())
+		return nil, err
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// the requests are acknowledged and buffered until the session starts,
+	// the variable carrying the code is not forwarded to the handler
+	var (
+		buffered []*gossh.Request
+		code     string
+	)
+	for req := range reqs {
+		if req.Type == "env" {
+			var env struct{ Name, Value string }
+			if err := gossh.Unmarshal(req.Payload, &env); err == nil && env.Name == secondFactorEnv {
+				code = env.Value
+				_ = req.Reply(true, nil)
+				continue
+			}
+		}
+		buffered = append(buffered, acknowledgeRequest(req))
+		if req.Type == "shell" || req.Type == "exec" || req.Type == "subsystem" {
+			break
+		}
+	}
+	accepted := &acceptedChannel{NewChannel: newChan, ch: ch, reqs: replayRequests(buffered, reqs)}
+	if err := crypto.UserDecrypt(actx.aesKey, &user); err != nil {
+		_ = accepted.Reject(gossh.ConnectionFailed, err.Error())
+		return nil, err
+	}
+	if code != "" {
+		err = verifySecondFactor(actx, &user, code, ch)
+	} else {
+		err = promptSecondFactor(actx, &user, ch)
+	}
+	if err != nil {
+		_ = accepted.Reject(gossh.Prohibited, err.Error())
+		return nil, err
+	}
+	state.verified = true
+	return accepted, nil
+}
+
+// acknowledgeRequest replies to a request received before the channel is
+// handed over to its handler, the clients waiting for the reply of a
+// pty-req before sending the shell request would hang otherwise, and
+// returns the copy replayed to the handler, whose reply is not sent
+func acknowledgeRequest(req *gossh.Request) *gossh.Request {
+	if req.WantReply {
+		_ = req.Reply(true, nil)
+	}
+	replayed := *req
+	replayed.WantReply = false
+	return &replayed
+}
+
+// promptSecondFactor reads a TOTP or a recovery code on rw
+func promptSecondFactor(actx *authContext, user *dbmodels.User, rw io.ReadWriter) error {
+	term := terminal.NewTerminal(rw, "")
+	for attempt := 0; attempt < secondFactorMaxAttempts; attempt++ {
+		code, err := term.ReadPassword("Verification code: ")
+		if err != nil {
+			return err
+		}
+		valid, err := checkSecondFactor(actx, user, code, rw)
+		if err != nil {
+			return err
+		}
+		if valid {
+			return nil
+		}
+		fmt.Fprint(rw, "Invalid code.\r\n")
+	}
+	dbmodels.NewEvent("auth", "2fa-failed").SetAuthor(user).Log(actx.db)
+	return errors.New("too many invalid verification codes")
+}
+
+// verifySecondFactor checks the code sent by the client with the session
+func verifySecondFactor(actx *authContext, user *dbmodels.User, code string, w io.Writer) error {
+	valid, err := checkSecondFactor(actx, user, code, w)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		dbmodels.NewEvent("auth", "2fa-failed").SetAuthor(user).Log(actx.db)
+		return fmt.Errorf("invalid verification code in %s", secondFactorEnv)
+	}
+	return nil
+}
+
+// checkSecondFactor returns true if code is a TOTP or a recovery code of the
+// user, each of them is only accepted once, even by concurrent connections
+func checkSecondFactor(actx *authContext, user *dbmodels.User, code string, w io.Writer) (bool, error) {
+	code = strings.TrimSpace(code)
+	if step, ok := crypto.ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		res := actx.db.Model(&dbmodels.User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		user.TOTPLastStep = step
+		return res.RowsAffected == 1, nil
+	}
+	previous := user.RecoveryCodes
+	if user.UseRecoveryCode(crypto.HashRecoveryCode(code)) {
+		res := actx.db.Model(&dbmodels.User{}).Where("id = ? AND recovery_codes = ?", user.ID, previous).Update("recovery_codes", user.RecoveryCodes)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		if res.RowsAffected != 1 {
+			user.RecoveryCodes = previous
+			return false, nil
+		}
+		remaining := 0
+		if user.RecoveryCodes != "" {
+			remaining = len(strings.Split(user.RecoveryCodes, ","))
+		}
+		dbmodels.NewEvent("auth", "2fa-recovery").SetAuthor(user).SetArg("remaining", remaining).Log(actx.db)
+		fmt.Fprintf(w, "Recovery code accepted, %d left.\r\n", remaining)
+		return true, nil
+	}
+	return false, nil
+}
+
+// secondFactorPending returns true if the user still has to enter a
+// verification code on a session channel before using the connection
+func secondFactorPending(actx *authContext) (bool, error) {
+	state := actx.secondFactor
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.verified {
+		return false, nil
+	}
+
+	var user dbmodels.User
+	if err := actx.db.Preload("Groups").Where("id = ?", actx.user.ID).First(&user).Error; err != nil {
+		return true, err
+	}
+	// groups granted by the certificate principals and the groups containing them
+	groups, err := dbmodels.UserGroupsWithParents(actx.db, append(user.Groups, actx.certGroups...))
+	if err != nil {
+		return true, err
+	}
+	user.Groups = groups
+	return user.Has2FA() || user.Requires2FA(), nil
+}
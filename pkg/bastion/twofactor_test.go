@@ -0,0 +1,79 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"moul.io/sshportal/pkg/crypto"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+type promptReadWriter struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (rw *promptReadWriter) Read(p []byte) (int, error)  { return rw.Reader.Read(p) }
+func (rw *promptReadWriter) Write(p []byte) (int, error) { return rw.Buffer.Write(p) }
+
+func TestPromptSecondFactor(t *testing.T) {
+	Convey("Testing promptSecondFactor", t, func(c C) {
+		db := newTestDB(c)
+
+		secret, err := crypto.NewTOTPSecret()
+		c.So(err, ShouldBeNil)
+		codes, hashes, err := crypto.NewRecoveryCodes(2)
+		c.So(err, ShouldBeNil)
+		user := dbmodels.User{Name: "alice", Email: "alice@example.com", TOTPSecret: secret, RecoveryCodes: strings.Join(hashes, ",")}
+		c.So(db.Create(&user).Error, ShouldBeNil)
+		actx := &authContext{db: db}
+
+		Convey("totp code after a typo", func() {
+			code, err := crypto.TOTPCode(secret, time.Now())
+			c.So(err, ShouldBeNil)
+			rw := &promptReadWriter{Reader: strings.NewReader("123\r" + code + "\r")}
+			c.So(promptSecondFactor(actx, &user, rw), ShouldBeNil)
+			c.So(rw.String(), ShouldContainSubstring, "Invalid code.")
+		})
+
+		Convey("totp codes are single-use", func() {
+			code, err := crypto.TOTPCode(secret, time.Now())
+			c.So(err, ShouldBeNil)
+			c.So(verifySecondFactor(actx, &user, code, ioutil.Discard), ShouldBeNil)
+
+			// another connection replaying the code
+			var stored dbmodels.User
+			c.So(db.First(&stored, user.ID).Error, ShouldBeNil)
+			c.So(stored.TOTPLastStep, ShouldBeGreaterThan, 0)
+			c.So(verifySecondFactor(actx, &stored, code, ioutil.Discard), ShouldNotBeNil)
+			stale := user
+			stale.TOTPLastStep = 0
+			c.So(verifySecondFactor(actx, &stale, code, ioutil.Discard), ShouldNotBeNil)
+
+			// the secrets are never serialized
+			out, err := json.Marshal(stored)
+			c.So(err, ShouldBeNil)
+			c.So(string(out), ShouldNotContainSubstring, secret)
+			c.So(string(out), ShouldNotContainSubstring, hashes[0])
+		})
+
+		Convey("recovery codes are single-use", func() {
+			rw := &promptReadWriter{Reader: strings.NewReader(codes[0] + "\r")}
+			c.So(promptSecondFactor(actx, &user, rw), ShouldBeNil)
+			c.So(rw.String(), ShouldContainSubstring, "1 left")
+
+			var stored dbmodels.User
+			c.So(db.First(&stored, user.ID).Error, ShouldBeNil)
+			c.So(stored.RecoveryCodes, ShouldEqual, hashes[1])
+
+			rw = &promptReadWriter{Reader: strings.NewReader(strings.Repeat(codes[0]+"\r", secondFactorMaxAttempts))}
+			c.So(promptSecondFactor(actx, &stored, rw), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+const sourceAddressCriticalOption = "source-address"
+
+// userCertificateAuth validates an OpenSSH user certificate against the
+// trusted user CAs and fills the auth context with the matching user.
+//
+// The first principal matching a user name or email identifies the user,
+// principals matching user group names grant those groups for the session.
+func userCertificateAuth(db *gorm.DB, actx *authContext, cert *gossh.Certificate, remoteAddr net.Addr) error {
+	if cert.CertType != gossh.UserCert {
+		return errors.New("certificate is not a user certificate")
+	}
+
+	var userCA dbmodels.UserCA
+	if err := dbmodels.UserCAsPreload(db).Where("authorized_key = ?", string(gossh.MarshalAuthorizedKey(cert.SignatureKey))).First(&userCA).Error; err != nil {
+		return errors.New("certificate is not signed by a trusted authority")
+	}
+
+	var principal string
+	for _, name := range cert.ValidPrincipals {
+		if err := db.Preload("Roles").Where("name = ? OR email = ?", name, name).First(&actx.user).Error; err == nil {
+			principal = name
+			break
+		}
+	}
+	if principal == "" {
+		actx.user = dbmodels.User{}
+		return errors.New("no user matches the certificate principals")
+	}
+
+	// checks the revocation, the validity window, the critical options and the signature
+	checker := gossh.CertChecker{
+		SupportedCriticalOptions: []string{sourceAddressCriticalOption},
+		IsRevoked: func(cert *gossh.Certificate) bool {
+			return userCA.IsRevoked(cert.Serial)
+		},
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return err
+	}
+	if sourceAddress, ok := cert.CriticalOptions[sourceAddressCriticalOption]; ok {
+		if err := checkSourceAddress(remoteAddr, sourceAddress); err != nil {
+			return err
+		}
+	}
+
+	if err := db.Preload("ACLs").Where("name IN (?)", cert.ValidPrincipals).Find(&actx.certGroups).Error; err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkSourceAddress enforces the "source-address" critical option, a
+// comma-separated list of addresses and CIDR ranges
+func checkSourceAddress(addr net.Addr, sourceAddrs string) error {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("cannot enforce source-address on %q", addr.String())
+	}
+	for _, sourceAddr := range strings.Split(sourceAddrs, ",") {
+		if allowedIP := net.ParseIP(sourceAddr); allowedIP != nil {
+			if allowedIP.Equal(tcpAddr.IP) {
+				return nil
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(sourceAddr)
+		if err != nil {
+			return fmt.Errorf("invalid source-address %q: %v", sourceAddr, err)
+		}
+		if ipNet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate is not allowed from %s", tcpAddr.IP)
+}
@@ -0,0 +1,95 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+func TestUserCertificateAuth(t *testing.T) {
+	Convey("Testing userCertificateAuth", t, func(c C) {
+		db := newTestDB(c)
+
+		// trust a CA and create a user and a group
+		_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+		c.So(err, ShouldBeNil)
+		caSigner, err := gossh.NewSignerFromKey(caPriv)
+		c.So(err, ShouldBeNil)
+		userCA := dbmodels.UserCA{
+			Name:          "corp",
+			Key:           caSigner.PublicKey().Marshal(),
+			AuthorizedKey: string(gossh.MarshalAuthorizedKey(caSigner.PublicKey())),
+		}
+		c.So(db.Create(&userCA).Error, ShouldBeNil)
+		c.So(db.Create(&dbmodels.User{Name: "alice", Email: "alice@example.com"}).Error, ShouldBeNil)
+		c.So(db.Create(&dbmodels.UserGroup{Name: "oncall"}).Error, ShouldBeNil)
+
+		userPub, _, err := ed25519.GenerateKey(rand.Reader)
+		c.So(err, ShouldBeNil)
+		userKey, err := gossh.NewPublicKey(userPub)
+		c.So(err, ShouldBeNil)
+		sign := func(signer gossh.Signer, cert *gossh.Certificate) *gossh.Certificate {
+			cert.Key = userKey
+			cert.CertType = gossh.UserCert
+			if cert.ValidBefore == 0 {
+				cert.ValidBefore = uint64(time.Now().Add(time.Hour).Unix())
+			}
+			c.So(cert.SignCert(rand.Reader, signer), ShouldBeNil)
+			return cert
+		}
+		remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 4242}
+
+		Convey("valid certificate", func() {
+			actx := &authContext{}
+			cert := sign(caSigner, &gossh.Certificate{Serial: 1, ValidPrincipals: []string{"unknown", "alice@example.com", "oncall"}})
+			c.So(userCertificateAuth(db, actx, cert, remote), ShouldBeNil)
+			c.So(actx.user.Name, ShouldEqual, "alice")
+			c.So(len(actx.certGroups), ShouldEqual, 1)
+			c.So(actx.certGroups[0].Name, ShouldEqual, "oncall")
+		})
+
+		Convey("source-address", func() {
+			cert := sign(caSigner, &gossh.Certificate{
+				Serial:          2,
+				ValidPrincipals: []string{"alice"},
+				Permissions:     gossh.Permissions{CriticalOptions: map[string]string{"source-address": "192.168.0.0/16,10.0.0.5"}},
+			})
+			c.So(userCertificateAuth(db, &authContext{}, cert, remote), ShouldBeNil)
+			c.So(userCertificateAuth(db, &authContext{}, cert, &net.TCPAddr{IP: net.ParseIP("10.0.0.6")}), ShouldNotBeNil)
+		})
+
+		Convey("rejected certificates", func() {
+			// revoked serial
+			c.So(db.Create(&dbmodels.UserCertRevocation{UserCAID: userCA.ID, Serial: 3}).Error, ShouldBeNil)
+			cert := sign(caSigner, &gossh.Certificate{Serial: 3, ValidPrincipals: []string{"alice"}})
+			c.So(userCertificateAuth(db, &authContext{}, cert, remote), ShouldNotBeNil)
+
+			// expired
+			cert = sign(caSigner, &gossh.Certificate{
+				Serial:          4,
+				ValidPrincipals: []string{"alice"},
+				ValidAfter:      uint64(time.Now().Add(-2 * time.Hour).Unix()),
+				ValidBefore:     uint64(time.Now().Add(-time.Hour).Unix()),
+			})
+			c.So(userCertificateAuth(db, &authContext{}, cert, remote), ShouldNotBeNil)
+
+			// unknown principal
+			cert = sign(caSigner, &gossh.Certificate{Serial: 5, ValidPrincipals: []string{"mallory"}})
+			c.So(userCertificateAuth(db, &authContext{}, cert, remote), ShouldNotBeNil)
+
+			// untrusted CA
+			_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+			c.So(err, ShouldBeNil)
+			otherSigner, err := gossh.NewSignerFromKey(otherPriv)
+			c.So(err, ShouldBeNil)
+			cert = sign(otherSigner, &gossh.Certificate{Serial: 6, ValidPrincipals: []string{"alice"}})
+			c.So(userCertificateAuth(db, &authContext{}, cert, remote), ShouldNotBeNil)
+		})
+	})
+}
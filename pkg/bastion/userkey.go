@@ -0,0 +1,47 @@
+package bastion
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+// minRSAKeyBits is the minimum size of the RSA keys added by the users
+const minRSAKeyBits = 2048
+
+// validateUserKey returns an error if the key cannot be added by a user to
+// their account: certificates, DSA or short RSA keys and registered keys
+func validateUserKey(db *gorm.DB, key gossh.PublicKey) error {
+	switch key.Type() {
+	case gossh.KeyAlgoDSA:
+		return errors.New("DSA keys are not supported anymore, use an ed25519, ECDSA or RSA key")
+	case gossh.KeyAlgoRSA:
+		cryptoKey, ok := key.(gossh.CryptoPublicKey)
+		if !ok {
+			return fmt.Errorf("unsupported %s key", key.Type())
+		}
+		rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("unsupported %s key", key.Type())
+		}
+		if rsaKey.N.BitLen() < minRSAKeyBits {
+			return fmt.Errorf("the RSA key is too short (%d bits), at least %d bits are required", rsaKey.N.BitLen(), minRSAKeyBits)
+		}
+	}
+	if _, ok := key.(*gossh.Certificate); ok {
+		return errors.New("certificates cannot be added as keys, ask an administrator to trust their CA")
+	}
+
+	var count int64
+	if err := db.Model(&dbmodels.UserKey{}).Where("authorized_key = ?", string(gossh.MarshalAuthorizedKey(key))).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("this key is already registered")
+	}
+	return nil
+}
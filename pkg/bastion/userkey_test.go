@@ -0,0 +1,45 @@
+package bastion // import "moul.io/sshportal/pkg/bastion"
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	gossh "golang.org/x/crypto/ssh"
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+func TestValidateUserKey(t *testing.T) {
+	Convey("Testing validateUserKey", t, func(c C) {
+		db := newTestDB(c)
+
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		c.So(err, ShouldBeNil)
+		key, err := gossh.NewPublicKey(pub)
+		c.So(err, ShouldBeNil)
+		c.So(validateUserKey(db, key), ShouldBeNil)
+
+		// a key belongs to a single user
+		c.So(db.Create(&dbmodels.UserKey{UserID: 1, Key: key.Marshal(), AuthorizedKey: string(gossh.MarshalAuthorizedKey(key))}).Error, ShouldBeNil)
+		c.So(validateUserKey(db, key), ShouldNotBeNil)
+
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		c.So(err, ShouldBeNil)
+		shortKey, err := gossh.NewPublicKey(&rsaKey.PublicKey)
+		c.So(err, ShouldBeNil)
+		c.So(validateUserKey(db, shortKey), ShouldNotBeNil)
+
+		signer, err := gossh.NewSignerFromKey(priv)
+		c.So(err, ShouldBeNil)
+		otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+		c.So(err, ShouldBeNil)
+		otherKey, err := gossh.NewPublicKey(otherPub)
+		c.So(err, ShouldBeNil)
+		c.So(validateUserKey(db, otherKey), ShouldBeNil)
+		cert := &gossh.Certificate{Key: otherKey, CertType: gossh.UserCert}
+		c.So(cert.SignCert(rand.Reader, signer), ShouldBeNil)
+		c.So(validateUserKey(db, cert), ShouldNotBeNil)
+	})
+}
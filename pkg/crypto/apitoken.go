@@ -0,0 +1,27 @@
+package crypto // import "moul.io/sshportal/pkg/crypto"
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// apiTokenPrefix makes the tokens easy to spot in configuration files and logs
+const apiTokenPrefix = "sshp_"
+
+// NewAPIToken generates a random API token, it returns the token displayed
+// once to the user and the hash stored in database
+func NewAPIToken() (string, string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := apiTokenPrefix + hex.EncodeToString(buf)
+	return token, HashAPIToken(token), nil
+}
+
+// HashAPIToken returns the stored form of an API token
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
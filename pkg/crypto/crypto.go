@@ -11,11 +11,15 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	gossh "golang.org/x/crypto/ssh"
 	"moul.io/sshportal/pkg/dbmodels"
@@ -166,30 +170,126 @@ func ImportSSHKey(keyValue string) (*dbmodels.SSHKey, error) {
 	return &key, nil
 }
 
+// NewSessionCertSigner generates an ephemeral key and signs it with caKey,
+// the resulting certificate is only valid for principal during ttl and only
+// permits the extensions (i.e., "permit-pty")
+func NewSessionCertSigner(caKey *dbmodels.SSHKey, principal, keyID string, extensions []string, ttl time.Duration) (gossh.Signer, error) {
+	caSigner, err := gossh.ParsePrivateKey([]byte(caKey.PrivKey))
+	if err != nil {
+		return nil, err
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	serial := make([]byte, 8)
+	if _, err = io.ReadFull(rand.Reader, serial); err != nil {
+		return nil, err
+	}
+	permissions := gossh.Permissions{Extensions: map[string]string{}}
+	for _, extension := range extensions {
+		permissions.Extensions[extension] = ""
+	}
+	now := time.Now()
+	cert := &gossh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        gossh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()), // tolerate clock skew
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+		Permissions:     permissions,
+	}
+	if err = cert.SignCert(rand.Reader, caSigner); err != nil {
+		return nil, err
+	}
+	return gossh.NewCertSigner(cert, signer)
+}
+
+// encryptedPrefix identifies the values encrypted with AES-GCM, the values
+// without prefix were encrypted with AES-CFB by previous versions
+const encryptedPrefix = "v2:"
+
+// IsEncrypted returns true if value was encrypted with AES-GCM, the values
+// encrypted with AES-CFB by previous versions are not reported as encrypted
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// IsLegacyEncrypted returns true if value looks encrypted with AES-CFB by
+// the previous versions, the other values without prefix were stored before
+// the AES key was configured. The base32 values (i.e., TOTP secrets) are
+// never CFB ciphertexts.
+func IsLegacyEncrypted(value string) bool {
+	if IsEncrypted(value) || strings.TrimLeft(value, "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567=") == "" {
+		return false
+	}
+	ciphertext, err := base64.URLEncoding.DecodeString(value)
+	return err == nil && len(ciphertext) >= aes.BlockSize
+}
+
 func encrypt(key []byte, text string) (string, error) {
-	plaintext := []byte(text)
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
-	return base64.URLEncoding.EncodeToString(ciphertext), nil
+	ciphertext := gcm.Seal(nonce, nonce, []byte(text), nil)
+	return encryptedPrefix + base64.URLEncoding.EncodeToString(ciphertext), nil
 }
 
 func decrypt(key []byte, cryptoText string) (string, error) {
-	ciphertext, _ := base64.URLEncoding.DecodeString(cryptoText)
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", err
 	}
-	if len(ciphertext) < aes.BlockSize {
-		return "", fmt.Errorf("ciphertext too short")
+	if !IsEncrypted(cryptoText) {
+		return decryptCFB(block, cryptoText)
+	}
+
+	ciphertext, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(cryptoText, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted value: ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt value, wrong AES key or tampered data: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// decryptCFB decrypts the legacy values, they have no integrity check so the
+// callers check that the plaintext is plausible.
+// Values which are not CFB ciphertexts were stored before the AES key was
+// configured and are returned as is.
+func decryptCFB(block cipher.Block, cryptoText string) (string, error) {
+	if !IsLegacyEncrypted(cryptoText) {
+		return cryptoText, nil
+	}
+	ciphertext, err := base64.URLEncoding.DecodeString(cryptoText)
+	if err != nil {
+		return "", err
 	}
 	iv := ciphertext[:aes.BlockSize]
 	ciphertext = ciphertext[aes.BlockSize:]
@@ -198,17 +298,6 @@ func decrypt(key []byte, cryptoText string) (string, error) {
 	return string(ciphertext), nil
 }
 
-func safeDecrypt(key []byte, cryptoText string) string {
-	if len(key) == 0 {
-		return cryptoText
-	}
-	out, err := decrypt(key, cryptoText)
-	if err != nil {
-		return cryptoText
-	}
-	return out
-}
-
 func HostEncrypt(aesKey string, host *dbmodels.Host) (err error) {
 	if aesKey == "" {
 		return nil
@@ -218,13 +307,19 @@ func HostEncrypt(aesKey string, host *dbmodels.Host) (err error) {
 	}
 	return
 }
-func HostDecrypt(aesKey string, host *dbmodels.Host) {
-	if aesKey == "" {
-		return
+func HostDecrypt(aesKey string, host *dbmodels.Host) error {
+	if aesKey == "" || host.Password == "" {
+		return nil
 	}
-	if host.Password != "" {
-		host.Password = safeDecrypt([]byte(aesKey), host.Password)
+	password, err := decrypt([]byte(aesKey), host.Password)
+	if err != nil {
+		return err
+	}
+	if !IsEncrypted(host.Password) && !IsSecretReference(password) && !isPrintable(password) {
+		return fmt.Errorf("cannot decrypt the password of host %q, wrong AES key?", host.Name)
 	}
+	host.Password = password
+	return nil
 }
 
 func SSHKeyEncrypt(aesKey string, key *dbmodels.SSHKey) (err error) {
@@ -234,9 +329,61 @@ func SSHKeyEncrypt(aesKey string, key *dbmodels.SSHKey) (err error) {
 	key.PrivKey, err = encrypt([]byte(aesKey), key.PrivKey)
 	return
 }
-func SSHKeyDecrypt(aesKey string, key *dbmodels.SSHKey) {
+func SSHKeyDecrypt(aesKey string, key *dbmodels.SSHKey) error {
+	if aesKey == "" {
+		return nil
+	}
+	privKey, err := decrypt([]byte(aesKey), key.PrivKey)
+	if err != nil {
+		return err
+	}
+	// the legacy values have no integrity check, a wrong key gives garbage
+	if !IsEncrypted(key.PrivKey) && !IsSecretReference(privKey) {
+		if _, err := gossh.ParsePrivateKey([]byte(privKey)); err != nil {
+			if _, ok := err.(*gossh.PassphraseMissingError); !ok {
+				return fmt.Errorf("cannot decrypt the private key of %q, wrong AES key?: %v", key.Name, err)
+			}
+		}
+	}
+	key.PrivKey = privKey
+	return nil
+}
+
+func UserEncrypt(aesKey string, user *dbmodels.User) (err error) {
 	if aesKey == "" {
-		return
+		return nil
+	}
+	if user.TOTPSecret != "" {
+		user.TOTPSecret, err = encrypt([]byte(aesKey), user.TOTPSecret)
+	}
+	return
+}
+func UserDecrypt(aesKey string, user *dbmodels.User) error {
+	if aesKey == "" || user.TOTPSecret == "" {
+		return nil
+	}
+	secret, err := decrypt([]byte(aesKey), user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	if !IsEncrypted(user.TOTPSecret) {
+		if _, err := TOTPCode(secret, time.Now()); err != nil {
+			return fmt.Errorf("cannot decrypt the TOTP secret of %q, wrong AES key?", user.Name)
+		}
+	}
+	user.TOTPSecret = secret
+	return nil
+}
+
+// isPrintable returns true if text is valid UTF-8 without control characters
+func isPrintable(text string) bool {
+	if !utf8.ValidString(text) {
+		return false
+	}
+	for _, r := range text {
+		if unicode.IsControl(r) {
+			return false
+		}
 	}
-	key.PrivKey = safeDecrypt([]byte(aesKey), key.PrivKey)
+	return true
 }
@@ -0,0 +1,226 @@
+package crypto // import "moul.io/sshportal/pkg/crypto"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+// SecretPrefix starts the values referencing a secret stored outside of the
+// database, i.e., secret://vault/db/password, the providers and what they can
+// reach are configured on the server, the references only pick a key
+const SecretPrefix = "secret://"
+
+// SecretExecTimeout is timeout for the exec secret provider commands
+const SecretExecTimeout = 5 * time.Second
+
+// SecretCacheTTL is the duration during which a resolved secret is reused
+var SecretCacheTTL = time.Minute
+
+// SecretProvider resolves the keys of the secret://<provider>/<key> references
+type SecretProvider interface {
+	Resolve(key string) (string, error)
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{}
+	secrets           = &secretCache{entries: map[string]cachedSecret{}}
+	secretKeyPattern  = regexp.MustCompile(`^[A-Za-z0-9_.][A-Za-z0-9_./-]*$`)
+)
+
+// RegisterSecretProvider makes provider available for the secret://<name>/... references
+func RegisterSecretProvider(name string, provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	secretProviders[name] = provider
+}
+
+// ParseSecretProvider parses the configuration of a provider, either
+// "<name>=exec:<command> [args]" running the command with the key as last
+// argument, or "<name>=file:<directory>" reading the key in the directory
+func ParseSecretProvider(spec string) (string, SecretProvider, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.Contains(parts[0], "/") {
+		return "", nil, fmt.Errorf("invalid secret provider %q, expected '<name>=exec:<command>' or '<name>=file:<directory>'", spec)
+	}
+	name, config := parts[0], parts[1]
+	switch {
+	case strings.HasPrefix(config, "exec:"):
+		command := strings.Fields(strings.TrimPrefix(config, "exec:"))
+		if len(command) == 0 {
+			return "", nil, fmt.Errorf("invalid secret provider %q, the command is missing", spec)
+		}
+		return name, execSecretProvider{command: command}, nil
+	case strings.HasPrefix(config, "file:"):
+		root := strings.TrimPrefix(config, "file:")
+		if !filepath.IsAbs(root) {
+			return "", nil, fmt.Errorf("invalid secret provider %q, the directory must be an absolute path", spec)
+		}
+		return name, fileSecretProvider{root: filepath.Clean(root)}, nil
+	default:
+		return "", nil, fmt.Errorf("invalid secret provider %q, expected '<name>=exec:<command>' or '<name>=file:<directory>'", spec)
+	}
+}
+
+// IsSecretReference returns true if value references a secret stored outside of the database
+func IsSecretReference(value string) bool {
+	return strings.HasPrefix(value, SecretPrefix)
+}
+
+// ResolveSecret returns the secret referenced by value, the other values are returned as is
+func ResolveSecret(value string) (string, error) {
+	if !IsSecretReference(value) {
+		return value, nil
+	}
+	if secret, found := secrets.get(value); found {
+		return secret, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, SecretPrefix), "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid secret reference %q, expected 'secret://<provider>/<key>'", value)
+	}
+	name, key := parts[0], parts[1]
+	if err := checkSecretKey(key); err != nil {
+		return "", fmt.Errorf("invalid secret reference %q: %v", value, err)
+	}
+	secretProvidersMu.RLock()
+	provider, found := secretProviders[name]
+	secretProvidersMu.RUnlock()
+	if !found {
+		return "", fmt.Errorf("unknown secret provider %q, the providers are configured with --secret-provider", name)
+	}
+	secret, err := provider.Resolve(key)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve secret %q: %v", value, err)
+	}
+	secrets.set(value, secret)
+	return secret, nil
+}
+
+// checkSecretKey returns an error if key could reach something else than the
+// secrets of its provider: absolute paths, parent directories or options
+func checkSecretKey(key string) error {
+	if !secretKeyPattern.MatchString(key) {
+		return errors.New("the key can only contain letters, digits, '_', '.', '-' and '/', and cannot start with '/' or '-'")
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return errors.New("the key cannot contain '..'")
+		}
+	}
+	return nil
+}
+
+// HostResolveSecrets replaces the secret references of a decrypted host by their values
+func HostResolveSecrets(host *dbmodels.Host) error {
+	password, err := ResolveSecret(host.Password)
+	if err != nil {
+		return err
+	}
+	host.Password = password
+	return nil
+}
+
+// SSHKeyResolveSecrets replaces the secret references of a decrypted key by their values
+func SSHKeyResolveSecrets(key *dbmodels.SSHKey) error {
+	privKey, err := ResolveSecret(key.PrivKey)
+	if err != nil {
+		return err
+	}
+	key.PrivKey = privKey
+	return nil
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+type secretCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedSecret
+}
+
+func (c *secretCache) get(reference string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[reference]
+	if !found {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, reference)
+		return "", false
+	}
+	return entry.value, true
+}
+
+func (c *secretCache) set(reference, value string) {
+	if SecretCacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[reference] = cachedSecret{value: value, expires: time.Now().Add(SecretCacheTTL)}
+}
+
+// fileSecretProvider reads the secret from a file of its directory, i.e.,
+// secret://files/db.pem reads /etc/sshportal/secrets/db.pem with
+// --secret-provider=files=file:/etc/sshportal/secrets
+type fileSecretProvider struct {
+	root string
+}
+
+func (p fileSecretProvider) Resolve(key string) (string, error) {
+	// the symlinks of the directory cannot lead outside of it
+	root, err := filepath.EvalSymlinks(p.root)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(key)))
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return "", errors.New("the secret is outside of the directory of the provider")
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(content), "\n"), nil
+}
+
+// execSecretProvider reads the secret from the output of its command run
+// with the key as last argument, i.e., secret://vault/db/password runs
+// `/usr/local/bin/vault-get db/password` with
+// --secret-provider=vault=exec:/usr/local/bin/vault-get
+type execSecretProvider struct {
+	command []string
+}
+
+func (p execSecretProvider) Resolve(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SecretExecTimeout)
+	defer cancel()
+
+	args := append(append([]string{}, p.command[1:]...), key)
+	out, err := exec.CommandContext(ctx, p.command[0], args...).Output() // #nosec
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("command timed out")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
@@ -0,0 +1,166 @@
+package crypto // import "moul.io/sshportal/pkg/crypto"
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"moul.io/sshportal/pkg/dbmodels"
+)
+
+type countingSecretProvider struct {
+	calls int
+}
+
+func (p *countingSecretProvider) Resolve(key string) (string, error) {
+	p.calls++
+	if key == "fail" {
+		return "", errors.New("failure")
+	}
+	return "value of " + key, nil
+}
+
+func TestParseSecretProvider(t *testing.T) {
+	for _, spec := range []string{"", "vault", "=exec:/bin/echo", "a/b=exec:/bin/echo", "vault=exec:", "files=file:relative", "vault=http://vault"} {
+		if _, _, err := ParseSecretProvider(spec); err == nil {
+			t.Errorf("ParseSecretProvider(%q) succeeded, expected an error", spec)
+		}
+	}
+	name, provider, err := ParseSecretProvider("vault=exec:/bin/echo prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := provider.Resolve("db/password"); name != "vault" || err != nil || secret != "prefix db/password" {
+		t.Errorf("Resolve() = %q, %v, expected %q", secret, err, "prefix db/password")
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sshportal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	root := filepath.Join(tempDir, "secrets")
+	if err := os.MkdirAll(filepath.Join(root, "db"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "db", "password"), []byte("from file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tempDir, "outside"), []byte("outside\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(tempDir, "outside"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"files=file:" + root, "echo=exec:/bin/echo from exec", "false=exec:/bin/false"} {
+		name, provider, err := ParseSecretProvider(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		RegisterSecretProvider(name, provider)
+	}
+
+	for _, tc := range []struct {
+		value    string
+		expected string
+		fails    bool
+	}{
+		{value: "not a reference", expected: "not a reference"},
+		{value: "", expected: ""},
+		{value: SecretPrefix + "files/db/password", expected: "from file"},
+		{value: SecretPrefix + "files/missing", fails: true},
+		{value: SecretPrefix + "files/../outside", fails: true},
+		{value: SecretPrefix + "files/db/../../outside", fails: true},
+		{value: SecretPrefix + "files/" + filepath.Join(tempDir, "outside"), fails: true},
+		{value: SecretPrefix + "files/link", fails: true},
+		{value: SecretPrefix + "echo/db", expected: "from exec db"},
+		{value: SecretPrefix + "echo/-n", fails: true},
+		{value: SecretPrefix + "echo/db; id", fails: true},
+		{value: SecretPrefix + "false/db", fails: true},
+		{value: SecretPrefix + "file/etc/passwd", fails: true},
+		{value: SecretPrefix + "exec/bin/echo", fails: true},
+		{value: SecretPrefix + "files", fails: true},
+	} {
+		secret, err := ResolveSecret(tc.value)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("ResolveSecret(%q) = %q, expected an error", tc.value, secret)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ResolveSecret(%q) failed: %v", tc.value, err)
+			continue
+		}
+		if secret != tc.expected {
+			t.Errorf("ResolveSecret(%q) = %q, expected %q", tc.value, secret, tc.expected)
+		}
+	}
+}
+
+func TestResolveSecretCache(t *testing.T) {
+	provider := &countingSecretProvider{}
+	RegisterSecretProvider("counting", provider)
+	secrets = &secretCache{entries: map[string]cachedSecret{}}
+
+	for i := 0; i < 3; i++ {
+		secret, err := ResolveSecret(SecretPrefix + "counting/cached")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "value of cached" {
+			t.Errorf("ResolveSecret() = %q, expected %q", secret, "value of cached")
+		}
+	}
+	if provider.calls != 1 {
+		t.Errorf("the provider was called %d times, expected once", provider.calls)
+	}
+
+	// the failures are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := ResolveSecret(SecretPrefix + "counting/fail"); err == nil {
+			t.Errorf("expected an error")
+		}
+	}
+	if provider.calls != 3 {
+		t.Errorf("the provider was called %d times, expected 3", provider.calls)
+	}
+
+	// expired entries are resolved again
+	secrets.mu.Lock()
+	entry := secrets.entries[SecretPrefix+"counting/cached"]
+	entry.expires = time.Now().Add(-time.Second)
+	secrets.entries[SecretPrefix+"counting/cached"] = entry
+	secrets.mu.Unlock()
+	if _, err := ResolveSecret(SecretPrefix + "counting/cached"); err != nil {
+		t.Fatal(err)
+	}
+	if provider.calls != 4 {
+		t.Errorf("the provider was called %d times, expected 4", provider.calls)
+	}
+}
+
+func TestHostResolveSecrets(t *testing.T) {
+	RegisterSecretProvider("counting", &countingSecretProvider{})
+
+	host := dbmodels.Host{Password: SecretPrefix + "counting/host"}
+	if err := HostResolveSecrets(&host); err != nil {
+		t.Fatal(err)
+	}
+	if host.Password != "value of host" {
+		t.Errorf("HostResolveSecrets() = %q, expected %q", host.Password, "value of host")
+	}
+
+	key := dbmodels.SSHKey{PrivKey: SecretPrefix + "counting/fail"}
+	if err := SSHKeyResolveSecrets(&key); err == nil {
+		t.Errorf("expected an error")
+	}
+	if key.PrivKey != SecretPrefix+"counting/fail" {
+		t.Errorf("the reference was replaced on error: %q", key.PrivKey)
+	}
+}
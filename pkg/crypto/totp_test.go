@@ -0,0 +1,75 @@
+package crypto // import "moul.io/sshportal/pkg/crypto"
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestHOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 test vectors
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		if got := hotp(key, uint64(test.unix/totpPeriod), 8); got != test.expected {
+			t.Errorf("hotp(%d) = %q, expected %q", test.unix, got, test.expected)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	step, ok := ValidateTOTP(secret, "081804", now, 0)
+	if !ok {
+		t.Errorf("expected current code to be valid")
+	}
+	if _, ok := ValidateTOTP(secret, "081804", now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Errorf("expected previous code to be valid")
+	}
+	if _, ok := ValidateTOTP(secret, "081804", now.Add(3*totpPeriod*time.Second), 0); ok {
+		t.Errorf("expected expired code to be invalid")
+	}
+	if _, ok := ValidateTOTP(secret, "000000", now, 0); ok {
+		t.Errorf("expected wrong code to be invalid")
+	}
+	if _, ok := ValidateTOTP(secret, "081804", now.Add(totpPeriod*time.Second), step); ok {
+		t.Errorf("expected used code to be invalid")
+	}
+
+	generated, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := TOTPCode(generated, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ValidateTOTP(generated, code, now, 0); !ok {
+		t.Errorf("expected generated code to be valid")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 3 || len(hashes) != 3 {
+		t.Fatalf("expected 3 codes, got %d", len(codes))
+	}
+	if HashRecoveryCode(" "+codes[0]+"\n") != hashes[0] {
+		t.Errorf("expected recovery code hash to ignore surrounding spaces")
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -24,6 +27,9 @@ type Config struct {
 	Settings   []*Setting   `json:"settings"`
 	Events     []*Event     `json:"events"`
 	Sessions   []*Session   `json:"sessions"`
+	UserCAs    []*UserCA    `json:"user_cas"`
+	// UserSecrets are the second factors of the users
+	UserSecrets []*UserSecret `json:"user_secrets"`
 	// FIXME: add latest migration
 	Date time.Time `json:"date"`
 }
@@ -58,12 +64,22 @@ type Host struct {
 	URL      string       `valid:"optional"`
 	SSHKey   *SSHKey      `gorm:"ForeignKey:SSHKeyID"` // SSHKey used to connect by the client
 	SSHKeyID uint         `gorm:"index"`
+	CAKey    *SSHKey      `gorm:"ForeignKey:CAKeyID"` // SSHKey used to sign short-lived session certificates
+	CAKeyID  uint         `gorm:"index"`
 	HostKey  []byte       `sql:"size:1000" valid:"optional"`
 	Groups   []*HostGroup `gorm:"many2many:host_host_groups;"`
 	Comment  string       `valid:"optional"`
 	Logging  string       `valid:"optional,host_logging_mode"`
 	Hop      *Host
 	HopID    uint
+	// TransferPolicy restricts sftp and scp transfers (allow, deny-upload, deny-download, deny)
+	TransferPolicy string `valid:"optional,host_transfer_policy"`
+	// RecordingFormat of the interactive sessions (ttyrec, asciicast)
+	RecordingFormat string `valid:"optional,host_recording_format"`
+	// AllowAgentForward routes the agent channels opened by the host back to the client (ssh -A)
+	AllowAgentForward bool
+	// Labels are comma-separated key=value pairs sorted by key, i.e., "env=prod,team=data"
+	Labels string `valid:"optional,host_labels"`
 }
 
 // UserKey defines a user public key used by sshportal to identify the user
@@ -76,10 +92,32 @@ type UserKey struct {
 	Comment       string `valid:"optional"`
 }
 
+// UserCA defines a trusted certificate authority whose OpenSSH user certificates are accepted by sshportal
+type UserCA struct {
+	gorm.Model
+	Name          string                `valid:"required,length(1|255),unix_user" gorm:"index:uix_usercas_name,unique"`
+	Key           []byte                `sql:"size:1000" valid:"length(1|1000)"`
+	AuthorizedKey string                `sql:"size:1000" valid:"required,length(1|1000)"`
+	Revocations   []*UserCertRevocation `gorm:"ForeignKey:UserCAID"`
+	Comment       string                `valid:"optional"`
+}
+
+// UserCertRevocation defines a revoked certificate serial for a user CA
+type UserCertRevocation struct {
+	gorm.Model
+	UserCAID uint    `gorm:"index"`
+	UserCA   *UserCA `gorm:"ForeignKey:UserCAID" json:"-"`
+	Serial   uint64  ``
+	Comment  string  `valid:"optional"`
+}
+
 type UserRole struct {
 	gorm.Model
 	Name  string  `valid:"required,length(1|255),unix_user"`
 	Users []*User `gorm:"many2many:user_user_roles"`
+	// Permissions are comma-separated, see the Permissions list
+	Permissions string `valid:"optional,role_permissions"`
+	Comment     string `valid:"optional"`
 }
 
 type User struct {
@@ -92,6 +130,31 @@ type User struct {
 	Groups      []*UserGroup `gorm:"many2many:user_user_groups;"`
 	Comment     string       `valid:"optional"`
 	InviteToken string       `valid:"optional,length(10|60)"`
+	// TOTPSecret enables the second factor once set, RecoveryCodes are
+	// comma-separated hashes of single-use codes, TOTPLastStep is the time
+	// step of the last accepted code, they are never serialized
+	TOTPSecret    string `valid:"optional" json:"-"`
+	RecoveryCodes string `valid:"optional" json:"-"`
+	TOTPLastStep  int64  `json:"-"`
+}
+
+// UserSecret holds the second factor of a user in the backups, it is not
+// serialized with the user
+type UserSecret struct {
+	UserID        uint   `json:"user_id"`
+	TOTPSecret    string `json:"totp_secret"`
+	RecoveryCodes string `json:"recovery_codes"`
+}
+
+// APIToken authenticates the requests of the REST API on behalf of a user,
+// only the hash of the token is stored
+type APIToken struct {
+	gorm.Model
+	Name    string `valid:"required,length(1|255),unix_user" gorm:"index:uix_apitokens_name,unique"`
+	Hash    string `valid:"required" gorm:"index:uix_apitokens_hash,unique" json:"-"`
+	UserID  uint   `gorm:"index"`
+	User    *User  `gorm:"ForeignKey:UserID"`
+	Comment string `valid:"optional"`
 }
 
 type UserGroup struct {
@@ -100,6 +163,10 @@ type UserGroup struct {
 	Users   []*User `gorm:"many2many:user_user_groups;"`
 	ACLs    []*ACL  `gorm:"many2many:user_group_acls;"`
 	Comment string  `valid:"optional"`
+	// Require2FA denies access to members without a second factor
+	Require2FA bool `gorm:"column:require_2fa"`
+	// Subgroups are the groups whose members are also members of this group
+	Subgroups []*UserGroup `gorm:"many2many:user_group_subgroups;"`
 }
 
 type HostGroup struct {
@@ -108,18 +175,34 @@ type HostGroup struct {
 	Hosts   []*Host `gorm:"many2many:host_host_groups;"`
 	ACLs    []*ACL  `gorm:"many2many:host_group_acls;"`
 	Comment string  `valid:"optional"`
+	// Subgroups are the groups whose hosts are also hosts of this group
+	Subgroups []*HostGroup `gorm:"many2many:host_group_subgroups;"`
 }
 
 type ACL struct {
 	gorm.Model
 	HostGroups  []*HostGroup `gorm:"many2many:host_group_acls;"`
 	UserGroups  []*UserGroup `gorm:"many2many:user_group_acls;"`
-	HostPattern string       `valid:"optional"`
+	HostPattern string       `valid:"optional,host_pattern"`
 	Action      string       `valid:"required"`
 	Weight      uint         ``
 	Comment     string       `valid:"optional"`
 	Inception   *time.Time
 	Expiration  *time.Time
+	// HostSelector targets the hosts whose labels match it, i.e., "env=prod,team!=data"
+	HostSelector string `valid:"optional,label_selector"`
+	// Schedule restricts the ACL to recurring windows, i.e., "Mon-Fri 08:00-19:00 Europe/Paris"
+	Schedule string `valid:"optional,acl_schedule"`
+	// ScheduleTerminate closes the sessions granted by the ACL at the end of the schedule window
+	ScheduleTerminate bool
+	// SourceCIDRs restricts the ACL to the clients connecting from these comma-separated ranges
+	SourceCIDRs string `gorm:"column:source_cidrs" valid:"optional,cidr_list"`
+	// DeniedSourceCIDRs excludes the clients connecting from these comma-separated ranges from the ACL
+	DeniedSourceCIDRs string `gorm:"column:denied_source_cidrs" valid:"optional,cidr_list"`
+	// AllowRemoteForward permits tcpip-forward requests (ssh -R) when the ACL grants the access
+	AllowRemoteForward bool
+	// AllowAgentForward permits agent forwarding (ssh -A) when the ACL grants the access
+	AllowAgentForward bool
 }
 
 type Session struct {
@@ -132,6 +215,9 @@ type Session struct {
 	HostID    uint       `valid:"optional"`
 	ErrMsg    string     `valid:"optional"`
 	Comment   string     `valid:"optional"`
+	// ClientAddr is the address of the client, SourceCIDR the range of the ACL granting the access it matched
+	ClientAddr string `valid:"optional"`
+	SourceCIDR string `gorm:"column:source_cidr" valid:"optional"`
 }
 
 type Event struct {
@@ -160,6 +246,24 @@ const (
 	ACLActionDeny  ACLAction = "deny"
 )
 
+type HostPatternType string
+
+const (
+	HostPatternTypeGlob  HostPatternType = "glob"
+	HostPatternTypeRegex HostPatternType = "regex"
+	// HostPatternTypeLegacy marks the untyped patterns of the previous
+	// versions, they were never matched and stay inert until an
+	// administrator gives them a type with `acl update --pattern`
+	HostPatternTypeLegacy HostPatternType = "legacy"
+)
+
+type RecordingFormat string
+
+const (
+	RecordingFormatTTYRec    RecordingFormat = "ttyrec"
+	RecordingFormatAsciicast RecordingFormat = "asciicast"
+)
+
 type BastionScheme string
 
 const (
@@ -193,7 +297,17 @@ func (host *Host) DialAddr() string {
 }
 func (host *Host) String() string {
 	if host.URL != "" {
-		return host.URL
+		u, err := url.Parse(host.URL)
+		if err != nil {
+			return host.URL
+		}
+		// never display the password
+		if _, set := u.User.Password(); set || (u.User != nil && host.Password != "") {
+			user := url.User(u.User.Username())
+			u.User = nil
+			return fmt.Sprintf("%s://%s:%s@%s", u.Scheme, user, strings.Repeat("*", 4), strings.TrimPrefix(u.String(), u.Scheme+"://"))
+		}
+		return u.String()
 	} else if host.Addr != "" { // to be removed in a future version in favor of URL
 		if host.Password != "" {
 			return fmt.Sprintf("ssh://%s:%s@%s", host.User, strings.Repeat("*", 4), host.Addr)
@@ -240,7 +354,31 @@ func (host *Host) Username() string {
 	}
 	return "root"
 }
+
+// DecryptedURL returns the URL with the password, unlike String which masks
+// it, the password field must be decrypted first
+func (host *Host) DecryptedURL() string {
+	password := host.Passwd()
+	if host.URL == "" {
+		if password != "" {
+			return fmt.Sprintf("ssh://%s@%s", url.UserPassword(host.User, password), host.Addr)
+		}
+		return host.String()
+	}
+	u, err := url.Parse(host.URL)
+	if err != nil || password == "" {
+		return host.URL
+	}
+	u.User = url.UserPassword(host.Username(), password)
+	return u.String()
+}
+
+// Passwd returns the password used to connect to the host, the password field
+// must be decrypted first
 func (host *Host) Passwd() string {
+	if host.Password != "" {
+		return host.Password
+	}
 	if host.URL != "" {
 		u, err := url.Parse(host.URL)
 		if err != nil {
@@ -250,11 +388,26 @@ func (host *Host) Passwd() string {
 			password, _ := u.User.Password()
 			return password
 		}
-	} else if host.Password != "" { // to be removed in a future version in favor of URL
-		return host.Password
 	}
 	return ""
 }
+
+// ExtractURLPassword moves the password embedded in the URL to the password
+// field, so it can be encrypted. It returns false if the URL has no password.
+func (host *Host) ExtractURLPassword() bool {
+	u, err := url.Parse(host.URL)
+	if err != nil || u.User == nil {
+		return false
+	}
+	password, set := u.User.Password()
+	if !set {
+		return false
+	}
+	host.Password = password
+	u.User = url.User(u.User.Username())
+	host.URL = u.String()
+	return true
+}
 func (host *Host) Port() uint64 {
 	var portString string
 	if host.URL != "" {
@@ -284,14 +437,14 @@ defaultPort:
 	}
 }
 func HostsPreload(db *gorm.DB) *gorm.DB {
-	return db.Preload("Groups").Preload("SSHKey")
+	return db.Preload("Groups").Preload("SSHKey").Preload("CAKey")
 }
 func HostsByIdentifiers(db *gorm.DB, identifiers []string) *gorm.DB {
 	return GenericNameOrID(db, identifiers)
 }
 func HostByName(db *gorm.DB, name string) (*Host, error) {
 	var host Host
-	db.Preload("SSHKey").Where("name = ?", name).Find(&host)
+	db.Preload("SSHKey").Preload("CAKey").Where("name = ?", name).Find(&host)
 	if host.Name == "" {
 		// FIXME: add available hosts
 		return nil, fmt.Errorf("no such target: %q", name)
@@ -315,7 +468,8 @@ func (host *Host) ClientConfig(hk gossh.HostKeyCallback) (*gossh.ClientConfig, e
 	if host.Passwd() != "" {
 		config.Auth = append(config.Auth, gossh.Password(host.Passwd()))
 	}
-	if len(config.Auth) == 0 {
+	// session certificates are signed by the bastion once the session is known
+	if len(config.Auth) == 0 && host.CAKeyID == 0 {
 		return nil, fmt.Errorf("no valid authentication method for host %q", host.Name)
 	}
 	return &config, nil
@@ -333,7 +487,7 @@ func SSHKeysByIdentifiers(db *gorm.DB, identifiers []string) *gorm.DB {
 // HostGroup helpers
 
 func HostGroupsPreload(db *gorm.DB) *gorm.DB {
-	return db.Preload("ACLs").Preload("Hosts")
+	return db.Preload("ACLs").Preload("Hosts").Preload("Subgroups")
 }
 func HostGroupsByIdentifiers(db *gorm.DB, identifiers []string) *gorm.DB {
 	return GenericNameOrID(db, identifiers)
@@ -342,7 +496,7 @@ func HostGroupsByIdentifiers(db *gorm.DB, identifiers []string) *gorm.DB {
 // UserGroup helpers
 
 func UserGroupsPreload(db *gorm.DB) *gorm.DB {
-	return db.Preload("ACLs").Preload("Users")
+	return db.Preload("ACLs").Preload("Users").Preload("Subgroups")
 }
 func UserGroupsByIdentifiers(db *gorm.DB, identifiers []string) *gorm.DB {
 	return GenericNameOrID(db, identifiers)
@@ -378,13 +532,33 @@ func (u *User) HasRole(name string) bool {
 	}
 	return false
 }
-func (u *User) CheckRoles(names []string) error {
-	for _, name := range names {
-		if u.HasRole(name) {
-			return nil
+func (u *User) Has2FA() bool {
+	return u.TOTPSecret != ""
+}
+
+// Requires2FA returns true if one of the (preloaded) groups of the user requires a second factor
+func (u *User) Requires2FA() bool {
+	for _, group := range u.Groups {
+		if group.Require2FA {
+			return true
+		}
+	}
+	return false
+}
+
+// UseRecoveryCode removes the recovery code matching hash, it returns false if there is none
+func (u *User) UseRecoveryCode(hash string) bool {
+	if u.RecoveryCodes == "" {
+		return false
+	}
+	hashes := strings.Split(u.RecoveryCodes, ",")
+	for idx, candidate := range hashes {
+		if candidate == hash {
+			u.RecoveryCodes = strings.Join(append(hashes[:idx], hashes[idx+1:]...), ",")
+			return true
 		}
 	}
-	return fmt.Errorf("you don't have permission to access this feature (requires any of these roles: '%s')", strings.Join(names, "', '"))
+	return false
 }
 
 // ACL helpers
@@ -396,6 +570,131 @@ func ACLsByIdentifiers(db *gorm.DB, identifiers []string) *gorm.DB {
 	return db.Where("id IN (?)", identifiers)
 }
 
+// HostPatternMatcher compiles a host pattern of the form "glob:<pattern>" or "regex:<pattern>"
+func HostPatternMatcher(pattern string) (func(string) bool, error) {
+	parts := strings.SplitN(pattern, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid host pattern %q, expected 'glob:<pattern>' or 'regex:<pattern>'", pattern)
+	}
+	expr := parts[1]
+	switch HostPatternType(parts[0]) {
+	case HostPatternTypeGlob:
+		if _, err := path.Match(expr, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob host pattern %q: %v", expr, err)
+		}
+		return func(input string) bool {
+			matched, _ := path.Match(expr, input)
+			return matched
+		}, nil
+	case HostPatternTypeRegex:
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex host pattern %q: %v", expr, err)
+		}
+		return re.MatchString, nil
+	default:
+		return nil, fmt.Errorf("invalid host pattern type %q, allowed values: glob, regex", parts[0])
+	}
+}
+
+// HasLegacyHostPattern returns true if the host pattern of the ACL was stored
+// without a type by a previous version
+func (acl *ACL) HasLegacyHostPattern() bool {
+	return strings.HasPrefix(acl.HostPattern, string(HostPatternTypeLegacy)+":")
+}
+
+// MatchHost checks if the ACL host pattern matches the host name or hostname,
+// the URL is not matched as it contains the username
+func (acl *ACL) MatchHost(host *Host) (bool, error) {
+	if acl.HostPattern == "" || acl.HasLegacyHostPattern() {
+		return false, nil
+	}
+	match, err := HostPatternMatcher(acl.HostPattern)
+	if err != nil {
+		return false, err
+	}
+	for _, candidate := range []string{host.Name, host.Hostname()} {
+		if candidate != "" && match(candidate) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MatchHostSelector checks if the ACL host selector matches the host labels
+func (acl *ACL) MatchHostSelector(host *Host) (bool, error) {
+	if acl.HostSelector == "" {
+		return false, nil
+	}
+	selector, err := ParseSelector(acl.HostSelector)
+	if err != nil {
+		return false, err
+	}
+	labels, err := ParseLabels(host.Labels)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels), nil
+}
+
+// ParseCIDRList parses a comma-separated list of CIDR ranges, the addresses
+// are converted to single-address ranges
+func ParseCIDRList(list string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if ip := net.ParseIP(item); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", item)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// MatchSource checks if the ACL applies to the clients connecting from ip, it
+// returns the allowed range matching ip, if any
+func (acl *ACL) MatchSource(ip net.IP) (bool, string, error) {
+	if acl.SourceCIDRs == "" && acl.DeniedSourceCIDRs == "" {
+		return true, "", nil
+	}
+	if ip == nil {
+		return false, "", nil
+	}
+	if acl.DeniedSourceCIDRs != "" {
+		denied, err := ParseCIDRList(acl.DeniedSourceCIDRs)
+		if err != nil {
+			return false, "", err
+		}
+		for _, ipNet := range denied {
+			if ipNet.Contains(ip) {
+				return false, "", nil
+			}
+		}
+	}
+	if acl.SourceCIDRs == "" {
+		return true, "", nil
+	}
+	allowed, err := ParseCIDRList(acl.SourceCIDRs)
+	if err != nil {
+		return false, "", err
+	}
+	for _, ipNet := range allowed {
+		if ipNet.Contains(ip) {
+			return true, ipNet.String(), nil
+		}
+	}
+	return false, "", nil
+}
+
 // UserKey helpers
 
 func UserKeysPreload(db *gorm.DB) *gorm.DB {
@@ -408,12 +707,47 @@ func UserKeysByUserID(db *gorm.DB, identifiers []string) *gorm.DB {
 	return db.Where("user_id IN (?)", identifiers)
 }
 
+// UserCA helpers
+
+func UserCAsPreload(db *gorm.DB) *gorm.DB {
+	return db.Preload("Revocations")
+}
+func UserCAsByIdentifiers(db *gorm.DB, identifiers []string) *gorm.DB {
+	return GenericNameOrID(db, identifiers)
+}
+func (ca *UserCA) IsRevoked(serial uint64) bool {
+	for _, revocation := range ca.Revocations {
+		if revocation.Serial == serial {
+			return true
+		}
+	}
+	return false
+}
+
 // UserRole helpers
 
+func UserRolesPreload(db *gorm.DB) *gorm.DB {
+	return db.Preload("Users")
+}
 func UserRolesByIdentifiers(db *gorm.DB, identifiers []string) *gorm.DB {
 	return GenericNameOrID(db, identifiers)
 }
 
+// UnlinkUserRoles removes the links between the roles and their users, the
+// IDs of the removed roles can be reused
+func UnlinkUserRoles(db *gorm.DB, ids []uint) error {
+	return db.Exec("DELETE FROM user_user_roles WHERE user_role_id IN (?)", ids).Error
+}
+
+// APIToken helpers
+
+func APITokensPreload(db *gorm.DB) *gorm.DB {
+	return db.Preload("User")
+}
+func APITokensByIdentifiers(db *gorm.DB, identifiers []string) *gorm.DB {
+	return GenericNameOrID(db, identifiers)
+}
+
 // Session helpers
 
 func SessionsPreload(db *gorm.DB) *gorm.DB {
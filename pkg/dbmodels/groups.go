@@ -0,0 +1,218 @@
+package dbmodels
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// UserGroupsWithParents returns the groups and the groups containing them,
+// transitively, with their ACLs
+func UserGroupsWithParents(db *gorm.DB, groups []*UserGroup) ([]*UserGroup, error) {
+	var all []*UserGroup
+	if err := db.Preload("ACLs").Preload("Subgroups").Find(&all).Error; err != nil {
+		return nil, err
+	}
+	byID := map[uint]*UserGroup{}
+	parents := map[uint][]uint{}
+	for _, group := range all {
+		byID[group.ID] = group
+		for _, subgroup := range group.Subgroups {
+			parents[subgroup.ID] = append(parents[subgroup.ID], group.ID)
+		}
+	}
+	ids := make([]uint, 0, len(groups))
+	for _, group := range groups {
+		ids = append(ids, group.ID)
+	}
+	expanded := []*UserGroup{}
+	for _, id := range groupClosure(ids, parents) {
+		if group, found := byID[id]; found {
+			expanded = append(expanded, group)
+		}
+	}
+	return expanded, nil
+}
+
+// HostGroupsWithParents returns the groups and the groups containing them,
+// transitively, with their ACLs
+func HostGroupsWithParents(db *gorm.DB, groups []*HostGroup) ([]*HostGroup, error) {
+	expand, err := HostGroupsExpander(db)
+	if err != nil {
+		return nil, err
+	}
+	return expand(groups), nil
+}
+
+// HostGroupsExpander loads the host groups once and returns a function
+// expanding the groups like HostGroupsWithParents, to expand the groups of
+// many hosts
+func HostGroupsExpander(db *gorm.DB) (func([]*HostGroup) []*HostGroup, error) {
+	var all []*HostGroup
+	if err := db.Preload("ACLs").Preload("Subgroups").Find(&all).Error; err != nil {
+		return nil, err
+	}
+	byID := map[uint]*HostGroup{}
+	parents := map[uint][]uint{}
+	for _, group := range all {
+		byID[group.ID] = group
+		for _, subgroup := range group.Subgroups {
+			parents[subgroup.ID] = append(parents[subgroup.ID], group.ID)
+		}
+	}
+	return func(groups []*HostGroup) []*HostGroup {
+		ids := make([]uint, 0, len(groups))
+		for _, group := range groups {
+			ids = append(ids, group.ID)
+		}
+		expanded := []*HostGroup{}
+		for _, id := range groupClosure(ids, parents) {
+			if group, found := byID[id]; found {
+				expanded = append(expanded, group)
+			}
+		}
+		return expanded
+	}, nil
+}
+
+// UserGroupMembers returns the users of the group and of its subgroups, transitively
+func UserGroupMembers(db *gorm.DB, group *UserGroup) ([]*User, error) {
+	children, err := userSubgroupsMap(db)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*UserGroup
+	if err := db.Preload("Users").Where("id IN (?)", groupClosure([]uint{group.ID}, children)).Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	seen := map[uint]bool{}
+	members := []*User{}
+	for _, group := range groups {
+		for _, user := range group.Users {
+			if !seen[user.ID] {
+				seen[user.ID] = true
+				members = append(members, user)
+			}
+		}
+	}
+	return members, nil
+}
+
+// HostGroupMembers returns the hosts of the group and of its subgroups, transitively
+func HostGroupMembers(db *gorm.DB, group *HostGroup) ([]*Host, error) {
+	children, err := hostSubgroupsMap(db)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*HostGroup
+	if err := db.Preload("Hosts").Where("id IN (?)", groupClosure([]uint{group.ID}, children)).Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	seen := map[uint]bool{}
+	members := []*Host{}
+	for _, group := range groups {
+		for _, host := range group.Hosts {
+			if !seen[host.ID] {
+				seen[host.ID] = true
+				members = append(members, host)
+			}
+		}
+	}
+	return members, nil
+}
+
+// CheckUserSubgroups returns an error if adding the subgroups to group creates a cycle
+func CheckUserSubgroups(db *gorm.DB, group *UserGroup, subgroups []*UserGroup) error {
+	children, err := userSubgroupsMap(db)
+	if err != nil {
+		return err
+	}
+	for _, subgroup := range subgroups {
+		if containsGroup(groupClosure([]uint{subgroup.ID}, children), group.ID) {
+			return fmt.Errorf("cannot add %q to the subgroups of %q, %q contains it", subgroup.Name, group.Name, subgroup.Name)
+		}
+	}
+	return nil
+}
+
+// CheckHostSubgroups returns an error if adding the subgroups to group creates a cycle
+func CheckHostSubgroups(db *gorm.DB, group *HostGroup, subgroups []*HostGroup) error {
+	children, err := hostSubgroupsMap(db)
+	if err != nil {
+		return err
+	}
+	for _, subgroup := range subgroups {
+		if containsGroup(groupClosure([]uint{subgroup.ID}, children), group.ID) {
+			return fmt.Errorf("cannot add %q to the subgroups of %q, %q contains it", subgroup.Name, group.Name, subgroup.Name)
+		}
+	}
+	return nil
+}
+
+// UnlinkUserGroups removes the links between the groups and their parents
+// and subgroups, the IDs of the removed groups can be reused
+func UnlinkUserGroups(db *gorm.DB, ids []uint) error {
+	return db.Exec("DELETE FROM user_group_subgroups WHERE user_group_id IN (?) OR subgroup_id IN (?)", ids, ids).Error
+}
+
+// UnlinkHostGroups removes the links between the groups and their parents
+// and subgroups, the IDs of the removed groups can be reused
+func UnlinkHostGroups(db *gorm.DB, ids []uint) error {
+	return db.Exec("DELETE FROM host_group_subgroups WHERE host_group_id IN (?) OR subgroup_id IN (?)", ids, ids).Error
+}
+
+func userSubgroupsMap(db *gorm.DB) (map[uint][]uint, error) {
+	var all []*UserGroup
+	if err := db.Preload("Subgroups").Find(&all).Error; err != nil {
+		return nil, err
+	}
+	children := map[uint][]uint{}
+	for _, group := range all {
+		for _, subgroup := range group.Subgroups {
+			children[group.ID] = append(children[group.ID], subgroup.ID)
+		}
+	}
+	return children, nil
+}
+
+func hostSubgroupsMap(db *gorm.DB) (map[uint][]uint, error) {
+	var all []*HostGroup
+	if err := db.Preload("Subgroups").Find(&all).Error; err != nil {
+		return nil, err
+	}
+	children := map[uint][]uint{}
+	for _, group := range all {
+		for _, subgroup := range group.Subgroups {
+			children[group.ID] = append(children[group.ID], subgroup.ID)
+		}
+	}
+	return children, nil
+}
+
+// groupClosure returns ids and the IDs reachable from them through edges,
+// each ID once, the cycles left by concurrent updates are ignored
+func groupClosure(ids []uint, edges map[uint][]uint) []uint {
+	seen := map[uint]bool{}
+	closure := []uint{}
+	queue := append([]uint{}, ids...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		closure = append(closure, id)
+		queue = append(queue, edges[id]...)
+	}
+	return closure
+}
+
+func containsGroup(ids []uint, id uint) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
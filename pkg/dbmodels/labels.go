@@ -0,0 +1,126 @@
+package dbmodels
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	labelKeyRegexp   = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._/-]*[a-zA-Z0-9])?$`)
+	labelValueRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]*$`)
+)
+
+// ParseLabels parses comma-separated key=value host labels, i.e., "env=prod,team=data"
+func ParseLabels(input string) (map[string]string, error) {
+	labels := map[string]string{}
+	if input == "" {
+		return labels, nil
+	}
+	for _, item := range strings.Split(input, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label %q, expected 'key=value'", item)
+		}
+		if err := validateLabel(parts[0], parts[1]); err != nil {
+			return nil, err
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// FormatLabels returns the labels as comma-separated key=value pairs sorted by key
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func validateLabel(key, value string) error {
+	if !labelKeyRegexp.MatchString(key) {
+		return fmt.Errorf("invalid label key %q, allowed characters: letters, digits, '.', '_', '/' and '-'", key)
+	}
+	if !labelValueRegexp.MatchString(value) {
+		return fmt.Errorf("invalid label value %q, allowed characters: letters, digits, '.', '_' and '-'", value)
+	}
+	return nil
+}
+
+// Selector is a list of requirements on the host labels, all of them must be met
+type Selector []selectorRequirement
+
+type selectorRequirement struct {
+	key      string
+	operator string // "=", "!=", "exists" or "!exists"
+	value    string
+}
+
+// ParseSelector parses a comma-separated label selector, the requirements
+// are "key=value" (or "key==value"), "key!=value", "key" for the hosts
+// having the label and "!key" for the hosts without it
+func ParseSelector(input string) (Selector, error) {
+	if strings.TrimSpace(input) == "" {
+		return nil, fmt.Errorf("empty selector")
+	}
+	selector := Selector{}
+	for _, item := range strings.Split(input, ",") {
+		item = strings.TrimSpace(item)
+		var requirement selectorRequirement
+		switch {
+		case strings.Contains(item, "!="):
+			parts := strings.SplitN(item, "!=", 2)
+			requirement = selectorRequirement{key: parts[0], operator: "!=", value: parts[1]}
+		case strings.Contains(item, "=="):
+			parts := strings.SplitN(item, "==", 2)
+			requirement = selectorRequirement{key: parts[0], operator: "=", value: parts[1]}
+		case strings.Contains(item, "="):
+			parts := strings.SplitN(item, "=", 2)
+			requirement = selectorRequirement{key: parts[0], operator: "=", value: parts[1]}
+		case strings.HasPrefix(item, "!"):
+			requirement = selectorRequirement{key: item[1:], operator: "!exists"}
+		default:
+			requirement = selectorRequirement{key: item, operator: "exists"}
+		}
+		if err := validateLabel(requirement.key, requirement.value); err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %v", input, err)
+		}
+		selector = append(selector, requirement)
+	}
+	return selector, nil
+}
+
+// Matches returns true if the labels meet all the requirements of the selector,
+// a "key!=value" requirement is met by the labels without key
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		value, found := labels[requirement.key]
+		switch requirement.operator {
+		case "=":
+			if !found || value != requirement.value {
+				return false
+			}
+		case "!=":
+			if found && value == requirement.value {
+				return false
+			}
+		case "exists":
+			if !found {
+				return false
+			}
+		case "!exists":
+			if found {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,163 @@
+package dbmodels
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Permissions lists the permissions that can be granted to the roles, "*"
+// grants all of them and "<resource>:*" all the permissions of a resource
+var Permissions = []string{
+	"acl:read", "acl:write",
+	"apitoken:read", "apitoken:write",
+	"config:backup", "config:restore",
+	"event:read",
+	"host:read", "host:write",
+	"hostgroup:read", "hostgroup:write",
+	"key:read", "key:write",
+	"role:read", "role:write",
+	"secret:use",
+	"server:read", "server:drain",
+	"session:read", "session:kill",
+	"user:read", "user:write", "user:invite",
+	"userca:read", "userca:write",
+	"usergroup:read", "usergroup:write",
+	"userkey:read", "userkey:write",
+}
+
+// ParsePermissions parses comma-separated permissions, i.e., "host:read,user:invite"
+func ParsePermissions(input string) ([]string, error) {
+	permissions := []string{}
+	if input == "" {
+		return permissions, nil
+	}
+	seen := map[string]bool{}
+	for _, item := range strings.Split(input, ",") {
+		permission := strings.TrimSpace(item)
+		if len(ExpandPermissions([]string{permission})) == 0 {
+			return nil, fmt.Errorf("invalid permission %q, see 'role create --help' for the list of permissions", permission)
+		}
+		if !seen[permission] {
+			seen[permission] = true
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions, nil
+}
+
+// ExpandPermissions returns the permissions granted by a list possibly
+// containing wildcards, the unknown permissions are ignored
+func ExpandPermissions(granted []string) []string {
+	expanded := []string{}
+	for _, permission := range Permissions {
+		for _, candidate := range granted {
+			if permissionGrants(candidate, permission) {
+				expanded = append(expanded, permission)
+				break
+			}
+		}
+	}
+	return expanded
+}
+
+// RevokePermissions returns the granted permissions without the revoked
+// ones, the wildcards covering a revoked permission are expanded
+func RevokePermissions(granted, revoked []string) []string {
+	revokedSet := map[string]bool{}
+	for _, permission := range ExpandPermissions(revoked) {
+		revokedSet[permission] = true
+	}
+	remaining := []string{}
+	for _, candidate := range granted {
+		expanded := ExpandPermissions([]string{candidate})
+		covered := false
+		for _, permission := range expanded {
+			if revokedSet[permission] {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			remaining = append(remaining, candidate)
+			continue
+		}
+		for _, permission := range expanded {
+			if !revokedSet[permission] {
+				remaining = append(remaining, permission)
+			}
+		}
+	}
+	return remaining
+}
+
+func permissionGrants(granted, permission string) bool {
+	if granted == "*" || granted == permission {
+		return true
+	}
+	return strings.HasSuffix(granted, ":*") && strings.HasPrefix(permission, strings.TrimSuffix(granted, "*"))
+}
+
+// HasPermission returns true if the role grants the permission
+func (r *UserRole) HasPermission(permission string) bool {
+	granted, err := ParsePermissions(r.Permissions)
+	if err != nil {
+		return false
+	}
+	for _, candidate := range granted {
+		if permissionGrants(candidate, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission returns true if one of the (preloaded) roles of the user grants the permission
+func (u *User) HasPermission(permission string) bool {
+	for _, role := range u.Roles {
+		if role.HasPermission(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPermission returns an error if none of the (preloaded) roles of the user grants the permission
+func (u *User) CheckPermission(permission string) error {
+	if !u.HasPermission(permission) {
+		return fmt.Errorf("you don't have permission to access this feature (requires the '%s' permission)", permission)
+	}
+	return nil
+}
+
+// CheckGrant returns an error if the user cannot grant the comma-separated
+// permissions, one can only grant the permissions one has
+func (u *User) CheckGrant(permissions string) error {
+	granted, err := ParsePermissions(permissions)
+	if err != nil {
+		return err
+	}
+	for _, permission := range ExpandPermissions(granted) {
+		if !u.HasPermission(permission) {
+			return fmt.Errorf("you cannot grant the '%s' permission, you don't have it", permission)
+		}
+	}
+	return nil
+}
+
+// CheckManage returns an error if the user cannot change the credentials,
+// keys, second factor or roles of target (with preloaded roles) or remove
+// it, one can only manage the users having no more permissions than oneself
+func (u *User) CheckManage(target *User) error {
+	for _, role := range target.Roles {
+		granted, err := ParsePermissions(role.Permissions)
+		if err != nil {
+			return err
+		}
+		for _, permission := range ExpandPermissions(granted) {
+			if !u.HasPermission(permission) {
+				return fmt.Errorf("you cannot manage the user %q, it has the '%s' permission you don't have", target.Name, permission)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package dbmodels
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is a recurring access window, i.e., "Mon-Fri 08:00-19:00 Europe/Paris"
+type Schedule struct {
+	days     [7]bool // indexed by time.Weekday
+	start    int     // minutes after midnight
+	end      int     // minutes after midnight, before start if the window ends the next day
+	location *time.Location
+}
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseSchedule parses a schedule of the form "<days> <HH:MM>-<HH:MM> [<timezone>]",
+// the days are a comma-separated list of days or day ranges (i.e., "Mon-Fri,Sun")
+// or "*", a window ending before its start ends the next day and the
+// timezone defaults to UTC
+func ParseSchedule(input string) (*Schedule, error) {
+	fields := strings.Fields(input)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("invalid schedule %q, expected '<days> <HH:MM>-<HH:MM> [<timezone>]'", input)
+	}
+	schedule := Schedule{location: time.UTC}
+
+	if fields[0] == "*" {
+		for day := range schedule.days {
+			schedule.days[day] = true
+		}
+	} else {
+		for _, item := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(item, "-", 2)
+			first, found := scheduleDays[strings.ToLower(bounds[0])]
+			if !found {
+				return nil, fmt.Errorf("invalid schedule day %q, allowed values: Mon, Tue, Wed, Thu, Fri, Sat, Sun", bounds[0])
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, found = scheduleDays[strings.ToLower(bounds[1])]; !found {
+					return nil, fmt.Errorf("invalid schedule day %q, allowed values: Mon, Tue, Wed, Thu, Fri, Sat, Sun", bounds[1])
+				}
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				schedule.days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid schedule hours %q, expected '<HH:MM>-<HH:MM>'", fields[1])
+	}
+	var err error
+	if schedule.start, err = parseScheduleTime(times[0]); err != nil {
+		return nil, err
+	}
+	if schedule.end, err = parseScheduleTime(times[1]); err != nil {
+		return nil, err
+	}
+	if schedule.start == schedule.end {
+		return nil, fmt.Errorf("invalid schedule hours %q, the window is empty", fields[1])
+	}
+	if schedule.start == 24*60 {
+		return nil, fmt.Errorf("invalid schedule hours %q, the window cannot start at 24:00", fields[1])
+	}
+	if schedule.end == 24*60 {
+		schedule.end = 0
+	}
+
+	if len(fields) == 3 {
+		if schedule.location, err = time.LoadLocation(fields[2]); err != nil {
+			return nil, fmt.Errorf("invalid schedule timezone %q: %v", fields[2], err)
+		}
+	}
+	return &schedule, nil
+}
+
+func parseScheduleTime(input string) (int, error) {
+	if input == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", input)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schedule time %q, expected HH:MM", input)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains returns true if t is in a window of the schedule
+func (s *Schedule) Contains(t time.Time) bool {
+	t = t.In(s.location)
+	minutes := t.Hour()*60 + t.Minute()
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+	if s.start < s.end {
+		return s.days[today] && minutes >= s.start && minutes < s.end
+	}
+	return (s.days[today] && minutes >= s.start) || (s.days[yesterday] && minutes < s.end)
+}
+
+// End returns the end of the window containing t, continuing with the
+// windows starting exactly when the previous one ends, or false if the
+// windows never end (i.e., "* 00:00-24:00")
+func (s *Schedule) End(t time.Time) (time.Time, bool) {
+	t = t.In(s.location)
+	end := time.Date(t.Year(), t.Month(), t.Day(), s.end/60, s.end%60, 0, 0, s.location)
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	// the windows start at the same time every day, after a week they repeat
+	for i := 0; i < 7; i++ {
+		if !s.Contains(end) {
+			return end, true
+		}
+		end = end.AddDate(0, 0, 1)
+	}
+	return time.Time{}, false
+}
@@ -26,8 +26,96 @@ func InitValidator() {
 		}
 		return IsValidHostLoggingMode(name)
 	}))
+	govalidator.CustomTypeTagMap.Set("host_transfer_policy", govalidator.CustomTypeValidator(func(i interface{}, context interface{}) bool {
+		name, ok := i.(string)
+		if !ok {
+			return false
+		}
+		if name == "" {
+			return true
+		}
+		return IsValidHostTransferPolicy(name)
+	}))
+	govalidator.CustomTypeTagMap.Set("host_recording_format", govalidator.CustomTypeValidator(func(i interface{}, context interface{}) bool {
+		name, ok := i.(string)
+		if !ok {
+			return false
+		}
+		if name == "" {
+			return true
+		}
+		return IsValidHostRecordingFormat(name)
+	}))
+	govalidator.CustomTypeTagMap.Set("host_pattern", govalidator.CustomTypeValidator(func(i interface{}, context interface{}) bool {
+		pattern, ok := i.(string)
+		if !ok {
+			return false
+		}
+		if pattern == "" || (&ACL{HostPattern: pattern}).HasLegacyHostPattern() {
+			return true
+		}
+		_, err := HostPatternMatcher(pattern)
+		return err == nil
+	}))
+	govalidator.CustomTypeTagMap.Set("cidr_list", govalidator.CustomTypeValidator(func(i interface{}, context interface{}) bool {
+		list, ok := i.(string)
+		if !ok {
+			return false
+		}
+		if list == "" {
+			return true
+		}
+		_, err := ParseCIDRList(list)
+		return err == nil
+	}))
+	govalidator.CustomTypeTagMap.Set("acl_schedule", govalidator.CustomTypeValidator(func(i interface{}, context interface{}) bool {
+		schedule, ok := i.(string)
+		if !ok {
+			return false
+		}
+		if schedule == "" {
+			return true
+		}
+		_, err := ParseSchedule(schedule)
+		return err == nil
+	}))
+	govalidator.CustomTypeTagMap.Set("host_labels", govalidator.CustomTypeValidator(func(i interface{}, context interface{}) bool {
+		labels, ok := i.(string)
+		if !ok {
+			return false
+		}
+		_, err := ParseLabels(labels)
+		return err == nil
+	}))
+	govalidator.CustomTypeTagMap.Set("label_selector", govalidator.CustomTypeValidator(func(i interface{}, context interface{}) bool {
+		selector, ok := i.(string)
+		if !ok {
+			return false
+		}
+		if selector == "" {
+			return true
+		}
+		_, err := ParseSelector(selector)
+		return err == nil
+	}))
+	govalidator.CustomTypeTagMap.Set("role_permissions", govalidator.CustomTypeValidator(func(i interface{}, context interface{}) bool {
+		permissions, ok := i.(string)
+		if !ok {
+			return false
+		}
+		_, err := ParsePermissions(permissions)
+		return err == nil
+	}))
 }
 
 func IsValidHostLoggingMode(name string) bool {
 	return name == "disabled" || name == "input" || name == "everything"
 }
+
+func IsValidHostTransferPolicy(name string) bool {
+	return name == "allow" || name == "deny-upload" || name == "deny-download" || name == "deny"
+}
+
+func IsValidHostRecordingFormat(name string) bool {
+	return name == string(RecordingFormatTTYRec) || name == string(RecordingFormatAsciicast)
+}
@@ -0,0 +1,265 @@
+// Package metrics implements the counters, gauges and histograms exported by
+// sshportal in the Prometheus text exposition format.
+package metrics // import "moul.io/sshportal/pkg/metrics"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds the metrics exported by a Handler
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes every metric of the registry in the text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, c := range collectors {
+		c.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// Handler serves the metrics of the registry to the Prometheus scrapers
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value uint64 // first field for the 64-bit alignment of atomic operations
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc() { atomic.AddUint64(&c.value, 1) }
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) { atomic.AddUint64(&c.value, n) }
+
+// Value returns the current value of the counter
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.value) }
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	desc
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec registers a new counter partitioned by labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name: name, help: help, labels: labels}, counters: map[string]*Counter{}}
+	r.register(c)
+	return c
+}
+
+// With returns the counter of the label values, given in the order of the
+// labels, the returned counter can be kept to avoid the lookups. With the
+// wrong number of values, the counter is not exported.
+func (c *CounterVec) With(values ...string) *Counter {
+	key, ok := c.labelPairs(values)
+	if !ok {
+		return &Counter{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, found := c.counters[key]
+	if !found {
+		counter = &Counter{}
+		c.counters[key] = counter
+	}
+	return counter
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.writeHeader(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.counters) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, braces(key), c.counters[key].Value())
+	}
+}
+
+// GaugeFunc is a value computed when the metrics are collected
+type GaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help}, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.writeHeader(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+// Histogram counts the observed values in buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe adds a value to the histogram
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	desc
+	buckets    []float64
+	mu         sync.Mutex
+	histograms map[string]*Histogram
+}
+
+// NewHistogramVec registers a new histogram partitioned by labels, buckets
+// are the upper bounds of the buckets in increasing order
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{desc: desc{name: name, help: help, labels: labels}, buckets: buckets, histograms: map[string]*Histogram{}}
+	r.register(h)
+	return h
+}
+
+// With returns the histogram of the label values, given in the order of the
+// labels. With the wrong number of values, the histogram is not exported.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	key, ok := h.labelPairs(values)
+	if !ok {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	histogram, found := h.histograms[key]
+	if !found {
+		histogram = &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = histogram
+	}
+	return histogram
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.writeHeader(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.histograms) {
+		histogram := h.histograms[key]
+		histogram.mu.Lock()
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(joinPairs(key, `le="`+formatFloat(bound)+`"`)), histogram.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(joinPairs(key, `le="+Inf"`)), histogram.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, braces(key), formatFloat(histogram.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(key), histogram.count)
+		histogram.mu.Unlock()
+	}
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, kind)
+}
+
+// labelPairs returns the label pairs of the values, i.e., method="pubkey",result="success",
+// or false if the number of values does not match the labels
+func (d desc) labelPairs(values []string) (string, bool) {
+	if len(values) != len(d.labels) {
+		return "", false
+	}
+	pairs := make([]string, len(values))
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, value := range values {
+		pairs[i] = d.labels[i] + `="` + escaper.Replace(value) + `"`
+	}
+	return strings.Join(pairs, ","), true
+}
+
+func joinPairs(pairs, pair string) string {
+	if pairs == "" {
+		return pair
+	}
+	return pairs + "," + pair
+}
+
+func braces(pairs string) string {
+	if pairs == "" {
+		return ""
+	}
+	return "{" + pairs + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*Counter:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*Histogram:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,69 @@
+package metrics_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"moul.io/sshportal/pkg/metrics"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	registry := metrics.NewRegistry()
+	attempts := registry.NewCounterVec("test_attempts_total", "Attempts.", "method", "result")
+	durations := registry.NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.1, 1})
+	registry.NewGaugeFunc("test_active", "Active things.", func() float64 { return 3 })
+
+	attempts.With("pubkey", "success").Inc()
+	attempts.With("pubkey", "success").Add(2)
+	attempts.With("password", `fail"ure`).Inc()
+	durations.With().Observe(0.05)
+	durations.With().Observe(0.5)
+	durations.With().Observe(math.Inf(1))
+
+	var buf bytes.Buffer
+	if _, err := registry.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	expected := `# HELP test_attempts_total Attempts.
+# TYPE test_attempts_total counter
+test_attempts_total{method="password",result="fail\"ure"} 1
+test_attempts_total{method="pubkey",result="success"} 3
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum +Inf
+test_duration_seconds_count 3
+# HELP test_active Active things.
+# TYPE test_active gauge
+test_active 3
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestVecWithInvalidLabels(t *testing.T) {
+	registry := metrics.NewRegistry()
+	attempts := registry.NewCounterVec("test_attempts_total", "Attempts.", "method")
+	durations := registry.NewHistogramVec("test_duration_seconds", "Durations.", []float64{1}, "method")
+
+	// the values are dropped instead of panicking in the callers
+	attempts.With("pubkey", "success").Inc()
+	durations.With().Observe(0.5)
+
+	var buf bytes.Buffer
+	if _, err := registry.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	expected := `# HELP test_attempts_total Attempts.
+# TYPE test_attempts_total counter
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/urfave/cli"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"moul.io/sshportal/pkg/bastion"
+)
+
+// rotateKey re-encrypts the sensitive data of the database with a new AES key
+func rotateKey(c *cli.Context) (err error) {
+	for _, key := range []string{c.String("old-key"), c.String("new-key")} {
+		switch len(key) {
+		case 0, 16, 24, 32:
+		default:
+			return fmt.Errorf("invalid aes key size, should be 16 or 24, 32")
+		}
+	}
+
+	db, err := dbConnect(&serverConfig{dbDriver: c.String("db-driver"), dbURL: c.String("db-conn")}, &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		origErr := err
+		err = sqlDB.Close()
+		if origErr != nil {
+			err = origErr
+		}
+	}()
+
+	if err = bastion.DBInit(db, c.String("old-key")); err != nil {
+		return err
+	}
+
+	updated, err := bastion.RotateAESKey(db, c.String("old-key"), c.String("new-key"), c.Bool("encrypt-all"))
+	if err != nil {
+		return err
+	}
+	log.Printf("info: %d rows encrypted with the new AES key", updated)
+	return nil
+}
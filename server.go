@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"math"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"gorm.io/driver/mysql"
@@ -15,6 +20,7 @@ import (
 	"gorm.io/gorm/logger"
 
 	"moul.io/sshportal/pkg/bastion"
+	"moul.io/sshportal/pkg/crypto"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/urfave/cli"
@@ -29,6 +35,13 @@ type serverConfig struct {
 	debug, demo     bool
 	idleTimeout     time.Duration
 	aclCheckCmd     string
+	apiBind         string
+	apiTLSCert      string
+	apiTLSKey       string
+	metricsBind     string
+	drainTimeout    time.Duration
+	hostPicker      bool
+	secretProviders map[string]crypto.SecretProvider
 }
 
 func parseServerConfig(c *cli.Context) (*serverConfig, error) {
@@ -42,15 +55,49 @@ func parseServerConfig(c *cli.Context) (*serverConfig, error) {
 		logsLocation: c.String("logs-location"),
 		idleTimeout:  c.Duration("idle-timeout"),
 		aclCheckCmd:  c.String("acl-check-cmd"),
+		apiBind:      c.String("api-bind"),
+		apiTLSCert:   c.String("api-tls-cert"),
+		apiTLSKey:    c.String("api-tls-key"),
+		metricsBind:  c.String("metrics-bind"),
+		drainTimeout: c.Duration("drain-timeout"),
+		hostPicker:   c.Bool("host-picker"),
 	}
 	switch len(ret.aesKey) {
 	case 0, 16, 24, 32:
 	default:
 		return nil, fmt.Errorf("invalid aes key size, should be 16 or 24, 32")
 	}
+	if (ret.apiTLSCert == "") != (ret.apiTLSKey == "") {
+		return nil, fmt.Errorf("--api-tls-cert and --api-tls-key should be used together")
+	}
+	if ret.apiBind != "" && ret.apiTLSCert == "" && !isLoopbackAddr(ret.apiBind) {
+		return nil, fmt.Errorf("the REST API serves plain HTTP without --api-tls-cert and --api-tls-key, bind it to a loopback address (%s)", ret.apiBind)
+	}
+	ret.secretProviders = map[string]crypto.SecretProvider{}
+	for _, spec := range c.StringSlice("secret-provider") {
+		name, provider, err := crypto.ParseSecretProvider(spec)
+		if err != nil {
+			return nil, err
+		}
+		ret.secretProviders[name] = provider
+	}
 	return ret, nil
 }
 
+// isLoopbackAddr returns true if the host:port address only listens on the
+// loopback interface
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func ensureLogDirectory(location string) error {
 	// check for the logdir existence
 	logsLocation, err := os.Stat(location)
@@ -101,7 +148,11 @@ func server(c *serverConfig) (err error) {
 		return
 	}
 
-	if err = bastion.DBInit(db); err != nil {
+	for name, provider := range c.secretProviders {
+		crypto.RegisterSecretProvider(name, provider)
+	}
+
+	if err = bastion.DBInit(db, c.aesKey); err != nil {
 		return
 	}
 
@@ -119,6 +170,10 @@ func server(c *serverConfig) (err error) {
 		ChannelHandlers: map[string]ssh.ChannelHandler{
 			"default": bastion.ChannelHandler,
 		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        bastion.RemoteForwardHandler,
+			"cancel-tcpip-forward": bastion.RemoteForwardHandler,
+		},
 	}
 
 	// configure channel handler
@@ -144,8 +199,8 @@ func server(c *serverConfig) (err error) {
 
 	for _, opt := range []ssh.Option{
 		// custom PublicKeyAuth handler
-		ssh.PublicKeyAuth(bastion.PublicKeyAuthHandler(db, c.logsLocation, c.aclCheckCmd, c.aesKey, c.dbDriver, c.dbURL, c.bindAddr, c.demo)),
-		ssh.PasswordAuth(bastion.PasswordAuthHandler(db, c.logsLocation, c.aclCheckCmd, c.aesKey, c.dbDriver, c.dbURL, c.bindAddr, c.demo)),
+		ssh.PublicKeyAuth(bastion.PublicKeyAuthHandler(db, c.logsLocation, c.aclCheckCmd, c.aesKey, c.dbDriver, c.dbURL, c.bindAddr, c.demo, c.hostPicker)),
+		ssh.PasswordAuth(bastion.PasswordAuthHandler(db, c.logsLocation, c.aclCheckCmd, c.aesKey, c.dbDriver, c.dbURL, c.bindAddr, c.demo, c.hostPicker)),
 		// retrieve sshportal SSH private key from database
 		bastion.PrivateKeyFromDB(db, c.aesKey),
 	} {
@@ -154,6 +209,100 @@ func server(c *serverConfig) (err error) {
 		}
 	}
 
+	// the REST API is optional
+	var httpServers []*http.Server
+	if c.apiBind != "" {
+		apiSrv := &http.Server{
+			Handler:           bastion.APIHandler(db, c.aesKey),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		// without certificate, parseServerConfig only allows the loopback addresses
+		if c.apiTLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(c.apiTLSCert, c.apiTLSKey)
+			if err != nil {
+				return err
+			}
+			apiSrv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+		apiLn, err := net.Listen("tcp", c.apiBind)
+		if err != nil {
+			return err
+		}
+		if apiSrv.TLSConfig != nil {
+			apiLn = tls.NewListener(apiLn, apiSrv.TLSConfig)
+		}
+		httpServers = append(httpServers, apiSrv)
+		go func() {
+			if err := apiSrv.Serve(apiLn); err != http.ErrServerClosed {
+				log.Printf("error: REST API server: %v", err)
+			}
+		}()
+		log.Printf("info: REST API accepting connections on %s", c.apiBind)
+	}
+
+	if c.metricsBind != "" {
+		metricsLn, err := net.Listen("tcp", c.metricsBind)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", bastion.MetricsHandler())
+		metricsSrv := &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		httpServers = append(httpServers, metricsSrv)
+		go func() {
+			if err := metricsSrv.Serve(metricsLn); err != http.ErrServerClosed {
+				log.Printf("error: metrics server: %v", err)
+			}
+		}()
+		log.Printf("info: metrics accepting connections on %s", c.metricsBind)
+	}
+
+	// SIGTERM and the `server drain` command stop accepting connections and
+	// wait for the running sessions before shutting down
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		select {
+		case sig := <-signals:
+			log.Printf("info: received %v, draining for %v", sig, c.drainTimeout)
+			signal.Stop(signals) // a second signal stops the server immediately
+		case <-bastion.DrainRequested():
+			log.Printf("info: drain requested, draining for %v", c.drainTimeout)
+		}
+		drain(srv, httpServers, c.drainTimeout)
+	}()
+
 	log.Printf("info: SSH Server accepting connections on %s, idle-timout=%v", c.bindAddr, c.idleTimeout)
-	return srv.Serve(ln)
+	if err := srv.Serve(ln); err != ssh.ErrServerClosed {
+		return err
+	}
+	<-drained
+	log.Printf("info: SSH Server stopped")
+	return nil
+}
+
+// drain closes the listeners, waits up to timeout for the connections to end
+// and closes the remaining ones
+func drain(srv *ssh.Server, httpServers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil && err != context.DeadlineExceeded {
+		log.Printf("error: SSH Server shutdown: %v", err)
+	}
+	// the sessions record their closure after their connection is closed
+	bastion.CloseSessions(ctx, bastion.DrainReason)
+	_ = srv.Close()
+
+	for _, httpSrv := range httpServers {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := httpSrv.Shutdown(ctx); err != nil {
+			log.Printf("error: HTTP server shutdown: %v", err)
+		}
+		cancel()
+	}
 }